@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,17 +16,30 @@ import (
 )
 
 import (
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+
 	"github.com/gorilla/mux"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 import (
 	"github.com/nanjiek/pixiu-rls/internal/api"
+	"github.com/nanjiek/pixiu-rls/internal/audit"
+	"github.com/nanjiek/pixiu-rls/internal/auth"
 	"github.com/nanjiek/pixiu-rls/internal/config"
 	"github.com/nanjiek/pixiu-rls/internal/core"
+	"github.com/nanjiek/pixiu-rls/internal/identity"
 	"github.com/nanjiek/pixiu-rls/internal/limiter"
+	"github.com/nanjiek/pixiu-rls/internal/metrics"
 	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/router"
 	"github.com/nanjiek/pixiu-rls/internal/rules"
 	"github.com/nanjiek/pixiu-rls/internal/rules/source"
+	"github.com/nanjiek/pixiu-rls/internal/tlsutil"
 )
 
 func main() {
@@ -38,28 +54,45 @@ func main() {
 	rootCtx, cancelRoot := context.WithCancel(context.Background())
 	defer cancelRoot()
 
-	repoAny, err := repo.NewRedis(cfg, nil)
-	if err != nil {
-		log.Fatalf("failed to init redis: %v", err)
-	}
-	rdb, ok := repoAny.(*repo.RedisRepo)
-	if !ok {
-		log.Fatalf("unexpected repo type: %T", repoAny)
+	var rdb *repo.RedisRepo
+	if cfg.Features.LocalOnly {
+		// no client: rules stay in memory and every limiter runs in-process
+		rdb = &repo.RedisRepo{Prefix: cfg.Redis.Prefix, UpdateChannel: cfg.Redis.UpdatesChannel}
+		log.Printf("running in local-only mode without redis")
+	} else {
+		repoAny, err := repo.NewRedis(cfg, nil)
+		if err != nil {
+			log.Fatalf("failed to init redis: %v", err)
+		}
+		var ok bool
+		if rdb, ok = repoAny.(*repo.RedisRepo); !ok {
+			log.Fatalf("unexpected repo type: %T", repoAny)
+		}
 	}
 	defer rdb.Close()
 
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	rlsMetrics := metrics.New(reg)
+
 	ruleCache := rules.NewCache(cfg, rdb)
-	if cfg.Nacos.Enabled() {
-		nacosSource := source.NewNacosSource(cfg.Nacos)
-		poller := rules.NewPoller(nacosSource, ruleCache, rules.PollerConfig{
-			Interval:   time.Duration(cfg.Nacos.PollIntervalMs) * time.Millisecond,
-			FailPolicy: cfg.Nacos.FailPolicy,
-		})
+	rlsMetrics.WatchRules(ruleCache)
+	matcher := router.NewMatcher(nil)
+	ruleCache.OnReplace(func(set *rules.ImmutableRuleSet) {
+		matcher.Replace(router.BuildRouteSnapshot(set.Rules))
+	})
+	src, name, pollCfg, err := ruleSource(cfg)
+	if err != nil {
+		log.Fatalf("invalid rules source: %v", err)
+	}
+	if src != nil {
+		poller := rules.NewPoller(src, ruleCache, pollCfg)
+		rlsMetrics.WatchPoller(poller)
 		if err := poller.SyncOnce(rootCtx); err != nil {
-			if strings.EqualFold(cfg.Nacos.FailPolicy, "fail-closed") {
-				log.Fatalf("failed to load rules from nacos: %v", err)
+			if strings.EqualFold(pollCfg.FailPolicy, "fail-closed") {
+				log.Fatalf("failed to load rules from %s: %v", name, err)
 			}
-			log.Printf("nacos pull failed, using last-good rules: %v", err)
+			log.Printf("%s pull failed, using last-good rules: %v", name, err)
 		}
 		go poller.Start(rootCtx)
 	} else {
@@ -69,19 +102,107 @@ func main() {
 		go ruleCache.StartWatcher(rootCtx)
 	}
 
-	tbLimiter := limiter.NewTokenBucket(rdb)
-	slidingLimiter := limiter.NewSlidingWindow(rdb)
-	leakyLimiter := limiter.NewLeakyBucket(rdb)
-	limiterMux := limiter.NewMux("token_bucket", map[string]limiter.Limiter{
-		"token_bucket":   tbLimiter,
-		"sliding_window": slidingLimiter,
-		"leaky_bucket":   leakyLimiter,
-	})
-	engine := core.NewEngine(rdb, limiterMux, cfg.Features.FailPolicy)
+	var engine *core.Engine
+	if cfg.Features.LocalOnly {
+		local := limiter.NewLocal(1)
+		go local.Run(rootCtx, time.Minute)
+		limiters := make(map[string]limiter.Limiter, len(limiter.LocalAlgos))
+		for _, algo := range limiter.LocalAlgos {
+			limiters[algo] = local
+		}
+		engine = core.NewEngine(rdb, limiter.NewMux("token_bucket", limiters), cfg.Features.FailPolicy)
+		ruleCache.OnReplace(localOnlyReporter())
+	} else {
+		tbLimiter := limiter.NewTokenBucket(rdb)
+		go tbLimiter.Run(rootCtx, time.Second) // returns expired localBatch leases
+		slidingLimiter := limiter.NewSlidingWindow(rdb)
+		leakyLimiter := limiter.NewLeakyBucket(rdb)
+		gcraLimiter := limiter.NewGCRA(rdb)
+		counterLimiter := limiter.NewSlidingWindowCounter(rdb)
+		concurrencyLimiter := limiter.NewConcurrency(rdb)
+		limiterMux := limiter.NewMux("token_bucket", map[string]limiter.Limiter{
+			"token_bucket":           tbLimiter,
+			"sliding_window":         slidingLimiter,
+			"sliding_window_counter": counterLimiter,
+			"leaky_bucket":           leakyLimiter,
+			"gcra":                   gcraLimiter,
+			"concurrency":            concurrencyLimiter,
+		})
+		engine = core.NewEngine(rdb, limiterMux, cfg.Features.FailPolicy)
+		if cfg.Features.LocalFallback {
+			local := limiter.NewLocal(cfg.Features.Replicas)
+			go local.Run(rootCtx, time.Minute)
+			engine.SetFallback(local)
+		}
+	}
+
+	engine.SetHook(rlsMetrics)
+	if strings.EqualFold(cfg.Features.Audit, "redis_stream") {
+		if rdb.Cli == nil {
+			log.Printf("audit %q needs redis, disabled in local-only mode", cfg.Features.Audit)
+		} else {
+			auditStream := audit.NewStream(rdb, cfg.Audit, nil)
+			go auditStream.Run(rootCtx)
+			engine.SetAuditor(auditStream)
+			rlsMetrics.WatchAudit(auditStream)
+		}
+	}
+
+	httpServer := api.NewServer(cfg.Server, ruleCache, engine, matcher)
+	trustedProxies, err := identity.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		log.Fatalf("invalid trustedProxies: %v", err)
+	}
+	httpServer.SetTrustedProxies(trustedProxies)
+	adminAuth, err := auth.New(cfg.AdminAuth)
+	if err != nil {
+		log.Fatalf("invalid admin auth config: %v", err)
+	}
+	if adminAuth != nil {
+		httpServer.SetAuthenticator(adminAuth)
+	} else {
+		log.Printf("admin API has no authentication configured; anyone who can reach it can change rules")
+	}
+	// one reloader serves every listener, so a rotated certificate reaches
+	// HTTP, admin and gRPC together
+	var certs *tlsutil.Reloader
+	if cfg.Server.TLS.Enabled() {
+		if certs, err = tlsutil.New(cfg.Server.TLS); err != nil {
+			log.Fatalf("invalid tls config: %v", err)
+		}
+		go certs.Run(rootCtx)
+	}
+	serve := func(srv *http.Server) error {
+		if certs == nil {
+			return srv.ListenAndServe()
+		}
+		srv.TLSConfig = certs.Config("h2", "http/1.1")
+		return srv.ListenAndServeTLS("", "")
+	}
 
-	httpServer := api.NewServer(cfg.Server, ruleCache, engine)
 	r := mux.NewRouter()
-	httpServer.RegisterRoutes(r)
+	httpServer.RegisterDataRoutes(r)
+	r.Handle("/metrics", metrics.Handler(reg)).Methods(http.MethodGet)
+
+	// the admin plane shares the data port unless server.adminAddr is set
+	var adminSrv *http.Server
+	if cfg.Server.AdminAddr != "" {
+		ar := mux.NewRouter()
+		httpServer.RegisterAdminRoutes(ar)
+		adminSrv = &http.Server{
+			Addr:              cfg.Server.AdminAddr,
+			Handler:           ar,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			log.Printf("admin API is running on %s", cfg.Server.AdminAddr)
+			if err := serve(adminSrv); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("admin server failed: %v", err)
+			}
+		}()
+	} else {
+		httpServer.RegisterAdminRoutes(r)
+	}
 
 	srv := &http.Server{
 		Addr:    cfg.Server.HTTPAddr,
@@ -90,22 +211,109 @@ func main() {
 
 	go func() {
 		log.Printf("server is running on %s (PID: %d)", cfg.Server.HTTPAddr, os.Getpid())
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := serve(srv); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("server failed: %v", err)
 		}
 	}()
 
+	var grpcSrv *grpc.Server
+	if cfg.Server.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.Server.GRPCAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", cfg.Server.GRPCAddr, err)
+		}
+		var opts []grpc.ServerOption
+		if certs != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(certs.Config("h2"))))
+		}
+		grpcSrv = grpc.NewServer(opts...)
+		rlsv3.RegisterRateLimitServiceServer(grpcSrv, api.NewRateLimitService(cfg.Envoy, ruleCache, engine, matcher))
+		go func() {
+			log.Printf("envoy rls grpc is running on %s", cfg.Server.GRPCAddr)
+			if err := grpcSrv.Serve(lis); err != nil {
+				log.Fatalf("grpc server failed: %v", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("shutting down server...")
 	cancelRoot()
 	engine.Close()
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("admin server shutdown failed: %v", err)
+		}
+	}
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("server shutdown failed: %v", err)
 	}
 	log.Println("server exited properly")
 }
+
+// localOnlyReporter logs every enabled concurrency rule once, at startup and
+// whenever one is added later: local-only mode has no shared lease store, so
+// such rules cannot be enforced.
+func localOnlyReporter() func(*rules.ImmutableRuleSet) {
+	reported := make(map[string]bool)
+	return func(set *rules.ImmutableRuleSet) {
+		next := make(map[string]bool)
+		for id, r := range set.Rules {
+			if !r.Enabled || !strings.EqualFold(strings.TrimSpace(r.Algo), "concurrency") {
+				continue
+			}
+			if !reported[id] {
+				log.Printf("rule %s uses concurrency, which local-only mode cannot enforce; its acquire requests are settled by failPolicy", id)
+			}
+			next[id] = true
+		}
+		reported = next
+	}
+}
+
+// ruleSource builds the dynamic rule source selected by rulesSource.type, or
+// returns a nil source when rules live in Redis.
+func ruleSource(cfg *config.Config) (source.RuleSource, string, rules.PollerConfig, error) {
+	rs := cfg.RulesSource
+	typ := strings.ToLower(strings.TrimSpace(rs.Type))
+	if typ == "" && cfg.Nacos.Enabled() {
+		typ = "nacos"
+	}
+	pollCfg := func(intervalMs int, failPolicy string) rules.PollerConfig {
+		return rules.PollerConfig{Interval: time.Duration(intervalMs) * time.Millisecond, FailPolicy: failPolicy, Source: typ}
+	}
+	switch typ {
+	case "", "redis":
+		return nil, "", rules.PollerConfig{}, nil
+	case "nacos":
+		if !cfg.Nacos.Enabled() {
+			return nil, "", rules.PollerConfig{}, errors.New("nacos.addr and nacos.dataId are required")
+		}
+		return source.NewNacosSource(cfg.Nacos), "nacos", pollCfg(cfg.Nacos.PollIntervalMs, cfg.Nacos.FailPolicy), nil
+	case "file":
+		if !rs.File.Enabled() {
+			return nil, "", rules.PollerConfig{}, errors.New("rulesSource.file.path is required")
+		}
+		return source.NewFileSource(rs.File), rs.File.Path, pollCfg(rs.File.PollIntervalMs, rs.File.FailPolicy), nil
+	case "etcd":
+		if len(rs.Etcd.Endpoints) == 0 || rs.Etcd.Key == "" {
+			return nil, "", rules.PollerConfig{}, errors.New("rulesSource.etcd.endpoints and key are required")
+		}
+		return source.NewEtcdSource(rs.Etcd), "etcd", pollCfg(rs.Etcd.PollIntervalMs, rs.Etcd.FailPolicy), nil
+	case "consul":
+		if rs.Consul.Addr == "" || rs.Consul.Key == "" {
+			return nil, "", rules.PollerConfig{}, errors.New("rulesSource.consul.addr and key are required")
+		}
+		return source.NewConsulSource(rs.Consul), "consul", pollCfg(rs.Consul.PollIntervalMs, rs.Consul.FailPolicy), nil
+	default:
+		return nil, "", rules.PollerConfig{}, fmt.Errorf("unknown rulesSource.type %q", rs.Type)
+	}
+}
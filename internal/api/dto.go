@@ -1,8 +1,67 @@
 package api
 
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/rules"
+)
+
 type AllowRequest struct {
 	RuleID string            `json:"ruleId"`
 	Dims   map[string]string `json:"dims"` // ip,userId,appId,route...
+	Cost   int64             `json:"cost"` // units to consume (bytes, tokens...), default 1
+}
+
+// BatchAllowRequest evaluates several rule/dims pairs in one call. With
+// Atomic set, either every item is admitted and consumed or none is.
+type BatchAllowRequest struct {
+	Atomic bool             `json:"atomic"`
+	Items  []BatchAllowItem `json:"items"`
+}
+
+type BatchAllowItem struct {
+	RuleID string            `json:"ruleId"`
+	Dims   map[string]string `json:"dims"`
+	Cost   int64             `json:"cost"` // units to consume, default 1
+}
+
+type BatchAllowResponse struct {
+	Allowed bool            `json:"allowed"` // every item was allowed
+	Results []AllowResponse `json:"results"` // one per item, in request order
+}
+
+// AcquireRequest takes cost slots of a concurrency rule for TTLMs
+// (default and maximum: the rule's windowMs).
+type AcquireRequest struct {
+	RuleID string            `json:"ruleId"`
+	Dims   map[string]string `json:"dims"`
+	Cost   int64             `json:"cost"`  // slots to hold, default 1
+	TTLMs  int64             `json:"ttlMs"` // lease lifetime, default windowMs
+}
+
+type AcquireResponse struct {
+	LeaseID   string `json:"leaseId"`
+	RuleID    string `json:"ruleId"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix ms; the slots are reclaimed after this
+	Remaining int64  `json:"remaining"`
+	Reason    string `json:"reason"`
+}
+
+type ReleaseRequest struct {
+	LeaseID string `json:"leaseId"`
+}
+
+type ReleaseResponse struct {
+	Released bool `json:"released"` // false if the lease had already expired
+}
+
+// CheckRequest describes an inbound request to be matched against route rules.
+type CheckRequest struct {
+	Path       string            `json:"path"`
+	Method     string            `json:"method"`
+	Headers    map[string]string `json:"headers"`    // identity headers; defaults to the caller's headers
+	RemoteAddr string            `json:"remoteAddr"` // honored only from a trusted proxy; defaults to the caller's address
+	Dims       map[string]string `json:"dims"`       // extra dims, win over derived ones
+	Cost       int64             `json:"cost"`       // units to consume, default 1
 }
 
 type AllowResponse struct {
@@ -10,6 +69,7 @@ type AllowResponse struct {
 	Remaining    int64  `json:"remaining"`
 	RetryAfterMs int64  `json:"retryAfterMs"`
 	Reason       string `json:"reason"`
+	RuleID       string `json:"ruleId,omitempty"`
 }
 
 type ErrorDetail struct {
@@ -20,7 +80,27 @@ type ErrorDetail struct {
 }
 
 type ErrorResponse struct {
-	Code    int          `json:"code"`
-	Message string       `json:"message"`
-	Detail  *ErrorDetail `json:"detail,omitempty"`
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Detail  *ErrorDetail       `json:"detail,omitempty"`
+	Errors  []rules.FieldError `json:"errors,omitempty"` // per-field errors of a rejected rule (422)
+}
+
+type RuleListResponse struct {
+	Items  []config.Rule `json:"items"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+}
+
+type RuleHistoryResponse struct {
+	RuleID string           `json:"ruleId"`
+	Items  []rules.Revision `json:"items"` // newest first
+}
+
+type RuleDiffResponse struct {
+	RuleID  string              `json:"ruleId"`
+	From    int64               `json:"from"` // 0: the empty rule
+	To      int64               `json:"to"`
+	Changes []rules.FieldChange `json:"changes"`
 }
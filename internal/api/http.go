@@ -3,41 +3,66 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"net"
+	"errors"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/nanjiek/pixiu-rls/internal/auth"
 	"github.com/nanjiek/pixiu-rls/internal/config"
 	"github.com/nanjiek/pixiu-rls/internal/core"
+	"github.com/nanjiek/pixiu-rls/internal/identity"
+	"github.com/nanjiek/pixiu-rls/internal/router"
 	"github.com/nanjiek/pixiu-rls/internal/rules"
 	"github.com/nanjiek/pixiu-rls/internal/types"
 )
 
+// RuleRequest is the admin API rule body. It carries every config.Rule field
+// under the same JSON names, so GET output can be sent back unchanged; the
+// legacy snake_case keys rule_id/window_ms are still accepted.
 type RuleRequest struct {
-	RuleID   string          `json:"rule_id"`
-	Enabled  bool            `json:"enabled"`
-	Algo     string          `json:"algo"`
-	Limit    int64           `json:"limit"`
-	WindowMs int64           `json:"window_ms"`
-	Burst    int64           `json:"burst"`
-	Dims     []string        `json:"dims"`
-	Quota    config.QuotaCfg `json:"quota"`
+	config.Rule
+	LegacyRuleID   string `json:"rule_id,omitempty"`
+	LegacyWindowMs int64  `json:"window_ms,omitempty"`
 }
 
+func (req RuleRequest) toRule() config.Rule {
+	rule := req.Rule
+	if rule.RuleID == "" {
+		rule.RuleID = req.LegacyRuleID
+	}
+	if rule.WindowMs == 0 {
+		rule.WindowMs = req.LegacyWindowMs
+	}
+	return rule
+}
+
+const maxBatchItems = 1000
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
 type Server struct {
 	cfg       config.ServerCfg
 	ruleCache *rules.Cache
 	engine    *core.Engine
-	srv       *http.Server // �?内部封装 http.Server
+	matcher   *router.Matcher
+	resolver  *identity.Resolver
+	auth      auth.Authenticator // nil leaves the admin routes open
+	srv       *http.Server       // �?内部封装 http.Server
 }
 
 const (
 	errCodeBadRequest    = 400000
+	errCodeUnauthorized  = 401000
 	errCodeForbidden     = 403000
 	errCodeNotFound      = 404000
+	errCodeValidation    = 422000
 	errCodeInternal      = 500000
 	errCodeRateLimit     = 429000
 	errCodeRateBlacklist = 429001
@@ -51,21 +76,121 @@ type allowContext struct {
 
 type allowHandlerFunc func(r *http.Request) (*allowContext, *ErrorResponse, int)
 
-func NewServer(cfg config.ServerCfg, ruleCache *rules.Cache, engine *core.Engine) *Server {
+// NewServer builds the HTTP server. If matcher is nil, a matcher that follows
+// ruleCache snapshot swaps is created for route-based checks.
+func NewServer(cfg config.ServerCfg, ruleCache *rules.Cache, engine *core.Engine, matcher *router.Matcher) *Server {
+	if matcher == nil {
+		matcher = router.NewMatcher(nil)
+		ruleCache.OnReplace(func(set *rules.ImmutableRuleSet) {
+			matcher.Replace(router.BuildRouteSnapshot(set.Rules))
+		})
+	}
 	return &Server{
 		cfg:       cfg,
 		ruleCache: ruleCache,
 		engine:    engine,
+		matcher:   matcher,
+		resolver:  identity.NewResolver(),
+	}
+}
+
+// SetAuthenticator requires callers of the admin routes to authenticate with
+// a and checks their role and rule prefixes on every admin request.
+func (s *Server) SetAuthenticator(a auth.Authenticator) {
+	s.auth = a
+}
+
+// SetTrustedProxies lists the proxies whose forwarding headers are believed
+// when deriving the ip dimension. Without any, the ip is the TCP peer.
+func (s *Server) SetTrustedProxies(p []netip.Prefix) {
+	s.resolver.TrustedProxies = p
+}
+
+// setClientIP fills dims["ip"] with the client address when the caller did
+// not pass one, and normalizes it otherwise so blacklist lookups see a single
+// spelling per address.
+func (s *Server) setClientIP(r *http.Request, dims map[string]string) {
+	if v, ok := dims["ip"]; ok {
+		dims["ip"] = identity.NormalizeIP(v)
+		return
+	}
+	if ip := s.resolver.ClientIP(r); ip != "" {
+		dims["ip"] = ip
 	}
 }
 
+// RegisterRoutes registers the data plane and the admin plane on r.
 func (s *Server) RegisterRoutes(r *mux.Router) {
+	s.RegisterDataRoutes(r)
+	s.RegisterAdminRoutes(r)
+}
+
+// RegisterDataRoutes registers the rate limiting endpoints.
+func (s *Server) RegisterDataRoutes(r *mux.Router) {
 	r.HandleFunc("/v1/allow", allowMiddleware(s.allowLogic)).Methods(http.MethodPost)
-	r.HandleFunc("/v1/rules", s.createRuleHandler).Methods(http.MethodPost)
-	r.HandleFunc("/v1/rules/{id}", s.getRuleHandler).Methods(http.MethodGet)
-	r.HandleFunc("/v1/rules/{id}", s.updateRuleHandler).Methods(http.MethodPut)
-	// 先别注册 DELETE，等你实现了 Cache.Delete 再放开
-	// r.HandleFunc("/v1/rules/{id}", s.deleteRuleHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/check", allowMiddleware(s.checkLogic)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/allow:batch", s.batchAllowHandler).Methods(http.MethodPost)
+	r.HandleFunc("/v1/acquire", s.acquireHandler).Methods(http.MethodPost)
+	r.HandleFunc("/v1/release", s.releaseHandler).Methods(http.MethodPost)
+}
+
+// RegisterAdminRoutes registers the rule management endpoints behind the
+// authenticator set with SetAuthenticator.
+func (s *Server) RegisterAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/v1/rules", s.admin(auth.ActionRead, s.listRulesHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/rules", s.admin(auth.ActionWrite, s.createRuleHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/rules/{id}", s.admin(auth.ActionRead, s.getRuleHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/rules/{id}", s.admin(auth.ActionWrite, s.updateRuleHandler)).Methods(http.MethodPut)
+	r.HandleFunc("/v1/rules/{id}", s.admin(auth.ActionDelete, s.deleteRuleHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/rules/{id}/history", s.admin(auth.ActionRead, s.ruleHistoryHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/rules/{id}/diff", s.admin(auth.ActionRead, s.ruleDiffHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/rules/{id}/rollback", s.admin(auth.ActionWrite, s.rollbackRuleHandler)).Methods(http.MethodPost)
+}
+
+// admin authenticates the caller and checks that its role permits action,
+// on the {id} rule when the route has one. Routes without an id (list,
+// create) narrow or check by rule ID in the handler.
+func (s *Server) admin(action auth.Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			next(w, r)
+			return
+		}
+		p, err := s.auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pixiu-rls"`)
+			writeError(w, http.StatusUnauthorized, &ErrorResponse{
+				Code:    errCodeUnauthorized,
+				Message: "Authentication required",
+				Detail:  &ErrorDetail{Reason: err.Error()},
+			})
+			return
+		}
+		ruleID, hasID := mux.Vars(r)["id"]
+		if !p.Allows(action) || (hasID && !p.Covers(ruleID)) {
+			writeForbidden(w, p, ruleID)
+			return
+		}
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), p)))
+	}
+}
+
+// authorize checks action on ruleID for handlers whose rule is in the body.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, action auth.Action, ruleID string) bool {
+	p := auth.FromContext(r.Context())
+	if s.auth == nil || p.Can(action, ruleID) {
+		return true
+	}
+	writeForbidden(w, p, ruleID)
+	return false
+}
+
+func writeForbidden(w http.ResponseWriter, p *auth.Principal, ruleID string) {
+	writeError(w, http.StatusForbidden, &ErrorResponse{
+		Code:    errCodeForbidden,
+		Message: "Permission denied",
+		Detail:  &ErrorDetail{Reason: "role " + p.Role + " of " + p.Subject + " does not permit this", RuleID: ruleID},
+	})
 }
 
 func (s *Server) ListenAndServe() error {
@@ -104,21 +229,22 @@ func (s *Server) allowLogic(r *http.Request) (*allowContext, *ErrorResponse, int
 			Message: "ruleId is required",
 		}, http.StatusBadRequest
 	}
+	if req.Cost < 0 {
+		return nil, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "cost must not be negative",
+		}, http.StatusBadRequest
+	}
 
 	dims := req.Dims
 	if dims == nil {
 		dims = make(map[string]string)
 	}
-	if _, ok := dims["ip"]; !ok {
-		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-		if ip == "" {
-			ip = r.RemoteAddr
-		}
-		dims["ip"] = ip
-	}
+	s.setClientIP(r, dims)
 	if _, ok := dims["route"]; !ok {
 		dims["route"] = r.URL.Path
 	}
+	identity.SetMTLSDim(dims, r.TLS)
 
 	rule, exists := s.ruleCache.Get(req.RuleID)
 	if !exists {
@@ -135,8 +261,15 @@ func (s *Server) allowLogic(r *http.Request) (*allowContext, *ErrorResponse, int
 			Detail:  &ErrorDetail{RuleID: req.RuleID},
 		}, http.StatusForbidden
 	}
+	if core.RequiresLease(rule) {
+		return nil, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Rule uses the concurrency algorithm; use /v1/acquire and /v1/release",
+			Detail:  &ErrorDetail{Reason: "lease_required", RuleID: rule.RuleID},
+		}, http.StatusBadRequest
+	}
 
-	dec, err := s.engine.Allow(r.Context(), rule, dims, time.Now())
+	dec, err := s.engine.Allow(r.Context(), rule, dims, req.Cost, time.Now())
 	if err != nil {
 		detail := &ErrorDetail{Reason: err.Error(), RuleID: rule.RuleID}
 		return nil, &ErrorResponse{
@@ -152,6 +285,307 @@ func (s *Server) allowLogic(r *http.Request) (*allowContext, *ErrorResponse, int
 	}, nil, 0
 }
 
+// batchAllowHandler serves POST /v1/allow:batch. Every item gets its own
+// result; in atomic mode the batch is admitted as a whole or not at all.
+func (s *Server) batchAllowHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchAllowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid request body",
+			Detail:  &ErrorDetail{Reason: err.Error()},
+		})
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBatchItems {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "items must contain 1 to " + strconv.Itoa(maxBatchItems) + " entries",
+		})
+		return
+	}
+
+	ip := s.resolver.ClientIP(r)
+	items := make([]core.BatchItem, len(req.Items))
+	for i, it := range req.Items {
+		if it.RuleID == "" || it.Cost < 0 {
+			writeError(w, http.StatusBadRequest, &ErrorResponse{
+				Code:    errCodeBadRequest,
+				Message: "items[" + strconv.Itoa(i) + "]: ruleId is required and cost must not be negative",
+			})
+			return
+		}
+		rule, ok := s.ruleCache.Get(it.RuleID)
+		if !ok {
+			writeError(w, http.StatusNotFound, &ErrorResponse{
+				Code:    errCodeNotFound,
+				Message: "Rule not found",
+				Detail:  &ErrorDetail{RuleID: it.RuleID},
+			})
+			return
+		}
+		if core.RequiresLease(rule) {
+			writeError(w, http.StatusBadRequest, &ErrorResponse{
+				Code:    errCodeBadRequest,
+				Message: "items[" + strconv.Itoa(i) + "]: rule uses the concurrency algorithm; use /v1/acquire and /v1/release",
+				Detail:  &ErrorDetail{Reason: "lease_required", RuleID: rule.RuleID},
+			})
+			return
+		}
+		dims := make(map[string]string, len(it.Dims)+2)
+		for k, v := range it.Dims {
+			dims[k] = v
+		}
+		if v, ok := dims["ip"]; ok {
+			dims["ip"] = identity.NormalizeIP(v)
+		} else if ip != "" {
+			dims["ip"] = ip
+		}
+		if _, ok := dims["route"]; !ok {
+			dims["route"] = r.URL.Path
+		}
+		identity.SetMTLSDim(dims, r.TLS)
+		items[i] = core.BatchItem{Rule: rule, Dims: dims, Cost: it.Cost}
+	}
+
+	decs, err := s.engine.AllowBatch(r.Context(), items, req.Atomic, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, &ErrorResponse{
+			Code:    errCodeInternal,
+			Message: "Batch allow check failed",
+			Detail:  &ErrorDetail{Reason: err.Error()},
+		})
+		return
+	}
+
+	resp := BatchAllowResponse{Allowed: true, Results: make([]AllowResponse, len(decs))}
+	for i, dec := range decs {
+		resp.Allowed = resp.Allowed && dec.Allowed
+		resp.Results[i] = AllowResponse{
+			Allowed:      dec.Allowed,
+			Remaining:    dec.Remaining,
+			RetryAfterMs: dec.RetryAfterMs,
+			Reason:       dec.Reason,
+			RuleID:       dec.RuleID,
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// acquireHandler serves POST /v1/acquire: it takes slots of a concurrency
+// rule and returns a lease that must be released, or expires after ttlMs.
+func (s *Server) acquireHandler(w http.ResponseWriter, r *http.Request) {
+	var req AcquireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid request body",
+			Detail:  &ErrorDetail{Reason: err.Error()},
+		})
+		return
+	}
+	if req.RuleID == "" || req.Cost < 0 || req.TTLMs < 0 {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "ruleId is required; cost and ttlMs must not be negative",
+		})
+		return
+	}
+
+	rule, ok := s.ruleCache.Get(req.RuleID)
+	if !ok {
+		writeError(w, http.StatusNotFound, &ErrorResponse{
+			Code:    errCodeNotFound,
+			Message: "Rule not found",
+			Detail:  &ErrorDetail{RuleID: req.RuleID},
+		})
+		return
+	}
+	if !rule.Enabled {
+		writeError(w, http.StatusForbidden, &ErrorResponse{
+			Code:    errCodeForbidden,
+			Message: "Rule is disabled",
+			Detail:  &ErrorDetail{RuleID: req.RuleID},
+		})
+		return
+	}
+	if !core.RequiresLease(rule) {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Rule does not use the concurrency algorithm",
+			Detail:  &ErrorDetail{RuleID: rule.RuleID},
+		})
+		return
+	}
+	if req.TTLMs > rule.WindowMs {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "ttlMs must not exceed the rule's windowMs (" + strconv.FormatInt(rule.WindowMs, 10) + ")",
+			Detail:  &ErrorDetail{RuleID: rule.RuleID},
+		})
+		return
+	}
+
+	dims := req.Dims
+	if dims == nil {
+		dims = make(map[string]string)
+	}
+	s.setClientIP(r, dims)
+	if _, ok := dims["route"]; !ok {
+		dims["route"] = r.URL.Path
+	}
+	identity.SetMTLSDim(dims, r.TLS)
+
+	ttl := time.Duration(req.TTLMs) * time.Millisecond
+	lease, dec, err := s.engine.Acquire(r.Context(), rule, dims, req.Cost, ttl, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, &ErrorResponse{
+			Code:    errCodeInternal,
+			Message: "Acquire failed",
+			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: rule.RuleID},
+		})
+		return
+	}
+	if !dec.Allowed {
+		renderDenied(w, dec, &rule)
+		return
+	}
+	setRateLimitHeaders(w, dec, &rule, 0)
+	writeJSON(w, http.StatusOK, AcquireResponse{
+		LeaseID:   lease.ID,
+		RuleID:    lease.RuleID,
+		ExpiresAt: lease.ExpiresAt.UnixMilli(),
+		Remaining: dec.Remaining,
+		Reason:    dec.Reason,
+	})
+}
+
+// releaseHandler serves POST /v1/release. Releasing an expired or unknown
+// lease is not an error; released reports whether slots were freed.
+func (s *Server) releaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid request body",
+			Detail:  &ErrorDetail{Reason: err.Error()},
+		})
+		return
+	}
+	ruleID, err := core.LeaseRuleID(req.LeaseID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid leaseId",
+		})
+		return
+	}
+	rule, ok := s.ruleCache.Get(ruleID)
+	if !ok {
+		writeError(w, http.StatusNotFound, &ErrorResponse{
+			Code:    errCodeNotFound,
+			Message: "Rule not found",
+			Detail:  &ErrorDetail{RuleID: ruleID},
+		})
+		return
+	}
+
+	released, err := s.engine.Release(r.Context(), rule, req.LeaseID, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, &ErrorResponse{
+			Code:    errCodeInternal,
+			Message: "Release failed",
+			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: rule.RuleID},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, ReleaseResponse{Released: released})
+}
+
+// checkLogic matches every applicable rule by path/method/client identity
+// instead of requiring an explicit ruleId.
+func (s *Server) checkLogic(r *http.Request) (*allowContext, *ErrorResponse, int) {
+	var req CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid request body",
+			Detail:  &ErrorDetail{Reason: err.Error()},
+		}, http.StatusBadRequest
+	}
+	if req.Path == "" {
+		return nil, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "path is required",
+		}, http.StatusBadRequest
+	}
+	if req.Cost < 0 {
+		return nil, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "cost must not be negative",
+		}, http.StatusBadRequest
+	}
+
+	origin := &http.Request{Header: r.Header, RemoteAddr: r.RemoteAddr}
+	if req.Headers != nil {
+		origin.Header = make(http.Header, len(req.Headers))
+		for k, v := range req.Headers {
+			origin.Header.Set(k, v)
+		}
+	}
+	// remoteAddr is the original client's peer as a gateway saw it; only a
+	// trusted proxy may vouch for it, otherwise anyone could name a trusted
+	// proxy here and forge the forwarding headers
+	if req.RemoteAddr != "" && s.resolver.TrustsPeer(r) {
+		origin.RemoteAddr = req.RemoteAddr
+	}
+	client, _ := s.resolver.Resolve(origin)
+
+	dims := make(map[string]string, len(req.Dims)+4)
+	if ip := s.resolver.ClientIP(origin); ip != "" {
+		dims["ip"] = ip
+	}
+	if client.Kind != "" {
+		dims[client.Kind] = client.ID
+		dims["client"] = client.Key
+	}
+	dims["route"] = req.Path
+	if req.Method != "" {
+		dims["method"] = strings.ToUpper(req.Method)
+	}
+	for k, v := range req.Dims {
+		dims[k] = v
+	}
+	if v, ok := dims["ip"]; ok {
+		dims["ip"] = identity.NormalizeIP(v)
+	}
+	identity.SetMTLSDim(dims, r.TLS)
+
+	matched := s.matcher.Match(router.RequestCtx{
+		Path:   req.Path,
+		Method: req.Method,
+		Client: client,
+	})
+
+	dec, err := s.engine.AllowRules(r.Context(), matched, dims, req.Cost, time.Now())
+	if err != nil {
+		return nil, &ErrorResponse{
+			Code:    errCodeInternal,
+			Message: "Allow check failed",
+			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: dec.RuleID},
+		}, http.StatusInternalServerError
+	}
+
+	ctx := &allowContext{dec: dec}
+	for _, rule := range matched {
+		if dec.RuleID == "" || rule.RuleID == dec.RuleID {
+			ctx.rule = rule
+			break
+		}
+	}
+	return ctx, nil, 0
+}
+
 func allowMiddleware(next allowHandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, apiErr, status := next(r)
@@ -181,6 +615,7 @@ func renderAllowed(w http.ResponseWriter, dec types.Decision, rule *config.Rule)
 		Remaining:    dec.Remaining,
 		RetryAfterMs: dec.RetryAfterMs,
 		Reason:       dec.Reason,
+		RuleID:       dec.RuleID,
 	})
 }
 
@@ -197,6 +632,9 @@ func renderDenied(w http.ResponseWriter, dec types.Decision, rule *config.Rule)
 	if rule != nil {
 		detail.RuleID = rule.RuleID
 	}
+	if dec.RuleID != "" {
+		detail.RuleID = dec.RuleID
+	}
 	writeError(w, http.StatusTooManyRequests, &ErrorResponse{
 		Code:    rateLimitCode(dec.Reason),
 		Message: "Too Many Requests",
@@ -216,7 +654,10 @@ func setRateLimitHeaders(w http.ResponseWriter, dec types.Decision, rule *config
 			w.Header().Set("X-RateLimit-Rule", rule.RuleID)
 		}
 	}
-	if retryAfterSec > 0 {
+	switch {
+	case dec.ResetAtMs > 0:
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt((dec.ResetAtMs+999)/1000, 10))
+	case retryAfterSec > 0:
 		reset := time.Now().Add(time.Duration(retryAfterSec) * time.Second).Unix()
 		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
 	}
@@ -251,20 +692,15 @@ func (s *Server) createRuleHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	rule := config.Rule{
-		RuleID: req.RuleID, Enabled: req.Enabled, Algo: req.Algo,
-		Limit: req.Limit, WindowMs: req.WindowMs, Burst: req.Burst,
-		Dims: req.Dims, Quota: req.Quota,
+	rule := req.toRule()
+	if !s.authorize(w, r, auth.ActionWrite, rule.RuleID) {
+		return
 	}
-	if err := s.ruleCache.Upsert(r.Context(), rule); err != nil {
-		writeError(w, http.StatusInternalServerError, &ErrorResponse{
-			Code:    errCodeInternal,
-			Message: "Failed to create rule",
-			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: req.RuleID},
-		})
+	if err := s.ruleCache.Upsert(changeContext(r), rule); err != nil {
+		writeUpsertError(w, err, rule.RuleID, "Failed to create rule")
 		return
 	}
-	writeJSON(w, http.StatusCreated, map[string]string{"status": "success", "rule_id": req.RuleID})
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "success", "rule_id": rule.RuleID})
 }
 func (s *Server) getRuleHandler(w http.ResponseWriter, r *http.Request) {
 	ruleID := mux.Vars(r)["id"]
@@ -290,22 +726,275 @@ func (s *Server) updateRuleHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	req.RuleID = ruleID
-	rule := config.Rule{
-		RuleID: req.RuleID, Enabled: req.Enabled, Algo: req.Algo,
-		Limit: req.Limit, WindowMs: req.WindowMs, Burst: req.Burst,
-		Dims: req.Dims, Quota: req.Quota,
+	rule := req.toRule()
+	rule.RuleID = ruleID
+	if err := s.ruleCache.Upsert(changeContext(r), rule); err != nil {
+		writeUpsertError(w, err, ruleID, "Failed to update rule")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "success", "rule_id": ruleID})
+}
+
+// writeUpsertError maps a rejected rule to 422 with the per-field errors and
+// anything else to 500.
+func writeUpsertError(w http.ResponseWriter, err error, ruleID, message string) {
+	var verr *rules.ValidationError
+	if errors.As(err, &verr) {
+		writeError(w, http.StatusUnprocessableEntity, &ErrorResponse{
+			Code:    errCodeValidation,
+			Message: "Invalid rule",
+			Detail:  &ErrorDetail{Reason: "validation_failed", RuleID: ruleID},
+			Errors:  verr.Errors,
+		})
+		return
 	}
-	if err := s.ruleCache.Upsert(r.Context(), rule); err != nil {
+	writeError(w, http.StatusInternalServerError, &ErrorResponse{
+		Code:    errCodeInternal,
+		Message: message,
+		Detail:  &ErrorDetail{Reason: err.Error(), RuleID: ruleID},
+	})
+}
+
+func (s *Server) deleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID := mux.Vars(r)["id"]
+	if err := s.ruleCache.Delete(changeContext(r), ruleID); err != nil {
+		if errors.Is(err, rules.ErrRuleNotFound) {
+			writeError(w, http.StatusNotFound, &ErrorResponse{
+				Code:    errCodeNotFound,
+				Message: "Rule not found",
+				Detail:  &ErrorDetail{RuleID: ruleID},
+			})
+			return
+		}
 		writeError(w, http.StatusInternalServerError, &ErrorResponse{
 			Code:    errCodeInternal,
-			Message: "Failed to update rule",
+			Message: "Failed to delete rule",
 			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: ruleID},
 		})
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"status": "success", "rule_id": ruleID})
 }
+
+// listRulesHandler serves GET /v1/rules?algo=&enabled=&match=&offset=&limit=.
+func (s *Server) listRulesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := rules.ListFilter{
+		Algo:        q.Get("algo"),
+		MatchPrefix: q.Get("match"),
+		Limit:       defaultListLimit,
+	}
+	if p := auth.FromContext(r.Context()); p != nil {
+		filter.IDPrefixes = p.RulePrefixes
+	}
+	if v := q.Get("enabled"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, &ErrorResponse{
+				Code:    errCodeBadRequest,
+				Message: "Invalid enabled filter",
+				Detail:  &ErrorDetail{Reason: err.Error()},
+			})
+			return
+		}
+		filter.Enabled = &enabled
+	}
+	for name, dst := range map[string]*int{"offset": &filter.Offset, "limit": &filter.Limit} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, &ErrorResponse{
+				Code:    errCodeBadRequest,
+				Message: "Invalid " + name,
+			})
+			return
+		}
+		*dst = n
+	}
+	if filter.Limit <= 0 || filter.Limit > maxListLimit {
+		filter.Limit = maxListLimit
+	}
+
+	items, total := s.ruleCache.List(filter)
+	writeJSON(w, http.StatusOK, RuleListResponse{
+		Items:  items,
+		Total:  total,
+		Offset: filter.Offset,
+		Limit:  filter.Limit,
+	})
+}
+
+// changeContext tags the request context with the rule change it makes, so
+// the revision records who made it and that it came over HTTP. The author is
+// the authenticated subject; X-Rls-Author is only trusted when the admin API
+// is open.
+func changeContext(r *http.Request) context.Context {
+	author := r.Header.Get("X-Rls-Author")
+	if p := auth.FromContext(r.Context()); p != nil {
+		author = p.Subject
+	}
+	return rules.WithChange(r.Context(), rules.Change{
+		Author: author,
+		Source: rules.SourceHTTP,
+	})
+}
+
+// ruleHistoryHandler serves GET /v1/rules/{id}/history?limit=, newest first.
+func (s *Server) ruleHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID := mux.Vars(r)["id"]
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, &ErrorResponse{
+				Code:    errCodeBadRequest,
+				Message: "Invalid limit",
+			})
+			return
+		}
+		limit = n
+	}
+	items, err := s.ruleCache.History(r.Context(), ruleID, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, &ErrorResponse{
+			Code:    errCodeInternal,
+			Message: "Failed to read rule history",
+			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: ruleID},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, RuleHistoryResponse{RuleID: ruleID, Items: items})
+}
+
+// ruleDiffHandler serves GET /v1/rules/{id}/diff?from=&to=. to defaults to
+// the latest revision and from to the one before to; from=0 diffs against
+// the empty rule.
+func (s *Server) ruleDiffHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID := mux.Vars(r)["id"]
+	from, ok := revParam(w, r, "from")
+	if !ok {
+		return
+	}
+	to, ok := revParam(w, r, "to")
+	if !ok {
+		return
+	}
+
+	if to < 0 {
+		latest, err := s.ruleCache.History(r.Context(), ruleID, 1)
+		if err != nil {
+			writeRevisionError(w, err, ruleID)
+			return
+		}
+		if len(latest) == 0 {
+			writeRevisionError(w, rules.ErrRevisionNotFound, ruleID)
+			return
+		}
+		to = latest[0].Rev
+	}
+	if from < 0 {
+		from = to - 1
+	}
+
+	var a, b *config.Rule
+	if from > 0 {
+		rev, err := s.ruleCache.Revision(r.Context(), ruleID, from)
+		if err != nil {
+			writeRevisionError(w, err, ruleID)
+			return
+		}
+		a = rev.Rule
+	}
+	if to > 0 {
+		rev, err := s.ruleCache.Revision(r.Context(), ruleID, to)
+		if err != nil {
+			writeRevisionError(w, err, ruleID)
+			return
+		}
+		b = rev.Rule
+	}
+	changes := rules.DiffRules(a, b)
+	if changes == nil {
+		changes = []rules.FieldChange{}
+	}
+	writeJSON(w, http.StatusOK, RuleDiffResponse{RuleID: ruleID, From: from, To: to, Changes: changes})
+}
+
+// rollbackRuleHandler serves POST /v1/rules/{id}/rollback?to=. The restored
+// rule is written and published like any update, and recorded as a new
+// revision.
+func (s *Server) rollbackRuleHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID := mux.Vars(r)["id"]
+	to, ok := revParam(w, r, "to")
+	if !ok {
+		return
+	}
+	if to <= 0 {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid to",
+			Detail:  &ErrorDetail{Reason: "a revision number is required", RuleID: ruleID},
+		})
+		return
+	}
+	rev, err := s.ruleCache.Rollback(changeContext(r), ruleID, to)
+	if err != nil {
+		var verr *rules.ValidationError
+		if errors.As(err, &verr) {
+			writeUpsertError(w, err, ruleID, "Failed to roll back rule")
+			return
+		}
+		writeRevisionError(w, err, ruleID)
+		return
+	}
+	writeJSON(w, http.StatusOK, rev)
+}
+
+// revParam parses a revision query parameter; absent is -1.
+func revParam(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return -1, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		writeError(w, http.StatusBadRequest, &ErrorResponse{
+			Code:    errCodeBadRequest,
+			Message: "Invalid " + name,
+		})
+		return 0, false
+	}
+	return n, true
+}
+
+// writeRevisionError maps a missing revision or rule to 404 and anything
+// else to 500.
+func writeRevisionError(w http.ResponseWriter, err error, ruleID string) {
+	switch {
+	case errors.Is(err, rules.ErrRevisionNotFound):
+		writeError(w, http.StatusNotFound, &ErrorResponse{
+			Code:    errCodeNotFound,
+			Message: "Revision not found",
+			Detail:  &ErrorDetail{RuleID: ruleID},
+		})
+	case errors.Is(err, rules.ErrRuleNotFound):
+		writeError(w, http.StatusNotFound, &ErrorResponse{
+			Code:    errCodeNotFound,
+			Message: "Rule not found",
+			Detail:  &ErrorDetail{RuleID: ruleID},
+		})
+	default:
+		writeError(w, http.StatusInternalServerError, &ErrorResponse{
+			Code:    errCodeInternal,
+			Message: "Failed to read rule history",
+			Detail:  &ErrorDetail{Reason: err.Error(), RuleID: ruleID},
+		})
+	}
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
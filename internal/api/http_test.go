@@ -0,0 +1,309 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/auth"
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/core"
+	"github.com/nanjiek/pixiu-rls/internal/identity"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/rules"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+func newTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	cache := rules.NewCache(&config.Config{}, nil)
+	cache.ReplaceAll(map[string]config.Rule{
+		"tenant": {RuleID: "tenant", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Dims: []string{"tenant"}, Enabled: true},
+	})
+	engine := core.NewEngine(&repo.RedisRepo{Prefix: "test"}, &stubLimiter{allowed: true}, "fail-closed")
+	r := mux.NewRouter()
+	NewServer(config.ServerCfg{}, cache, engine, nil).RegisterRoutes(r)
+	return r
+}
+
+func TestCreateRuleRejectsInvalid(t *testing.T) {
+	h := newTestServer(t)
+	body := `{"ruleId":"bad","algo":"token_bucket","windowMs":0,"limit":10,"methods":["FETCH"]}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/rules", strings.NewReader(body)))
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Code != errCodeValidation || len(resp.Errors) != 2 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.Errors[0].Field != "methods[0]" || resp.Errors[1].Field != "windowMs" {
+		t.Fatalf("unexpected field errors: %+v", resp.Errors)
+	}
+}
+
+func TestBatchAllow(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/allow:batch",
+		strings.NewReader(`{"items":[{"ruleId":"missing"}]}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown rule: status = %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/allow:batch",
+		strings.NewReader(`{"items":[{"ruleId":"tenant","dims":{"tenant":"a","ip":""},"cost":2},{"ruleId":"tenant","dims":{"ip":""}}]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var resp BatchAllowResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// An empty ip dim skips the IP lists; without Redis behind the engine
+	// every item fails closed, each with its own result.
+	if resp.Allowed || len(resp.Results) != 2 || resp.Results[1].Reason != "fail_closed" || resp.Results[1].RuleID != "tenant" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+type stubLeaser struct {
+	stubLimiter
+	held map[string]bool
+}
+
+func (s *stubLeaser) Acquire(ctx context.Context, rule config.Rule, key, leaseID string, cost int64, ttl time.Duration, now time.Time) (types.Decision, error) {
+	if len(s.held) >= int(rule.Limit) {
+		return types.Decision{Allowed: false, Reason: "concurrency_exceeded", RetryAfterMs: 500}, nil
+	}
+	s.held[leaseID] = true
+	return types.Decision{Allowed: true, Remaining: rule.Limit - int64(len(s.held)), Reason: "allowed"}, nil
+}
+
+func (s *stubLeaser) Release(ctx context.Context, rule config.Rule, key, leaseID string, now time.Time) (bool, error) {
+	ok := s.held[leaseID]
+	delete(s.held, leaseID)
+	return ok, nil
+}
+
+func TestAcquireRelease(t *testing.T) {
+	cache := rules.NewCache(&config.Config{}, nil)
+	cache.ReplaceAll(map[string]config.Rule{
+		"exports": {RuleID: "exports", Algo: "concurrency", WindowMs: 60000, Limit: 1, Dims: []string{"tenant"}, Enabled: true},
+		"tenant":  {RuleID: "tenant", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Dims: []string{"tenant"}, Enabled: true},
+	})
+	engine := core.NewEngine(&repo.RedisRepo{Prefix: "test"}, &stubLeaser{held: map[string]bool{}}, "fail-closed")
+	h := mux.NewRouter()
+	NewServer(config.ServerCfg{}, cache, engine, nil).RegisterRoutes(h)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post("/v1/acquire", `{"ruleId":"tenant","dims":{"tenant":"a","ip":""}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("non-concurrency rule: status = %d", rec.Code)
+	}
+	// a slot taken by /v1/allow could never be released
+	if rec := post("/v1/allow", `{"ruleId":"exports","dims":{"tenant":"a","ip":""}}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "lease_required") {
+		t.Fatalf("allow on a concurrency rule: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := post("/v1/allow:batch", `{"items":[{"ruleId":"exports","dims":{"tenant":"a","ip":""}}]}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "lease_required") {
+		t.Fatalf("batch on a concurrency rule: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := post("/v1/acquire", `{"ruleId":"exports","dims":{"tenant":"a","ip":""},"ttlMs":120000}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("ttl above windowMs: status = %d", rec.Code)
+	}
+
+	rec := post("/v1/acquire", `{"ruleId":"exports","dims":{"tenant":"a","ip":""},"ttlMs":5000}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("acquire: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var lease AcquireResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &lease); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if lease.LeaseID == "" || lease.RuleID != "exports" || lease.ExpiresAt == 0 {
+		t.Fatalf("unexpected lease: %+v", lease)
+	}
+
+	if rec := post("/v1/acquire", `{"ruleId":"exports","dims":{"tenant":"a","ip":""}}`); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second acquire: status = %d", rec.Code)
+	}
+
+	for _, want := range []bool{true, false} {
+		rec = post("/v1/release", `{"leaseId":"`+lease.LeaseID+`"}`)
+		var resp ReleaseResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("release: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		if resp.Released != want {
+			t.Fatalf("released = %v, want %v", resp.Released, want)
+		}
+	}
+
+	if rec := post("/v1/release", `{"leaseId":"bogus"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bogus lease: status = %d", rec.Code)
+	}
+}
+
+func TestRuleHistoryDiffRollback(t *testing.T) {
+	h := newTestServer(t)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Rls-Author", "alice")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	do(http.MethodPost, "/v1/rules", `{"ruleId":"r1","algo":"token_bucket","windowMs":1000,"limit":10}`)
+	do(http.MethodPut, "/v1/rules/r1", `{"algo":"token_bucket","windowMs":1000,"limit":20}`)
+
+	rec := do(http.MethodGet, "/v1/rules/r1/history", "")
+	var hist RuleHistoryResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &hist); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if len(hist.Items) != 2 || hist.Items[0].Rev != 2 || hist.Items[0].Author != "alice" {
+		t.Fatalf("unexpected history: %+v", hist)
+	}
+
+	rec = do(http.MethodGet, "/v1/rules/r1/diff", "")
+	var diff RuleDiffResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if diff.From != 1 || diff.To != 2 || len(diff.Changes) != 1 || diff.Changes[0].Field != "limit" {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+
+	if rec = do(http.MethodPost, "/v1/rules/r1/rollback?to=1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec = do(http.MethodGet, "/v1/rules/r1", ""); !strings.Contains(rec.Body.String(), `"limit":10`) {
+		t.Fatalf("rule not rolled back: %s", rec.Body)
+	}
+	if rec = do(http.MethodPost, "/v1/rules/r1/rollback?to=7", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec = do(http.MethodPost, "/v1/rules/r1/rollback", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAdminAuthRoles(t *testing.T) {
+	cache := rules.NewCache(&config.Config{}, nil)
+	cache.ReplaceAll(map[string]config.Rule{
+		"team-a.login": {RuleID: "team-a.login", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true},
+		"team-b.login": {RuleID: "team-b.login", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true},
+	})
+	engine := core.NewEngine(&repo.RedisRepo{Prefix: "test"}, &stubLimiter{allowed: true}, "fail-closed")
+	a, err := auth.New(config.AdminAuthCfg{Tokens: []config.AdminTokenCfg{
+		{Token: "view", Subject: "viewer", AdminGrant: config.AdminGrant{Role: auth.RoleViewer}},
+		{Token: "team-a", Subject: "alice", AdminGrant: config.AdminGrant{Role: auth.RoleOperator, RulePrefixes: []string{"team-a."}}},
+	}})
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	srv := NewServer(config.ServerCfg{}, cache, engine, nil)
+	srv.SetAuthenticator(a)
+	h := mux.NewRouter()
+	srv.RegisterRoutes(h)
+
+	do := func(token, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rule := `{"ruleId":"%s","algo":"token_bucket","windowMs":1000,"limit":5}`
+
+	if rec := do("", http.MethodGet, "/v1/rules", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous list: status = %d", rec.Code)
+	}
+	if rec := do("", http.MethodPost, "/v1/allow", `{"ruleId":"team-a.login","dims":{}}`); rec.Code == http.StatusUnauthorized {
+		t.Fatalf("the data plane must stay open")
+	}
+	if rec := do("view", http.MethodPost, "/v1/rules", fmt.Sprintf(rule, "team-a.new")); rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer create: status = %d", rec.Code)
+	}
+	if rec := do("team-a", http.MethodPost, "/v1/rules", fmt.Sprintf(rule, "team-b.new")); rec.Code != http.StatusForbidden {
+		t.Fatalf("create outside prefix: status = %d", rec.Code)
+	}
+	if rec := do("team-a", http.MethodPut, "/v1/rules/team-b.login", fmt.Sprintf(rule, "")); rec.Code != http.StatusForbidden {
+		t.Fatalf("update outside prefix: status = %d", rec.Code)
+	}
+	if rec := do("team-a", http.MethodPost, "/v1/rules", fmt.Sprintf(rule, "team-a.new")); rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do("team-a", http.MethodDelete, "/v1/rules/team-a.new", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("operator delete: status = %d", rec.Code)
+	}
+
+	var list RuleListResponse
+	rec := do("team-a", http.MethodGet, "/v1/rules", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || list.Total != 2 {
+		t.Fatalf("list should only show team-a rules: %s", rec.Body)
+	}
+	if revs, _ := cache.History(context.Background(), "team-a.new", 1); len(revs) != 1 || revs[0].Author != "alice" {
+		t.Fatalf("author not taken from the principal: %+v", revs)
+	}
+}
+
+func TestCheckClientIPThroughTrustedProxies(t *testing.T) {
+	lim := &stubLimiter{allowed: true}
+	engine := core.NewEngine(&repo.RedisRepo{Prefix: "test"}, lim, "fail-closed")
+	srv := NewServer(config.ServerCfg{}, rules.NewCache(&config.Config{}, nil), engine, nil)
+	srv.ruleCache.ReplaceAll(map[string]config.Rule{
+		"per-ip": {RuleID: "per-ip", Match: "/api/*", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Dims: []string{"ip"}, Enabled: true},
+	})
+	proxies, _ := identity.ParseTrustedProxies([]string{"10.0.0.0/8"})
+	srv.SetTrustedProxies(proxies)
+	h := mux.NewRouter()
+	srv.RegisterRoutes(h)
+
+	check := func(peer, body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/check", strings.NewReader(body))
+		req.RemoteAddr = peer
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("check from %s: status %d: %s", peer, rec.Code, rec.Body.String())
+		}
+		return lim.keys[len(lim.keys)-1]
+	}
+	forged := `{"path":"/api/x","remoteAddr":"10.0.0.1:80","headers":{"X-Forwarded-For":"198.51.100.1"}}`
+
+	// an untrusted caller cannot pose as a trusted proxy through remoteAddr
+	attacker := check("203.0.113.9:4000", `{"path":"/api/x"}`)
+	if got := check("203.0.113.9:4000", forged); got != attacker {
+		t.Fatalf("forged remoteAddr changed the ip dimension")
+	}
+	// a trusted gateway may report the original peer and its forwarding headers
+	direct := check("10.0.0.1:80", `{"path":"/api/x","headers":{"X-Forwarded-For":"198.51.100.1"}}`)
+	if got := check("10.0.0.7:5000", forged); got != direct || got == attacker {
+		t.Fatalf("trusted gateway's remoteAddr was not honored")
+	}
+}
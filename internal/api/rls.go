@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"strings"
+	"time"
+)
+
+import (
+	rlcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/core"
+	"github.com/nanjiek/pixiu-rls/internal/identity"
+	"github.com/nanjiek/pixiu-rls/internal/router"
+	"github.com/nanjiek/pixiu-rls/internal/rules"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+// Descriptor entry keys with special meaning. Every other entry is copied
+// into dims verbatim.
+const (
+	descriptorRuleKey   = "rule_id"        // selects a rule explicitly
+	descriptorRemoteKey = "remote_address" // Envoy remote_address action -> dims["ip"]
+	descriptorPathKey   = "path"           // request path -> dims["route"], used for route matching
+	descriptorMethodKey = "method"         // request method, used for route matching
+)
+
+// RateLimitService implements envoy.service.ratelimit.v3.RateLimitService
+// on top of the rule cache and engine.
+//
+// Rules for a descriptor are chosen in this order:
+//  1. an explicit "rule_id" entry;
+//  2. the rule IDs configured for the request domain;
+//  3. router.Matcher on the "path"/"method" entries.
+type RateLimitService struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	ruleCache *rules.Cache
+	engine    *core.Engine
+	matcher   *router.Matcher
+	domains   map[string][]string
+}
+
+func NewRateLimitService(cfg config.EnvoyCfg, ruleCache *rules.Cache, engine *core.Engine, matcher *router.Matcher) *RateLimitService {
+	return &RateLimitService{
+		ruleCache: ruleCache,
+		engine:    engine,
+		matcher:   matcher,
+		domains:   cfg.Domains,
+	}
+}
+
+// ShouldRateLimit evaluates every descriptor independently and reports
+// OVER_LIMIT overall if any of them is over its limit.
+func (s *RateLimitService) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req == nil {
+		return nil, status.Error(codes.InvalidArgument, "nil request")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no descriptors")
+	}
+
+	now := time.Now()
+	resp := &rlsv3.RateLimitResponse{
+		OverallCode: rlsv3.RateLimitResponse_OK,
+		Statuses:    make([]*rlsv3.RateLimitResponse_DescriptorStatus, 0, len(req.GetDescriptors())),
+	}
+	state := peerTLS(ctx)
+	for _, desc := range req.GetDescriptors() {
+		dims := descriptorDims(desc)
+		identity.SetMTLSDim(dims, state)
+		matched := s.selectRules(req.GetDomain(), dims)
+		if len(matched) == 0 {
+			resp.Statuses = append(resp.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{
+				Code: rlsv3.RateLimitResponse_OK,
+			})
+			continue
+		}
+
+		dec, err := s.engine.AllowRules(ctx, matched, dims, descriptorCost(req, desc), now)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		st := descriptorStatus(dec, decidingRule(matched, dec))
+		if st.Code == rlsv3.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		resp.Statuses = append(resp.Statuses, st)
+	}
+	return resp, nil
+}
+
+func (s *RateLimitService) selectRules(domain string, dims map[string]string) []config.Rule {
+	if id := dims[descriptorRuleKey]; id != "" {
+		if rule, ok := s.ruleCache.Get(id); ok && rule.Enabled {
+			return []config.Rule{rule}
+		}
+		return nil
+	}
+
+	if ids, ok := s.domains[domain]; ok {
+		out := make([]config.Rule, 0, len(ids))
+		for _, id := range ids {
+			if rule, ok := s.ruleCache.Get(id); ok && rule.Enabled {
+				out = append(out, rule)
+			}
+		}
+		return out
+	}
+
+	if s.matcher == nil {
+		return nil
+	}
+	return s.matcher.Match(router.RequestCtx{
+		Path:   dims["route"],
+		Method: dims[descriptorMethodKey],
+	})
+}
+
+// decidingRule returns the rule that denied the request, or the first
+// (highest-priority) rule when all of them allowed it.
+func decidingRule(matched []config.Rule, dec types.Decision) config.Rule {
+	for _, rule := range matched {
+		if rule.RuleID == dec.RuleID {
+			return rule
+		}
+	}
+	return matched[0]
+}
+
+// descriptorCost maps Envoy hits_addend onto cost: the descriptor value
+// overrides the request value, and unset means 1.
+func descriptorCost(req *rlsv3.RateLimitRequest, desc *rlcommonv3.RateLimitDescriptor) int64 {
+	if h := desc.GetHitsAddend(); h != nil && h.GetValue() > 0 {
+		return int64(min(h.GetValue(), uint64(math.MaxInt64)))
+	}
+	if h := req.GetHitsAddend(); h > 0 {
+		return int64(h)
+	}
+	return 1
+}
+
+func descriptorDims(desc *rlcommonv3.RateLimitDescriptor) map[string]string {
+	dims := make(map[string]string, len(desc.GetEntries())+2)
+	for _, entry := range desc.GetEntries() {
+		dims[entry.GetKey()] = entry.GetValue()
+	}
+	if _, ok := dims["ip"]; !ok {
+		if ip := strings.TrimSpace(dims[descriptorRemoteKey]); ip != "" {
+			dims["ip"] = ip
+		}
+	}
+	if ip, ok := dims["ip"]; ok {
+		dims["ip"] = identity.NormalizeIP(ip)
+	}
+	if _, ok := dims["route"]; !ok {
+		if path := dims[descriptorPathKey]; path != "" {
+			dims["route"] = path
+		}
+	}
+	return dims
+}
+
+func descriptorStatus(dec types.Decision, rule config.Rule) *rlsv3.RateLimitResponse_DescriptorStatus {
+	st := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:           rlsv3.RateLimitResponse_OK,
+		CurrentLimit:   currentLimit(rule),
+		LimitRemaining: clampUint32(dec.Remaining),
+	}
+	if !dec.Allowed {
+		st.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+		st.LimitRemaining = 0
+	}
+	if dec.RetryAfterMs > 0 {
+		st.DurationUntilReset = durationpb.New(time.Duration(dec.RetryAfterMs) * time.Millisecond)
+	}
+	return st
+}
+
+var envoyUnits = []struct {
+	unit rlsv3.RateLimitResponse_RateLimit_Unit
+	ms   int64
+}{
+	{rlsv3.RateLimitResponse_RateLimit_SECOND, int64(time.Second / time.Millisecond)},
+	{rlsv3.RateLimitResponse_RateLimit_MINUTE, int64(time.Minute / time.Millisecond)},
+	{rlsv3.RateLimitResponse_RateLimit_HOUR, int64(time.Hour / time.Millisecond)},
+	{rlsv3.RateLimitResponse_RateLimit_DAY, int64(24 * time.Hour / time.Millisecond)},
+}
+
+// currentLimit expresses limit/windowMs in the smallest Envoy unit that
+// represents it exactly, falling back to a per-day rate.
+func currentLimit(rule config.Rule) *rlsv3.RateLimitResponse_RateLimit {
+	if rule.Limit <= 0 || rule.WindowMs <= 0 {
+		return nil
+	}
+	out := &rlsv3.RateLimitResponse_RateLimit{Name: rule.RuleID}
+	for _, u := range envoyUnits {
+		scaled := rule.Limit * u.ms
+		if scaled%rule.WindowMs == 0 {
+			out.Unit = u.unit
+			out.RequestsPerUnit = clampUint32(scaled / rule.WindowMs)
+			return out
+		}
+	}
+	last := envoyUnits[len(envoyUnits)-1]
+	out.Unit = last.unit
+	out.RequestsPerUnit = clampUint32(rule.Limit * last.ms / rule.WindowMs)
+	return out
+}
+
+func clampUint32(v int64) uint32 {
+	if v <= 0 {
+		return 0
+	}
+	if v > int64(^uint32(0)) {
+		return ^uint32(0)
+	}
+	return uint32(v)
+}
+
+// peerTLS returns the TLS state of the calling gateway's connection, or nil
+// when it is not TLS.
+func peerTLS(ctx context.Context) *tls.ConnectionState {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return &info.State
+}
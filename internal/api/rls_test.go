@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+import (
+	rlcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/core"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/router"
+	"github.com/nanjiek/pixiu-rls/internal/rules"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+type stubLimiter struct {
+	allowed bool
+	keys    []string
+}
+
+func (s *stubLimiter) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	s.keys = append(s.keys, key)
+	if !s.allowed {
+		return types.Decision{Allowed: false, Reason: "rate_limited", RetryAfterMs: 1500}, nil
+	}
+	return types.Decision{Allowed: true, Remaining: 7, Reason: "allowed"}, nil
+}
+
+func newTestRLS(t *testing.T, lim *stubLimiter, domains map[string][]string) *RateLimitService {
+	t.Helper()
+	cache := rules.NewCache(&config.Config{}, nil)
+	matcher := router.NewMatcher(nil)
+	cache.OnReplace(func(set *rules.ImmutableRuleSet) {
+		matcher.Replace(router.BuildRouteSnapshot(set.Rules))
+	})
+	cache.ReplaceAll(map[string]config.Rule{
+		"login":  {RuleID: "login", Match: "/api/login", Algo: "token_bucket", WindowMs: 60000, Limit: 100, Dims: []string{"route"}, Enabled: true},
+		"tenant": {RuleID: "tenant", Match: "/tenants/*", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Dims: []string{"tenant"}, Enabled: true},
+	})
+	engine := core.NewEngine(&repo.RedisRepo{Prefix: "test"}, lim, "fail-closed")
+	return NewRateLimitService(config.EnvoyCfg{Domains: domains}, cache, engine, matcher)
+}
+
+func descriptor(kv ...string) *rlcommonv3.RateLimitDescriptor {
+	d := &rlcommonv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		d.Entries = append(d.Entries, &rlcommonv3.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return d
+}
+
+func TestShouldRateLimitRouteMatch(t *testing.T) {
+	lim := &stubLimiter{allowed: true}
+	svc := newTestRLS(t, lim, nil)
+
+	resp, err := svc.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*rlcommonv3.RateLimitDescriptor{descriptor("path", "/api/login", "method", "POST")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OK || len(resp.Statuses) != 1 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	st := resp.Statuses[0]
+	if st.LimitRemaining != 7 {
+		t.Fatalf("remaining = %d", st.LimitRemaining)
+	}
+	if st.CurrentLimit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE || st.CurrentLimit.GetRequestsPerUnit() != 100 {
+		t.Fatalf("unexpected current limit: %v", st.CurrentLimit)
+	}
+	if len(lim.keys) != 1 {
+		t.Fatalf("expected one limiter call, got %d", len(lim.keys))
+	}
+}
+
+func TestShouldRateLimitDomainOverLimit(t *testing.T) {
+	lim := &stubLimiter{allowed: false}
+	svc := newTestRLS(t, lim, map[string][]string{"tenants": {"tenant"}})
+
+	resp, err := svc.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain: "tenants",
+		Descriptors: []*rlcommonv3.RateLimitDescriptor{
+			descriptor("tenant", "acme"),
+			descriptor("rule_id", "missing"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("overall = %v", resp.OverallCode)
+	}
+	if resp.Statuses[0].Code != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("descriptor 0 = %v", resp.Statuses[0].Code)
+	}
+	if got := resp.Statuses[0].DurationUntilReset.AsDuration(); got != 1500*time.Millisecond {
+		t.Fatalf("duration_until_reset = %v", got)
+	}
+	if resp.Statuses[1].Code != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("unknown rule_id should pass, got %v", resp.Statuses[1].Code)
+	}
+}
+
+func TestCurrentLimitUnits(t *testing.T) {
+	tests := []struct {
+		windowMs int64
+		limit    int64
+		unit     rlsv3.RateLimitResponse_RateLimit_Unit
+		perUnit  uint32
+	}{
+		{1000, 10, rlsv3.RateLimitResponse_RateLimit_SECOND, 10},
+		{10000, 5, rlsv3.RateLimitResponse_RateLimit_MINUTE, 30},
+		{3600000, 7, rlsv3.RateLimitResponse_RateLimit_HOUR, 7},
+	}
+	for _, tt := range tests {
+		got := currentLimit(config.Rule{RuleID: "r", WindowMs: tt.windowMs, Limit: tt.limit})
+		if got.Unit != tt.unit || got.RequestsPerUnit != tt.perUnit {
+			t.Fatalf("currentLimit(%d/%dms) = %v", tt.limit, tt.windowMs, got)
+		}
+	}
+}
+
+func TestDescriptorDims(t *testing.T) {
+	dims := descriptorDims(descriptor("remote_address", "10.0.0.1", "path", "/a", "tenant", "acme"))
+	if dims["ip"] != "10.0.0.1" || dims["route"] != "/a" || dims["tenant"] != "acme" {
+		t.Fatalf("unexpected dims: %v", dims)
+	}
+
+	dims = descriptorDims(descriptor("ip", "1.1.1.1", "remote_address", "10.0.0.1"))
+	if dims["ip"] != "1.1.1.1" {
+		t.Fatalf("explicit ip should win, got %q", dims["ip"])
+	}
+
+	dims = descriptorDims(descriptor("remote_address", "::ffff:10.0.0.1"))
+	if dims["ip"] != "10.0.0.1" {
+		t.Fatalf("ipv4-mapped address should be normalized, got %q", dims["ip"])
+	}
+}
+
+func TestDescriptorCost(t *testing.T) {
+	desc := descriptor("path", "/a")
+	if got := descriptorCost(&rlsv3.RateLimitRequest{}, desc); got != 1 {
+		t.Fatalf("default cost = %d, want 1", got)
+	}
+	if got := descriptorCost(&rlsv3.RateLimitRequest{HitsAddend: 3}, desc); got != 3 {
+		t.Fatalf("request cost = %d, want 3", got)
+	}
+	desc.HitsAddend = wrapperspb.UInt64(7)
+	if got := descriptorCost(&rlsv3.RateLimitRequest{HitsAddend: 3}, desc); got != 7 {
+		t.Fatalf("descriptor cost = %d, want 7", got)
+	}
+}
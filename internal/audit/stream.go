@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+	"github.com/nanjiek/pixiu-rls/internal/util"
+)
+
+const (
+	defaultMaxLen     = 100000
+	defaultBufferSize = 4096
+	defaultBatchSize  = 128
+	defaultFlushMs    = 200
+)
+
+// Stream writes engine decisions to a Redis stream. Record only enqueues;
+// Run batches the events into pipelined XADDs. An event is dropped, never
+// waited for, when the buffer is full or its write fails, so auditing cannot
+// slow down or fail a request.
+type Stream struct {
+	key        string
+	maxLen     int64
+	deniedOnly bool
+	dims       []string
+	batchSize  int
+	interval   time.Duration
+	events     chan event
+	dropped    atomic.Uint64
+	logger     *slog.Logger
+
+	xadd func(ctx context.Context, stream string, maxLen int64, entries []map[string]interface{}) error
+}
+
+type event struct {
+	ruleID    string
+	dimKey    string
+	dims      map[string]string
+	reason    string
+	allowed   bool
+	remaining int64
+	at        int64
+}
+
+// NewStream builds an audit stream writing to r.KeyAudit(). Call Run to start
+// writing.
+func NewStream(r *repo.RedisRepo, cfg config.AuditCfg, logger *slog.Logger) *Stream {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &Stream{
+		key:        r.KeyAudit(),
+		maxLen:     cfg.MaxLen,
+		deniedOnly: cfg.DeniedOnly,
+		dims:       cfg.Dims,
+		batchSize:  cfg.BatchSize,
+		interval:   time.Duration(cfg.FlushIntervalMs) * time.Millisecond,
+		logger:     logger,
+		xadd:       r.XAddPipelined,
+	}
+	if s.maxLen <= 0 {
+		s.maxLen = defaultMaxLen
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = defaultBatchSize
+	}
+	if s.interval <= 0 {
+		s.interval = defaultFlushMs * time.Millisecond
+	}
+	size := cfg.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	s.events = make(chan event, size)
+	return s
+}
+
+// Record enqueues a decision. Only the allowlisted dims are kept raw; the
+// rule's dims are recorded as their hashed dim key.
+func (s *Stream) Record(rule config.Rule, dims map[string]string, dec types.Decision, now time.Time) {
+	if s.deniedOnly && dec.Allowed {
+		return
+	}
+	ev := event{
+		ruleID:    rule.RuleID,
+		reason:    dec.Reason,
+		allowed:   dec.Allowed,
+		remaining: dec.Remaining,
+		at:        now.UnixMilli(),
+	}
+	if rule.RuleID != "" {
+		if dimKey, err := util.HashDims(rule.Dims, dims); err == nil {
+			ev.dimKey = dimKey
+		}
+	}
+	for _, d := range s.dims {
+		if v, ok := dims[d]; ok {
+			if ev.dims == nil {
+				ev.dims = make(map[string]string, len(s.dims))
+			}
+			ev.dims[d] = v
+		}
+	}
+	select {
+	case s.events <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many events were lost to a full buffer or a failed write.
+func (s *Stream) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Run writes queued events until ctx is done, then flushes what is left.
+func (s *Stream) Run(ctx context.Context) {
+	batch := make([]map[string]interface{}, 0, s.batchSize)
+	failing := false
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		err := s.xadd(ctx, s.key, s.maxLen, batch)
+		switch {
+		case err != nil:
+			s.dropped.Add(uint64(len(batch)))
+			if !failing {
+				s.logger.Warn("audit write failed, dropping events", "stream", s.key, "err", err)
+			}
+			failing = true
+		case failing:
+			s.logger.Info("audit writes recovered", "stream", s.key)
+			failing = false
+		}
+		batch = batch[:0]
+	}
+
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			for {
+				select {
+				case ev := <-s.events:
+					if batch = append(batch, ev.values()); len(batch) >= s.batchSize {
+						flush(fctx)
+					}
+				default:
+					flush(fctx)
+					return
+				}
+			}
+		case ev := <-s.events:
+			if batch = append(batch, ev.values()); len(batch) >= s.batchSize {
+				flush(ctx)
+			}
+		case <-t.C:
+			flush(ctx)
+		}
+	}
+}
+
+func (ev event) values() map[string]interface{} {
+	v := map[string]interface{}{
+		"rule_id":   ev.ruleID,
+		"dim_key":   ev.dimKey,
+		"reason":    ev.reason,
+		"allowed":   boolFlag(ev.allowed),
+		"remaining": ev.remaining,
+		"ts":        strconv.FormatInt(ev.at, 10),
+	}
+	if len(ev.dims) > 0 {
+		b, _ := json.Marshal(ev.dims)
+		v["dims"] = string(b)
+	}
+	return v
+}
+
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
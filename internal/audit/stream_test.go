@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+type fakeXAdd struct {
+	mu      sync.Mutex
+	stream  string
+	maxLen  int64
+	entries []map[string]interface{}
+	err     error
+}
+
+func (f *fakeXAdd) xadd(ctx context.Context, stream string, maxLen int64, entries []map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.stream, f.maxLen = stream, maxLen
+	f.entries = append(f.entries, entries...)
+	return nil
+}
+
+func newTestStream(cfg config.AuditCfg, f *fakeXAdd) *Stream {
+	s := NewStream(&repo.RedisRepo{Prefix: "pixiu"}, cfg, nil)
+	s.xadd = f.xadd
+	return s
+}
+
+func runUntilDone(s *Stream) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx) // a cancelled Run flushes what is queued and returns
+}
+
+func TestStreamRecordsDecision(t *testing.T) {
+	f := &fakeXAdd{}
+	s := newTestStream(config.AuditCfg{Dims: []string{"route"}}, f)
+	rule := config.Rule{RuleID: "r1", Dims: []string{"ip"}}
+
+	s.Record(rule, map[string]string{"ip": "10.0.0.1", "route": "/login", "token": "secret"},
+		types.Decision{Allowed: false, Reason: "rate_limited", Remaining: 0}, time.UnixMilli(1700000000000))
+	runUntilDone(s)
+
+	if f.stream != "pixiu:audit:decisions" || f.maxLen != defaultMaxLen || len(f.entries) != 1 {
+		t.Fatalf("unexpected write: stream=%s maxLen=%d entries=%d", f.stream, f.maxLen, len(f.entries))
+	}
+	ev := f.entries[0]
+	if ev["rule_id"] != "r1" || ev["reason"] != "rate_limited" || ev["allowed"] != "0" || ev["ts"] != "1700000000000" {
+		t.Fatalf("unexpected entry: %#v", ev)
+	}
+	if ev["dims"] != `{"route":"/login"}` {
+		t.Fatalf("only allowlisted dims may be recorded: %#v", ev["dims"])
+	}
+	if ev["dim_key"] == "" {
+		t.Fatalf("missing dim key: %#v", ev)
+	}
+}
+
+func TestStreamDeniedOnly(t *testing.T) {
+	f := &fakeXAdd{}
+	s := newTestStream(config.AuditCfg{DeniedOnly: true}, f)
+	s.Record(config.Rule{RuleID: "r1"}, nil, types.Decision{Allowed: true, Reason: "allowed"}, time.Now())
+	s.Record(config.Rule{RuleID: "r1"}, nil, types.Decision{Allowed: false, Reason: "rate_limited"}, time.Now())
+	runUntilDone(s)
+	if len(f.entries) != 1 || f.entries[0]["reason"] != "rate_limited" {
+		t.Fatalf("unexpected entries: %#v", f.entries)
+	}
+}
+
+func TestStreamDropsWhenFullOrFailing(t *testing.T) {
+	f := &fakeXAdd{}
+	s := newTestStream(config.AuditCfg{BufferSize: 2}, f)
+	for i := 0; i < 5; i++ {
+		s.Record(config.Rule{RuleID: "r1"}, nil, types.Decision{Reason: "rate_limited"}, time.Now())
+	}
+	if s.Dropped() != 3 {
+		t.Fatalf("dropped = %d, want 3", s.Dropped())
+	}
+
+	f.err = errors.New("redis down")
+	runUntilDone(s)
+	if s.Dropped() != 5 {
+		t.Fatalf("failed writes should count as dropped, got %d", s.Dropped())
+	}
+}
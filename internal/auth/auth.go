@@ -0,0 +1,163 @@
+// Package auth authenticates admin API requests and decides what the caller
+// may do with which rules.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+// Roles, each including the permissions of the one before it.
+const (
+	RoleViewer   = "viewer"   // read rules, history and diffs
+	RoleOperator = "operator" // also create, update and roll back rules
+	RoleAdmin    = "admin"    // also delete rules
+)
+
+// Action is what a request does to a rule.
+type Action int
+
+const (
+	ActionRead Action = iota + 1
+	ActionWrite
+	ActionDelete
+)
+
+var roleRank = map[string]Action{
+	RoleViewer:   ActionRead,
+	RoleOperator: ActionWrite,
+	RoleAdmin:    ActionDelete,
+}
+
+var (
+	// ErrNoCredentials means the request carries no credentials this
+	// authenticator understands.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means the credentials were recognized but are
+	// wrong, expired or not trusted.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Subject      string   // recorded as the author of rule changes
+	Role         string   // viewer | operator | admin
+	RulePrefixes []string // rule ID prefixes the role covers; empty means every rule
+	Method       string   // token | hmac | jwt
+}
+
+// Allows reports whether the role permits action on some rule.
+func (p *Principal) Allows(action Action) bool {
+	return p != nil && roleRank[p.Role] >= action
+}
+
+// Covers reports whether ruleID is within the principal's prefixes.
+func (p *Principal) Covers(ruleID string) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.RulePrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.RulePrefixes {
+		if strings.HasPrefix(ruleID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the principal may perform action on rule ruleID.
+func (p *Principal) Can(action Action, ruleID string) bool {
+	return p.Allows(action) && p.Covers(ruleID)
+}
+
+// Authenticator identifies the caller of a request. It returns
+// ErrNoCredentials when the request has none of its kind, so that the next
+// authenticator can try.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain tries each authenticator in turn; the first that recognizes the
+// credentials decides.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// New builds the authenticators configured in cfg, or returns nil when none
+// is, which leaves the admin API open.
+func New(cfg config.AdminAuthCfg) (Authenticator, error) {
+	var chain Chain
+	if len(cfg.Tokens) > 0 {
+		a, err := NewTokenAuth(cfg.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if len(cfg.HMAC.Keys) > 0 {
+		a, err := NewHMACAuth(cfg.HMAC)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if cfg.JWT.JWKSFile != "" {
+		a, err := NewJWTAuth(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+func checkGrant(g config.AdminGrant) error {
+	if _, ok := roleRank[g.Role]; !ok {
+		return fmt.Errorf("unknown role %q (want viewer, operator or admin)", g.Role)
+	}
+	return nil
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal in ctx, or nil when the request was not
+// authenticated.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// bearer returns the token of an "Authorization: Bearer" header.
+func bearer(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
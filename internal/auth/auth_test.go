@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestPrincipalCan(t *testing.T) {
+	p := &Principal{Role: RoleOperator, RulePrefixes: []string{"team-a."}}
+	if !p.Can(ActionWrite, "team-a.login") || !p.Can(ActionRead, "team-a.login") {
+		t.Fatalf("operator should read and write its own rules")
+	}
+	if p.Can(ActionDelete, "team-a.login") {
+		t.Fatalf("operator must not delete")
+	}
+	if p.Can(ActionRead, "team-b.login") {
+		t.Fatalf("rules outside the prefixes are not covered")
+	}
+	var anon *Principal
+	if anon.Can(ActionRead, "x") {
+		t.Fatalf("nil principal can do nothing")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	a, err := New(config.AdminAuthCfg{Tokens: []config.AdminTokenCfg{
+		{Token: "s3cret", Subject: "ci", AdminGrant: config.AdminGrant{Role: RoleViewer}},
+	}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/rules", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	p, err := a.Authenticate(req)
+	if err != nil || p.Subject != "ci" || p.Role != RoleViewer {
+		t.Fatalf("unexpected principal %+v err=%v", p, err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	if _, err := a.Authenticate(req); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+
+	if _, err := New(config.AdminAuthCfg{Tokens: []config.AdminTokenCfg{{Token: "x", AdminGrant: config.AdminGrant{Role: "root"}}}}); err == nil {
+		t.Fatalf("expected an unknown role to be rejected")
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	a, err := NewHMACAuth(config.AdminHMACCfg{Keys: []config.AdminHMACKeyCfg{
+		{KeyID: "k1", Secret: "secret", AdminGrant: config.AdminGrant{Role: RoleAdmin}},
+	}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	now := time.Unix(1760000000, 0)
+	a.now = func() time.Time { return now }
+
+	body := `{"ruleId":"r1"}`
+	signed := func(ts int64, secret string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/rules?dry=1", strings.NewReader(body))
+		stamp := strconv.FormatInt(ts, 10)
+		sig := Sign([]byte(secret), StringToSign(http.MethodPost, "/v1/rules?dry=1", stamp, []byte(body)))
+		req.Header.Set("Authorization", HMACScheme+" keyId=k1,timestamp="+stamp+",signature="+sig)
+		return req
+	}
+
+	req := signed(now.Unix(), "secret")
+	p, err := a.Authenticate(req)
+	if err != nil || p.Subject != "k1" || p.Method != "hmac" {
+		t.Fatalf("unexpected principal %+v err=%v", p, err)
+	}
+	if b, _ := io.ReadAll(req.Body); string(b) != body {
+		t.Fatalf("body not restored: %q", b)
+	}
+	if _, err := a.Authenticate(signed(now.Unix(), "other")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected a bad signature to fail, got %v", err)
+	}
+	if _, err := a.Authenticate(signed(now.Add(-10*time.Minute).Unix(), "secret")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected a stale timestamp to fail, got %v", err)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaPriv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "n": b64(rsaPriv.N.Bytes()), "e": b64(big.NewInt(int64(rsaPriv.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecPriv.X.FillBytes(make([]byte, 32))), "y": b64(ecPriv.Y.FillBytes(make([]byte, 32)))},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewJWTAuth(config.AdminJWTCfg{JWKSFile: path, Issuer: "idp", Audience: "rls"})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	sign := func(alg, kid string, claims map[string]interface{}) string {
+		h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+		c, _ := json.Marshal(claims)
+		input := b64(h) + "." + b64(c)
+		sum := sha256.Sum256([]byte(input))
+		var sig []byte
+		if alg == "RS256" {
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaPriv, crypto.SHA256, sum[:])
+		} else {
+			r, s, _ := ecdsa.Sign(rand.Reader, ecPriv, sum[:])
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+		return input + "." + b64(sig)
+	}
+	check := func(tok string) (*Principal, error) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/rules", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		return a.Authenticate(req)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := map[string]interface{}{"sub": "alice", "iss": "idp", "aud": []string{"rls"}, "exp": exp,
+		"role": RoleOperator, "rulePrefixes": []string{"team-a."}}
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa1", "ES256": "ec1"}[alg]
+		p, err := check(sign(alg, kid, claims))
+		if err != nil || p.Subject != "alice" || p.Role != RoleOperator || len(p.RulePrefixes) != 1 {
+			t.Fatalf("%s: unexpected principal %+v err=%v", alg, p, err)
+		}
+	}
+	if _, err := check(sign("RS256", "ec1", claims)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected an alg/key mismatch to fail, got %v", err)
+	}
+	expired := map[string]interface{}{"sub": "alice", "iss": "idp", "aud": "rls", "exp": time.Now().Add(-time.Hour).Unix(), "role": RoleAdmin}
+	if _, err := check(sign("RS256", "rsa1", expired)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected an expired token to fail, got %v", err)
+	}
+	other := map[string]interface{}{"sub": "alice", "iss": "evil", "aud": "rls", "exp": exp, "role": RoleAdmin}
+	if _, err := check(sign("ES256", "ec1", other)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected a foreign issuer to fail, got %v", err)
+	}
+}
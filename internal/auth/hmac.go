@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+// HMACScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: RLS-HMAC-SHA256 keyId=<id>,timestamp=<unix seconds>,signature=<hex>
+//
+// where signature is HMAC-SHA256(secret, StringToSign(...)).
+const HMACScheme = "RLS-HMAC-SHA256"
+
+const (
+	defaultHMACSkew = 300 * time.Second
+	maxSignedBody   = 1 << 20
+)
+
+// HMACAuth accepts requests signed with one of the configured keys.
+type HMACAuth struct {
+	keys map[string]hmacKey
+	skew time.Duration
+	now  func() time.Time
+}
+
+type hmacKey struct {
+	secret    []byte
+	principal Principal
+}
+
+func NewHMACAuth(cfg config.AdminHMACCfg) (*HMACAuth, error) {
+	skew := time.Duration(cfg.MaxSkewSec) * time.Second
+	if skew <= 0 {
+		skew = defaultHMACSkew
+	}
+	a := &HMACAuth{keys: make(map[string]hmacKey, len(cfg.Keys)), skew: skew, now: time.Now}
+	for i, k := range cfg.Keys {
+		if k.KeyID == "" || k.Secret == "" {
+			return nil, fmt.Errorf("adminAuth.hmac.keys[%d]: keyId and secret are required", i)
+		}
+		if _, dup := a.keys[k.KeyID]; dup {
+			return nil, fmt.Errorf("adminAuth.hmac.keys[%d]: duplicate keyId %q", i, k.KeyID)
+		}
+		if err := checkGrant(k.AdminGrant); err != nil {
+			return nil, fmt.Errorf("adminAuth.hmac.keys[%d]: %w", i, err)
+		}
+		subject := k.Subject
+		if subject == "" {
+			subject = k.KeyID
+		}
+		a.keys[k.KeyID] = hmacKey{
+			secret: []byte(k.Secret),
+			principal: Principal{
+				Subject:      subject,
+				Role:         k.Role,
+				RulePrefixes: k.RulePrefixes,
+				Method:       "hmac",
+			},
+		}
+	}
+	return a, nil
+}
+
+// StringToSign is what a request signature covers: the method, the request
+// URI (path and query as sent), the timestamp and the hex SHA-256 of the
+// body, joined by newlines.
+func StringToSign(method, requestURI, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + requestURI + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:])
+}
+
+// Sign returns the hex signature of StringToSign under secret.
+func Sign(secret []byte, stringToSign string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate verifies the signature and the timestamp window. The body is
+// read for the digest and put back for the handler.
+func (a *HMACAuth) Authenticate(r *http.Request) (*Principal, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, HMACScheme+" ") {
+		return nil, ErrNoCredentials
+	}
+	params := make(map[string]string, 3)
+	for _, kv := range strings.Split(strings.TrimPrefix(h, HMACScheme+" "), ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+			params[k] = v
+		}
+	}
+	key, ok := a.keys[params["keyId"]]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown keyId", ErrInvalidCredentials)
+	}
+	ts, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad timestamp", ErrInvalidCredentials)
+	}
+	if d := a.now().Sub(time.Unix(ts, 0)); d > a.skew || d < -a.skew {
+		return nil, fmt.Errorf("%w: timestamp outside the allowed skew", ErrInvalidCredentials)
+	}
+	sig, err := hex.DecodeString(params["signature"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxSignedBody {
+			return nil, fmt.Errorf("%w: signed body too large", ErrInvalidCredentials)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(StringToSign(r.Method, r.URL.RequestURI(), params["timestamp"], body)))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidCredentials)
+	}
+	p := key.principal
+	return &p, nil
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+const defaultJWTLeeway = 60 * time.Second
+
+// JWTAuth accepts bearer JWTs signed by a key in a local JWKS file. The file
+// is re-read when its size or mtime changes, so keys can be rotated in place.
+// The role and rule prefixes come from configurable claims.
+type JWTAuth struct {
+	cfg    config.AdminJWTCfg
+	leeway time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	keys  map[string]crypto.PublicKey // by kid
+	size  int64
+	mtime time.Time
+}
+
+func NewJWTAuth(cfg config.AdminJWTCfg) (*JWTAuth, error) {
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "role"
+	}
+	if cfg.PrefixesClaim == "" {
+		cfg.PrefixesClaim = "rulePrefixes"
+	}
+	leeway := time.Duration(cfg.LeewaySec) * time.Second
+	if leeway <= 0 {
+		leeway = defaultJWTLeeway
+	}
+	a := &JWTAuth{cfg: cfg, leeway: leeway, now: time.Now}
+	if _, err := a.loadKeys(); err != nil {
+		return nil, fmt.Errorf("adminAuth.jwt: %w", err)
+	}
+	return a, nil
+}
+
+// Authenticate verifies a bearer token that looks like a JWT.
+func (a *JWTAuth) Authenticate(r *http.Request) (*Principal, error) {
+	tok := bearer(r)
+	if strings.Count(tok, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := a.verify(tok)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	p := &Principal{Method: "jwt"}
+	p.Subject, _ = claims["sub"].(string)
+	p.Role, _ = claims[a.cfg.RoleClaim].(string)
+	if _, ok := roleRank[p.Role]; !ok {
+		return nil, fmt.Errorf("%w: no valid %s claim", ErrInvalidCredentials, a.cfg.RoleClaim)
+	}
+	switch v := claims[a.cfg.PrefixesClaim].(type) {
+	case string:
+		p.RulePrefixes = []string{v}
+	case []interface{}:
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s must be strings", ErrInvalidCredentials, a.cfg.PrefixesClaim)
+			}
+			p.RulePrefixes = append(p.RulePrefixes, s)
+		}
+	}
+	return p, nil
+}
+
+func (a *JWTAuth) verify(tok string) (map[string]interface{}, error) {
+	parts := strings.Split(tok, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	hash, ecSize, err := algHash(header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if ecSize != 0 {
+			return nil, fmt.Errorf("key %q does not match alg %s", header.Kid, header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return nil, errors.New("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if ecSize == 0 || (k.Curve.Params().BitSize+7)/8 != ecSize || len(sig) != 2*ecSize {
+			return nil, fmt.Errorf("key %q does not match alg %s", header.Kid, header.Alg)
+		}
+		rr, ss := new(big.Int).SetBytes(sig[:ecSize]), new(big.Int).SetBytes(sig[ecSize:])
+		if !ecdsa.Verify(k, digest, rr, ss) {
+			return nil, errors.New("bad signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type for %q", header.Kid)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("missing exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if a.cfg.Issuer != "" && claims["iss"] != a.cfg.Issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if a.cfg.Audience != "" && !hasAudience(claims["aud"], a.cfg.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+// key returns the public key kid, re-reading the JWKS file if it changed. A
+// token without kid is accepted when the file holds a single key.
+func (a *JWTAuth) key(kid string) (crypto.PublicKey, error) {
+	keys, err := a.loadKeys()
+	if err != nil {
+		// keep verifying with the keys already loaded
+		slog.Warn("failed to reload jwks file", "path", a.cfg.JWKSFile, "error", err)
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, nil
+		}
+	}
+	k, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// loadKeys returns the current keys, reading the file again if its size or
+// mtime changed. On error the previous keys are returned with it.
+func (a *JWTAuth) loadKeys() (map[string]crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fi, err := os.Stat(a.cfg.JWKSFile)
+	if err != nil {
+		return a.keys, err
+	}
+	if a.keys != nil && fi.Size() == a.size && fi.ModTime().Equal(a.mtime) {
+		return a.keys, nil
+	}
+	b, err := os.ReadFile(a.cfg.JWKSFile)
+	if err != nil {
+		return a.keys, err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return a.keys, err
+	}
+	a.keys, a.size, a.mtime = keys, fi.Size(), fi.ModTime()
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the RSA and EC signing keys of a JWKS document; other key
+// types are skipped.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("malformed jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var (
+			pub crypto.PublicKey
+			err error
+		)
+		switch k.Kty {
+		case "RSA":
+			pub, err = rsaKey(k)
+		case "EC":
+			pub, err = ecKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func rsaKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("bad RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+func ecKey(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return pub, nil
+}
+
+// algHash maps a JWS alg to its hash and, for ECDSA, the size of each
+// signature half. HMAC and "none" are refused: the keys are public.
+func algHash(alg string) (crypto.Hash, int, error) {
+	switch alg {
+	case "RS256":
+		return crypto.SHA256, 0, nil
+	case "RS384":
+		return crypto.SHA384, 0, nil
+	case "RS512":
+		return crypto.SHA512, 0, nil
+	case "ES256":
+		return crypto.SHA256, 32, nil
+	case "ES384":
+		return crypto.SHA384, 48, nil
+	case "ES512":
+		return crypto.SHA512, 66, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported alg %q", alg)
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, e := range v {
+			if e == want {
+				return true
+			}
+		}
+	}
+	return false
+}
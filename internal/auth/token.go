@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+// TokenAuth accepts the static bearer tokens from config.
+type TokenAuth struct {
+	tokens []staticToken
+}
+
+type staticToken struct {
+	sum       [sha256.Size]byte
+	principal Principal
+}
+
+func NewTokenAuth(cfg []config.AdminTokenCfg) (*TokenAuth, error) {
+	a := &TokenAuth{}
+	for i, t := range cfg {
+		if t.Token == "" {
+			return nil, fmt.Errorf("adminAuth.tokens[%d]: token is required", i)
+		}
+		if err := checkGrant(t.AdminGrant); err != nil {
+			return nil, fmt.Errorf("adminAuth.tokens[%d]: %w", i, err)
+		}
+		subject := t.Subject
+		if subject == "" {
+			subject = fmt.Sprintf("token-%d", i)
+		}
+		a.tokens = append(a.tokens, staticToken{
+			sum: sha256.Sum256([]byte(t.Token)),
+			principal: Principal{
+				Subject:      subject,
+				Role:         t.Role,
+				RulePrefixes: t.RulePrefixes,
+				Method:       "token",
+			},
+		})
+	}
+	return a, nil
+}
+
+// Authenticate compares the bearer token with every configured token in
+// constant time. An unknown token is left to the next authenticator (it may
+// be a JWT).
+func (a *TokenAuth) Authenticate(r *http.Request) (*Principal, error) {
+	tok := bearer(r)
+	if tok == "" {
+		return nil, ErrNoCredentials
+	}
+	sum := sha256.Sum256([]byte(tok))
+	var found *Principal
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], a.tokens[i].sum[:]) == 1 {
+			p := a.tokens[i].principal
+			found = &p
+		}
+	}
+	if found == nil {
+		return nil, ErrNoCredentials
+	}
+	return found, nil
+}
@@ -10,14 +10,39 @@ import (
 
 // ServerCfg —— HTTP 服务端口/地址配置
 type ServerCfg struct {
-	HTTPAddr string `yaml:"httpAddr"` // 监听地址，例如 ":8080" 或 "0.0.0.0:8080"
+	HTTPAddr       string   `yaml:"httpAddr"`       // 监听地址，例如 ":8080" 或 "0.0.0.0:8080"
+	GRPCAddr       string   `yaml:"grpcAddr"`       // Envoy RLS gRPC 监听地址，例如 ":8081"（为空则不启动）
+	AdminAddr      string   `yaml:"adminAddr"`      // 管理接口（/v1/rules*）单独监听地址，例如 "127.0.0.1:9090"（为空则与 httpAddr 共用）
+	TLS            TLSCfg   `yaml:"tls"`            // HTTP、管理接口与 gRPC 监听的 TLS / mTLS 配置
+	TrustedProxies []string `yaml:"trustedProxies"` // 可信代理 CIDR 或 IP；仅当直连对端在其中时才解析 Forwarded / X-Forwarded-For / X-Real-IP
+}
+
+// TLSCfg - TLS for every listener. The files are re-read when they change,
+// so rotated certificates take effect without a restart.
+type TLSCfg struct {
+	CertFile         string   `yaml:"certFile"`         // PEM server certificate (chain); empty disables TLS
+	KeyFile          string   `yaml:"keyFile"`          // PEM private key
+	ClientCAFile     string   `yaml:"clientCAFile"`     // PEM CAs that sign client certificates
+	ClientAuth       string   `yaml:"clientAuth"`       // none | optional | require (default require when clientCAFile is set, else none)
+	AllowedSANs      []string `yaml:"allowedSANs"`      // accepted client DNS/URI/email/IP SANs; empty with allowedCNs empty accepts any verified client
+	AllowedCNs       []string `yaml:"allowedCNs"`       // accepted client subject CNs
+	MinVersion       string   `yaml:"minVersion"`       // "1.2" (default) | "1.3"
+	ReloadIntervalMs int      `yaml:"reloadIntervalMs"` // how often the files are checked for changes (default 10000)
+}
+
+// Enabled reports whether TLS is configured.
+func (c TLSCfg) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
 }
 
 // RedisCfg —— Redis 连接与命名空间配置
 type RedisCfg struct {
+	Mode               string   `yaml:"mode"`               // standalone | sentinel | cluster (default cluster)
 	Addr               string   `yaml:"addr"`               // Redis address, e.g. "127.0.0.1:6379"
 	Addrs              []string `yaml:"addrs"`              // Optional shard addresses
 	Password           string   `yaml:"password"`           // Redis password
+	MasterName         string   `yaml:"masterName"`         // Sentinel master name (sentinel mode)
+	SentinelPassword   string   `yaml:"sentinelPassword"`   // Sentinel password (sentinel mode, optional)
 	DB                 int      `yaml:"db"`                 // Redis DB index
 	Prefix             string   `yaml:"prefix"`             // Key prefix
 	UpdatesChannel     string   `yaml:"updatesChannel"`     // Pub/Sub channel for rule updates
@@ -35,34 +60,147 @@ type RedisCfg struct {
 
 // Features —— 特性开关
 type Features struct {
-	Audit         string `yaml:"audit"`         // 审计模式："redis_stream" | "none" （后续可扩展 "kafka" 等）
-	LocalFallback bool   `yaml:"localFallback"` // Redis 故障是否启用本地退化（仅建议开发/测试场景开启）
+	Audit         string `yaml:"audit"`         // 审计模式："redis_stream" | "none" （后续可扩展 "kafka" 等），细节见 AuditCfg
+	LocalFallback bool   `yaml:"localFallback"` // Redis 限流调用失败时改用本地限流（按 replicas 分摊 limit），而非直接 fail-open/closed
+	LocalOnly     bool   `yaml:"localOnly"`     // 不连接 Redis，全部使用本地限流与内存规则（开发/CI）
+	Replicas      int    `yaml:"replicas"`      // 实例数，本地退化时每个实例分得 limit/replicas（<=1 表示单实例）
 	FailPolicy    string `yaml:"failPolicy"`    // fail-open | fail-closed
 }
 
-// NacosCfg - Nacos config center (pull mode)
+// AuditCfg —— 判定审计（features.audit 开启时生效）
+type AuditCfg struct {
+	DeniedOnly      bool     `yaml:"deniedOnly"`      // 只记录拒绝的判定
+	Dims            []string `yaml:"dims"`            // 允许写入审计的原始维度（白名单），为空则只记录哈希后的 dimKey
+	MaxLen          int64    `yaml:"maxLen"`          // Stream 近似最大长度（XADD MAXLEN ~），默认 100000
+	BufferSize      int      `yaml:"bufferSize"`      // 内存缓冲事件数，满时丢弃，默认 4096
+	BatchSize       int      `yaml:"batchSize"`       // 每次 pipeline 写入的事件数，默认 128
+	FlushIntervalMs int      `yaml:"flushIntervalMs"` // 未满批时的最长等待（毫秒），默认 200
+}
+
+// NacosCfg - Nacos config center (long-polling listener, periodic pull as fallback)
 type NacosCfg struct {
-	Addr           string `yaml:"addr"`           // Nacos address, e.g. "http://127.0.0.1:8848"
-	Namespace      string `yaml:"namespace"`      // tenant/namespace
-	Group          string `yaml:"group"`          // rule group, default DEFAULT_GROUP
-	DataID         string `yaml:"dataId"`         // config dataId
-	Username       string `yaml:"username"`       // optional
-	Password       string `yaml:"password"`       // optional
-	PollIntervalMs int    `yaml:"pollIntervalMs"` // default 5000
-	TimeoutMs      int    `yaml:"timeoutMs"`      // default 2000
-	FailPolicy     string `yaml:"failPolicy"`     // fail-open | fail-closed
-	Format         string `yaml:"format"`         // json | yaml (auto-detect if empty)
+	Addr              string `yaml:"addr"`              // Nacos address, e.g. "http://127.0.0.1:8848"
+	Namespace         string `yaml:"namespace"`         // tenant/namespace
+	Group             string `yaml:"group"`             // rule group, default DEFAULT_GROUP
+	DataID            string `yaml:"dataId"`            // config dataId
+	Username          string `yaml:"username"`          // optional; exchanged for an accessToken via /nacos/v1/auth/login
+	Password          string `yaml:"password"`          // optional
+	APIVersion        string `yaml:"apiVersion"`        // v1 (default) | v2 (open API)
+	PollIntervalMs    int    `yaml:"pollIntervalMs"`    // fallback pull interval, default 5000
+	LongPollTimeoutMs int    `yaml:"longPollTimeoutMs"` // listener long-poll timeout, default 30000; <0 disables the listener
+	TimeoutMs         int    `yaml:"timeoutMs"`         // default 2000
+	FailPolicy        string `yaml:"failPolicy"`        // fail-open | fail-closed
+	Format            string `yaml:"format"`            // json | yaml (auto-detect if empty)
 }
 
 func (n NacosCfg) Enabled() bool {
 	return n.Addr != "" && n.DataID != ""
 }
 
+// FileCfg - rules read from a local file or directory (e.g. a mounted ConfigMap)
+type FileCfg struct {
+	Path            string `yaml:"path"`            // rule file, or a directory whose *.json/*.yaml/*.yml files are merged
+	Format          string `yaml:"format"`          // json | yaml (by file extension if empty)
+	WatchIntervalMs int    `yaml:"watchIntervalMs"` // mtime check interval, default 1000
+	PollIntervalMs  int    `yaml:"pollIntervalMs"`  // fallback full reload interval, default 5000
+	FailPolicy      string `yaml:"failPolicy"`      // fail-open | fail-closed
+}
+
+func (f FileCfg) Enabled() bool {
+	return f.Path != ""
+}
+
+// EtcdCfg - etcd v3 KV read through the JSON gateway, watched by revision
+type EtcdCfg struct {
+	Endpoints      []string `yaml:"endpoints"`      // e.g. ["http://127.0.0.1:2379"], tried in order
+	Key            string   `yaml:"key"`            // rule key, or key prefix when prefix is true
+	Prefix         bool     `yaml:"prefix"`         // merge every key under key, in key order
+	Username       string   `yaml:"username"`       // optional
+	Password       string   `yaml:"password"`       // optional
+	PollIntervalMs int      `yaml:"pollIntervalMs"` // fallback pull interval, default 5000
+	TimeoutMs      int      `yaml:"timeoutMs"`      // default 2000
+	FailPolicy     string   `yaml:"failPolicy"`     // fail-open | fail-closed
+	Format         string   `yaml:"format"`         // json | yaml (by key extension, else auto-detect)
+}
+
+// ConsulCfg - Consul KV, watched with blocking queries on X-Consul-Index
+type ConsulCfg struct {
+	Addr           string `yaml:"addr"`           // e.g. "http://127.0.0.1:8500"
+	Key            string `yaml:"key"`            // rule key, or key prefix when prefix is true
+	Prefix         bool   `yaml:"prefix"`         // merge every key under key, in key order
+	Token          string `yaml:"token"`          // optional ACL token
+	Datacenter     string `yaml:"datacenter"`     // optional, default the agent's
+	WaitMs         int    `yaml:"waitMs"`         // blocking query wait, default 30000
+	PollIntervalMs int    `yaml:"pollIntervalMs"` // fallback pull interval, default 5000
+	TimeoutMs      int    `yaml:"timeoutMs"`      // default 2000
+	FailPolicy     string `yaml:"failPolicy"`     // fail-open | fail-closed
+	Format         string `yaml:"format"`         // json | yaml (by key extension, else auto-detect)
+}
+
+// RulesSourceCfg - selects the dynamic rule source
+type RulesSourceCfg struct {
+	Type   string    `yaml:"type"`   // nacos | file | etcd | consul; empty means nacos if configured, else rules live in Redis
+	File   FileCfg   `yaml:"file"`   // type: file
+	Etcd   EtcdCfg   `yaml:"etcd"`   // type: etcd
+	Consul ConsulCfg `yaml:"consul"` // type: consul (type nacos uses the top-level nacos block)
+}
+
+// AdminAuthCfg - authentication of the admin rule API. With no tokens, HMAC
+// keys or JWKS file configured the admin API is open.
+type AdminAuthCfg struct {
+	Tokens []AdminTokenCfg `yaml:"tokens"` // static bearer tokens
+	HMAC   AdminHMACCfg    `yaml:"hmac"`   // HMAC-signed requests
+	JWT    AdminJWTCfg     `yaml:"jwt"`    // JWTs verified against a local JWKS file
+}
+
+// AdminGrant - a role over the rules whose ID starts with one of RulePrefixes
+type AdminGrant struct {
+	Role         string   `yaml:"role"`         // viewer | operator | admin
+	RulePrefixes []string `yaml:"rulePrefixes"` // rule ID prefixes the role applies to; empty means every rule
+}
+
+// AdminTokenCfg - a static bearer token
+type AdminTokenCfg struct {
+	Token      string `yaml:"token"`
+	Subject    string `yaml:"subject"` // recorded as the author of rule changes
+	AdminGrant `yaml:",inline"`
+}
+
+// AdminHMACCfg - HMAC-SHA256 request signing keys
+type AdminHMACCfg struct {
+	MaxSkewSec int               `yaml:"maxSkewSec"` // accepted clock skew of the signed timestamp (default 300)
+	Keys       []AdminHMACKeyCfg `yaml:"keys"`
+}
+
+// AdminHMACKeyCfg - one HMAC signing key
+type AdminHMACKeyCfg struct {
+	KeyID      string `yaml:"keyId"`
+	Secret     string `yaml:"secret"`
+	Subject    string `yaml:"subject"` // recorded as the author of rule changes (default keyId)
+	AdminGrant `yaml:",inline"`
+}
+
+// AdminJWTCfg - JWT bearer tokens signed with RS256/384/512 or ES256/384/512
+type AdminJWTCfg struct {
+	JWKSFile      string `yaml:"jwksFile"`      // local JWKS file, re-read when it changes
+	Issuer        string `yaml:"issuer"`        // required iss claim (optional)
+	Audience      string `yaml:"audience"`      // required aud claim (optional)
+	RoleClaim     string `yaml:"roleClaim"`     // claim holding the role (default "role")
+	PrefixesClaim string `yaml:"prefixesClaim"` // claim holding the rule ID prefixes (default "rulePrefixes")
+	LeewaySec     int    `yaml:"leewaySec"`     // clock leeway for exp/nbf (default 60)
+}
+
+// EnvoyCfg - Envoy ratelimit (RLS v3) protocol mapping
+type EnvoyCfg struct {
+	Domains map[string][]string `yaml:"domains"` // domain -> ruleIds evaluated for every descriptor of that domain
+}
+
 // QuotaCfg —— 配额（分钟/小时/天）
 type QuotaCfg struct {
-	PerMinute int64 `yaml:"perMinute"` // 分钟内最大请求数（<=0 表示不限制）
-	PerHour   int64 `yaml:"perHour"`   // 小时内最大请求数（<=0 表示不限制）
-	PerDay    int64 `yaml:"perDay"`    // 天内最大请求数（<=0 表示不限制）
+	PerMinute int64  `yaml:"perMinute" json:"perMinute"` // 分钟内最大请求数（<=0 表示不限制）
+	PerHour   int64  `yaml:"perHour"   json:"perHour"`   // 小时内最大请求数（<=0 表示不限制）
+	PerDay    int64  `yaml:"perDay"    json:"perDay"`    // 天内最大请求数（<=0 表示不限制）
+	TimeZone  string `yaml:"timeZone"  json:"timeZone"`  // 窗口边界时区（IANA 名称，如 "Asia/Shanghai"；为空使用服务器本地时区）
 }
 
 // BreakerCfg —— 熔断器配置（可针对规则+维度细粒度生效）
@@ -89,23 +227,38 @@ type Rule struct {
 	Methods  []string   `yaml:"methods" json:"methods"`   // HTTP methods
 	Client   string     `yaml:"client"  json:"client"`    // client kind
 	Priority int        `yaml:"priority" json:"priority"` // higher wins
-	Algo     string     `yaml:"algo"     json:"algo"`     // 算法："sliding_window" | "token_bucket" | "leaky_bucket"
+	Algo     string     `yaml:"algo"     json:"algo"`     // 算法："sliding_window" | "token_bucket" | "leaky_bucket" | "gcra" | "sliding_window_counter" | "concurrency"
 	WindowMs int64      `yaml:"windowMs" json:"windowMs"` // 时间窗口（毫秒），不同算法语义略有不同
 	Limit    int64      `yaml:"limit"    json:"limit"`    // 基础速率/上限（例如每窗口允许的次数）
 	Burst    int64      `yaml:"burst"    json:"burst"`    // 允许的突发容量（令牌桶/漏桶会用到）
 	Dims     []string   `yaml:"dims"     json:"dims"`     // 维度声明（如 ["ip","route","appId"]）
 	Quota    QuotaCfg   `yaml:"quota"    json:"quota"`    // 分钟/小时/天级配额
 	Enabled  bool       `yaml:"enabled"  json:"enabled"`  // 是否启用此规则
+	Mode     string     `yaml:"mode"     json:"mode"`     // "enforce"（默认）| "shadow"：只评估、记录 shadow_denied，从不拒绝
 	Breaker  BreakerCfg `yaml:"breaker"  json:"breaker"`  // 熔断配置（可选）
+
+	LocalBatch LocalBatchCfg `yaml:"localBatch" json:"localBatch"` // 本地批量租用令牌（仅 token_bucket，可选）
+}
+
+// LocalBatchCfg —— 每个实例一次从 Redis 租用一批令牌并在本地扣减，换取吞吐。
+// 代价是有界的超额放行：每个实例最多提前持有 Size 个令牌，任一窗口内
+// 全局最多超额放行 实例数 × Size；租约到期后未用完的令牌归还 Redis。
+type LocalBatchCfg struct {
+	Size    int64 `yaml:"size"    json:"size"`    // 每次租用的令牌数，即单实例超额放行上限（<=0 表示关闭）
+	LeaseMs int64 `yaml:"leaseMs" json:"leaseMs"` // 本地租约有效期（毫秒），默认 100，不超过 windowMs
 }
 
 // Config —— 全量配置
 type Config struct {
-	Server         ServerCfg `yaml:"server"`         // 服务配置
-	Redis          RedisCfg  `yaml:"redis"`          // Redis 配置
-	Features       Features  `yaml:"features"`       // 特性开关
-	Nacos          NacosCfg  `yaml:"nacos"`          // Nacos dynamic rules config
-	BootstrapRules []Rule    `yaml:"bootstrapRules"` // 启动时注入的初始规则（如无则可留空）
+	Server         ServerCfg      `yaml:"server"`         // 服务配置
+	Redis          RedisCfg       `yaml:"redis"`          // Redis 配置
+	Features       Features       `yaml:"features"`       // 特性开关
+	Audit          AuditCfg       `yaml:"audit"`          // 审计配置
+	Nacos          NacosCfg       `yaml:"nacos"`          // Nacos dynamic rules config
+	RulesSource    RulesSourceCfg `yaml:"rulesSource"`    // dynamic rule source selection
+	AdminAuth      AdminAuthCfg   `yaml:"adminAuth"`      // admin rule API authentication and roles
+	Envoy          EnvoyCfg       `yaml:"envoy"`          // Envoy RLS gRPC mapping
+	BootstrapRules []Rule         `yaml:"bootstrapRules"` // 启动时注入的初始规则（如无则可留空）
 }
 
 // Load —— 从 YAML 文件加载配置
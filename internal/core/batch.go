@@ -0,0 +1,431 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/limiter"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+	"github.com/nanjiek/pixiu-rls/internal/util"
+)
+
+// batchEvaler runs one script call per slot group in a single pipeline;
+// *repo.RedisRepo satisfies it.
+type batchEvaler interface {
+	EvalPipelined(ctx context.Context, script *redis.Script, calls []repo.ScriptCall) ([][]interface{}, []error)
+}
+
+// BatchItem is one rule evaluation of AllowBatch.
+type BatchItem struct {
+	Rule config.Rule
+	Dims map[string]string
+	Cost int64 // units consumed; <=0 means 1
+}
+
+type batchEntry struct {
+	idx        int
+	rule       config.Rule
+	dims       map[string]string
+	dimKey     string
+	key        string
+	cost       int64
+	op         *limiter.BatchOp // nil: evaluated through the engine's limiter
+	ticket     breakerTicket
+	useBreaker bool
+	quotaUsed  bool  // quota was taken and must be refunded if the item is denied
+	quotaLeft  int64 // quota remaining after this item
+}
+
+type batchGroup struct {
+	entries   []*batchEntry
+	committed bool // limiter state was written and must be refunded on rollback
+}
+
+// AllowBatch evaluates many items in one pass. Items are grouped by the
+// cluster slot of their limiter key; each group is one limiter.BatchScript
+// call and all calls go out in one pipeline.
+//
+// Quotas are taken before the limiter, as in AllowRules, and refunded when
+// the limiter denies. In independent mode every item gets its own decision.
+// In atomic mode either every item is admitted and consumed or none is: each
+// slot group is committed all-or-nothing, and if any item is denied the groups
+// and quotas that were already consumed are refunded.
+func (e *Engine) AllowBatch(ctx context.Context, items []BatchItem, atomic bool, now time.Time) ([]types.Decision, error) {
+	start := time.Now()
+	decs, err := e.allowBatch(ctx, items, atomic, now)
+	if err == nil {
+		for i, dec := range decs {
+			if e.auditor != nil {
+				e.auditor.Record(items[i].Rule, items[i].Dims, dec, now)
+			}
+			if e.hook != nil {
+				e.hook.OnDecision(items[i].Rule, dec)
+			}
+		}
+		if e.hook != nil {
+			e.hook.OnEvaluate("batch", time.Since(start))
+		}
+	}
+	return decs, err
+}
+
+func (e *Engine) allowBatch(ctx context.Context, items []BatchItem, atomic bool, now time.Time) ([]types.Decision, error) {
+	decs := make([]types.Decision, len(items))
+	if len(items) == 0 {
+		return decs, nil
+	}
+	if e.repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+
+	done := make([]bool, len(items))
+	token := batchToken()
+	var all, scripted, single []*batchEntry
+	for i, it := range items {
+		if it.Rule.Enabled && IsShadow(it.Rule) {
+			// shadow items never deny, so they take no part in atomicity
+			decs[i], _ = e.allowRules(ctx, []config.Rule{it.Rule}, it.Dims, it.Cost, now)
+			done[i] = true
+			continue
+		}
+		dec, entry, err := e.prepareBatchItem(ctx, i, it, atomic, now)
+		if err != nil {
+			decs[i], done[i] = e.batchFailure(it.Rule, err), true
+			continue
+		}
+		if entry == nil {
+			decs[i], done[i] = dec, true
+			continue
+		}
+		// localBatch rules keep their leased path unless the batch is atomic,
+		// which has to be decided against the shared bucket
+		if e.batch != nil && (atomic || entry.rule.LocalBatch.Size <= 0) {
+			entry.op, _ = limiter.NewBatchOp(entry.rule, entry.key, entry.cost, now, token+":"+strconv.Itoa(i))
+		}
+		all = append(all, entry)
+		if entry.op != nil {
+			scripted = append(scripted, entry)
+		} else {
+			single = append(single, entry)
+		}
+	}
+
+	if atomic {
+		if len(single) > 0 {
+			err := errors.New("rule cannot run in an atomic batch: " + normalizeAlgo(single[0].rule.Algo))
+			decs[single[0].idx], done[single[0].idx] = types.Decision{Allowed: false, Reason: "unsupported_algorithm", RuleID: single[0].rule.RuleID, Err: err}, true
+			single = nil
+		}
+		if rejected(decs, done) {
+			e.rollbackBatch(ctx, nil, all, now)
+			return abortBatch(decs, done), nil
+		}
+	}
+
+	groups := groupBySlot(scripted)
+	e.commitGroups(ctx, groups, atomic, now, decs, done)
+
+	for _, entry := range single {
+		dec, err := e.allowLimiter(ctx, entry.rule, entry.key, entry.cost, now)
+		if err != nil {
+			decs[entry.idx] = e.batchDegrade(ctx, entry, atomic, now, err)
+			done[entry.idx] = true
+			continue
+		}
+		if !dec.Allowed {
+			dec.RuleID = entry.rule.RuleID
+		}
+		decs[entry.idx] = dec
+	}
+
+	for _, entry := range all {
+		dec := &decs[entry.idx]
+		if entry.useBreaker && !done[entry.idx] && dec.Reason != "batch_rejected" {
+			e.breaker.Record(ctx, entry.rule, entry.dimKey, now, entry.ticket, dec.Allowed)
+		}
+		if !entry.quotaUsed {
+			continue
+		}
+		if !dec.Allowed || dec.Err != nil {
+			// a rejected atomic batch refunds every quota below
+			if !atomic {
+				e.refundQuota(ctx, entry.rule, entry.dimKey, entry.cost, now)
+				entry.quotaUsed = false
+			}
+			continue
+		}
+		if entry.quotaLeft < dec.Remaining {
+			dec.Remaining = entry.quotaLeft
+		}
+	}
+	if atomic && rejected(decs, nil) {
+		e.rollbackBatch(ctx, groups, all, now)
+		return abortBatch(decs, nil), nil
+	}
+
+	for _, entry := range all {
+		if !decs[entry.idx].Allowed && e.ipCache != nil {
+			if ip := strings.TrimSpace(entry.dims["ip"]); ip != "" {
+				e.ipCache.RecordDeny(ctx, ip)
+			}
+		}
+	}
+	return decs, nil
+}
+
+// prepareBatchItem runs the per-item checks that precede the limiter: rule
+// state, IP lists, dims, the quota and the breaker. It returns a final decision
+// with a nil entry when the item is settled without touching the limiter; any
+// quota it took is then already refunded.
+func (e *Engine) prepareBatchItem(ctx context.Context, idx int, it BatchItem, atomic bool, now time.Time) (types.Decision, *batchEntry, error) {
+	rule := it.Rule
+	if !rule.Enabled {
+		return types.Decision{Allowed: false, Reason: "rule_disabled", RuleID: rule.RuleID}, nil, nil
+	}
+	if RequiresLease(rule) {
+		return types.Decision{Allowed: false, Reason: "lease_required", RuleID: rule.RuleID}, nil, nil
+	}
+	dims := it.Dims
+	if dims == nil {
+		dims = map[string]string{}
+	}
+
+	ipDec, handled, err := e.checkIPLists(ctx, dims)
+	if err != nil {
+		return types.Decision{}, nil, err
+	}
+	if handled {
+		if !ipDec.Allowed {
+			ipDec.RuleID = rule.RuleID
+		}
+		return ipDec, nil, nil
+	}
+
+	dimKey, err := util.HashDims(rule.Dims, dims)
+	if err != nil {
+		return types.Decision{}, nil, err
+	}
+	key, err := e.limiterKey(rule, dimKey)
+	if err != nil {
+		return types.Decision{}, nil, err
+	}
+	entry := &batchEntry{idx: idx, rule: rule, dims: dims, dimKey: dimKey, key: key, cost: it.Cost}
+	if entry.cost <= 0 {
+		entry.cost = 1
+	}
+	if capacity, ok := limiter.Capacity(rule); ok && entry.cost > capacity {
+		return types.Decision{Allowed: false, Reason: "cost_exceeds_capacity", RuleID: rule.RuleID}, nil, nil
+	}
+
+	if e.enforcesQuota(rule) {
+		qd, err := e.checkQuota(ctx, rule, dimKey, entry.cost, now, types.Decision{Allowed: true, Remaining: math.MaxInt64})
+		switch {
+		case err != nil && e.fallback != nil && !atomic:
+			// Redis is failing; quotas live there too, let the limiter degrade
+		case err != nil:
+			return types.Decision{}, nil, err
+		case !qd.Allowed:
+			qd.RuleID = rule.RuleID
+			if !atomic {
+				e.recordDeny(ctx, rule, dims)
+			}
+			return qd, nil, nil
+		default:
+			entry.quotaUsed, entry.quotaLeft = true, qd.Remaining
+		}
+	}
+
+	if rule.Breaker.Enabled && e.breaker != nil {
+		bd, ticket, err := e.breaker.Acquire(ctx, rule, dimKey, now)
+		if err == nil && bd.Allowed {
+			entry.ticket, entry.useBreaker = ticket, true
+			return types.Decision{}, entry, nil
+		}
+		if entry.quotaUsed {
+			e.refundQuota(ctx, rule, dimKey, entry.cost, now)
+		}
+		if err != nil {
+			return types.Decision{}, nil, err
+		}
+		bd.RuleID = rule.RuleID
+		return bd, nil, nil
+	}
+	return types.Decision{}, entry, nil
+}
+
+// commitGroups runs the commit op for every slot group. Failed groups are
+// settled through the fail policy and marked done.
+func (e *Engine) commitGroups(ctx context.Context, groups []*batchGroup, atomic bool, now time.Time, decs []types.Decision, done []bool) {
+	if len(groups) == 0 {
+		return
+	}
+
+	calls := make([]repo.ScriptCall, len(groups))
+	for i, g := range groups {
+		calls[i] = batchCall(g, "commit", atomic)
+	}
+	results, errs := e.batch.EvalPipelined(ctx, limiter.BatchScript, calls)
+	for i, g := range groups {
+		err := errs[i]
+		if err == nil && len(results[i]) < len(g.entries) {
+			err = errors.New("invalid batch script response")
+		}
+		if err != nil {
+			for _, entry := range g.entries {
+				decs[entry.idx], done[entry.idx] = e.batchDegrade(ctx, entry, atomic, now, err), true
+			}
+			continue
+		}
+
+		allowedAll := true
+		for j, entry := range g.entries {
+			dec, err := entry.op.Decode(results[i][j])
+			if err != nil {
+				decs[entry.idx], done[entry.idx] = e.batchFailure(entry.rule, err), true
+				allowedAll = false
+				continue
+			}
+			if !dec.Allowed {
+				allowedAll = false
+				dec.RuleID = entry.rule.RuleID
+			}
+			decs[entry.idx] = dec
+		}
+		g.committed = !atomic || allowedAll
+		if !g.committed {
+			// the script already gave back what this group took; its passing
+			// items are void
+			for _, entry := range g.entries {
+				if decs[entry.idx].Allowed {
+					decs[entry.idx] = types.Decision{Allowed: false, Reason: "batch_rejected"}
+				}
+			}
+		}
+	}
+}
+
+// rollbackBatch refunds the limiter state and quotas consumed by an atomic
+// batch that ended up rejected. Refund failures are logged; the consumed
+// units then expire with their windows.
+func (e *Engine) rollbackBatch(ctx context.Context, groups []*batchGroup, entries []*batchEntry, now time.Time) {
+	var calls []repo.ScriptCall
+	for _, g := range groups {
+		if g.committed {
+			calls = append(calls, batchCall(g, "refund", false))
+		}
+	}
+	if len(calls) > 0 {
+		_, errs := e.batch.EvalPipelined(ctx, limiter.BatchScript, calls)
+		for _, err := range errs {
+			if err != nil {
+				e.logger.Warn("batch refund failed", "err", err)
+			}
+		}
+	}
+	for _, entry := range entries {
+		if entry.quotaUsed && e.quota != nil {
+			if err := e.quota.Refund(ctx, entry.rule, entry.dimKey, entry.cost, now); err != nil {
+				e.logger.Warn("batch quota refund failed", "rule_id", entry.rule.RuleID, "err", err)
+			}
+		}
+	}
+}
+
+// batchFailure applies the fail policy to an item whose evaluation errored.
+func (e *Engine) batchFailure(rule config.Rule, err error) types.Decision {
+	if e.failPolicy == "fail-open" {
+		e.logger.Warn("fail-open due to batch error", "rule_id", rule.RuleID, "err", err)
+		return types.Decision{Allowed: true, Reason: "fail_open", Err: err}
+	}
+	return types.Decision{Allowed: false, Reason: "fail_closed", RuleID: rule.RuleID, Err: err}
+}
+
+// batchDegrade settles an item whose limiter call failed: on the fallback
+// limiter in independent mode, otherwise by the fail policy. An atomic batch
+// cannot mix Redis and local state, so it never degrades.
+func (e *Engine) batchDegrade(ctx context.Context, entry *batchEntry, atomic bool, now time.Time, err error) types.Decision {
+	if !atomic {
+		if dec, ok := e.degrade(ctx, entry.rule, entry.key, entry.cost, now, err); ok {
+			if !dec.Allowed {
+				dec.RuleID = entry.rule.RuleID
+			}
+			return dec
+		}
+	}
+	return e.batchFailure(entry.rule, err)
+}
+
+func batchCall(g *batchGroup, op string, atomic bool) repo.ScriptCall {
+	ops := make([]*limiter.BatchOp, len(g.entries))
+	for i, entry := range g.entries {
+		ops[i] = entry.op
+	}
+	return limiter.BatchCall(op, atomic, ops)
+}
+
+// groupBySlot splits entries into per-slot groups, ordered by slot so the
+// script calls are deterministic.
+func groupBySlot(entries []*batchEntry) []*batchGroup {
+	bySlot := make(map[int]*batchGroup)
+	slots := make([]int, 0)
+	for _, entry := range entries {
+		slot := repo.Slot(entry.key)
+		g, ok := bySlot[slot]
+		if !ok {
+			g = &batchGroup{}
+			bySlot[slot] = g
+			slots = append(slots, slot)
+		}
+		g.entries = append(g.entries, entry)
+	}
+	sort.Ints(slots)
+	out := make([]*batchGroup, len(slots))
+	for i, slot := range slots {
+		out[i] = bySlot[slot]
+	}
+	return out
+}
+
+// rejected reports whether any settled decision denies. A nil done means
+// every decision is settled.
+func rejected(decs []types.Decision, done []bool) bool {
+	for i, dec := range decs {
+		if (done == nil || done[i]) && !dec.Allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// abortBatch turns an atomic batch into all-denied: items that would have
+// passed are reported as "batch_rejected", the others keep their reason.
+func abortBatch(decs []types.Decision, done []bool) []types.Decision {
+	for i := range decs {
+		if (done == nil || done[i]) && !decs[i].Allowed {
+			continue
+		}
+		decs[i] = types.Decision{Allowed: false, Reason: "batch_rejected"}
+	}
+	return decs
+}
+
+func batchToken() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,270 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+// fakeBatch answers commit calls from a per-rule table and records every
+// pipeline it receives. Replies are shaped for token buckets, whose denials
+// can retry after 250ms; the extra reset field lets gcra items decode too.
+// taken tracks the token bucket units held per rule across commits and
+// refunds.
+type fakeBatch struct {
+	allow map[string]bool  // rule ID -> allowed
+	fail  map[string]error // rule ID -> group error
+	taken map[string]int64 // rule ID -> token bucket units held
+	runs  [][]repo.ScriptCall
+}
+
+func (f *fakeBatch) EvalPipelined(ctx context.Context, script *redis.Script, calls []repo.ScriptCall) ([][]interface{}, []error) {
+	f.runs = append(f.runs, calls)
+	if f.taken == nil {
+		f.taken = make(map[string]int64)
+	}
+	out := make([][]interface{}, len(calls))
+	errs := make([]error, len(calls))
+	for i, c := range calls {
+		pos := 2
+		for ki := 0; pos < len(c.Args); {
+			// token bucket and gcra args both start limit, window_ms, burst, now_ms
+			nk, n := c.Args[pos+1].(int), c.Args[pos+2].(int)
+			id := ruleOfKey(c.Keys[ki])
+			nowMs := c.Args[pos+6].(int64)
+			var cost int64
+			if c.Args[pos] == "token_bucket" {
+				cost = c.Args[pos+8].(int64)
+			}
+			ki, pos = ki+nk, pos+3+n
+			if c.Args[0] == "refund" {
+				f.taken[id] -= cost
+				continue
+			}
+			if err := f.fail[id]; err != nil {
+				errs[i] = err
+				break
+			}
+			if f.allow[id] {
+				f.taken[id] += cost
+			}
+			out[i] = append(out[i], []interface{}{int64(boolArg(f.allow[id])), int64(3), nowMs + 250, nowMs + 250})
+		}
+	}
+	return out, errs
+}
+
+// ruleOfKey extracts the {hash tag} of a limiter key, which is the rule ID.
+func ruleOfKey(key string) string {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '{' {
+			for j := i + 1; j < len(key); j++ {
+				if key[j] == '}' {
+					return key[i+1 : j]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func batchRule(id string) config.Rule {
+	return config.Rule{RuleID: id, Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10, Dims: []string{"user"}}
+}
+
+func newBatchEngine(fb *fakeBatch, policy string) *Engine {
+	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true}, policy)
+	engine.batch = fb
+	return engine
+}
+
+func TestAllowBatchGroupsBySlot(t *testing.T) {
+	fb := &fakeBatch{allow: map[string]bool{"a": true, "b": true}}
+	engine := newBatchEngine(fb, "fail-closed")
+
+	items := []BatchItem{
+		{Rule: batchRule("a"), Dims: map[string]string{"user": "1"}, Cost: 3},
+		{Rule: batchRule("b"), Dims: map[string]string{"user": "1"}},
+		{Rule: batchRule("a"), Dims: map[string]string{"user": "2"}},
+	}
+	decs, err := engine.AllowBatch(context.Background(), items, false, time.UnixMilli(5000))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for i, dec := range decs {
+		if !dec.Allowed || dec.Remaining != 3 {
+			t.Fatalf("item %d: unexpected decision %+v", i, dec)
+		}
+	}
+	if len(fb.runs) != 1 || len(fb.runs[0]) != 2 {
+		t.Fatalf("expected one pipeline with two slot groups, got %v", fb.runs)
+	}
+	for _, call := range fb.runs[0] {
+		if ruleOfKey(call.Keys[0]) == "a" {
+			if len(call.Keys) != 2 || call.Args[0] != "commit" || call.Args[1] != 0 {
+				t.Fatalf("unexpected call for rule a: %v", call)
+			}
+			// the first item runs script.lua with the args of TokenBucket.Allow
+			if call.Args[2] != "token_bucket" || call.Args[3] != 1 || call.Args[4] != 6 || call.Args[8] != int64(5000) || call.Args[10] != int64(3) {
+				t.Fatalf("unexpected item args: %v", call.Args)
+			}
+		}
+	}
+}
+
+func TestAllowBatchAtomicRollsBack(t *testing.T) {
+	fb := &fakeBatch{allow: map[string]bool{"a": true, "b": false}}
+	engine := newBatchEngine(fb, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: true, Remaining: 1}}
+	engine.quota = quota
+
+	items := []BatchItem{
+		{Rule: batchRule("a"), Dims: map[string]string{"user": "1"}},
+		{Rule: batchRule("b"), Dims: map[string]string{"user": "1"}},
+	}
+	decs, err := engine.AllowBatch(context.Background(), items, true, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if decs[0].Allowed || decs[0].Reason != "batch_rejected" {
+		t.Fatalf("item 0 should be rejected with the batch: %+v", decs[0])
+	}
+	if decs[1].Allowed || decs[1].Reason != "rate_limited" || decs[1].RuleID != "b" || decs[1].RetryAfterMs != 250 {
+		t.Fatalf("item 1 should carry its own denial: %+v", decs[1])
+	}
+	if len(fb.runs) != 2 || len(fb.runs[1]) != 1 || fb.runs[1][0].Args[0] != "refund" || ruleOfKey(fb.runs[1][0].Keys[0]) != "a" {
+		t.Fatalf("expected a refund of rule a only, got %v", fb.runs)
+	}
+	if quota.calls != 0 {
+		t.Fatalf("quota must not be consumed by a rejected batch")
+	}
+}
+
+func TestAllowBatchAtomicQuotaRollback(t *testing.T) {
+	fb := &fakeBatch{allow: map[string]bool{"a": true, "b": true}}
+	engine := newBatchEngine(fb, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: false, Reason: "quota_exceeded:day"}}
+	engine.quota = quota
+
+	qa := batchRule("a")
+	qa.Quota = config.QuotaCfg{PerDay: 1}
+	items := []BatchItem{
+		{Rule: qa, Dims: map[string]string{"user": "1"}},
+		{Rule: batchRule("b"), Dims: map[string]string{"user": "1"}},
+	}
+	decs, _ := engine.AllowBatch(context.Background(), items, true, time.Now())
+	if decs[0].Reason != "quota_exceeded:day" || decs[1].Reason != "batch_rejected" {
+		t.Fatalf("unexpected decisions: %+v", decs)
+	}
+	if len(fb.runs) != 0 {
+		t.Fatalf("a quota denial should settle the batch before the limiter, got %v", fb.runs)
+	}
+
+	// the quota admits but the limiter denies another item: both the
+	// committed group and the quota are given back
+	quota.dec = types.Decision{Allowed: true, Remaining: 0}
+	fb.allow["b"] = false
+	decs, _ = engine.AllowBatch(context.Background(), items, true, time.Now())
+	if decs[0].Reason != "batch_rejected" || decs[1].Reason != "rate_limited" {
+		t.Fatalf("unexpected decisions: %+v", decs)
+	}
+	if quota.refunds != 1 || fb.taken["a"] != 0 {
+		t.Fatalf("quota refunds = %d, units held = %d; want 1, 0", quota.refunds, fb.taken["a"])
+	}
+}
+
+func TestAllowBatchQuotaBeforeLimiter(t *testing.T) {
+	fb := &fakeBatch{allow: map[string]bool{"a": true, "b": true}}
+	engine := newBatchEngine(fb, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: false, Reason: "quota_exceeded:day"}}
+	engine.quota = quota
+
+	qa := batchRule("a")
+	qa.Quota = config.QuotaCfg{PerDay: 1}
+	items := []BatchItem{
+		{Rule: qa, Dims: map[string]string{"user": "1"}, Cost: 4},
+		{Rule: batchRule("b"), Dims: map[string]string{"user": "1"}, Cost: 2},
+	}
+	decs, _ := engine.AllowBatch(context.Background(), items, false, time.Now())
+	if decs[0].Allowed || decs[0].Reason != "quota_exceeded:day" || decs[0].RuleID != "a" {
+		t.Fatalf("item 0 should be denied by its quota: %+v", decs[0])
+	}
+	if !decs[1].Allowed {
+		t.Fatalf("item 1 should pass: %+v", decs[1])
+	}
+	// the limiter would have admitted item 0; it must not have spent units
+	if fb.taken["a"] != 0 || fb.taken["b"] != 2 {
+		t.Fatalf("units held = %v, want a:0 b:2", fb.taken)
+	}
+
+	// the quota admits and the limiter denies: the quota is refunded
+	quota.dec = types.Decision{Allowed: true, Remaining: 7}
+	fb.allow["a"] = false
+	decs, _ = engine.AllowBatch(context.Background(), items, false, time.Now())
+	if decs[0].Allowed || decs[0].Reason != "rate_limited" || quota.refunds != 1 {
+		t.Fatalf("limiter denial should refund the quota: %+v, refunds %d", decs[0], quota.refunds)
+	}
+}
+
+func TestAllowBatchIndependentFailPolicy(t *testing.T) {
+	fb := &fakeBatch{
+		allow: map[string]bool{"a": true},
+		fail:  map[string]error{"b": errors.New("CLUSTERDOWN")},
+	}
+	engine := newBatchEngine(fb, "fail-closed")
+
+	disabled := batchRule("c")
+	disabled.Enabled = false
+	items := []BatchItem{
+		{Rule: batchRule("a"), Dims: map[string]string{"user": "1"}},
+		{Rule: batchRule("b"), Dims: map[string]string{"user": "1"}},
+		{Rule: disabled, Dims: map[string]string{"user": "1"}},
+		{Rule: batchRule("a"), Dims: map[string]string{}},
+	}
+	decs, _ := engine.AllowBatch(context.Background(), items, false, time.Now())
+	want := []string{"allowed", "fail_closed", "rule_disabled", "fail_closed"}
+	for i, dec := range decs {
+		if dec.Reason != want[i] || dec.Allowed != (i == 0) {
+			t.Fatalf("item %d: got %+v, want %s", i, dec, want[i])
+		}
+	}
+}
+
+func TestAllowBatchLocalBatchKeepsLease(t *testing.T) {
+	fb := &fakeBatch{allow: map[string]bool{"a": true, "g": true}}
+	engine := newBatchEngine(fb, "fail-closed")
+
+	leased := batchRule("a")
+	leased.LocalBatch = config.LocalBatchCfg{Size: 5}
+	cellRule := batchRule("g")
+	cellRule.Algo = "gcra"
+	items := []BatchItem{
+		{Rule: leased, Dims: map[string]string{"user": "1"}},
+		{Rule: cellRule, Dims: map[string]string{"user": "1"}},
+	}
+
+	decs, _ := engine.AllowBatch(context.Background(), items, false, time.Now())
+	if decs[0].Reason != "mock_decision" {
+		t.Fatalf("localBatch rule should use the engine limiter: %+v", decs[0])
+	}
+	if len(fb.runs) != 1 || len(fb.runs[0]) != 1 || ruleOfKey(fb.runs[0][0].Keys[0]) != "g" {
+		t.Fatalf("only the gcra item should be scripted, got %v", fb.runs)
+	}
+
+	fb.runs = nil
+	decs, _ = engine.AllowBatch(context.Background(), items, true, time.Now())
+	if !decs[0].Allowed || !decs[1].Allowed || len(fb.runs) != 1 || len(fb.runs[0]) != 2 {
+		t.Fatalf("atomic batch should script every item: %+v, %v", decs, fb.runs)
+	}
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+// breakerScript keeps the per-rule, per-dimension breaker state machine in a
+// Redis hash so that every replica observes the same Closed/Open/HalfOpen state.
+const breakerScript = `
+-- KEYS[1] = breaker hash
+-- ARGV[1] = op: "acquire" | "record"
+-- ARGV[2] = now_ms
+-- ARGV[3] = deny_threshold
+-- ARGV[4] = deny_window_ms
+-- ARGV[5] = min_open_ms
+-- ARGV[6] = half_open_min_pass
+-- ARGV[7] = half_open_max_fail
+-- ARGV[8] = ttl_ms
+-- ARGV[9] = acquire: 1 if sampled as half-open probe | record: 1 if the limiter allowed
+-- ARGV[10] = record: 1 if the request was admitted as a half-open probe
+-- returns {flag, state, ms}
+--   acquire: flag=1 admitted; ms = time until the open period ends
+--   record:  flag=1 state changed
+
+local op        = ARGV[1]
+local now       = tonumber(ARGV[2])
+local threshold = tonumber(ARGV[3])
+local window    = tonumber(ARGV[4])
+local min_open  = tonumber(ARGV[5])
+local min_pass  = tonumber(ARGV[6])
+local max_fail  = tonumber(ARGV[7])
+local ttl       = tonumber(ARGV[8])
+local flag      = tonumber(ARGV[9])
+
+local state  = tonumber(redis.call('HGET', KEYS[1], 'state') or 0)
+local opened = tonumber(redis.call('HGET', KEYS[1], 'opened_at') or 0)
+
+if op == 'acquire' then
+  if state == 1 then
+    local left = opened + min_open - now
+    if left > 0 then
+      return {0, 1, left}
+    end
+    state = 2
+    redis.call('HSET', KEYS[1], 'state', 2, 'pass', 0, 'fail', 0)
+    redis.call('PEXPIRE', KEYS[1], ttl)
+  end
+  if state == 2 then
+    if flag == 1 then
+      return {1, 2, 0}
+    end
+    return {0, 2, 0}
+  end
+  return {1, 0, 0}
+end
+
+if state == 0 then
+  if flag == 1 then
+    return {0, 0, 0}
+  end
+  local ws     = tonumber(redis.call('HGET', KEYS[1], 'win_start') or 0)
+  local denies = tonumber(redis.call('HGET', KEYS[1], 'denies') or 0)
+  if now - ws >= window then
+    ws = now
+    denies = 0
+  end
+  denies = denies + 1
+  if denies >= threshold then
+    redis.call('HSET', KEYS[1], 'state', 1, 'opened_at', now, 'denies', 0, 'win_start', now)
+    redis.call('PEXPIRE', KEYS[1], ttl)
+    return {1, 1, min_open}
+  end
+  redis.call('HSET', KEYS[1], 'win_start', ws, 'denies', denies)
+  redis.call('PEXPIRE', KEYS[1], ttl)
+  return {0, 0, 0}
+end
+
+if state == 2 and tonumber(ARGV[10]) == 1 then
+  if flag == 1 then
+    local pass = redis.call('HINCRBY', KEYS[1], 'pass', 1)
+    if pass >= min_pass then
+      redis.call('HSET', KEYS[1], 'state', 0, 'pass', 0, 'fail', 0, 'denies', 0, 'win_start', now)
+      redis.call('PEXPIRE', KEYS[1], ttl)
+      return {1, 0, 0}
+    end
+  else
+    local fail = redis.call('HINCRBY', KEYS[1], 'fail', 1)
+    redis.call('HSET', KEYS[1], 'pass', 0)
+    if fail >= max_fail then
+      redis.call('HSET', KEYS[1], 'state', 1, 'opened_at', now, 'pass', 0, 'fail', 0)
+      redis.call('PEXPIRE', KEYS[1], ttl)
+      return {1, 1, min_open}
+    end
+  end
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return {0, state, 0}
+`
+
+const (
+	defaultBreakerThreshold    = 20
+	defaultBreakerWindowMs     = 10000
+	defaultBreakerMinOpenMs    = 5000
+	defaultBreakerProbePercent = 10
+	breakerHalfOpenRetryMs     = 1000
+)
+
+// scriptEvaler runs a Lua script; *repo.RedisRepo satisfies it.
+type scriptEvaler interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) ([]interface{}, error)
+}
+
+// Breaker is a per-rule, per-dimension-key circuit breaker driven by
+// config.BreakerCfg. It opens when rate-limit denials for a key reach
+// RLDenyThreshold within RLDenyWindowMs, hard-denies for MinOpenMs, then
+// admits HalfOpenProbePercent of traffic as probes until HalfOpenMinPass
+// consecutive probes pass (Closed) or HalfOpenMaxFail fail (Open again).
+type Breaker struct {
+	repo   *repo.RedisRepo
+	exec   scriptEvaler
+	logger *slog.Logger
+	sample func() int // returns [0,100)
+}
+
+// breakerTicket carries the acquire-time state into Record.
+type breakerTicket struct {
+	state int32
+	probe bool
+}
+
+func NewBreaker(r *repo.RedisRepo, logger *slog.Logger) *Breaker {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Breaker{
+		repo:   r,
+		exec:   r,
+		logger: logger,
+		sample: func() int { return rand.Intn(100) },
+	}
+}
+
+// Acquire decides whether the breaker admits the request. A denied decision
+// carries reason "breaker_open".
+func (b *Breaker) Acquire(ctx context.Context, rule config.Rule, dimKey string, now time.Time) (types.Decision, breakerTicket, error) {
+	cfg := normalizeBreaker(rule.Breaker)
+	probe := b.sample() < cfg.HalfOpenProbePercent
+	res, err := b.run(ctx, "acquire", rule.RuleID, dimKey, cfg, now, boolArg(probe), 0)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "breaker_failed", Err: err}, breakerTicket{}, err
+	}
+
+	ticket := breakerTicket{state: int32(res[1])}
+	if res[0] == 1 {
+		ticket.probe = ticket.state == StateHalfOpen
+		return types.Decision{Allowed: true}, ticket, nil
+	}
+	retry := res[2]
+	if ticket.state == StateHalfOpen {
+		retry = breakerHalfOpenRetryMs
+	}
+	return types.Decision{Allowed: false, Reason: "breaker_open", RetryAfterMs: retry}, ticket, nil
+}
+
+// Record feeds the limiter outcome back into the state machine. Allowed
+// requests in the Closed state need no bookkeeping and skip the round trip.
+func (b *Breaker) Record(ctx context.Context, rule config.Rule, dimKey string, now time.Time, ticket breakerTicket, allowed bool) {
+	if allowed && !ticket.probe {
+		return
+	}
+	cfg := normalizeBreaker(rule.Breaker)
+	res, err := b.run(ctx, "record", rule.RuleID, dimKey, cfg, now, boolArg(allowed), boolArg(ticket.probe))
+	if err != nil {
+		b.logger.Warn("breaker record failed", "rule_id", rule.RuleID, "err", err)
+		return
+	}
+	if res[0] == 1 {
+		b.logger.Info("breaker state changed", "rule_id", rule.RuleID, "dim_key", dimKey, "state", breakerStateName(int32(res[1])))
+	}
+}
+
+func (b *Breaker) run(ctx context.Context, op, ruleID, dimKey string, cfg config.BreakerCfg, now time.Time, flag, probed int) ([3]int64, error) {
+	var out [3]int64
+	if b.exec == nil || b.repo == nil {
+		return out, errors.New("breaker repo is nil")
+	}
+	ttlMs := cfg.RLDenyWindowMs + cfg.MinOpenMs + 60000
+	res, err := b.exec.Eval(ctx, breakerScript, []string{b.repo.KeyBreaker(ruleID, dimKey)},
+		op, now.UnixMilli(), cfg.RLDenyThreshold, cfg.RLDenyWindowMs, cfg.MinOpenMs,
+		cfg.HalfOpenMinPass, cfg.HalfOpenMaxFail, ttlMs, flag, probed)
+	if err != nil {
+		return out, err
+	}
+	if len(res) < 3 {
+		return out, errors.New("invalid breaker script response")
+	}
+	for i := range out {
+		v, ok := toInt64(res[i])
+		if !ok {
+			return out, errors.New("invalid breaker script response")
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// normalizeBreaker guards against rules that bypassed validation, which
+// rejects an enabled breaker with any zero field.
+func normalizeBreaker(cfg config.BreakerCfg) config.BreakerCfg {
+	if cfg.RLDenyThreshold <= 0 {
+		cfg.RLDenyThreshold = defaultBreakerThreshold
+	}
+	if cfg.RLDenyWindowMs <= 0 {
+		cfg.RLDenyWindowMs = defaultBreakerWindowMs
+	}
+	if cfg.MinOpenMs <= 0 {
+		cfg.MinOpenMs = defaultBreakerMinOpenMs
+	}
+	if cfg.HalfOpenProbePercent <= 0 {
+		cfg.HalfOpenProbePercent = defaultBreakerProbePercent
+	}
+	if cfg.HalfOpenMinPass <= 0 {
+		cfg.HalfOpenMinPass = 1
+	}
+	if cfg.HalfOpenMaxFail <= 0 {
+		cfg.HalfOpenMaxFail = 1
+	}
+	return cfg
+}
+
+func breakerStateName(state int32) string {
+	switch state {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+func boolArg(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
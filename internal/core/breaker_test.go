@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+type fakeEvaler struct {
+	results [][]interface{}
+	calls   [][]interface{}
+	keys    []string
+}
+
+func (f *fakeEvaler) Eval(ctx context.Context, script string, keys []string, args ...interface{}) ([]interface{}, error) {
+	f.calls = append(f.calls, args)
+	f.keys = append(f.keys, keys...)
+	if len(f.results) == 0 {
+		return []interface{}{int64(0), int64(0), int64(0)}, nil
+	}
+	res := f.results[0]
+	f.results = f.results[1:]
+	return res, nil
+}
+
+func newTestBreaker(exec *fakeEvaler, sample int) *Breaker {
+	b := NewBreaker(newTestRepo(), slog.Default())
+	b.exec = exec
+	b.sample = func() int { return sample }
+	return b
+}
+
+var breakerRule = config.Rule{
+	RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+	Breaker: config.BreakerCfg{Enabled: true, RLDenyThreshold: 3, RLDenyWindowMs: 1000, MinOpenMs: 8000, HalfOpenProbePercent: 10},
+}
+
+func TestBreakerAcquireOpen(t *testing.T) {
+	exec := &fakeEvaler{results: [][]interface{}{{int64(0), int64(StateOpen), int64(4200)}}}
+	b := newTestBreaker(exec, 50)
+
+	dec, _, err := b.Acquire(context.Background(), breakerRule, "d1", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "breaker_open" || dec.RetryAfterMs != 4200 {
+		t.Fatalf("unexpected decision: %+v", dec)
+	}
+	if exec.keys[0] != "test:br:{r1}:d1" {
+		t.Fatalf("unexpected key: %s", exec.keys[0])
+	}
+	if exec.calls[0][0] != "acquire" || exec.calls[0][8] != 0 {
+		t.Fatalf("unexpected args: %v", exec.calls[0])
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	exec := &fakeEvaler{results: [][]interface{}{{int64(1), int64(StateHalfOpen), int64(0)}}}
+	b := newTestBreaker(exec, 5)
+
+	dec, ticket, err := b.Acquire(context.Background(), breakerRule, "d1", time.UnixMilli(1000))
+	if err != nil || !dec.Allowed || !ticket.probe {
+		t.Fatalf("expected probe admission: %+v %+v %v", dec, ticket, err)
+	}
+	if exec.calls[0][8] != 1 {
+		t.Fatalf("probe flag not sent: %v", exec.calls[0])
+	}
+
+	b.Record(context.Background(), breakerRule, "d1", time.UnixMilli(1000), ticket, true)
+	if len(exec.calls) != 2 || exec.calls[1][0] != "record" || exec.calls[1][9] != 1 {
+		t.Fatalf("probe outcome not recorded: %v", exec.calls)
+	}
+}
+
+func TestBreakerRecordSkipsClosedAllow(t *testing.T) {
+	exec := &fakeEvaler{}
+	b := newTestBreaker(exec, 50)
+
+	b.Record(context.Background(), breakerRule, "d1", time.Now(), breakerTicket{state: StateClosed}, true)
+	if len(exec.calls) != 0 {
+		t.Fatalf("expected no redis call, got %d", len(exec.calls))
+	}
+	b.Record(context.Background(), breakerRule, "d1", time.Now(), breakerTicket{state: StateClosed}, false)
+	if len(exec.calls) != 1 {
+		t.Fatalf("expected deny to be recorded, got %d calls", len(exec.calls))
+	}
+}
+
+type countingLimiter struct {
+	calls int
+	cost  int64
+}
+
+func (c *countingLimiter) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	c.calls++
+	c.cost = cost
+	return types.Decision{Allowed: true, Reason: "allowed"}, nil
+}
+
+func TestAllowRules_BreakerOpenSkipsLimiter(t *testing.T) {
+	lim := &countingLimiter{}
+	engine := NewEngine(newTestRepo(), lim, "fail-closed")
+	engine.breaker = newTestBreaker(&fakeEvaler{results: [][]interface{}{{int64(0), int64(StateOpen), int64(100)}}}, 50)
+
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{breakerRule}, map[string]string{"route": "/api"}, 1, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "breaker_open" || dec.RuleID != "r1" {
+		t.Fatalf("unexpected decision: %+v", dec)
+	}
+	if lim.calls != 0 {
+		t.Fatalf("limiter should not run while breaker is open")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"math"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,18 +17,33 @@ import (
 	"github.com/nanjiek/pixiu-rls/internal/util"
 )
 
-// Limiter defines the limiter interface used by the engine.
+// Limiter defines the limiter interface used by the engine. cost is the
+// number of units the request consumes.
 type Limiter interface {
-	Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error)
+	Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error)
+}
+
+// quotaChecker is satisfied by *Quota; it is an interface so tests can stub it.
+type quotaChecker interface {
+	CheckAndIncr(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) types.Decision
+	Refund(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) error
 }
 
 // Engine evaluates rules and applies limiter with fail policy.
 type Engine struct {
 	repo       *repo.RedisRepo
 	ipCache    *IPListCache
+	quota      quotaChecker
+	breaker    *Breaker
+	batch      batchEvaler
 	limiter    Limiter
+	fallback   Limiter // evaluates rules locally when limiter fails
+	hook       Hook    // optional observer, see SetHook
+	auditor    Auditor // optional decision log, see SetAuditor
 	failPolicy string
 	logger     *slog.Logger
+
+	quotaSkipped sync.Map // rule IDs whose unenforced quota was logged
 }
 
 // NewEngine constructs an engine with the limiter and fail policy.
@@ -36,31 +53,60 @@ func NewEngine(rdb *repo.RedisRepo, limiter Limiter, failPolicy string) *Engine
 	}
 	logger := slog.Default()
 	var ipCache *IPListCache
-	if rdb != nil {
+	var quota quotaChecker
+	var breaker *Breaker
+	var batch batchEvaler
+	// Without a Redis client (local-only mode) there are no IP lists,
+	// breakers, quotas or batch scripts.
+	if rdb != nil && rdb.Cli != nil {
 		ipCache = NewIPListCache(rdb, "", logger)
+		breaker = NewBreaker(rdb, logger)
+		quota = NewQuota(rdb, logger)
+		batch = rdb
 	}
 	return &Engine{
 		repo:       rdb,
 		ipCache:    ipCache,
+		quota:      quota,
+		breaker:    breaker,
+		batch:      batch,
 		limiter:    limiter,
 		failPolicy: normalizeFailPolicy(failPolicy),
 		logger:     logger,
 	}
 }
 
+// SetFallback makes the engine evaluate a rule with fallback, typically a
+// limiter.Local, when the primary limiter fails instead of applying the fail
+// policy. Call it before serving requests.
+func (e *Engine) SetFallback(fallback Limiter) {
+	e.fallback = fallback
+}
+
 // Allow evaluates a single rule (kept for compatibility).
-func (e *Engine) Allow(ctx context.Context, rule config.Rule, dims map[string]string, now time.Time) (types.Decision, error) {
-	return e.AllowRules(ctx, []config.Rule{rule}, dims, now)
+func (e *Engine) Allow(ctx context.Context, rule config.Rule, dims map[string]string, cost int64, now time.Time) (types.Decision, error) {
+	return e.AllowRules(ctx, []config.Rule{rule}, dims, cost, now)
 }
 
 // AllowRules evaluates multiple rules in order and applies fail policy.
-func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[string]string, now time.Time) (types.Decision, error) {
+// Every rule, and its quota, is charged cost units (<=0 means 1).
+func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[string]string, cost int64, now time.Time) (types.Decision, error) {
+	start := time.Now()
+	dec, err := e.allowRules(ctx, rules, dims, cost, now)
+	e.observe("allow", start, rules, dims, dec, now)
+	return dec, err
+}
+
+func (e *Engine) allowRules(ctx context.Context, rules []config.Rule, dims map[string]string, cost int64, now time.Time) (types.Decision, error) {
 	if len(rules) == 0 {
 		return types.Decision{Allowed: true, Reason: "no_rules"}, nil
 	}
 	if dims == nil {
 		dims = map[string]string{}
 	}
+	if cost <= 0 {
+		cost = 1
+	}
 
 	anyError := false
 	ipDecision, handled, err := e.checkIPLists(ctx, dims)
@@ -81,7 +127,7 @@ func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[s
 
 	anyRule := false
 	minRemainingSet := false
-	var minRemaining int64
+	var minRemaining, resetAtMs int64
 
 	for _, rule := range rules {
 		if !rule.Enabled {
@@ -95,7 +141,11 @@ func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[s
 		}
 
 		anyRule = true
-		dec, err := e.allowRule(ctx, rule, dims, now)
+		if IsShadow(rule) {
+			e.allowShadow(ctx, rule, dims, cost, now)
+			continue
+		}
+		dec, err := e.allowRule(ctx, rule, dims, cost, now)
 		if err != nil {
 			anyError = true
 			if e.failPolicy == "fail-open" {
@@ -105,16 +155,19 @@ func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[s
 			return types.Decision{
 				Allowed: false,
 				Reason:  "fail_closed",
+				RuleID:  rule.RuleID,
 				Err:     err,
 			}, nil
 		}
 
 		if !dec.Allowed {
+			dec.RuleID = rule.RuleID
 			return dec, nil
 		}
 		if dec.Remaining >= 0 {
 			if !minRemainingSet || dec.Remaining < minRemaining {
 				minRemaining = dec.Remaining
+				resetAtMs = dec.ResetAtMs
 				minRemainingSet = true
 			}
 		}
@@ -130,6 +183,7 @@ func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[s
 	}
 	if minRemainingSet {
 		out.Remaining = minRemaining
+		out.ResetAtMs = resetAtMs
 	}
 	if anyError && e.failPolicy == "fail-open" {
 		out.Reason = "fail_open"
@@ -137,7 +191,10 @@ func (e *Engine) AllowRules(ctx context.Context, rules []config.Rule, dims map[s
 	return out, nil
 }
 
-func (e *Engine) allowRule(ctx context.Context, rule config.Rule, dims map[string]string, now time.Time) (types.Decision, error) {
+func (e *Engine) allowRule(ctx context.Context, rule config.Rule, dims map[string]string, cost int64, now time.Time) (types.Decision, error) {
+	if RequiresLease(rule) {
+		return types.Decision{Allowed: false, Reason: "lease_required"}, nil
+	}
 	if e.repo == nil {
 		err := errors.New("repo is nil")
 		return types.Decision{Allowed: false, Reason: "repo_unavailable", Err: err}, err
@@ -148,35 +205,174 @@ func (e *Engine) allowRule(ctx context.Context, rule config.Rule, dims map[strin
 		return types.Decision{Allowed: false, Reason: "dim_hash_failed", Err: err}, err
 	}
 
-	algo := normalizeAlgo(rule.Algo)
-	var key string
-	switch algo {
+	key, err := e.limiterKey(rule, dimKey)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "unsupported_algorithm", Err: err}, err
+	}
+
+	// Quotas are taken before the limiter: they can be refunded and limiter
+	// tokens cannot, so a request denied by either consumes nothing.
+	quotaTaken := false
+	quotaLeft := int64(math.MaxInt64)
+	if e.enforcesQuota(rule) {
+		qd, err := e.checkQuota(ctx, rule, dimKey, cost, now, types.Decision{Allowed: true, Remaining: quotaLeft})
+		switch {
+		case err != nil && e.fallback != nil:
+			// Redis is failing; quotas live there too, let the limiter degrade
+		case err != nil:
+			return qd, err
+		case !qd.Allowed:
+			e.recordDeny(ctx, rule, dims)
+			return qd, nil
+		default:
+			quotaTaken, quotaLeft = true, qd.Remaining
+		}
+	}
+	refund := func() {
+		if quotaTaken {
+			e.refundQuota(ctx, rule, dimKey, cost, now)
+		}
+	}
+
+	var ticket breakerTicket
+	useBreaker := rule.Breaker.Enabled && e.breaker != nil
+	if useBreaker {
+		bd, t, err := e.breaker.Acquire(ctx, rule, dimKey, now)
+		switch {
+		case err != nil && e.fallback != nil:
+			useBreaker = false // Redis is failing; let the limiter degrade
+		case err != nil:
+			refund()
+			return bd, err
+		case !bd.Allowed:
+			refund()
+			return bd, nil
+		}
+		ticket = t
+	}
+
+	degraded := false
+	dec, err := e.allowLimiter(ctx, rule, key, cost, now)
+	if err != nil {
+		ldec, ok := e.degrade(ctx, rule, key, cost, now, err)
+		if !ok {
+			refund()
+			if dec.Reason == "" {
+				dec.Reason = "limiter_failed"
+			}
+			dec.Err = err
+			return dec, err
+		}
+		// breaker state lives in Redis too; the local decision stands alone
+		dec, degraded = ldec, true
+	}
+	if useBreaker && !degraded {
+		e.breaker.Record(ctx, rule, dimKey, now, ticket, dec.Allowed)
+	}
+	if !dec.Allowed {
+		refund()
+		e.recordDeny(ctx, rule, dims)
+		return dec, nil
+	}
+	if quotaLeft < dec.Remaining {
+		dec.Remaining = quotaLeft
+	}
+	return dec, nil
+}
+
+// recordDeny feeds a non-shadow deny to the hot-IP tracker.
+func (e *Engine) recordDeny(ctx context.Context, rule config.Rule, dims map[string]string) {
+	if e.ipCache == nil || IsShadow(rule) {
+		return
+	}
+	if ip := strings.TrimSpace(dims["ip"]); ip != "" {
+		e.ipCache.RecordDeny(ctx, ip)
+	}
+}
+
+// refundQuota gives back quota taken for a request that was denied later.
+func (e *Engine) refundQuota(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) {
+	if err := e.quota.Refund(ctx, rule, dimKey, cost, now); err != nil {
+		e.logger.Warn("quota refund failed", "rule_id", rule.RuleID, "err", err)
+	}
+}
+
+// degrade evaluates rule on the fallback limiter after the primary limiter
+// failed with err. It reports false when there is no fallback or it failed
+// too, leaving the fail policy to the caller.
+func (e *Engine) degrade(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time, err error) (types.Decision, bool) {
+	if e.fallback == nil {
+		return types.Decision{}, false
+	}
+	dec, ferr := e.fallback.Allow(ctx, rule, key, cost, now)
+	if ferr != nil {
+		e.logger.Warn("local fallback failed", "rule_id", rule.RuleID, "err", ferr)
+		return types.Decision{}, false
+	}
+	e.logger.Warn("limiter degraded to local fallback", "rule_id", rule.RuleID, "err", err)
+	return dec, true
+}
+
+// limiterKey returns the Redis key holding the limiter state of rule for dimKey.
+func (e *Engine) limiterKey(rule config.Rule, dimKey string) (string, error) {
+	switch algo := normalizeAlgo(rule.Algo); algo {
 	case "token_bucket":
-		key = e.repo.KeyTB(rule.RuleID, dimKey)
+		return e.repo.KeyTB(rule.RuleID, dimKey), nil
 	case "sliding_window":
-		key = e.repo.KeySW(rule.RuleID, dimKey)
+		return e.repo.KeySW(rule.RuleID, dimKey), nil
 	case "leaky_bucket":
-		key = e.repo.KeyLB(rule.RuleID, dimKey)
+		return e.repo.KeyLB(rule.RuleID, dimKey), nil
+	case "gcra":
+		return e.repo.KeyGCRA(rule.RuleID, dimKey), nil
+	case "sliding_window_counter":
+		return e.repo.KeySWC(rule.RuleID, dimKey), nil
+	case "concurrency":
+		return e.repo.KeyCC(rule.RuleID, dimKey), nil
 	default:
-		err = errors.New("unsupported algorithm: " + algo)
-		return types.Decision{Allowed: false, Reason: "unsupported_algorithm", Err: err}, err
+		return "", errors.New("unsupported algorithm: " + algo)
 	}
+}
 
-	dec, err := e.limiter.Allow(ctx, rule, key, now)
-	if err != nil {
-		if dec.Reason == "" {
-			dec.Reason = "limiter_failed"
-		}
-		dec.Err = err
-		return dec, err
+// checkQuota consumes the rule's minute/hour/day quotas and lowers
+// dec.Remaining to what the quotas have left. Quota exhaustion is a deny; any other quota failure
+// (Redis error, breaker open) is returned as an error so the fail policy applies.
+func (e *Engine) checkQuota(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time, dec types.Decision) (types.Decision, error) {
+	if !e.enforcesQuota(rule) {
+		return dec, nil
 	}
-	if !dec.Allowed && e.ipCache != nil {
-		ip := strings.TrimSpace(dims["ip"])
-		if ip != "" {
-			e.ipCache.RecordDeny(ctx, ip)
+
+	qd := e.quota.CheckAndIncr(ctx, rule, dimKey, cost, now)
+	if qd.Allowed {
+		if qd.Remaining < dec.Remaining {
+			dec.Remaining = qd.Remaining
 		}
+		return dec, nil
 	}
-	return dec, nil
+	if strings.HasPrefix(qd.Reason, "quota_exceeded") {
+		return qd, nil
+	}
+	err := qd.Err
+	if err == nil {
+		err = errors.New("quota check failed: " + qd.Reason)
+	}
+	qd.Err = err
+	return qd, err
+}
+
+// enforcesQuota reports whether rule has a quota the engine can count. Without
+// Redis (local-only mode) there is nowhere to keep quota counters: the quota
+// is skipped and a warning is logged once per rule.
+func (e *Engine) enforcesQuota(rule config.Rule) bool {
+	if !HasQuota(rule.Quota) {
+		return false
+	}
+	if e.quota != nil {
+		return true
+	}
+	if _, logged := e.quotaSkipped.LoadOrStore(rule.RuleID, true); !logged {
+		e.logger.Warn("quota not enforced without redis", "rule_id", rule.RuleID)
+	}
+	return false
 }
 
 func (e *Engine) checkIPLists(ctx context.Context, dims map[string]string) (types.Decision, bool, error) {
@@ -190,6 +386,9 @@ func (e *Engine) checkIPLists(ctx context.Context, dims map[string]string) (type
 	if e.repo == nil {
 		return types.Decision{}, false, errors.New("repo is nil")
 	}
+	if e.repo.Cli == nil {
+		return types.Decision{}, false, nil // local-only mode: no IP lists
+	}
 
 	inBlack, err := e.repo.IsInSet(ctx, e.repo.KeyBlacklistIP(), ip)
 	if err != nil {
@@ -1,8 +1,11 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,7 +22,7 @@ type mockLimiter struct {
 	err       error
 }
 
-func (m *mockLimiter) Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error) {
+func (m *mockLimiter) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
 	if m.err != nil {
 		return types.Decision{Allowed: false, Reason: "mock_error"}, m.err
 	}
@@ -39,7 +42,7 @@ func TestNewEngine_DefaultFailPolicy(t *testing.T) {
 
 func TestAllowRules_NoRules(t *testing.T) {
 	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true}, "fail-closed")
-	dec, err := engine.AllowRules(context.Background(), nil, map[string]string{"route": "/api"}, time.Now())
+	dec, err := engine.AllowRules(context.Background(), nil, map[string]string{"route": "/api"}, 1, time.Now())
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
@@ -51,7 +54,7 @@ func TestAllowRules_NoRules(t *testing.T) {
 func TestAllowRules_SingleDisabledRule(t *testing.T) {
 	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true}, "fail-closed")
 	rule := config.Rule{RuleID: "r1", Enabled: false}
-	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, time.Now())
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
 	if err == nil {
 		t.Fatalf("expected error for disabled rule")
 	}
@@ -63,7 +66,7 @@ func TestAllowRules_SingleDisabledRule(t *testing.T) {
 func TestAllowRules_FailClosedOnLimiterError(t *testing.T) {
 	engine := NewEngine(newTestRepo(), &mockLimiter{err: errors.New("boom")}, "fail-closed")
 	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 1}
-	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, time.Now())
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
@@ -75,7 +78,7 @@ func TestAllowRules_FailClosedOnLimiterError(t *testing.T) {
 func TestAllowRules_FailOpenOnLimiterError(t *testing.T) {
 	engine := NewEngine(newTestRepo(), &mockLimiter{err: errors.New("boom")}, "fail-open")
 	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 1}
-	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, time.Now())
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
@@ -92,7 +95,7 @@ func TestAllowRules_DenyWins(t *testing.T) {
 	}
 
 	dims := map[string]string{"route": "/api"}
-	dec, err := engine.AllowRules(context.Background(), rules, dims, time.Now())
+	dec, err := engine.AllowRules(context.Background(), rules, dims, 1, time.Now())
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
@@ -102,7 +105,7 @@ func TestAllowRules_DenyWins(t *testing.T) {
 
 	denyLimiter := &mockLimiter{allowed: false, remaining: 0}
 	engine = NewEngine(newTestRepo(), denyLimiter, "fail-closed")
-	dec, err = engine.AllowRules(context.Background(), rules, dims, time.Now())
+	dec, err = engine.AllowRules(context.Background(), rules, dims, 1, time.Now())
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
@@ -110,3 +113,318 @@ func TestAllowRules_DenyWins(t *testing.T) {
 		t.Fatalf("expected deny, got: %+v", dec)
 	}
 }
+
+type ruleDenyLimiter struct {
+	deny string
+	keys []string
+}
+
+func (m *ruleDenyLimiter) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	m.keys = append(m.keys, key)
+	if rule.RuleID == m.deny {
+		return types.Decision{Allowed: false, Reason: "rate_limited"}, nil
+	}
+	return types.Decision{Allowed: true, Remaining: 5, Reason: "allowed"}, nil
+}
+
+func TestAllowRules_ReportsDenyingRule(t *testing.T) {
+	engine := NewEngine(newTestRepo(), &ruleDenyLimiter{deny: "r2"}, "fail-closed")
+	rules := []config.Rule{
+		{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10},
+		{RuleID: "r2", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10},
+	}
+
+	dec, err := engine.AllowRules(context.Background(), rules, map[string]string{"route": "/api"}, 1, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.RuleID != "r2" {
+		t.Fatalf("unexpected decision: %+v", dec)
+	}
+}
+
+type stubQuota struct {
+	dec     types.Decision
+	calls   int
+	refunds int
+	cost    int64
+}
+
+func (s *stubQuota) CheckAndIncr(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) types.Decision {
+	s.calls++
+	s.cost = cost
+	return s.dec
+}
+
+func (s *stubQuota) Refund(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) error {
+	s.refunds++
+	return nil
+}
+
+func TestAllowRules_QuotaExceededDenies(t *testing.T) {
+	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true, remaining: 5}, "fail-open")
+	quota := &stubQuota{dec: types.Decision{Allowed: false, Reason: "quota_exceeded:minute", RetryAfterMs: 30000}}
+	engine.quota = quota
+
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+		Quota: config.QuotaCfg{PerMinute: 100}}
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "quota_exceeded:minute" || dec.RetryAfterMs != 30000 || dec.RuleID != "r1" {
+		t.Fatalf("unexpected decision: %+v", dec)
+	}
+}
+
+func TestAllowRules_QuotaDenyConsumesNoTokens(t *testing.T) {
+	lim := &countingLimiter{}
+	engine := NewEngine(newTestRepo(), lim, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: false, Reason: "quota_exceeded:minute"}}
+	engine.quota = quota
+
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+		Quota: config.QuotaCfg{PerMinute: 100}}
+	dims := map[string]string{"route": "/api"}
+	dec, _ := engine.AllowRules(context.Background(), []config.Rule{rule}, dims, 1, time.Now())
+	if dec.Allowed || lim.calls != 0 {
+		t.Fatalf("a quota deny must not reach the limiter: %+v calls=%d", dec, lim.calls)
+	}
+
+	quota.dec = types.Decision{Allowed: true, Reason: "quota_ok", Remaining: 3}
+	dec, _ = engine.AllowRules(context.Background(), []config.Rule{rule}, dims, 1, time.Now())
+	if !dec.Allowed || lim.calls != 1 || quota.refunds != 0 {
+		t.Fatalf("expected the limiter to admit once the quota allows: %+v calls=%d refunds=%d", dec, lim.calls, quota.refunds)
+	}
+}
+
+func TestAllowRules_LimiterDenyRefundsQuota(t *testing.T) {
+	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: false}, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: true, Reason: "quota_ok", Remaining: 3}}
+	engine.quota = quota
+
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+		Quota: config.QuotaCfg{PerMinute: 100}}
+	dec, _ := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
+	if dec.Allowed || quota.calls != 1 || quota.refunds != 1 {
+		t.Fatalf("expected the quota to be refunded: %+v calls=%d refunds=%d", dec, quota.calls, quota.refunds)
+	}
+}
+
+func TestAllowRules_QuotaSkippedWhenUnset(t *testing.T) {
+	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true, remaining: 5}, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: false, Reason: "quota_exceeded:day"}}
+	engine.quota = quota
+
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10}
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !dec.Allowed || quota.calls != 0 {
+		t.Fatalf("unexpected decision: %+v (calls=%d)", dec, quota.calls)
+	}
+}
+
+func TestAllowRules_QuotaRemainingAndFailPolicy(t *testing.T) {
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+		Quota: config.QuotaCfg{PerHour: 100}}
+	dims := map[string]string{"route": "/api"}
+
+	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true, remaining: 5}, "fail-closed")
+	engine.quota = &stubQuota{dec: types.Decision{Allowed: true, Reason: "quota_ok", Remaining: 2}}
+	dec, _ := engine.AllowRules(context.Background(), []config.Rule{rule}, dims, 1, time.Now())
+	if !dec.Allowed || dec.Remaining != 2 {
+		t.Fatalf("expected quota remaining to win: %+v", dec)
+	}
+
+	engine.quota = &stubQuota{dec: types.Decision{Allowed: false, Reason: "redis_error", Err: errors.New("boom")}}
+	dec, _ = engine.AllowRules(context.Background(), []config.Rule{rule}, dims, 1, time.Now())
+	if dec.Allowed || dec.Reason != "fail_closed" {
+		t.Fatalf("expected fail_closed on quota error: %+v", dec)
+	}
+}
+
+func TestAllowRules_QuotaSkippedWithoutRedis(t *testing.T) {
+	// built like the local-only engine of cmd/rls-http: no Redis client
+	engine := NewEngine(newTestRepo(), &mockLimiter{allowed: true, remaining: 5}, "fail-closed")
+	var buf bytes.Buffer
+	engine.logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+	rule := config.Rule{RuleID: "login", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+		Quota: config.QuotaCfg{PerDay: 1}}
+	dims := map[string]string{"route": "/login"}
+	for i := 0; i < 3; i++ {
+		dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, dims, 1, time.Now())
+		if err != nil || !dec.Allowed || dec.Remaining != 5 {
+			t.Fatalf("request %d: the limiter alone should decide: %+v, %v", i, dec, err)
+		}
+	}
+	decs, _ := engine.AllowBatch(context.Background(), []BatchItem{{Rule: rule, Dims: dims}}, false, time.Now())
+	if !decs[0].Allowed {
+		t.Fatalf("batch item: the limiter alone should decide: %+v", decs[0])
+	}
+	if n := strings.Count(buf.String(), "quota not enforced"); n != 1 {
+		t.Fatalf("logged %d warnings, want 1:\n%s", n, buf.String())
+	}
+}
+
+func TestAllowRules_CostReachesLimiterAndQuota(t *testing.T) {
+	lim := &countingLimiter{}
+	engine := NewEngine(newTestRepo(), lim, "fail-closed")
+	quota := &stubQuota{dec: types.Decision{Allowed: true, Reason: "quota_ok", Remaining: 10}}
+	engine.quota = quota
+
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10,
+		Quota: config.QuotaCfg{PerDay: 100}}
+	if _, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 4, time.Now()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if lim.cost != 4 || quota.cost != 4 {
+		t.Fatalf("cost not propagated: limiter=%d quota=%d", lim.cost, quota.cost)
+	}
+
+	if _, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 0, time.Now()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if lim.cost != 1 || quota.cost != 1 {
+		t.Fatalf("zero cost should count as 1: limiter=%d quota=%d", lim.cost, quota.cost)
+	}
+}
+
+func TestAllowRules_LocalFallbackOnLimiterError(t *testing.T) {
+	engine := NewEngine(newTestRepo(), &mockLimiter{err: errors.New("boom")}, "fail-closed")
+	engine.SetFallback(&mockLimiter{allowed: false, remaining: 0})
+	quota := &stubQuota{dec: types.Decision{Allowed: true, Reason: "quota_ok"}}
+	engine.quota = quota
+
+	rule := config.Rule{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 1,
+		Quota: config.QuotaCfg{PerMinute: 10}}
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "mock_decision" || dec.RuleID != "r1" {
+		t.Fatalf("expected the fallback decision, got %+v", dec)
+	}
+	if quota.calls != 1 || quota.refunds != 1 {
+		t.Fatalf("quota taken for a denied request should be refunded, calls=%d refunds=%d", quota.calls, quota.refunds)
+	}
+
+	// a failing fallback leaves the fail policy in charge
+	engine.SetFallback(&mockLimiter{err: errors.New("local")})
+	dec, _ = engine.AllowRules(context.Background(), []config.Rule{rule}, map[string]string{"route": "/api"}, 1, time.Now())
+	if dec.Allowed || dec.Reason != "fail_closed" {
+		t.Fatalf("expected fail_closed, got %+v", dec)
+	}
+}
+
+type recordingHook struct {
+	decisions []string
+	ops       []string
+	limiter   int
+	errs      int
+	lookups   []string
+}
+
+func (h *recordingHook) OnDecision(rule config.Rule, dec types.Decision) {
+	h.decisions = append(h.decisions, rule.RuleID+":"+dec.Reason)
+}
+
+func (h *recordingHook) OnEvaluate(op string, elapsed time.Duration) {
+	h.ops = append(h.ops, op)
+}
+
+func (h *recordingHook) OnLimiter(rule config.Rule, elapsed time.Duration, err error) {
+	h.limiter++
+	if err != nil {
+		h.errs++
+	}
+}
+
+func (h *recordingHook) OnIPListLookup(level string) {
+	h.lookups = append(h.lookups, level)
+}
+
+func TestAllowRules_ReportsToHook(t *testing.T) {
+	hook := &recordingHook{}
+	engine := NewEngine(newTestRepo(), &mockLimiter{err: errors.New("boom")}, "fail-open")
+	engine.SetHook(hook)
+
+	rules := []config.Rule{
+		{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 1},
+		{RuleID: "r2", Enabled: true, Algo: "gcra", WindowMs: 1000, Limit: 1},
+	}
+	if _, err := engine.AllowRules(context.Background(), rules, map[string]string{"route": "/api"}, 1, time.Now()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := engine.AllowRules(context.Background(), rules[:1], map[string]string{"route": "/api"}, 1, time.Now()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(hook.decisions) != 2 || hook.decisions[0] != ":fail_open" || hook.decisions[1] != "r1:fail_open" {
+		t.Fatalf("unexpected decisions: %v", hook.decisions)
+	}
+	if len(hook.ops) != 2 || hook.ops[0] != "allow" || hook.limiter != 3 || hook.errs != 3 {
+		t.Fatalf("unexpected hook calls: ops=%v limiter=%d errs=%d", hook.ops, hook.limiter, hook.errs)
+	}
+}
+
+type recordingAuditor struct {
+	rules   []string
+	reasons []string
+	dims    []map[string]string
+}
+
+func (a *recordingAuditor) Record(rule config.Rule, dims map[string]string, dec types.Decision, now time.Time) {
+	a.rules = append(a.rules, rule.RuleID)
+	a.reasons = append(a.reasons, dec.Reason)
+	a.dims = append(a.dims, dims)
+}
+
+func TestAllowRules_RecordsToAuditor(t *testing.T) {
+	aud := &recordingAuditor{}
+	engine := NewEngine(newTestRepo(), &ruleDenyLimiter{deny: "r2"}, "fail-closed")
+	engine.SetAuditor(aud)
+
+	rules := []config.Rule{
+		{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10},
+		{RuleID: "r2", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10},
+	}
+	dims := map[string]string{"route": "/api"}
+	if _, err := engine.AllowRules(context.Background(), rules, dims, 1, time.Now()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(aud.rules) != 1 || aud.rules[0] != "r2" || aud.reasons[0] != "rate_limited" || aud.dims[0]["route"] != "/api" {
+		t.Fatalf("unexpected audit: rules=%v reasons=%v dims=%v", aud.rules, aud.reasons, aud.dims)
+	}
+}
+
+func TestAllowRules_ShadowRuleNeverDenies(t *testing.T) {
+	hook := &recordingHook{}
+	aud := &recordingAuditor{}
+	lim := &ruleDenyLimiter{deny: "shadow/r2"}
+	engine := NewEngine(newTestRepo(), lim, "fail-closed")
+	engine.SetHook(hook)
+	engine.SetAuditor(aud)
+
+	rules := []config.Rule{
+		{RuleID: "r1", Enabled: true, Algo: "token_bucket", WindowMs: 1000, Limit: 10},
+		{RuleID: "r2", Enabled: true, Mode: "shadow", Algo: "token_bucket", WindowMs: 1000, Limit: 10},
+	}
+	dec, err := engine.AllowRules(context.Background(), rules, map[string]string{"route": "/api"}, 1, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !dec.Allowed || dec.Reason != "allowed" {
+		t.Fatalf("shadow rule must not deny: %+v", dec)
+	}
+	if len(lim.keys) != 2 || lim.keys[1] != "test:tb:{shadow/r2}:"+lim.keys[0][len("test:tb:{r1}:"):] {
+		t.Fatalf("shadow state should live under its own key: %v", lim.keys)
+	}
+	if len(hook.decisions) != 2 || hook.decisions[0] != "r2:shadow_denied" || hook.decisions[1] != ":allowed" {
+		t.Fatalf("unexpected decisions: %v", hook.decisions)
+	}
+	if len(aud.reasons) != 2 || aud.rules[0] != "r2" || aud.reasons[0] != "shadow_denied" {
+		t.Fatalf("unexpected audit: rules=%v reasons=%v", aud.rules, aud.reasons)
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+// Hook receives engine events, e.g. to export metrics. Methods are called
+// inline on the request path and must be cheap and safe for concurrent use.
+type Hook interface {
+	// OnDecision reports the final decision of an AllowRules call, an
+	// AllowBatch item or an Acquire. rule is the rule that decided, or the
+	// zero Rule when several rules were evaluated and none denied. A shadow
+	// rule that would have denied is reported separately with reason
+	// "shadow_denied".
+	OnDecision(rule config.Rule, dec types.Decision)
+	// OnEvaluate reports the duration of one engine call; op is "allow",
+	// "batch" or "acquire".
+	OnEvaluate(op string, elapsed time.Duration)
+	// OnLimiter reports one limiter evaluation and its error, if any.
+	OnLimiter(rule config.Rule, elapsed time.Duration, err error)
+	// OnIPListLookup reports one IP list lookup answered from level "l1"
+	// (the local cache) or "l2" (Redis).
+	OnIPListLookup(level string)
+}
+
+// Auditor records decisions together with the request dims, e.g. to a Redis
+// stream. Record is called on the request path and must not block; dims must
+// not be retained after it returns.
+type Auditor interface {
+	Record(rule config.Rule, dims map[string]string, dec types.Decision, now time.Time)
+}
+
+// SetAuditor installs a on the engine. Call it before serving requests.
+func (e *Engine) SetAuditor(a Auditor) {
+	e.auditor = a
+}
+
+// SetHook installs h on the engine and its IP list cache. Call it before
+// serving requests.
+func (e *Engine) SetHook(h Hook) {
+	e.hook = h
+	if e.ipCache != nil {
+		e.ipCache.hook = h
+	}
+}
+
+func (e *Engine) observe(op string, start time.Time, rules []config.Rule, dims map[string]string, dec types.Decision, now time.Time) {
+	if e.hook == nil && e.auditor == nil {
+		return
+	}
+	rule := decidingRule(rules, dec)
+	if e.auditor != nil {
+		e.auditor.Record(rule, dims, dec, now)
+	}
+	if e.hook != nil {
+		e.hook.OnDecision(rule, dec)
+		e.hook.OnEvaluate(op, time.Since(start))
+	}
+}
+
+// allowLimiter runs the limiter and reports it to the hook.
+func (e *Engine) allowLimiter(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	if e.hook == nil {
+		return e.limiter.Allow(ctx, rule, key, cost, now)
+	}
+	start := time.Now()
+	dec, err := e.limiter.Allow(ctx, rule, key, cost, now)
+	e.hook.OnLimiter(rule, time.Since(start), err)
+	return dec, err
+}
+
+// decidingRule returns the rule named by dec, or the only rule evaluated.
+func decidingRule(rules []config.Rule, dec types.Decision) config.Rule {
+	if dec.RuleID == "" {
+		if len(rules) == 1 {
+			return rules[0]
+		}
+		return config.Rule{}
+	}
+	for _, r := range rules {
+		if r.RuleID == dec.RuleID {
+			return r
+		}
+	}
+	return config.Rule{RuleID: dec.RuleID}
+}
@@ -3,22 +3,50 @@ package core
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 import (
+	"github.com/nanjiek/pixiu-rls/internal/identity"
+	"github.com/nanjiek/pixiu-rls/internal/rcu"
 	"github.com/nanjiek/pixiu-rls/internal/repo"
 	"github.com/nanjiek/pixiu-rls/internal/types"
 )
 
+// defaultListRefresh re-reads the black and white lists even without an
+// update message, in case one was lost while the subscription reconnected.
+const defaultListRefresh = time.Minute
+
+// defaultTempMissTTL caches "not temporarily blacklisted" per IP. New entries
+// reach every replica as update events right away; the TTL only bounds how
+// long a lost event goes unnoticed.
+const defaultTempMissTTL = time.Second
+
+// tempBlockEvent prefixes the update message announcing a new temporary
+// blacklist entry: "black_tmp <ip> <ttl_ms>". Any other message on the
+// channel means the black or white list changed.
+const tempBlockEvent = "black_tmp"
+
 type cacheEntry struct {
 	value     bool
 	expiresAt int64
 }
 
-// IPListCache provides a two-level cache for blacklist/whitelist checks.
+// ipLists is an immutable view of the black and white lists.
+type ipLists struct {
+	black, white *prefixTrie
+}
+
+// IPListCache answers blacklist/whitelist checks. The lists hold IPs or
+// CIDRs and are kept in memory as prefix tries, rebuilt from Redis on every
+// list update message and swapped atomically. Temporary blacklist entries
+// are per IP and go through a two-level cache in front of Redis; replicas
+// learn about new ones from update events without asking Redis.
 type IPListCache struct {
 	repo          *repo.RedisRepo
 	localCache    sync.Map
@@ -27,12 +55,17 @@ type IPListCache struct {
 	hotThreshold  int64
 	hotWindow     time.Duration
 	blacklistTTL  time.Duration
+	tempMissTTL   time.Duration
 	updateChannel string
 	logger        *slog.Logger
 	cancel        context.CancelFunc
+	hook          Hook // set by Engine.SetHook
+	lists         *rcu.Snapshot[ipLists]
+	listRefresh   time.Duration
+	refreshMu     sync.Mutex
 
 	isTempBlacklisted func(ctx context.Context, ip string) (bool, error)
-	isInSet           func(ctx context.Context, setKey, member string) (bool, error)
+	setMembers        func(ctx context.Context, setKey string) ([]string, error)
 	incrAndExpire     func(ctx context.Context, key string, ttl time.Duration) (int64, error)
 	setTempBlacklist  func(ctx context.Context, ip string, ttl time.Duration) error
 	publish           func(ctx context.Context, channel, msg string) error
@@ -53,11 +86,14 @@ func NewIPListCache(r *repo.RedisRepo, updateChan string, logger *slog.Logger) *
 		hotThreshold:  10,
 		hotWindow:     time.Minute,
 		blacklistTTL:  10 * time.Minute,
+		tempMissTTL:   defaultTempMissTTL,
+		lists:         rcu.NewSnapshot[ipLists](nil),
+		listRefresh:   defaultListRefresh,
 		logger:        logger,
 	}
 	if r != nil {
 		c.isTempBlacklisted = r.IsTempBlacklisted
-		c.isInSet = r.IsInSet
+		c.setMembers = r.SetMembers
 		c.incrAndExpire = r.IncrAndExpire
 		c.setTempBlacklist = r.SetTempBlacklistIP
 		if r.Cli != nil {
@@ -66,6 +102,11 @@ func NewIPListCache(r *repo.RedisRepo, updateChan string, logger *slog.Logger) *
 			}
 		}
 	}
+	if r != nil && r.Cli != nil {
+		if err := c.Refresh(context.Background()); err != nil {
+			c.logger.Error("initial ip list load failed", "err", err)
+		}
+	}
 	if r != nil && r.Cli != nil && updateChan != "" {
 		ctx, cancel := context.WithCancel(context.Background())
 		c.cancel = cancel
@@ -74,8 +115,53 @@ func NewIPListCache(r *repo.RedisRepo, updateChan string, logger *slog.Logger) *
 	return c
 }
 
-// CheckIP checks blacklist/whitelist with L1 cache and Redis as source of truth.
-// Safety-first: any Redis error results in deny.
+// Refresh rebuilds the in-memory black and white lists from Redis. On error
+// the lists already loaded stay in use.
+func (c *IPListCache) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	return c.refreshLocked(ctx)
+}
+
+func (c *IPListCache) refreshLocked(ctx context.Context) error {
+	if c.repo == nil || c.setMembers == nil {
+		return errors.New("redis accessors not set")
+	}
+	black, err := c.loadList(ctx, c.repo.KeyBlacklistIP())
+	if err != nil {
+		return err
+	}
+	white, err := c.loadList(ctx, c.repo.KeyWhitelistIP())
+	if err != nil {
+		return err
+	}
+	c.lists.Replace(&ipLists{black: black, white: white})
+	return nil
+}
+
+// loadList reads a set of IPs and CIDRs into a trie. Entries that are
+// neither are logged and skipped.
+func (c *IPListCache) loadList(ctx context.Context, key string) (*prefixTrie, error) {
+	members, err := c.setMembers(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", key, err)
+	}
+	t := &prefixTrie{}
+	for _, m := range members {
+		p, err := identity.ParsePrefix(m)
+		if err != nil {
+			c.logger.Warn("skipping invalid ip list entry", "key", key, "entry", m)
+			continue
+		}
+		t.insert(p)
+	}
+	return t, nil
+}
+
+// CheckIP checks the temporary blacklist (L1 cache, then Redis) and the
+// black/white lists in memory. Each lookup is reported once: as "l2" if it
+// had to ask Redis, otherwise as "l1". Safety-first: any Redis error, or
+// lists that could not be loaded yet, result in deny.
 func (c *IPListCache) CheckIP(ctx context.Context, ip string) (types.Decision, bool, error) {
 	if ip == "" {
 		return types.Decision{}, false, nil
@@ -85,55 +171,58 @@ func (c *IPListCache) CheckIP(ctx context.Context, ip string) (types.Decision, b
 		c.logger.Error("ip list repo is nil", "err", err)
 		return types.Decision{Allowed: false, Reason: "iplist_repo_nil", Err: err}, true, nil
 	}
-	if c.isTempBlacklisted == nil || c.isInSet == nil {
+	if c.isTempBlacklisted == nil || c.setMembers == nil {
 		err := errors.New("redis accessors not set")
 		c.logger.Error("ip list redis accessors not set", "err", err)
 		return types.Decision{Allowed: false, Reason: "iplist_redis_nil", Err: err}, true, nil
 	}
 
+	level := "l1"
+	defer func() { c.observe(level) }()
+
 	tempKey := ip + ":black_tmp"
-	if val, ok := c.get(tempKey); ok && val {
-		return types.Decision{Allowed: false, Reason: "ip_in_temp_blacklist_l1"}, true, nil
-	}
-	inTemp, err := c.isTempBlacklisted(ctx, ip)
-	if err != nil {
-		c.logger.Error("temp blacklist check failed", "err", err)
-		return types.Decision{Allowed: false, Reason: "temp_blacklist_check_failed", Err: err}, true, nil
+	inTemp, cached := c.get(tempKey)
+	if !cached {
+		level = "l2"
+		var err error
+		if inTemp, err = c.isTempBlacklisted(ctx, ip); err != nil {
+			c.logger.Error("temp blacklist check failed", "err", err)
+			return types.Decision{Allowed: false, Reason: "temp_blacklist_check_failed", Err: err}, true, nil
+		}
+		if inTemp {
+			c.setWithTTL(tempKey, true, c.blacklistTTL)
+		} else {
+			c.setWithTTL(tempKey, false, c.tempMissTTL)
+		}
 	}
 	if inTemp {
-		c.setWithTTL(tempKey, true, c.blacklistTTL)
-		return types.Decision{Allowed: false, Reason: "ip_in_temp_blacklist_l2"}, true, nil
+		return types.Decision{Allowed: false, Reason: "ip_in_temp_blacklist_" + level}, true, nil
 	}
 
-	blackKey := ip + ":black"
-	if val, ok := c.get(blackKey); ok && val {
-		return types.Decision{Allowed: false, Reason: "ip_in_blacklist_l1"}, true, nil
+	lists := c.lists.Load()
+	if lists == nil {
+		// not loaded yet (Redis was down at start): one request retries the
+		// load, the others are denied meanwhile
+		err := errors.New("ip lists not loaded")
+		if c.refreshMu.TryLock() {
+			level = "l2"
+			err = c.refreshLocked(ctx)
+			c.refreshMu.Unlock()
+		}
+		if lists = c.lists.Load(); lists == nil {
+			c.logger.Error("ip list load failed", "err", err)
+			return types.Decision{Allowed: false, Reason: "iplist_load_failed", Err: err}, true, nil
+		}
 	}
-	inBlack, err := c.isInSet(ctx, c.repo.KeyBlacklistIP(), ip)
-	if err != nil {
-		c.logger.Error("blacklist check failed", "err", err)
-		return types.Decision{Allowed: false, Reason: "blacklist_check_failed", Err: err}, true, nil
+	addr, err := identity.ParsePrefix(ip)
+	if err != nil || !addr.IsSingleIP() {
+		return types.Decision{}, false, nil
 	}
-	if inBlack {
-		c.setWithTTL(blackKey, true, c.defaultTTL)
-		return types.Decision{Allowed: false, Reason: "ip_in_blacklist_l2"}, true, nil
+	if lists.black.contains(addr.Addr()) {
+		return types.Decision{Allowed: false, Reason: "ip_in_blacklist"}, true, nil
 	}
-
-	whiteKey := ip + ":white"
-	if val, ok := c.get(whiteKey); ok {
-		if val {
-			return types.Decision{Allowed: true, Reason: "ip_in_whitelist_l1"}, true, nil
-		}
-	} else {
-		inWhite, err := c.isInSet(ctx, c.repo.KeyWhitelistIP(), ip)
-		if err != nil {
-			c.logger.Error("whitelist check failed", "err", err)
-			return types.Decision{Allowed: false, Reason: "whitelist_check_failed", Err: err}, true, nil
-		}
-		c.set(whiteKey, inWhite)
-		if inWhite {
-			return types.Decision{Allowed: true, Reason: "ip_in_whitelist_l2"}, true, nil
-		}
+	if lists.white.contains(addr.Addr()) {
+		return types.Decision{Allowed: true, Reason: "ip_in_whitelist"}, true, nil
 	}
 
 	return types.Decision{}, false, nil
@@ -173,7 +262,14 @@ func (c *IPListCache) RecordDeny(ctx context.Context, ip string) {
 		return
 	}
 	c.setWithTTL(tempKey, true, c.blacklistTTL)
-	c.publishUpdate(ctx)
+	c.publishTempBlock(ctx, ip)
+}
+
+// observe reports a lookup answered from level ("l1" or "l2") to the hook.
+func (c *IPListCache) observe(level string) {
+	if c.hook != nil {
+		c.hook.OnIPListLookup(level)
+	}
 }
 
 func (c *IPListCache) get(key string) (bool, bool) {
@@ -187,10 +283,6 @@ func (c *IPListCache) get(key string) (bool, bool) {
 	return false, false
 }
 
-func (c *IPListCache) set(key string, value bool) {
-	c.setWithTTL(key, value, c.defaultTTL)
-}
-
 func (c *IPListCache) setWithTTL(key string, value bool, ttl time.Duration) {
 	if ttl <= 0 {
 		ttl = c.defaultTTL
@@ -205,6 +297,8 @@ func (c *IPListCache) watchUpdates(ctx context.Context) {
 	sub := c.repo.Cli.Subscribe(ctx, c.updateChannel)
 	defer sub.Close()
 
+	ticker := time.NewTicker(c.listRefresh)
+	defer ticker.Stop()
 	ch := sub.Channel()
 	for {
 		select {
@@ -215,12 +309,57 @@ func (c *IPListCache) watchUpdates(ctx context.Context) {
 				c.logger.Warn("pubsub channel closed, stopping watcher")
 				return
 			}
-			c.logger.Debug("received cache invalidation", "channel", msg.Channel)
-			c.clear()
+			c.apply(ctx, msg.Payload)
+		case <-ticker.C:
+			c.refresh(ctx)
+			c.sweep(time.Now())
 		}
 	}
 }
 
+// apply handles one update message: a temporary blacklist event is cached
+// as is, anything else reloads the lists and drops the cached temp results.
+func (c *IPListCache) apply(ctx context.Context, msg string) {
+	if ip, ttl, ok := parseTempBlock(msg); ok {
+		c.setWithTTL(ip+":black_tmp", true, ttl)
+		return
+	}
+	c.logger.Debug("received ip list update", "msg", msg)
+	c.clear()
+	c.refresh(ctx)
+}
+
+// parseTempBlock parses "black_tmp <ip> <ttl_ms>".
+func parseTempBlock(msg string) (string, time.Duration, bool) {
+	f := strings.Fields(msg)
+	if len(f) != 3 || f[0] != tempBlockEvent {
+		return "", 0, false
+	}
+	ms, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil || ms <= 0 {
+		return "", 0, false
+	}
+	return f[1], time.Duration(ms) * time.Millisecond, true
+}
+
+func (c *IPListCache) refresh(ctx context.Context) {
+	if err := c.Refresh(ctx); err != nil {
+		c.logger.Warn("ip list refresh failed, keeping the loaded lists", "err", err)
+	}
+}
+
+// sweep drops expired entries. get only removes the entries it reads, and
+// the temp blacklist misses of one-off IPs are never read again.
+func (c *IPListCache) sweep(now time.Time) {
+	ns := now.UnixNano()
+	c.localCache.Range(func(key, value any) bool {
+		if value.(cacheEntry).expiresAt < ns {
+			c.localCache.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
 func (c *IPListCache) clear() {
 	c.localCache.Range(func(key, value any) bool {
 		c.localCache.Delete(key)
@@ -228,11 +367,14 @@ func (c *IPListCache) clear() {
 	})
 }
 
-func (c *IPListCache) publishUpdate(ctx context.Context) {
+// publishTempBlock tells the other replicas about a new temporary blacklist
+// entry, so they stop admitting ip without a Redis lookup.
+func (c *IPListCache) publishTempBlock(ctx context.Context, ip string) {
 	if c.publish == nil || c.updateChannel == "" {
 		return
 	}
-	if err := c.publish(ctx, c.updateChannel, "iplist_update"); err != nil {
+	msg := fmt.Sprintf("%s %s %d", tempBlockEvent, ip, c.blacklistTTL.Milliseconds())
+	if err := c.publish(ctx, c.updateChannel, msg); err != nil {
 		c.logger.Warn("ip list publish update failed", "err", err)
 	}
 }
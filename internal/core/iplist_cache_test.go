@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"testing"
 	"time"
@@ -17,8 +18,24 @@ func newDummyIPListCache() *IPListCache {
 	c.isTempBlacklisted = func(ctx context.Context, ip string) (bool, error) {
 		return false, nil
 	}
-	c.isInSet = func(ctx context.Context, setKey, member string) (bool, error) {
-		return false, nil
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		return nil, nil
+	}
+	_ = c.Refresh(context.Background())
+	return c
+}
+
+func newListIPListCache(t *testing.T, black, white []string) *IPListCache {
+	t.Helper()
+	c := newDummyIPListCache()
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		if setKey == c.repo.KeyBlacklistIP() {
+			return black, nil
+		}
+		return white, nil
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
 	}
 	return c
 }
@@ -45,12 +62,11 @@ func TestIPListCache_L1TempBlacklistHit(t *testing.T) {
 	}
 }
 
-func TestIPListCache_L1BlacklistHit(t *testing.T) {
-	c := newDummyIPListCache()
-	c.localCache.Store("1.1.1.1:black", cacheEntry{
-		value:     true,
-		expiresAt: time.Now().Add(time.Minute).UnixNano(),
-	})
+// The list hits used to carry the lookup level ("ip_in_blacklist_l1",
+// "ip_in_whitelist_l2"); the lists are answered from memory now and their
+// reasons have no suffix.
+func TestIPListCache_BlacklistHit(t *testing.T) {
+	c := newListIPListCache(t, []string{"1.1.1.1"}, nil)
 
 	dec, handled, err := c.CheckIP(context.Background(), "1.1.1.1")
 	if err != nil {
@@ -62,17 +78,13 @@ func TestIPListCache_L1BlacklistHit(t *testing.T) {
 	if dec.Allowed {
 		t.Fatalf("expected deny, got %+v", dec)
 	}
-	if dec.Reason != "ip_in_blacklist_l1" {
+	if dec.Reason != "ip_in_blacklist" {
 		t.Fatalf("unexpected reason: %s", dec.Reason)
 	}
 }
 
-func TestIPListCache_L1WhitelistHit(t *testing.T) {
-	c := newDummyIPListCache()
-	c.localCache.Store("2.2.2.2:white", cacheEntry{
-		value:     true,
-		expiresAt: time.Now().Add(time.Minute).UnixNano(),
-	})
+func TestIPListCache_WhitelistHit(t *testing.T) {
+	c := newListIPListCache(t, nil, []string{"2.2.2.2"})
 
 	dec, handled, err := c.CheckIP(context.Background(), "2.2.2.2")
 	if err != nil {
@@ -84,11 +96,113 @@ func TestIPListCache_L1WhitelistHit(t *testing.T) {
 	if !dec.Allowed {
 		t.Fatalf("expected allow, got %+v", dec)
 	}
-	if dec.Reason != "ip_in_whitelist_l1" {
+	if dec.Reason != "ip_in_whitelist" {
 		t.Fatalf("unexpected reason: %s", dec.Reason)
 	}
 }
 
+func TestIPListCache_SweepDropsExpired(t *testing.T) {
+	c := newDummyIPListCache()
+	for _, ip := range []string{"1.1.1.1", "1.1.1.2", "1.1.1.3"} {
+		if _, _, err := c.CheckIP(context.Background(), ip); err != nil {
+			t.Fatalf("%s: unexpected err: %v", ip, err)
+		}
+	}
+	c.setWithTTL("9.9.9.9:black_tmp", true, time.Hour)
+
+	c.sweep(time.Now().Add(2 * defaultTempMissTTL))
+	n := 0
+	c.localCache.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	if _, ok := c.get("9.9.9.9:black_tmp"); n != 1 || !ok {
+		t.Fatalf("expected only the live entry to remain, have %d", n)
+	}
+}
+
+func TestIPListCache_CIDRLists(t *testing.T) {
+	c := newListIPListCache(t,
+		[]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7", "not-an-ip"},
+		[]string{"10.1.0.0/16", "203.0.113.0/24"})
+
+	cases := []struct {
+		ip      string
+		handled bool
+		allowed bool
+		reason  string
+	}{
+		{"10.200.0.1", true, false, "ip_in_blacklist"},
+		{"10.1.2.3", true, false, "ip_in_blacklist"}, // blacklist wins over a whitelisted subnet
+		{"::ffff:10.0.0.1", true, false, "ip_in_blacklist"},
+		{"2001:db8:1::5", true, false, "ip_in_blacklist"},
+		{"192.0.2.7", true, false, "ip_in_blacklist"},
+		{"192.0.2.8", false, false, ""},
+		{"203.0.113.50", true, true, "ip_in_whitelist"},
+		{"2001:db9::1", false, false, ""},
+		{"user-42", false, false, ""},
+	}
+	for _, tc := range cases {
+		dec, handled, err := c.CheckIP(context.Background(), tc.ip)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", tc.ip, err)
+		}
+		if handled != tc.handled || dec.Allowed != tc.allowed || dec.Reason != tc.reason {
+			t.Errorf("%s: handled=%v decision=%+v", tc.ip, handled, dec)
+		}
+	}
+}
+
+func TestIPListCache_RefreshSwapsLists(t *testing.T) {
+	black := []string{"198.51.100.0/24"}
+	c := newListIPListCache(t, nil, nil)
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		if setKey == c.repo.KeyBlacklistIP() {
+			return black, nil
+		}
+		return nil, nil
+	}
+	if _, handled, _ := c.CheckIP(context.Background(), "198.51.100.1"); handled {
+		t.Fatal("lists must not change before a refresh")
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if dec, _, _ := c.CheckIP(context.Background(), "198.51.100.1"); dec.Reason != "ip_in_blacklist" {
+		t.Fatalf("expected the new blacklist to apply, got %+v", dec)
+	}
+
+	// a failed refresh keeps the loaded lists
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		return nil, errors.New("redis down")
+	}
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	if dec, _, _ := c.CheckIP(context.Background(), "198.51.100.1"); dec.Reason != "ip_in_blacklist" {
+		t.Fatalf("expected the previous lists to stay, got %+v", dec)
+	}
+}
+
+func TestIPListCache_NotLoadedDenies(t *testing.T) {
+	c := newDummyIPListCache()
+	c.lists.Replace(nil)
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		return nil, errors.New("redis down")
+	}
+	dec, handled, _ := c.CheckIP(context.Background(), "1.1.1.1")
+	if !handled || dec.Allowed || dec.Reason != "iplist_load_failed" {
+		t.Fatalf("expected deny while lists are not loaded, got handled=%v %+v", handled, dec)
+	}
+
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		return nil, nil
+	}
+	if _, handled, _ := c.CheckIP(context.Background(), "1.1.1.1"); handled {
+		t.Fatal("expected the lists to load on the next check")
+	}
+}
+
 func TestIPListCache_RepoNilDenies(t *testing.T) {
 	c := &IPListCache{
 		repo:       nil,
@@ -147,9 +261,9 @@ func TestIPListCache_RecordDenySetsTempBlacklist(t *testing.T) {
 		setCalled = true
 		return nil
 	}
-	publishCalled := false
+	published := ""
 	c.publish = func(ctx context.Context, channel, msg string) error {
-		publishCalled = true
+		published = msg
 		return nil
 	}
 
@@ -158,17 +272,70 @@ func TestIPListCache_RecordDenySetsTempBlacklist(t *testing.T) {
 	if !setCalled {
 		t.Fatal("expected temp blacklist to be set")
 	}
-	if !publishCalled {
-		t.Fatal("expected update publish to be called")
+	if published != "black_tmp 5.5.5.5 60000" {
+		t.Fatalf("expected a temp blacklist event, got %q", published)
 	}
 	if val, ok := c.get("5.5.5.5:black_tmp"); !ok || !val {
 		t.Fatal("expected temp blacklist cached in L1")
 	}
 }
 
+func TestIPListCache_TempMissCachedAndObservedOnce(t *testing.T) {
+	c := newDummyIPListCache()
+	hook := &recordingHook{}
+	c.hook = hook
+	lookups := 0
+	c.isTempBlacklisted = func(ctx context.Context, ip string) (bool, error) {
+		lookups++
+		return false, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, handled, _ := c.CheckIP(context.Background(), "6.6.6.6"); handled {
+			t.Fatalf("check %d: unlisted ip should not be handled", i)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("temp blacklist miss should be cached, redis lookups = %d", lookups)
+	}
+	if len(hook.lookups) != 2 || hook.lookups[0] != "l2" || hook.lookups[1] != "l1" {
+		t.Fatalf("expected one outcome per lookup, got %v", hook.lookups)
+	}
+}
+
+func TestIPListCache_ApplyUpdates(t *testing.T) {
+	c := newDummyIPListCache()
+	loads := 0
+	c.setMembers = func(ctx context.Context, setKey string) ([]string, error) {
+		loads++
+		return nil, nil
+	}
+	c.isTempBlacklisted = func(ctx context.Context, ip string) (bool, error) {
+		t.Fatalf("temp blacklist event should answer without redis")
+		return false, nil
+	}
+
+	c.apply(context.Background(), "black_tmp 2001:db8::1 60000")
+	if loads != 0 {
+		t.Fatalf("temp blacklist event should not reload the lists")
+	}
+	dec, handled, _ := c.CheckIP(context.Background(), "2001:db8::1")
+	if !handled || dec.Reason != "ip_in_temp_blacklist_l1" {
+		t.Fatalf("expected temp blacklist deny, got %+v", dec)
+	}
+
+	c.apply(context.Background(), "iplist_update")
+	if loads != 2 {
+		t.Fatalf("list update should reload both lists, loads = %d", loads)
+	}
+	if _, ok := c.get("2001:db8::1:black_tmp"); ok {
+		t.Fatal("list update should drop cached temp results")
+	}
+}
+
 func BenchmarkIPListCache_CheckIP_L1(b *testing.B) {
 	c := newDummyIPListCache()
-	c.localCache.Store("9.9.9.9:black", cacheEntry{
+	c.localCache.Store("9.9.9.9:black_tmp", cacheEntry{
 		value:     true,
 		expiresAt: time.Now().Add(time.Minute).UnixNano(),
 	})
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"net/netip"
+)
+
+// prefixTrie is a binary trie of IP prefixes with one root per address
+// family. It is built once from the Redis sets and then only read, so it is
+// shared through rcu.Snapshot without locks.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	child    [2]*trieNode
+	terminal bool // a prefix ends here and covers every address below
+}
+
+func (t *prefixTrie) insert(p netip.Prefix) {
+	root := &t.v4
+	if p.Addr().Is6() {
+		root = &t.v6
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+	n := *root
+	addr := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		if n.terminal {
+			return // already covered by a shorter prefix
+		}
+		b := bitAt(addr, i)
+		if n.child[b] == nil {
+			n.child[b] = &trieNode{}
+		}
+		n = n.child[b]
+	}
+	n.terminal = true
+	n.child = [2]*trieNode{} // longer prefixes below are redundant
+}
+
+// contains reports whether ip falls inside any inserted prefix.
+func (t *prefixTrie) contains(ip netip.Addr) bool {
+	if t == nil {
+		return false
+	}
+	ip = ip.Unmap()
+	n := t.v4
+	if ip.Is6() {
+		n = t.v6
+	}
+	addr := ip.AsSlice()
+	for i := 0; n != nil; i++ {
+		if n.terminal {
+			return true
+		}
+		if i == len(addr)*8 {
+			return false
+		}
+		n = n.child[bitAt(addr, i)]
+	}
+	return false
+}
+
+func bitAt(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	tr := &prefixTrie{}
+	for _, p := range []string{"10.1.2.0/24", "10.0.0.0/8", "172.16.5.4/32", "fd00::/8"} {
+		tr.insert(netip.MustParsePrefix(p))
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":        true, // the /8 inserted after the /24 still covers it
+		"10.255.0.1":      true,
+		"11.0.0.1":        false,
+		"172.16.5.4":      true,
+		"172.16.5.5":      false,
+		"fd12::1":         true,
+		"fe80::1":         false,
+		"::ffff:10.9.9.9": true,
+	} {
+		if got := tr.contains(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	all := &prefixTrie{}
+	all.insert(netip.MustParsePrefix("0.0.0.0/0"))
+	if !all.contains(netip.MustParseAddr("8.8.8.8")) || all.contains(netip.MustParseAddr("::1")) {
+		t.Fatal("a /0 covers its own family only")
+	}
+	var empty *prefixTrie
+	if empty.contains(netip.MustParseAddr("8.8.8.8")) {
+		t.Fatal("nil trie contains nothing")
+	}
+}
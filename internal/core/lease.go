@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+	"github.com/nanjiek/pixiu-rls/internal/util"
+)
+
+// ErrInvalidLease is returned for a lease ID that was not issued by Acquire
+// or does not belong to the given rule.
+var ErrInvalidLease = errors.New("invalid lease id")
+
+// Lease is a set of slots held on a concurrency rule. The ID carries the
+// rule and dimension key, so releasing needs nothing but the ID.
+type Lease struct {
+	ID        string
+	RuleID    string
+	ExpiresAt time.Time
+}
+
+// RequiresLease reports whether rule holds slots until they are released, so
+// it can only be evaluated through Acquire and Release. Allow and AllowBatch
+// deny it with reason "lease_required" instead of taking a slot nobody could
+// give back.
+func RequiresLease(rule config.Rule) bool {
+	return normalizeAlgo(rule.Algo) == "concurrency"
+}
+
+// leaser is satisfied by limiter.Mux when a concurrency limiter is registered.
+type leaser interface {
+	Acquire(ctx context.Context, rule config.Rule, key, leaseID string, cost int64, ttl time.Duration, now time.Time) (types.Decision, error)
+	Release(ctx context.Context, rule config.Rule, key, leaseID string, now time.Time) (bool, error)
+}
+
+// Acquire takes cost slots of rule for dims and holds them for ttl (<=0 means
+// rule.WindowMs). IP lists, quotas and the fail policy apply as in Allow; a
+// lease granted by fail-open or the IP whitelist holds no slots.
+func (e *Engine) Acquire(ctx context.Context, rule config.Rule, dims map[string]string, cost int64, ttl time.Duration, now time.Time) (Lease, types.Decision, error) {
+	start := time.Now()
+	lease, dec, err := e.acquire(ctx, rule, dims, cost, ttl, now)
+	e.observe("acquire", start, []config.Rule{rule}, dims, dec, now)
+	return lease, dec, err
+}
+
+func (e *Engine) acquire(ctx context.Context, rule config.Rule, dims map[string]string, cost int64, ttl time.Duration, now time.Time) (Lease, types.Decision, error) {
+	ls, ok := e.limiter.(leaser)
+	if !ok {
+		err := errors.New("limiter does not support leases")
+		return Lease{}, types.Decision{Allowed: false, Reason: "unsupported_algorithm", Err: err}, err
+	}
+	if !rule.Enabled {
+		return Lease{}, types.Decision{Allowed: false, Reason: "rule_disabled"}, errors.New("rule is disabled")
+	}
+	if dims == nil {
+		dims = map[string]string{}
+	}
+	if cost <= 0 {
+		cost = 1
+	}
+	if ttl <= 0 || ttl.Milliseconds() > rule.WindowMs {
+		ttl = time.Duration(rule.WindowMs) * time.Millisecond
+	}
+	if e.repo == nil {
+		err := errors.New("repo is nil")
+		return Lease{}, types.Decision{Allowed: false, Reason: "repo_unavailable", Err: err}, err
+	}
+
+	dimKey, err := util.HashDims(rule.Dims, dims)
+	if err != nil {
+		return Lease{}, types.Decision{Allowed: false, Reason: "dim_hash_failed", Err: err}, err
+	}
+	state := stateRule(rule)
+	key, err := e.limiterKey(state, dimKey)
+	if err != nil {
+		return Lease{}, types.Decision{Allowed: false, Reason: "unsupported_algorithm", Err: err}, err
+	}
+	lease := Lease{
+		ID:        encodeLeaseID(rule.RuleID, dimKey),
+		RuleID:    rule.RuleID,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	ipDecision, handled, err := e.checkIPLists(ctx, dims)
+	if err != nil {
+		if e.failPolicy == "fail-closed" {
+			return Lease{}, types.Decision{Allowed: false, Reason: "fail_closed", Err: err}, nil
+		}
+		e.logger.Warn("fail-open due to ip list error", "err", err)
+	}
+	if handled {
+		if !ipDecision.Allowed {
+			return Lease{}, ipDecision, nil
+		}
+		return lease, ipDecision, nil
+	}
+
+	limStart := time.Now()
+	dec, err := ls.Acquire(ctx, state, key, lease.ID, cost, ttl, now)
+	if e.hook != nil {
+		e.hook.OnLimiter(rule, time.Since(limStart), err)
+	}
+	if err != nil {
+		return e.leaseFailure(rule, lease, err)
+	}
+	if !dec.Allowed {
+		return e.leaseDenied(ctx, rule, lease, dims, dec)
+	}
+
+	dec, err = e.checkQuota(ctx, state, dimKey, cost, now, dec)
+	if err != nil || !dec.Allowed {
+		if _, rerr := ls.Release(ctx, state, key, lease.ID, now); rerr != nil {
+			e.logger.Warn("lease release failed", "rule_id", rule.RuleID, "err", rerr)
+		}
+		if err != nil {
+			return e.leaseFailure(rule, lease, err)
+		}
+		return e.leaseDenied(ctx, rule, lease, dims, dec)
+	}
+	return lease, dec, nil
+}
+
+// Release frees a lease taken by Acquire on rule. It reports false when the
+// lease was no longer held, e.g. because it expired.
+func (e *Engine) Release(ctx context.Context, rule config.Rule, leaseID string, now time.Time) (bool, error) {
+	ls, ok := e.limiter.(leaser)
+	if !ok {
+		return false, errors.New("limiter does not support leases")
+	}
+	if e.repo == nil {
+		return false, errors.New("repo is nil")
+	}
+	ruleID, dimKey, err := decodeLeaseID(leaseID)
+	if err != nil || ruleID != rule.RuleID {
+		return false, ErrInvalidLease
+	}
+	state := stateRule(rule)
+	key, err := e.limiterKey(state, dimKey)
+	if err != nil {
+		return false, err
+	}
+	return ls.Release(ctx, state, key, leaseID, now)
+}
+
+// LeaseRuleID returns the rule a lease ID was issued for.
+func LeaseRuleID(leaseID string) (string, error) {
+	ruleID, _, err := decodeLeaseID(leaseID)
+	return ruleID, err
+}
+
+func (e *Engine) leaseFailure(rule config.Rule, lease Lease, err error) (Lease, types.Decision, error) {
+	if e.failPolicy == "fail-open" || IsShadow(rule) {
+		e.logger.Warn("fail-open due to lease error", "rule_id", rule.RuleID, "err", err)
+		return lease, types.Decision{Allowed: true, Reason: "fail_open"}, nil
+	}
+	return Lease{}, types.Decision{Allowed: false, Reason: "fail_closed", RuleID: rule.RuleID, Err: err}, nil
+}
+
+// leaseDenied settles a denied Acquire. A shadow rule admits the request
+// instead; its lease holds no slot, so releasing it reports false.
+func (e *Engine) leaseDenied(ctx context.Context, rule config.Rule, lease Lease, dims map[string]string, dec types.Decision) (Lease, types.Decision, error) {
+	if IsShadow(rule) {
+		return lease, e.shadowDecision(rule, dec), nil
+	}
+	dec.RuleID = rule.RuleID
+	if e.ipCache != nil {
+		if ip := strings.TrimSpace(dims["ip"]); ip != "" {
+			e.ipCache.RecordDeny(ctx, ip)
+		}
+	}
+	return Lease{}, dec, nil
+}
+
+// encodeLeaseID builds "<base64url(ruleID)>.<dimKey>.<random>".
+func encodeLeaseID(ruleID, dimKey string) string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString([]byte(ruleID)) + "." + dimKey + "." + hex.EncodeToString(b[:])
+}
+
+func decodeLeaseID(leaseID string) (ruleID, dimKey string, err error) {
+	parts := strings.Split(leaseID, ".")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", ErrInvalidLease
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(raw) == 0 {
+		return "", "", ErrInvalidLease
+	}
+	return string(raw), parts[1], nil
+}
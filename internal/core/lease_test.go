@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+type fakeLeaser struct {
+	mockLimiter
+	acquireErr error
+	released   []string
+}
+
+func (f *fakeLeaser) Acquire(ctx context.Context, rule config.Rule, key, leaseID string, cost int64, ttl time.Duration, now time.Time) (types.Decision, error) {
+	if f.acquireErr != nil {
+		return types.Decision{Allowed: false, Reason: "limiter_eval_failed"}, f.acquireErr
+	}
+	return types.Decision{Allowed: f.allowed, Remaining: 3, Reason: "allowed"}, nil
+}
+
+func (f *fakeLeaser) Release(ctx context.Context, rule config.Rule, key, leaseID string, now time.Time) (bool, error) {
+	f.released = append(f.released, leaseID)
+	return true, nil
+}
+
+var leaseRule = config.Rule{RuleID: "exp:1", Enabled: true, Algo: "concurrency", WindowMs: 60000, Limit: 5}
+
+func TestLeaseIDRoundTrip(t *testing.T) {
+	id := encodeLeaseID("exp:1", "abcd")
+	ruleID, dimKey, err := decodeLeaseID(id)
+	if err != nil || ruleID != "exp:1" || dimKey != "abcd" {
+		t.Fatalf("decode(%q) = %q, %q, %v", id, ruleID, dimKey, err)
+	}
+	for _, bad := range []string{"", "a.b", "!!.b.c", "YQ..c"} {
+		if _, err := LeaseRuleID(bad); !errors.Is(err, ErrInvalidLease) {
+			t.Fatalf("LeaseRuleID(%q) err = %v", bad, err)
+		}
+	}
+}
+
+func TestAcquire_QuotaDenyReleasesLease(t *testing.T) {
+	lim := &fakeLeaser{mockLimiter: mockLimiter{allowed: true}}
+	engine := NewEngine(newTestRepo(), lim, "fail-closed")
+	engine.quota = &stubQuota{dec: types.Decision{Allowed: false, Reason: "quota_exceeded:day"}}
+
+	rule := leaseRule
+	rule.Quota = config.QuotaCfg{PerDay: 10}
+	lease, dec, err := engine.Acquire(context.Background(), rule, map[string]string{}, 1, 0, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "quota_exceeded:day" || lease.ID != "" {
+		t.Fatalf("unexpected result: %+v %+v", lease, dec)
+	}
+	if len(lim.released) != 1 {
+		t.Fatalf("lease should be released after quota deny")
+	}
+}
+
+func TestAcquire_FailPolicy(t *testing.T) {
+	lim := &fakeLeaser{acquireErr: errors.New("boom")}
+	now := time.Now()
+
+	engine := NewEngine(newTestRepo(), lim, "fail-closed")
+	lease, dec, err := engine.Acquire(context.Background(), leaseRule, map[string]string{}, 1, 0, now)
+	if err != nil || dec.Allowed || dec.Reason != "fail_closed" || lease.ID != "" {
+		t.Fatalf("fail-closed: %+v %+v %v", lease, dec, err)
+	}
+
+	engine = NewEngine(newTestRepo(), lim, "fail-open")
+	lease, dec, err = engine.Acquire(context.Background(), leaseRule, map[string]string{}, 1, 0, now)
+	if err != nil || !dec.Allowed || dec.Reason != "fail_open" || lease.ID == "" {
+		t.Fatalf("fail-open: %+v %+v %v", lease, dec, err)
+	}
+	if !lease.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expiresAt = %v, want windowMs after now", lease.ExpiresAt)
+	}
+
+	ok, err := engine.Release(context.Background(), config.Rule{RuleID: "other", Algo: "concurrency"}, lease.ID, now)
+	if ok || !errors.Is(err, ErrInvalidLease) {
+		t.Fatalf("release on another rule = %v, %v", ok, err)
+	}
+}
+
+func TestAllow_ConcurrencyRequiresLease(t *testing.T) {
+	// fail-open must not let the rule through either
+	engine := NewEngine(newTestRepo(), &fakeLeaser{mockLimiter: mockLimiter{allowed: true}}, "fail-open")
+	now := time.Now()
+
+	dec, err := engine.AllowRules(context.Background(), []config.Rule{leaseRule}, map[string]string{}, 1, now)
+	if err != nil || dec.Allowed || dec.Reason != "lease_required" || dec.RuleID != "exp:1" {
+		t.Fatalf("allow: %+v, %v", dec, err)
+	}
+
+	items := []BatchItem{{Rule: leaseRule, Dims: map[string]string{}}}
+	decs, err := engine.AllowBatch(context.Background(), items, false, now)
+	if err != nil || decs[0].Allowed || decs[0].Reason != "lease_required" || decs[0].RuleID != "exp:1" {
+		t.Fatalf("batch: %+v, %v", decs, err)
+	}
+}
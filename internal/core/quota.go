@@ -2,10 +2,12 @@ package core
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log/slog"
 	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -25,11 +27,12 @@ import (
 )
 
 type Quota struct {
-	repo    *repo.RedisRepo
-	logger  *slog.Logger
-	resName string
-	state   atomic.Int32
+	repo     *repo.RedisRepo
+	logger   *slog.Logger
+	resName  string
+	state    atomic.Int32
 	openTime atomic.Int64
+	zones    sync.Map // time zone name -> *time.Location
 }
 
 const (
@@ -39,35 +42,52 @@ const (
 )
 
 var quotaScript = redis.NewScript(`
-    local h_limit = tonumber(ARGV[1])
-    local d_limit = tonumber(ARGV[2])
-    local h_ttl   = tonumber(ARGV[3])
-    local d_ttl   = tonumber(ARGV[4])
-    local default_rem = tonumber(ARGV[5])
-
-    local h_current = tonumber(redis.call("GET", KEYS[1]) or "0")
-    local d_current = tonumber(redis.call("GET", KEYS[2]) or "0")
-
-    if h_limit > 0 and h_current + 1 > h_limit then
-        return {0, "hour", h_current}
+    -- KEYS[1..3] = minute / hour / day counters
+    -- ARGV[1..3] = minute / hour / day limits (<=0 means unlimited)
+    -- ARGV[4..6] = minute / hour / day ttl (seconds)
+    -- ARGV[7]    = remaining reported for unlimited windows
+    -- ARGV[8]    = cost (units consumed, default 1)
+    local scopes = {"minute", "hour", "day"}
+    local default_rem = tonumber(ARGV[7])
+    local cost = tonumber(ARGV[8] or 1)
+
+    for i = 1, 3 do
+        local limit = tonumber(ARGV[i])
+        if limit > 0 then
+            local current = tonumber(redis.call("GET", KEYS[i]) or "0")
+            if current + cost > limit then
+                return {0, scopes[i], current}
+            end
+        end
     end
-    if d_limit > 0 and d_current + 1 > d_limit then
-        return {0, "day", d_current}
-    end
-
-    local h_new = redis.call("INCR", KEYS[1])
-    local d_new = redis.call("INCR", KEYS[2])
 
-    if h_new == 1 then redis.call("EXPIRE", KEYS[1], h_ttl) end
-    if d_new == 1 then redis.call("EXPIRE", KEYS[2], d_ttl) end
-
-    local h_rem = h_limit > 0 and (h_limit - h_new) or default_rem
-    local d_rem = d_limit > 0 and (d_limit - d_new) or default_rem
-    local min_rem = math.min(h_rem, d_rem)
+    local min_rem = default_rem
+    for i = 1, 3 do
+        local limit = tonumber(ARGV[i])
+        if limit > 0 then
+            local n = redis.call("INCRBY", KEYS[i], cost)
+            if n == cost then redis.call("EXPIRE", KEYS[i], tonumber(ARGV[i + 3])) end
+            min_rem = math.min(min_rem, limit - n)
+        end
+    end
 
     return {1, "ok", min_rem}
 `)
 
+var quotaRefundScript = redis.NewScript(`
+    -- KEYS[1..3] = minute / hour / day counters
+    -- ARGV[1..3] = minute / hour / day limits (<=0 means unlimited)
+    -- ARGV[4]    = cost to give back
+    local cost = tonumber(ARGV[4])
+    for i = 1, 3 do
+        local current = tonumber(redis.call("GET", KEYS[i]) or "0")
+        if tonumber(ARGV[i]) > 0 and current > 0 then
+            redis.call("DECRBY", KEYS[i], math.min(cost, current))
+        end
+    end
+    return 1
+`)
+
 // 实现 circuitbreaker.StateChangeListener 接口
 // 1. 完善结构体以完全实现 circuitbreaker.StateChangeListener 接口
 type quotaStateListener struct {
@@ -139,19 +159,29 @@ func (q *Quota) initSentinel() {
 
 func (q *Quota) getAllowedRatio() float64 {
 	state := q.state.Load()
-	if state == StateClosed { return 1.0 }
-	if state == StateOpen { return 0.0 }
+	if state == StateClosed {
+		return 1.0
+	}
+	if state == StateOpen {
+		return 0.0
+	}
 
 	elapsed := time.Now().Unix() - q.openTime.Load()
 	switch {
-	case elapsed < 5:  return 0.1
-	case elapsed < 10: return 0.2
-	case elapsed < 20: return 0.5
-	default:           return 1.0
+	case elapsed < 5:
+		return 0.1
+	case elapsed < 10:
+		return 0.2
+	case elapsed < 20:
+		return 0.5
+	default:
+		return 1.0
 	}
 }
 
-func (q *Quota) CheckAndIncr(ctx context.Context, rule config.Rule, dimKey string, now time.Time) types.Decision {
+// CheckAndIncr consumes cost units from every configured window, or none if
+// any window would be exceeded.
+func (q *Quota) CheckAndIncr(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) types.Decision {
 	// 修复：ResTypeAPIGateway 在 base 包中
 	entry, blockErr := sentinel.Entry(q.resName, sentinel.WithResourceType(base.ResTypeAPIGateway))
 	if blockErr != nil {
@@ -170,7 +200,11 @@ func (q *Quota) CheckAndIncr(ctx context.Context, rule config.Rule, dimKey strin
 		return types.Decision{Allowed: false, Reason: "no_redis_client"}
 	}
 
-	res, err := q.runLua(ctx, cli, rule, dimKey, now)
+	now = now.In(q.location(rule.Quota.TimeZone))
+	if cost <= 0 {
+		cost = 1
+	}
+	res, err := q.runLua(ctx, cli, rule, dimKey, cost, now)
 	if err != nil {
 		sentinel.TraceError(entry, err)
 		q.logger.Error("quota lua execute error", "err", err)
@@ -180,35 +214,79 @@ func (q *Quota) CheckAndIncr(ctx context.Context, rule config.Rule, dimKey strin
 	return q.parseDecision(res, now)
 }
 
-// 修复：补充 getClientForKey
-func (q *Quota) getClientForKey(key string) *redis.ClusterClient {
-	// 假设你的 repo 暴露了底层 ClusterClient
-	// 在 Redis Cluster 下，go-redis 会自动处理分片，通常直接用 ClusterClient 即可
-	return q.repo.Cli 
+// location resolves the time zone used for quota window boundaries.
+// Empty or unknown names fall back to the server local time zone.
+func (q *Quota) location(name string) *time.Location {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.Local
+	}
+	if loc, ok := q.zones.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		q.logger.Warn("unknown quota time zone, using local", "tz", name, "err", err)
+		loc = time.Local
+	}
+	q.zones.Store(name, loc)
+	return loc
+}
+
+// HasQuota reports whether any quota window is configured.
+func HasQuota(cfg config.QuotaCfg) bool {
+	return cfg.PerMinute > 0 || cfg.PerHour > 0 || cfg.PerDay > 0
+}
+
+// getClientForKey 返回 repo 的客户端；集群模式下 go-redis 按 key 自动路由分片
+func (q *Quota) getClientForKey(key string) redis.UniversalClient {
+	return q.repo.Cli
 }
 
-func (q *Quota) runLua(ctx context.Context, cli *redis.ClusterClient, rule config.Rule, dimKey string, now time.Time) ([]interface{}, error) {
+func (q *Quota) runLua(ctx context.Context, cli redis.UniversalClient, rule config.Rule, dimKey string, cost int64, now time.Time) ([]interface{}, error) {
 	tCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
 	defer cancel()
 
-	hashTag := fmt.Sprintf("{%s:q:%s:%s}", q.repo.Prefix, rule.RuleID, dimKey)
-	keys := []string{
-		fmt.Sprintf("%s:h:%s", hashTag, now.Format("2006010215")),
-		fmt.Sprintf("%s:d:%s", hashTag, now.Format("20060102")),
+	res, err := quotaScript.Run(tCtx, cli, q.keys(rule, dimKey, now),
+		rule.Quota.PerMinute, rule.Quota.PerHour, rule.Quota.PerDay,
+		60+60, 3600+600, 86400+3600, 999999, cost).Slice()
+	return res, err
+}
+
+// keys returns the minute/hour/day counters for now. All keys share the
+// {ruleID} hash tag so the scripts stay single-slot.
+func (q *Quota) keys(rule config.Rule, dimKey string, now time.Time) []string {
+	return []string{
+		q.repo.KeyQuota("min", rule.RuleID, dimKey, now.Format("200601021504")),
+		q.repo.KeyQuota("hour", rule.RuleID, dimKey, now.Format("2006010215")),
+		q.repo.KeyQuota("day", rule.RuleID, dimKey, now.Format("20060102")),
 	}
+}
 
-	res, err := quotaScript.Run(tCtx, cli, keys,
-		rule.Quota.PerHour, rule.Quota.PerDay,
-		3600+600, 86400+3600, 999999).Slice()
-	return res, err
+// Refund gives back the cost consumed by a CheckAndIncr with the same now,
+// e.g. when an atomic batch is rolled back.
+func (q *Quota) Refund(ctx context.Context, rule config.Rule, dimKey string, cost int64, now time.Time) error {
+	cli := q.getClientForKey(dimKey)
+	if cli == nil {
+		return errors.New("no redis client")
+	}
+	tCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	now = now.In(q.location(rule.Quota.TimeZone))
+	return quotaRefundScript.Run(tCtx, cli, q.keys(rule, dimKey, now),
+		rule.Quota.PerMinute, rule.Quota.PerHour, rule.Quota.PerDay, cost).Err()
 }
 
-// 修复：补充 calcRetryAfter
+// calcRetryAfter returns the time until the scope window resets, using the
+// location carried by now for minute/hour/day boundaries.
 func (q *Quota) calcRetryAfter(scope string, now time.Time) int64 {
 	switch scope {
+	case "minute":
+		next := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()+1, 0, 0, now.Location())
+		return next.Sub(now).Milliseconds()
 	case "hour":
-		nextHour := now.Truncate(time.Hour).Add(time.Hour)
-		return nextHour.Sub(now).Milliseconds()
+		next := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
+		return next.Sub(now).Milliseconds()
 	case "day":
 		nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
 		return nextDay.Sub(now).Milliseconds()
@@ -239,11 +317,14 @@ func (q *Quota) parseDecision(res []interface{}, now time.Time) types.Decision {
 
 func toInt64(v interface{}) (int64, bool) {
 	switch val := v.(type) {
-	case int64: return val, true
-	case int:   return int64(val), true
+	case int64:
+		return val, true
+	case int:
+		return int64(val), true
 	case string:
 		i, err := strconv.ParseInt(val, 10, 64)
 		return i, err == nil
-	default: return 0, false
+	default:
+		return 0, false
 	}
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"log/slog"
 	"testing"
 	"time"
 )
@@ -95,3 +96,25 @@ func BenchmarkQuota_calcRetryAfter(b *testing.B) {
 		})
 	}
 }
+
+func TestQuota_calcRetryAfterMinute(t *testing.T) {
+	q := &Quota{}
+	now := time.Date(2024, 1, 1, 10, 30, 15, 0, time.UTC)
+	if got := q.calcRetryAfter("minute", now); got != 45000 {
+		t.Errorf("calcRetryAfter(minute) = %d, want 45000", got)
+	}
+}
+
+func TestQuota_calcRetryAfterDayTimeZone(t *testing.T) {
+	q := &Quota{logger: slog.Default()}
+	loc := q.location("Asia/Shanghai")
+
+	// 2024-01-01 15:00 UTC == 2024-01-01 23:00 UTC+8，距当地午夜 1 小时
+	now := time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC).In(loc)
+	if got := q.calcRetryAfter("day", now); got != time.Hour.Milliseconds() {
+		t.Errorf("calcRetryAfter(day, UTC+8) = %d, want %d", got, time.Hour.Milliseconds())
+	}
+	if q.location("Not/AZone") != time.Local {
+		t.Errorf("unknown zone should fall back to local")
+	}
+}
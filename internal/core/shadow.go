@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+// shadowPrefix marks the rule ID a shadow rule keeps its state under. "/" is
+// not allowed in rule IDs, so shadow keys never collide with enforced ones.
+const shadowPrefix = "shadow/"
+
+// IsShadow reports whether rule runs in shadow (dry-run) mode.
+func IsShadow(rule config.Rule) bool {
+	return strings.EqualFold(strings.TrimSpace(rule.Mode), "shadow")
+}
+
+// stateRule returns the rule whose ID names the limiter, breaker and quota
+// state: shadow rules keep theirs apart from the enforced rule of the same ID.
+func stateRule(rule config.Rule) config.Rule {
+	if IsShadow(rule) {
+		rule.RuleID = shadowPrefix + rule.RuleID
+	}
+	return rule
+}
+
+// allowShadow evaluates a shadow rule, consuming its shadow state, and reports
+// a request it would have denied as a "shadow_denied" decision. It never
+// affects the outcome of the request.
+func (e *Engine) allowShadow(ctx context.Context, rule config.Rule, dims map[string]string, cost int64, now time.Time) {
+	dec, err := e.allowRule(ctx, stateRule(rule), dims, cost, now)
+	if err != nil {
+		e.logger.Warn("shadow rule evaluation failed", "rule_id", rule.RuleID, "err", err)
+		return
+	}
+	if dec.Allowed {
+		return
+	}
+	shadow := e.shadowDecision(rule, dec)
+	if e.auditor != nil {
+		e.auditor.Record(rule, dims, shadow, now)
+	}
+	if e.hook != nil {
+		e.hook.OnDecision(rule, shadow)
+	}
+}
+
+// shadowDecision logs the deny a shadow rule would have issued and turns it
+// into an admission with reason "shadow_denied". The log is at debug level: a
+// shadow rule may deny on every request, and the metric and audit event
+// already count each one.
+func (e *Engine) shadowDecision(rule config.Rule, dec types.Decision) types.Decision {
+	e.logger.Debug("shadow rule would deny", "rule_id", rule.RuleID, "reason", dec.Reason, "retry_after_ms", dec.RetryAfterMs)
+	return types.Decision{
+		Allowed:      true,
+		Remaining:    dec.Remaining,
+		RetryAfterMs: dec.RetryAfterMs,
+		ResetAtMs:    dec.ResetAtMs,
+		Reason:       "shadow_denied",
+		RuleID:       rule.RuleID,
+	}
+}
@@ -0,0 +1,28 @@
+package identity
+
+import (
+	"crypto/tls"
+)
+
+// DimMTLSCN is the dimension holding the subject CN of the caller's verified
+// client certificate. It is only ever set from the TLS handshake: a value the
+// caller sends itself is dropped.
+const DimMTLSCN = "mtls_cn"
+
+// PeerCN returns the subject CN of the verified client certificate, or ""
+// when the connection has none.
+func PeerCN(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// SetMTLSDim sets dims[DimMTLSCN] from the connection state, removing any
+// caller-supplied value.
+func SetMTLSDim(dims map[string]string, state *tls.ConnectionState) {
+	delete(dims, DimMTLSCN)
+	if cn := PeerCN(state); cn != "" {
+		dims[DimMTLSCN] = cn
+	}
+}
@@ -2,8 +2,9 @@ package identity
 
 import (
 	"errors"
-	"net"
+	"fmt"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
@@ -24,7 +25,12 @@ type ClientKey struct {
 type Resolver struct {
 	UserHeader string
 	APIKeyHdr  string
-	IPHeader   string
+	IPHeader   string // X-Forwarded-For style header, walked from the right
+
+	// TrustedProxies are the peers whose forwarding headers are believed.
+	// With none, forwarding headers are ignored and the client IP is always
+	// the connection's peer address.
+	TrustedProxies []netip.Prefix
 }
 
 func NewResolver() *Resolver {
@@ -49,15 +55,116 @@ func (r *Resolver) Resolve(req *http.Request) (ClientKey, error) {
 		return newKey(KindAPIKey, apiKey), nil
 	}
 
-	if ip := parseForwardedIP(req.Header.Get(r.IPHeader)); ip != "" {
+	if ip := r.ClientIP(req); ip != "" {
 		return newKey(KindIP, ip), nil
 	}
 
-	if ip := parseRemoteIP(req.RemoteAddr); ip != "" {
-		return newKey(KindIP, ip), nil
+	return ClientKey{}, errors.New("no client identity found")
+}
+
+// ClientIP returns the normalized client IP, regardless of which identity
+// Resolve would pick. Forwarding headers are only consulted when the peer
+// (RemoteAddr) is a trusted proxy; in order of preference they are the RFC
+// 7239 Forwarded header, IPHeader (X-Forwarded-For) and X-Real-IP. The hop
+// lists are walked from the right, skipping trusted proxies, so the result is
+// the address the outermost trusted proxy saw and cannot be forged by
+// prepending entries.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	remote, ok := parseAddr(req.RemoteAddr)
+	if !ok {
+		return ""
 	}
+	if !r.trusted(remote) {
+		return remote.String()
+	}
+	if hops := forwardedFor(req.Header.Values("Forwarded")); len(hops) > 0 {
+		return r.walk(hops, remote)
+	}
+	if hops := splitList(req.Header.Values(r.IPHeader)); len(hops) > 0 {
+		return r.walk(hops, remote)
+	}
+	if ip, ok := parseAddr(req.Header.Get("X-Real-IP")); ok {
+		return ip.String()
+	}
+	return remote.String()
+}
 
-	return ClientKey{}, errors.New("no client identity found")
+// TrustsPeer reports whether the direct peer of req is a trusted proxy.
+func (r *Resolver) TrustsPeer(req *http.Request) bool {
+	remote, ok := parseAddr(req.RemoteAddr)
+	return ok && r.trusted(remote)
+}
+
+// walk returns the rightmost hop that is not a trusted proxy. An unparsable
+// hop (e.g. "unknown") ends the walk at the last good one; if every hop is
+// trusted, the leftmost is returned.
+func (r *Resolver) walk(hops []string, remote netip.Addr) string {
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseAddr(hops[i])
+		if !ok {
+			break
+		}
+		client = ip
+		if !r.trusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func (r *Resolver) trusted(ip netip.Addr) bool {
+	for _, p := range r.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses CIDRs or bare IPs into prefixes for
+// Resolver.TrustedProxies.
+func ParseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// ParsePrefix parses a CIDR or a single IP (as a /32 or /128). IPv4-mapped
+// IPv6 prefixes are turned into their IPv4 form so they match NormalizeIP
+// output.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if p, err := netip.ParsePrefix(s); err == nil {
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	ip, ok := parseAddr(s)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("invalid ip or cidr %q", s)
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// NormalizeIP returns ip in canonical form: IPv4-mapped IPv6 addresses are
+// unmapped, IPv6 is compressed and lower-cased, and zones and ports are
+// dropped. A value that is not an IP is returned trimmed but otherwise as is.
+func NormalizeIP(ip string) string {
+	if addr, ok := parseAddr(ip); ok {
+		return addr.String()
+	}
+	return strings.TrimSpace(ip)
 }
 
 func newKey(kind, id string) ClientKey {
@@ -68,24 +175,54 @@ func newKey(kind, id string) ClientKey {
 	}
 }
 
-func parseForwardedIP(value string) string {
-	if value == "" {
-		return ""
+// parseAddr parses an IP optionally carrying a port ("1.2.3.4:80",
+// "[::1]:80"), brackets or quotes, and normalizes it.
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if s == "" {
+		return netip.Addr{}, false
 	}
-	parts := strings.Split(value, ",")
-	if len(parts) == 0 {
-		return ""
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		ap, perr := netip.ParseAddrPort(s)
+		if perr != nil {
+			if addr, err = netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err != nil {
+				return netip.Addr{}, false
+			}
+		} else {
+			addr = ap.Addr()
+		}
 	}
-	return strings.TrimSpace(parts[0])
+	return addr.Unmap().WithZone(""), true
 }
 
-func parseRemoteIP(remoteAddr string) string {
-	if remoteAddr == "" {
-		return ""
+// splitList splits comma-separated header values across repeated headers.
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
 	}
-	host, _, err := net.SplitHostPort(remoteAddr)
-	if err == nil && host != "" {
-		return host
+	return out
+}
+
+// forwardedFor returns the for= parameter of every element of RFC 7239
+// Forwarded headers, in order. An element without for= yields "", which
+// parseAddr rejects like the obfuscated identifiers "unknown" and "_x".
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, elem := range splitList(values) {
+		var hop string
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(k), "for") {
+				hop = strings.TrimSpace(v)
+			}
+		}
+		out = append(out, hop)
 	}
-	return remoteAddr
+	return out
 }
@@ -1,6 +1,9 @@
 package identity
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
 	"strings"
 	"testing"
@@ -42,17 +45,71 @@ func TestResolveAPIKey(t *testing.T) {
 func TestResolveForwardedIP(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
 	req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	req.RemoteAddr = "192.168.0.10:4000"
 
 	resolver := NewResolver()
+	resolver.TrustedProxies, _ = ParseTrustedProxies([]string{"192.168.0.0/24"})
 	key, err := resolver.Resolve(req)
 	if err != nil {
 		t.Fatalf("resolve failed: %v", err)
 	}
-	if key.Kind != KindIP || key.ID != "10.0.0.1" {
+	if key.Kind != KindIP || key.ID != "10.0.0.2" {
 		t.Fatalf("unexpected key: %#v", key)
 	}
 }
 
+func TestClientIPTrustedProxies(t *testing.T) {
+	resolver := NewResolver()
+	resolver.TrustedProxies, _ = ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+
+	cases := []struct {
+		name   string
+		remote string
+		header map[string]string
+		want   string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.9"},
+		{"spoofed leftmost entry", "10.0.0.5:80", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.1.1.1"}, "198.51.100.7"},
+		{"all hops trusted", "10.0.0.5:80", map[string]string{"X-Forwarded-For": "10.2.2.2, 10.1.1.1"}, "10.2.2.2"},
+		{"forwarded wins over xff", "10.0.0.5:80", map[string]string{
+			"Forwarded":       `for="[2001:DB8:cafe::17]:4711";proto=https, for=10.1.1.1`,
+			"X-Forwarded-For": "1.1.1.1",
+		}, "2001:db8:cafe::17"},
+		{"forwarded unknown hop", "10.0.0.5:80", map[string]string{"Forwarded": "for=unknown, for=10.1.1.1"}, "10.1.1.1"},
+		{"x-real-ip", "[2001:db8::1]:443", map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"ipv4-mapped peer", "[::ffff:10.0.0.5]:80", map[string]string{"X-Forwarded-For": "::ffff:198.51.100.9"}, "198.51.100.9"},
+		{"no remote addr", "", map[string]string{"X-Forwarded-For": "1.1.1.1"}, ""},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = tc.remote
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		if got := resolver.ClientIP(req); got != tc.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	for in, want := range map[string]string{
+		"::ffff:192.0.2.1":   "192.0.2.1",
+		"2001:DB8:0:0::1":    "2001:db8::1",
+		"[2001:db8::1]:8080": "2001:db8::1",
+		"192.0.2.1:80":       "192.0.2.1",
+		" fe80::1%eth0 ":     "fe80::1",
+		"not-an-ip":          "not-an-ip",
+	} {
+		if got := NormalizeIP(in); got != want {
+			t.Errorf("NormalizeIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("expected an invalid prefix to be rejected")
+	}
+}
+
 func TestResolveRemoteAddr(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
 	req.RemoteAddr = "192.168.1.1:1234"
@@ -76,3 +133,28 @@ func TestResolveEmpty(t *testing.T) {
 		t.Fatal("expected error for missing identity")
 	}
 }
+
+func TestClientIPIgnoresUserHeader(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("X-User-Id", "user-1")
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	resolver := NewResolver()
+	if ip := resolver.ClientIP(req); ip != "192.168.1.1" {
+		t.Fatalf("unexpected ip: %q", ip)
+	}
+}
+
+func TestSetMTLSDim(t *testing.T) {
+	dims := map[string]string{DimMTLSCN: "spoofed"}
+	SetMTLSDim(dims, nil)
+	if _, ok := dims[DimMTLSCN]; ok {
+		t.Fatalf("a caller-supplied mtls_cn must be dropped")
+	}
+
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "gw-1"}}
+	SetMTLSDim(dims, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}})
+	if dims[DimMTLSCN] != "gw-1" {
+		t.Fatalf("mtls_cn = %q", dims[DimMTLSCN])
+	}
+}
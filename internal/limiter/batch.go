@@ -0,0 +1,133 @@
+package limiter
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+//go:embed batch.lua
+var batchDispatch string
+
+// BatchScript evaluates several items whose limiter keys live in one cluster
+// slot in a single call. It is assembled from the single-item scripts, so a
+// batch item runs exactly the code, against exactly the state, of the
+// matching limiter's Allow.
+var BatchScript = redis.NewScript(batchSource())
+
+func batchSource() string {
+	var b strings.Builder
+	for _, s := range []struct{ name, src string }{
+		{"token_bucket", tokenBucketScript},
+		{"sliding_window", slidingWindowScript},
+		{"leaky_bucket", leakyBucketScript},
+		{"gcra", gcraScript},
+		{"sliding_window_counter", slidingCounterScript},
+	} {
+		fmt.Fprintf(&b, "local function %s(KEYS, ARGV)\n%s\nend\n\n", s.name, s.src)
+	}
+	b.WriteString(batchDispatch)
+	return b.String()
+}
+
+// BatchOp is one item of a BatchScript call.
+type BatchOp struct {
+	Keys   []string
+	algo   string
+	args   []interface{}
+	decode func(res []interface{}) (types.Decision, error)
+}
+
+// NewBatchOp prepares the evaluation of rule for key. id must be unique
+// within the batch; it tells apart the sliding window entries of the item so
+// they can be refunded. It reports false for rules BatchScript cannot run,
+// including concurrency rules, which need a lease. token_bucket rules with
+// localBatch are evaluated against the shared bucket, bypassing the local
+// lease.
+func NewBatchOp(rule config.Rule, key string, cost int64, now time.Time, id string) (*BatchOp, bool) {
+	if rule.WindowMs <= 0 || rule.Limit <= 0 || key == "" {
+		return nil, false
+	}
+	cost = normalizeCost(cost)
+	nowMs := now.UnixMilli()
+	op := &BatchOp{Keys: []string{key}, algo: normalizeAlgo(rule.Algo)}
+	switch op.algo {
+	case "", "token_bucket":
+		op.algo = "token_bucket"
+		op.args = tokenBucketArgs(rule, nowMs, tokenBucketTTL(rule, defaultTTLFactor), cost)
+		op.decode = func(res []interface{}) (types.Decision, error) { return decodeTokenBucket(res, nowMs) }
+	case "sliding_window":
+		op.Keys = slidingWindowKeys(key)
+		op.args = slidingWindowArgs(rule, nowMs, cost, id)
+		op.decode = decodeQueue
+	case "leaky_bucket":
+		op.args = leakyBucketArgs(rule, nowMs, cost)
+		op.decode = decodeQueue
+	case "gcra":
+		op.args = gcraArgs(rule, nowMs, cost)
+		op.decode = decodeGCRA
+	case "sliding_window_counter":
+		op.args = slidingCounterArgs(rule, nowMs, cost)
+		op.decode = decodeSlidingCounter
+	default:
+		return nil, false
+	}
+	return op, true
+}
+
+// Decode turns the item's reply of a commit call into a decision.
+func (o *BatchOp) Decode(reply interface{}) (types.Decision, error) {
+	res, ok := reply.([]interface{})
+	if !ok {
+		err := errors.New("invalid script response")
+		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+	}
+	return o.decode(res)
+}
+
+// BatchCall builds the BatchScript call for ops, which must share a slot. op
+// is "commit" or "refund"; a refund gives back what a committed call took.
+// An atomic commit refunds its own admitted items if any item is denied.
+func BatchCall(op string, atomic bool, ops []*BatchOp) repo.ScriptCall {
+	call := repo.ScriptCall{
+		Keys: make([]string, 0, len(ops)),
+		Args: make([]interface{}, 0, 2+9*len(ops)),
+	}
+	flag := 0
+	if atomic {
+		flag = 1
+	}
+	call.Args = append(call.Args, op, flag)
+	for _, o := range ops {
+		call.Keys = append(call.Keys, o.Keys...)
+		call.Args = append(call.Args, o.algo, len(o.Keys), len(o.args))
+		call.Args = append(call.Args, o.args...)
+	}
+	return call
+}
+
+// Capacity is the largest cost rule can ever admit, or false for an unknown
+// algorithm.
+func Capacity(rule config.Rule) (int64, bool) {
+	switch normalizeAlgo(rule.Algo) {
+	case "", "token_bucket", "gcra":
+		return rule.Limit + max(rule.Burst, 0), true
+	case "sliding_window", "sliding_window_counter", "concurrency":
+		return rule.Limit, true
+	case "leaky_bucket":
+		return leakyQueue(rule), true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+-- Batch dispatcher, appended to the single-item scripts, each wrapped as a
+-- function of (KEYS, ARGV) named after its algorithm
+-- KEYS: the keys of every item, in item order
+-- ARGV[1]: op ("commit" | "refund")
+-- ARGV[2]: commit: 1 = all-or-nothing (admitted items are refunded if any item is denied)
+-- ARGV[3 ...]: per item: algo, k, n, then the n arguments of the item's script,
+--              which gets the next k KEYS
+-- commit returns each item's script reply; refund returns {}
+
+local scripts = {
+  token_bucket = token_bucket,
+  sliding_window = sliding_window,
+  leaky_bucket = leaky_bucket,
+  gcra = gcra,
+  sliding_window_counter = sliding_window_counter,
+}
+
+-- refunds give back what an admitted item took, from the same arguments
+local refunds = {}
+
+refunds.token_bucket = function(keys, a)
+  local tokens = tonumber(redis.call("HGET", keys[1], "tokens"))
+  if tokens then
+    redis.call("HSET", keys[1], "tokens", math.min(tonumber(a[1]) + tonumber(a[3]), tokens + tonumber(a[6])))
+  end
+end
+
+refunds.sliding_window = function(keys, a)
+  local cost = tonumber(a[4])
+  if redis.call("ZREM", keys[1], tonumber(a[1]) .. ':' .. a[5] .. '#' .. cost) == 1 then
+    local total = tonumber(redis.call("GET", keys[2]))
+    if total then
+      redis.call("SET", keys[2], math.max(0, total - cost), "PX", math.max(1, redis.call("PTTL", keys[1])))
+    end
+  end
+end
+
+refunds.leaky_bucket = function(keys, a)
+  local lvl = tonumber(redis.call("HGET", keys[1], "level"))
+  if lvl then
+    redis.call("HSET", keys[1], "level", math.max(0, lvl - tonumber(a[5])))
+  end
+end
+
+refunds.gcra = function(keys, a)
+  local now_ms = tonumber(a[4])
+  local tat = tonumber(redis.call("GET", keys[1]))
+  if tat then
+    tat = tat - tonumber(a[5]) * tonumber(a[2]) / tonumber(a[1])
+    if tat > now_ms then
+      redis.call("SET", keys[1], string.format("%.3f", tat), "PX", math.max(1, math.ceil(tat - now_ms)))
+    else
+      -- a TAT in the past admits exactly like a missing one
+      redis.call("DEL", keys[1])
+    end
+  end
+end
+
+refunds.sliding_window_counter = function(keys, a)
+  local win = math.floor(tonumber(a[3]) / tonumber(a[2]))
+  local cost = tonumber(a[4])
+  local state = redis.call("HMGET", keys[1], "win", "cur", "prev")
+  local last = tonumber(state[1])
+  if last == win then
+    redis.call("HSET", keys[1], "cur", math.max(0, (tonumber(state[2]) or 0) - cost))
+  elseif last == win + 1 then
+    redis.call("HSET", keys[1], "prev", math.max(0, (tonumber(state[3]) or 0) - cost))
+  end
+end
+
+local items = {}
+local k, pos = 1, 3
+while pos <= #ARGV do
+  local nk, n = tonumber(ARGV[pos + 1]), tonumber(ARGV[pos + 2])
+  items[#items + 1] = {
+    algo = ARGV[pos],
+    keys = { unpack(KEYS, k, k + nk - 1) },
+    args = { unpack(ARGV, pos + 3, pos + 2 + n) },
+  }
+  k = k + nk
+  pos = pos + 3 + n
+end
+
+if ARGV[1] == "refund" then
+  for i = #items, 1, -1 do
+    refunds[items[i].algo](items[i].keys, items[i].args)
+  end
+  return {}
+end
+
+-- items run in order, so items sharing a key see each other's consumption
+local out = {}
+local denied = false
+for i = 1, #items do
+  out[i] = scripts[items[i].algo](items[i].keys, items[i].args)
+  if out[i][1] ~= 1 then
+    denied = true
+  end
+end
+
+if tonumber(ARGV[2]) == 1 and denied then
+  for i = #items, 1, -1 do
+    if out[i][1] == 1 then
+      refunds[items[i].algo](items[i].keys, items[i].args)
+    end
+  end
+end
+return out
@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestBatchSourceWrapsSingleScripts(t *testing.T) {
+	src := batchSource()
+	for name, body := range map[string]string{
+		"token_bucket":           tokenBucketScript,
+		"sliding_window":         slidingWindowScript,
+		"leaky_bucket":           leakyBucketScript,
+		"gcra":                   gcraScript,
+		"sliding_window_counter": slidingCounterScript,
+	} {
+		if !strings.Contains(src, "local function "+name+"(KEYS, ARGV)\n"+body+"\nend\n") {
+			t.Fatalf("batch script does not wrap the %s script", name)
+		}
+	}
+}
+
+func TestBatchOpMatchesAllowArgs(t *testing.T) {
+	exec := &fakeExec{result: []interface{}{int64(1), int64(11), int64(0), int64(1100)}}
+	rule := config.Rule{RuleID: "r1", Algo: "gcra", Limit: 10, WindowMs: 1000, Burst: 2}
+	now := time.UnixMilli(1000)
+	if _, err := NewGCRA(exec).Allow(context.Background(), rule, "k1", 3, now); err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+
+	op, ok := NewBatchOp(rule, "k1", 3, now, "tok:0")
+	if !ok {
+		t.Fatalf("gcra should run in a batch")
+	}
+	call := BatchCall("commit", true, []*BatchOp{op})
+	if len(call.Keys) != 1 || call.Keys[0] != "k1" || call.Args[0] != "commit" || call.Args[1] != 1 {
+		t.Fatalf("unexpected call: %#v", call)
+	}
+	if call.Args[2] != "gcra" || call.Args[3] != 1 || call.Args[4] != len(exec.args) {
+		t.Fatalf("unexpected item header: %#v", call.Args)
+	}
+	for i, want := range exec.args {
+		if call.Args[5+i] != want {
+			t.Fatalf("arg %d = %#v, want %#v", i, call.Args[5+i], want)
+		}
+	}
+
+	dec, err := op.Decode(exec.result)
+	if err != nil || !dec.Allowed || dec.Remaining != 11 || dec.ResetAtMs != 1100 {
+		t.Fatalf("unexpected decision: %#v, %v", dec, err)
+	}
+}
+
+func TestNewBatchOpRejectsUnknown(t *testing.T) {
+	if _, ok := NewBatchOp(config.Rule{Algo: "fixed_window", Limit: 1, WindowMs: 1000}, "k1", 1, time.Now(), "t"); ok {
+		t.Fatalf("unknown algorithm should not run in a batch")
+	}
+	if _, ok := NewBatchOp(config.Rule{Algo: "concurrency", Limit: 5, WindowMs: 30000}, "k1", 1, time.Now(), "t"); ok {
+		t.Fatalf("concurrency needs a lease and should not run in a batch")
+	}
+	if _, ok := NewBatchOp(config.Rule{Limit: 0, WindowMs: 1000}, "k1", 1, time.Now(), "t"); ok {
+		t.Fatalf("invalid rule should not run in a batch")
+	}
+}
+
+func TestBatchOpSlidingWindow(t *testing.T) {
+	rule := config.Rule{RuleID: "r1", Algo: "sliding_window", Limit: 10, WindowMs: 1000}
+	op, ok := NewBatchOp(rule, "pixiu:sw:{r1}:d1", 4, time.UnixMilli(1000), "tok:2")
+	if !ok {
+		t.Fatalf("sliding_window should run in a batch")
+	}
+	call := BatchCall("commit", false, []*BatchOp{op})
+	// one request is one weighted member, so the total lives next to the log
+	if len(call.Keys) != 2 || call.Keys[1] != "pixiu:sw:{r1}:d1:total" || call.Args[3] != 2 {
+		t.Fatalf("unexpected call: %#v", call)
+	}
+	want := []interface{}{int64(1000), int64(1000), int64(10), int64(4), "tok:2"}
+	for i := range want {
+		if call.Args[5+i] != want[i] {
+			t.Fatalf("arg %d = %#v, want %#v", i, call.Args[5+i], want[i])
+		}
+	}
+}
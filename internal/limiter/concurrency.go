@@ -0,0 +1,136 @@
+package limiter
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+//go:embed concurrency.lua
+var concurrencyScript string
+
+// ErrLeaseRequired is returned by Concurrency.Allow: a slot taken without a
+// lease ID could never be released, so concurrency rules are served only
+// through Acquire and Release.
+var ErrLeaseRequired = errors.New("concurrency rules are evaluated through Acquire and Release")
+
+// Leaser is implemented by limiters that hold slots until they are released
+// or their lease expires.
+type Leaser interface {
+	Acquire(ctx context.Context, rule config.Rule, key, leaseID string, cost int64, ttl time.Duration, now time.Time) (types.Decision, error)
+	Release(ctx context.Context, rule config.Rule, key, leaseID string, now time.Time) (bool, error)
+}
+
+// Concurrency limits the number of in-flight requests: rule.Limit slots are
+// shared by all replicas through a Redis ZSET, and every lease expires after
+// its TTL so slots held by crashed clients are reclaimed. rule.WindowMs is
+// the default and maximum lease TTL.
+type Concurrency struct {
+	exec   ScriptExecutor
+	script string
+}
+
+func NewConcurrency(exec ScriptExecutor) *Concurrency {
+	if exec == nil {
+		panic("limiter: nil ScriptExecutor")
+	}
+	return &Concurrency{
+		exec:   exec,
+		script: concurrencyScript,
+	}
+}
+
+// Allow always fails with ErrLeaseRequired; see Acquire.
+func (c *Concurrency) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	return types.Decision{Allowed: false, Reason: "lease_required", Err: ErrLeaseRequired}, ErrLeaseRequired
+}
+
+// Acquire takes cost slots under leaseID for ttl; ttl <= 0 or above
+// rule.WindowMs means rule.WindowMs.
+func (c *Concurrency) Acquire(ctx context.Context, rule config.Rule, key, leaseID string, cost int64, ttl time.Duration, now time.Time) (types.Decision, error) {
+	if rule.WindowMs <= 0 || rule.Limit <= 0 {
+		err := errors.New("invalid rule")
+		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
+	}
+	if key == "" || leaseID == "" {
+		err := errors.New("empty key")
+		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
+	}
+	cost = normalizeCost(cost)
+	if dec, ok := exceedsCapacity(cost, rule.Limit); ok {
+		return dec, nil
+	}
+	ttlMs := ttl.Milliseconds()
+	if ttlMs <= 0 || ttlMs > rule.WindowMs {
+		ttlMs = rule.WindowMs
+	}
+
+	nowMs := now.UnixMilli()
+	res, err := c.exec.Eval(ctx, c.script, []string{key}, acquireArgs(rule, leaseID, nowMs, ttlMs, cost)...)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
+	}
+	return decodeAcquire(res, nowMs+ttlMs)
+}
+
+func acquireArgs(rule config.Rule, leaseID string, nowMs, ttlMs, cost int64) []interface{} {
+	return []interface{}{"acquire", nowMs, leaseID, rule.Limit, nowMs + ttlMs, cost}
+}
+
+// decodeAcquire turns a concurrency.lua acquire reply into a decision; an
+// admitted lease expires at expireAt.
+func decodeAcquire(res []interface{}, expireAt int64) (types.Decision, error) {
+	if len(res) < 3 {
+		err := errors.New("invalid script response")
+		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+	}
+
+	vals := make([]int64, 3)
+	for i := range vals {
+		v, ok := toInt64(res[i])
+		if !ok {
+			err := errors.New("invalid script response")
+			return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+		}
+		vals[i] = v
+	}
+
+	decision := types.Decision{
+		Allowed:   vals[0] > 0,
+		Remaining: vals[1],
+		Reason:    "allowed",
+	}
+	if decision.Allowed {
+		decision.ResetAtMs = expireAt
+	} else {
+		decision.Reason = "concurrency_exceeded"
+		decision.RetryAfterMs = vals[2]
+	}
+	return decision, nil
+}
+
+// Release frees the slots of leaseID. It reports false when the lease was
+// not held, e.g. because it already expired.
+func (c *Concurrency) Release(ctx context.Context, rule config.Rule, key, leaseID string, now time.Time) (bool, error) {
+	if key == "" || leaseID == "" {
+		return false, errors.New("empty key")
+	}
+	res, err := c.exec.Eval(ctx, c.script, []string{key}, "release", now.UnixMilli(), leaseID)
+	if err != nil {
+		return false, err
+	}
+	if len(res) < 1 {
+		return false, errors.New("invalid script response")
+	}
+	n, ok := toInt64(res[0])
+	if !ok {
+		return false, errors.New("invalid script response")
+	}
+	return n > 0, nil
+}
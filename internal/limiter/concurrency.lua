@@ -0,0 +1,44 @@
+-- Concurrency lease script
+-- KEYS[1]: lease zset (member = lease_id:j, score = expiry ms)
+-- ARGV[1]: op ("acquire" | "release")
+-- ARGV[2]: now_ms
+-- ARGV[3]: lease_id
+-- acquire: ARGV[4] = limit, ARGV[5] = expire_at_ms, ARGV[6] = cost (default 1)
+--          returns { allowed, remaining, retry_after_ms }
+-- release: returns { released_slots }
+
+local op = ARGV[1]
+local now_ms = tonumber(ARGV[2])
+local lease = ARGV[3]
+
+-- leases of crashed clients are reclaimed once they expire
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now_ms)
+
+if op == "release" then
+  local n = 0
+  while redis.call("ZREM", KEYS[1], lease .. ":" .. (n + 1)) == 1 do
+    n = n + 1
+  end
+  return { n }
+end
+
+local limit = tonumber(ARGV[4])
+local expire_at = tonumber(ARGV[5])
+local cost = tonumber(ARGV[6] or 1)
+
+local held = redis.call("ZCARD", KEYS[1])
+if held + cost > limit then
+  -- wait until enough of the earliest leases expire
+  local e = redis.call("ZRANGE", KEYS[1], held + cost - limit - 1, held + cost - limit - 1, "WITHSCORES")
+  local retry = math.max(1, tonumber(e[2]) - now_ms)
+  return { 0, math.max(0, limit - held), retry }
+end
+
+for j = 1, cost do
+  redis.call("ZADD", KEYS[1], expire_at, lease .. ":" .. j)
+end
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+-- relative expiry keeps the key alive until its last lease, whatever the Redis clock says
+redis.call("PEXPIRE", KEYS[1], math.max(1, tonumber(last[2]) - now_ms))
+
+return { 1, limit - held - cost, 0 }
@@ -0,0 +1,86 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestConcurrencyAcquire(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(1), int64(48), int64(0)},
+	}
+	c := NewConcurrency(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 50, WindowMs: 60000}
+	dec, err := c.Acquire(context.Background(), rule, "k1", "lease-1", 2, 90*time.Second, time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if !dec.Allowed || dec.Remaining != 48 || dec.ResetAtMs != 61000 {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+	// ttl above WindowMs is capped at WindowMs
+	want := []interface{}{"acquire", int64(1000), "lease-1", int64(50), int64(61000), int64(2)}
+	if len(exec.args) != len(want) {
+		t.Fatalf("unexpected args: %#v", exec.args)
+	}
+	for i := range want {
+		if exec.args[i] != want[i] {
+			t.Fatalf("arg %d = %#v, want %#v", i, exec.args[i], want[i])
+		}
+	}
+}
+
+func TestConcurrencyExceeded(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(0), int64(0), int64(4000)},
+	}
+	c := NewConcurrency(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 50, WindowMs: 60000}
+	dec, err := c.Acquire(context.Background(), rule, "k1", "lease-1", 1, 0, time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "concurrency_exceeded" || dec.RetryAfterMs != 4000 {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+}
+
+func TestConcurrencyAllowRequiresLease(t *testing.T) {
+	exec := &fakeExec{result: []interface{}{int64(1), int64(49), int64(0)}}
+	c := NewConcurrency(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 50, WindowMs: 60000}
+	dec, err := c.Allow(context.Background(), rule, "k1", 1, time.UnixMilli(1000))
+	if !errors.Is(err, ErrLeaseRequired) || dec.Allowed || dec.Reason != "lease_required" {
+		t.Fatalf("allow = %#v, %v", dec, err)
+	}
+	if exec.args != nil {
+		t.Fatalf("allow must not take a slot: %#v", exec.args)
+	}
+}
+
+func TestConcurrencyRelease(t *testing.T) {
+	exec := &fakeExec{result: []interface{}{int64(2)}}
+	c := NewConcurrency(exec)
+
+	ok, err := c.Release(context.Background(), config.Rule{}, "k1", "lease-1", time.UnixMilli(1000))
+	if err != nil || !ok {
+		t.Fatalf("release = %v, %v", ok, err)
+	}
+	if exec.args[0] != "release" || exec.args[2] != "lease-1" {
+		t.Fatalf("unexpected args: %#v", exec.args)
+	}
+
+	exec.result = []interface{}{int64(0)}
+	if ok, _ := c.Release(context.Background(), config.Rule{}, "k1", "lease-1", time.UnixMilli(1000)); ok {
+		t.Fatalf("expired lease should report false")
+	}
+}
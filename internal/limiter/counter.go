@@ -0,0 +1,88 @@
+package limiter
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+//go:embed counter.lua
+var slidingCounterScript string
+
+// SlidingWindowCounter approximates a sliding window with the counters of the
+// current and previous fixed windows, so each key costs O(1) memory instead
+// of one ZSET member per request.
+type SlidingWindowCounter struct {
+	exec   ScriptExecutor
+	script string
+}
+
+func NewSlidingWindowCounter(exec ScriptExecutor) *SlidingWindowCounter {
+	if exec == nil {
+		panic("limiter: nil ScriptExecutor")
+	}
+	return &SlidingWindowCounter{
+		exec:   exec,
+		script: slidingCounterScript,
+	}
+}
+
+func (s *SlidingWindowCounter) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	if rule.WindowMs <= 0 || rule.Limit <= 0 {
+		err := errors.New("invalid rule")
+		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
+	}
+	if key == "" {
+		err := errors.New("empty key")
+		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
+	}
+	cost = normalizeCost(cost)
+	if dec, ok := exceedsCapacity(cost, rule.Limit); ok {
+		return dec, nil
+	}
+
+	res, err := s.exec.Eval(ctx, s.script, []string{key}, slidingCounterArgs(rule, now.UnixMilli(), cost)...)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
+	}
+	return decodeSlidingCounter(res)
+}
+
+func slidingCounterArgs(rule config.Rule, nowMs, cost int64) []interface{} {
+	return []interface{}{rule.Limit, rule.WindowMs, nowMs, cost}
+}
+
+// decodeSlidingCounter turns a counter.lua reply into a decision.
+func decodeSlidingCounter(res []interface{}) (types.Decision, error) {
+	if len(res) < 3 {
+		err := errors.New("invalid script response")
+		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+	}
+
+	vals := make([]int64, 3)
+	for i := range vals {
+		v, ok := toInt64(res[i])
+		if !ok {
+			err := errors.New("invalid script response")
+			return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+		}
+		vals[i] = v
+	}
+
+	decision := types.Decision{
+		Allowed:   vals[0] > 0,
+		Remaining: vals[1],
+		Reason:    "allowed",
+	}
+	if !decision.Allowed {
+		decision.Reason = "rate_limited"
+		decision.RetryAfterMs = vals[2]
+	}
+	return decision, nil
+}
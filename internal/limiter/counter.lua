@@ -0,0 +1,51 @@
+-- Sliding window counter script
+-- KEYS[1]: counter hash (fields: win, cur, prev)
+-- ARGV[1]: limit
+-- ARGV[2]: window_ms
+-- ARGV[3]: now_ms
+-- ARGV[4]: cost (default 1)
+-- returns { allowed, remaining, retry_after_ms }
+--
+-- The count of the previous fixed window is weighted by how much of it still
+-- overlaps the sliding window ending at now.
+
+local limit = tonumber(ARGV[1])
+local window_ms = tonumber(ARGV[2])
+local now_ms = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4] or 1)
+
+local win = math.floor(now_ms / window_ms)
+local state = redis.call("HMGET", KEYS[1], "win", "cur", "prev")
+local last = tonumber(state[1])
+local cur = tonumber(state[2]) or 0
+local prev = tonumber(state[3]) or 0
+
+if last == nil or last < win - 1 then
+  prev = 0
+  cur = 0
+elseif last == win - 1 then
+  prev = cur
+  cur = 0
+end
+
+local elapsed = now_ms - win * window_ms
+local estimate = prev * (window_ms - elapsed) / window_ms + cur
+
+if estimate + cost > limit then
+  local retry
+  if cur + cost > limit then
+    -- wait for the next window, then until this window's count has decayed enough
+    local decay = window_ms * (1 - (limit - cost) / cur)
+    retry = window_ms - elapsed + math.max(0, math.ceil(decay))
+  else
+    local decay = window_ms * (1 - (limit - cost - cur) / prev)
+    retry = math.ceil(decay) - elapsed
+  end
+  return { 0, math.max(0, math.floor(limit - estimate)), math.max(1, retry) }
+end
+
+cur = cur + cost
+redis.call("HSET", KEYS[1], "win", win, "cur", cur, "prev", prev)
+redis.call("PEXPIRE", KEYS[1], window_ms * 2)
+
+return { 1, math.max(0, math.floor(limit - estimate - cost)), 0 }
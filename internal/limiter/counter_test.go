@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestSlidingWindowCounterAllow(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(1), int64(6), int64(0)},
+	}
+	c := NewSlidingWindowCounter(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000}
+	dec, err := c.Allow(context.Background(), rule, "k1", 4, time.UnixMilli(10500))
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if !dec.Allowed || dec.Remaining != 6 || dec.RetryAfterMs != 0 {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+	want := []interface{}{int64(10), int64(1000), int64(10500), int64(4)}
+	if len(exec.args) != len(want) {
+		t.Fatalf("unexpected args: %#v", exec.args)
+	}
+	for i := range want {
+		if exec.args[i] != want[i] {
+			t.Fatalf("arg %d = %#v, want %#v", i, exec.args[i], want[i])
+		}
+	}
+}
+
+func TestSlidingWindowCounterRateLimited(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(0), int64(2), int64(100)},
+	}
+	c := NewSlidingWindowCounter(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000}
+	dec, err := c.Allow(context.Background(), rule, "k1", 3, time.UnixMilli(11400))
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "rate_limited" || dec.Remaining != 2 || dec.RetryAfterMs != 100 {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+}
+
+func TestSlidingWindowCounterCostExceedsCapacity(t *testing.T) {
+	exec := &fakeExec{}
+	c := NewSlidingWindowCounter(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000, Burst: 5}
+	dec, err := c.Allow(context.Background(), rule, "k1", 11, time.Now())
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "cost_exceeds_capacity" || exec.args != nil {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+}
+
+func TestSlidingWindowCounterError(t *testing.T) {
+	exec := &fakeExec{err: errors.New("boom")}
+	c := NewSlidingWindowCounter(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 1, WindowMs: 1000}
+	if _, err := c.Allow(context.Background(), rule, "k1", 1, time.Now()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRequestTokenUnique(t *testing.T) {
+	if a, b := requestToken(), requestToken(); a == "" || a == b {
+		t.Fatalf("tokens should be unique: %q %q", a, b)
+	}
+}
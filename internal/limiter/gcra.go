@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+//go:embed gcra.lua
+var gcraScript string
+
+// GCRA applies the generic cell rate algorithm via Lua script. It keeps a
+// single theoretical arrival time per key: requests are spaced WindowMs/Limit
+// apart and may run up to Limit+Burst intervals ahead of now.
+type GCRA struct {
+	exec   ScriptExecutor
+	script string
+}
+
+func NewGCRA(exec ScriptExecutor) *GCRA {
+	if exec == nil {
+		panic("limiter: nil ScriptExecutor")
+	}
+	return &GCRA{
+		exec:   exec,
+		script: gcraScript,
+	}
+}
+
+func (g *GCRA) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	if rule.WindowMs <= 0 || rule.Limit <= 0 {
+		err := errors.New("invalid rule")
+		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
+	}
+	if key == "" {
+		err := errors.New("empty key")
+		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
+	}
+	cost = normalizeCost(cost)
+	if dec, ok := exceedsCapacity(cost, rule.Limit+max(rule.Burst, 0)); ok {
+		return dec, nil
+	}
+
+	res, err := g.exec.Eval(ctx, g.script, []string{key}, gcraArgs(rule, now.UnixMilli(), cost)...)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
+	}
+	return decodeGCRA(res)
+}
+
+func gcraArgs(rule config.Rule, nowMs, cost int64) []interface{} {
+	return []interface{}{rule.Limit, rule.WindowMs, max(rule.Burst, 0), nowMs, cost}
+}
+
+// decodeGCRA turns a gcra.lua reply into a decision.
+func decodeGCRA(res []interface{}) (types.Decision, error) {
+	if len(res) < 4 {
+		err := errors.New("invalid script response")
+		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+	}
+
+	vals := make([]int64, 4)
+	for i := range vals {
+		v, ok := toInt64(res[i])
+		if !ok {
+			err := errors.New("invalid script response")
+			return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+		}
+		vals[i] = v
+	}
+
+	decision := types.Decision{
+		Allowed:   vals[0] > 0,
+		Remaining: vals[1],
+		ResetAtMs: vals[3],
+		Reason:    "allowed",
+	}
+	if !decision.Allowed {
+		decision.Reason = "rate_limited"
+		decision.RetryAfterMs = vals[2]
+	}
+	return decision, nil
+}
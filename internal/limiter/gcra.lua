@@ -0,0 +1,38 @@
+-- GCRA (generic cell rate algorithm) script
+-- KEYS[1]: theoretical arrival time (TAT) key
+-- ARGV[1]: limit
+-- ARGV[2]: window_ms
+-- ARGV[3]: burst
+-- ARGV[4]: now_ms
+-- ARGV[5]: cost (cells to admit, default 1)
+-- returns { allowed, remaining, retry_after_ms, reset_ms }
+
+local limit = tonumber(ARGV[1])
+local window_ms = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local now_ms = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5] or 1)
+
+-- tolerate float rounding when the interval is not a whole number of ms
+local eps = 1e-6
+
+-- emission interval per cell and how far the TAT may run ahead of now
+local interval = window_ms / limit
+local tolerance = interval * (limit + burst)
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if tat == nil or tat < now_ms then
+  tat = now_ms
+end
+
+local new_tat = tat + cost * interval
+if new_tat - now_ms > tolerance + eps then
+  local retry = math.max(1, math.ceil(new_tat - tolerance - now_ms - eps))
+  local remaining = math.floor((tolerance - (tat - now_ms)) / interval + eps)
+  return { 0, math.max(0, remaining), retry, math.ceil(tat) }
+end
+
+redis.call("SET", KEYS[1], string.format("%.3f", new_tat), "PX", math.max(1, math.ceil(new_tat - now_ms)))
+
+local remaining = math.floor((tolerance - (new_tat - now_ms)) / interval + eps)
+return { 1, math.max(0, remaining), 0, math.ceil(new_tat) }
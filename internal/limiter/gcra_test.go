@@ -0,0 +1,179 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+)
+
+func TestGCRAAllow(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(1), int64(11), int64(0), int64(1100)},
+	}
+	g := NewGCRA(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000, Burst: 2}
+	dec, err := g.Allow(context.Background(), rule, "k1", 1, time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if !dec.Allowed || dec.Remaining != 11 || dec.RetryAfterMs != 0 || dec.ResetAtMs != 1100 {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+	if len(exec.keys) != 1 || exec.keys[0] != "k1" {
+		t.Fatalf("unexpected keys: %#v", exec.keys)
+	}
+	want := []interface{}{int64(10), int64(1000), int64(2), int64(1000), int64(1)}
+	if len(exec.args) != len(want) {
+		t.Fatalf("unexpected args: %#v", exec.args)
+	}
+	for i := range want {
+		if exec.args[i] != want[i] {
+			t.Fatalf("arg %d = %#v, want %#v", i, exec.args[i], want[i])
+		}
+	}
+}
+
+func TestGCRARateLimited(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(0), int64(0), int64(250), int64(2200)},
+	}
+	g := NewGCRA(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000}
+	dec, err := g.Allow(context.Background(), rule, "k1", 3, time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "rate_limited" || dec.RetryAfterMs != 250 || dec.ResetAtMs != 2200 {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+	if exec.args[4] != int64(3) {
+		t.Fatalf("cost not passed to script: %#v", exec.args)
+	}
+}
+
+func TestGCRACostExceedsCapacity(t *testing.T) {
+	exec := &fakeExec{}
+	g := NewGCRA(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000, Burst: 5}
+	dec, err := g.Allow(context.Background(), rule, "k1", 16, time.Now())
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "cost_exceeds_capacity" {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+	if exec.args != nil {
+		t.Fatalf("script should not run for an impossible cost")
+	}
+}
+
+func TestGCRAError(t *testing.T) {
+	exec := &fakeExec{err: errors.New("boom")}
+	g := NewGCRA(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 1, WindowMs: 1000}
+	if _, err := g.Allow(context.Background(), rule, "k1", 1, time.Now()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestGCRAInvalidResponse(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(1), int64(1), int64(0)},
+	}
+	g := NewGCRA(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 1, WindowMs: 1000}
+	if _, err := g.Allow(context.Background(), rule, "k1", 1, time.Now()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// newLuaRepo runs the scripts against an in-memory Redis with a Lua engine.
+func newLuaRepo(t *testing.T) (*repo.RedisRepo, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = cli.Close() })
+	return &repo.RedisRepo{Cli: cli}, mr
+}
+
+func TestGCRAScript(t *testing.T) {
+	rr, mr := newLuaRepo(t)
+	g := NewGCRA(rr)
+	ctx := context.Background()
+	// one cell every 100ms; the TAT may run limit+burst = 12 cells ahead
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000, Burst: 2}
+	now := time.UnixMilli(10_000)
+
+	dec, err := g.Allow(ctx, rule, "k1", 1, now)
+	if err != nil || !dec.Allowed || dec.Remaining != 11 || dec.ResetAtMs != 10_100 {
+		t.Fatalf("first cell: %+v, %v", dec, err)
+	}
+	if tat, _ := mr.Get("k1"); tat != "10100.000" {
+		t.Fatalf("TAT = %q, want 10100.000", tat)
+	}
+
+	dec, err = g.Allow(ctx, rule, "k1", 3, now)
+	if err != nil || !dec.Allowed || dec.Remaining != 8 || dec.ResetAtMs != 10_400 {
+		t.Fatalf("cost 3 should advance the TAT by 3 intervals: %+v, %v", dec, err)
+	}
+
+	// fill the tolerance exactly: 12 cells in total at the same instant
+	for i := 0; i < 8; i++ {
+		if dec, err = g.Allow(ctx, rule, "k1", 1, now); err != nil || !dec.Allowed {
+			t.Fatalf("cell %d within limit+burst denied: %+v, %v", 5+i, dec, err)
+		}
+	}
+	if dec.Remaining != 0 || dec.ResetAtMs != 11_200 {
+		t.Fatalf("last cell: %+v", dec)
+	}
+
+	dec, err = g.Allow(ctx, rule, "k1", 1, now)
+	if err != nil || dec.Allowed || dec.RetryAfterMs != 100 || dec.ResetAtMs != 11_200 {
+		t.Fatalf("cell past the burst should wait one interval: %+v, %v", dec, err)
+	}
+	dec, _ = g.Allow(ctx, rule, "k1", 2, now.Add(50*time.Millisecond))
+	if dec.Allowed || dec.RetryAfterMs != 150 {
+		t.Fatalf("two cells 50ms later should wait 150ms: %+v", dec)
+	}
+	if tat, _ := mr.Get("k1"); tat != "11200.000" {
+		t.Fatalf("a denial must not move the TAT: %q", tat)
+	}
+
+	dec, _ = g.Allow(ctx, rule, "k1", 1, now.Add(100*time.Millisecond))
+	if !dec.Allowed || dec.Remaining != 0 || dec.ResetAtMs != 11_300 {
+		t.Fatalf("one interval later a cell is admitted: %+v", dec)
+	}
+
+	// a TAT in the past restarts from now
+	dec, _ = g.Allow(ctx, rule, "k1", 1, now.Add(5*time.Second))
+	if !dec.Allowed || dec.Remaining != 11 || dec.ResetAtMs != 15_100 {
+		t.Fatalf("idle key should start over: %+v", dec)
+	}
+
+	// a fractional interval (1000/3 ms) still admits exactly limit cells
+	odd := config.Rule{RuleID: "r2", Limit: 3, WindowMs: 1000}
+	for i := 0; i < 3; i++ {
+		if dec, _ = g.Allow(ctx, odd, "k2", 1, now); !dec.Allowed {
+			t.Fatalf("cell %d of a fractional interval denied: %+v", i+1, dec)
+		}
+	}
+	if dec, _ = g.Allow(ctx, odd, "k2", 1, now); dec.Allowed || dec.RetryAfterMs != 334 {
+		t.Fatalf("fourth cell should wait one interval: %+v", dec)
+	}
+}
@@ -2,30 +2,38 @@ package limiter
 
 import (
 	"context"
+	_ "embed"
 	"errors"
 	"time"
 )
 
+import (
+	"github.com/redis/go-redis/v9"
+)
+
 import (
 	"github.com/nanjiek/pixiu-rls/internal/config"
 	"github.com/nanjiek/pixiu-rls/internal/repo"
 	"github.com/nanjiek/pixiu-rls/internal/types"
-	"github.com/nanjiek/pixiu-rls/internal/util"
 )
 
+//go:embed leaky.lua
+var leakyBucketScript string
+
 // LeakyBucket enforces rate limits with a leaky bucket script.
 type LeakyBucket struct {
-	repo *repo.RedisRepo
+	repo   *repo.RedisRepo
+	script *redis.Script
 }
 
 func NewLeakyBucket(rdb *repo.RedisRepo) *LeakyBucket {
 	if rdb == nil {
 		panic("limiter: nil redis repo")
 	}
-	return &LeakyBucket{repo: rdb}
+	return &LeakyBucket{repo: rdb, script: redis.NewScript(leakyBucketScript)}
 }
 
-func (l *LeakyBucket) Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error) {
+func (l *LeakyBucket) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
 	if rule.WindowMs <= 0 || rule.Limit <= 0 {
 		err := errors.New("invalid rule")
 		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
@@ -35,40 +43,35 @@ func (l *LeakyBucket) Allow(ctx context.Context, rule config.Rule, key string, n
 		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
 	}
 
-	maxQueue := rule.Burst
-	if maxQueue <= 0 {
-		maxQueue = rule.Limit
-	}
-
-	ratePerMs := float64(rule.Limit) / float64(rule.WindowMs)
-
-	ttlMs := int64(float64(maxQueue) / ratePerMs)
-	if ttlMs < 1000 {
-		ttlMs = 1000
+	cost = normalizeCost(cost)
+	if dec, ok := exceedsCapacity(cost, leakyQueue(rule)); ok {
+		return dec, nil
 	}
-	ttlMs += 1000
 
-	res, err := repo.ScriptLeaky.Run(ctx, l.repo.Cli, []string{key}, ratePerMs, now.UnixMilli(), maxQueue, ttlMs).Result()
+	res, err := l.script.Run(ctx, l.repo.Cli, []string{key}, leakyBucketArgs(rule, now.UnixMilli(), cost)...).Result()
 	if err != nil {
 		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
 	}
+	results, _ := res.([]interface{})
+	return decodeQueue(results)
+}
 
-	results, ok := res.([]interface{})
-	if !ok || len(results) < 2 {
-		err = errors.New("invalid script response")
-		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+// leakyQueue is the queue depth: rule.Burst, or rule.Limit when unset.
+func leakyQueue(rule config.Rule) int64 {
+	if rule.Burst > 0 {
+		return rule.Burst
 	}
+	return rule.Limit
+}
 
-	allowed := util.ToInt64(results[0]) == 1
-	remaining := util.ToInt64(results[1])
+func leakyBucketArgs(rule config.Rule, nowMs, cost int64) []interface{} {
+	maxQueue := leakyQueue(rule)
+	ratePerMs := float64(rule.Limit) / float64(rule.WindowMs)
 
-	decision := types.Decision{
-		Allowed:   allowed,
-		Remaining: remaining,
-		Reason:    "allowed",
-	}
-	if !allowed {
-		decision.Reason = "rate_limited"
+	ttlMs := int64(float64(maxQueue) / ratePerMs)
+	if ttlMs < 1000 {
+		ttlMs = 1000
 	}
-	return decision, nil
+	ttlMs += 1000
+	return []interface{}{ratePerMs, nowMs, maxQueue, ttlMs, cost}
 }
@@ -0,0 +1,40 @@
+-- Leaky bucket script
+-- KEYS[1]=bucket hash
+-- ARGV[1]=rate_per_ms, ARGV[2]=now_ms, ARGV[3]=max_queue, ARGV[4]=ttl_ms, ARGV[5]=cost (default 1)
+-- returns {allowed, remaining, retry_ms}
+
+local rate = tonumber(ARGV[1])
+local now  = tonumber(ARGV[2])
+local maxq = tonumber(ARGV[3])
+local ttl  = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5] or 1)
+
+local lvl  = tonumber(redis.call('HGET', KEYS[1], 'level') or 0)
+local last = tonumber(redis.call('HGET', KEYS[1], 'last_ts') or now)
+
+-- 漏水
+if now > last then
+  local leak = (now - last) * rate
+  lvl = math.max(0, lvl - leak)
+end
+
+-- 加入请求（cost 个单位；cost=1 时与 lvl < maxq 等价）
+local ok = 0
+local retry = 0
+if lvl + cost - 1 < maxq then
+  lvl = lvl + cost
+  ok = 1
+else
+  retry = math.floor((lvl + cost - 1 - maxq) / rate) + 1
+end
+
+-- 保存状态并设置过期时间
+redis.call('HSET', KEYS[1], 'level', lvl, 'last_ts', now)
+redis.call('PEXPIRE', KEYS[1], ttl)
+
+local remaining = maxq - lvl
+if remaining < 0 then
+  remaining = 0
+end
+
+return {ok, math.floor(remaining), retry}
@@ -0,0 +1,230 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+const localShards = 64
+
+// LocalAlgos lists the algorithms Local serves. concurrency is not among them:
+// its leases have to be shared through Redis.
+var LocalAlgos = []string{"token_bucket", "sliding_window", "sliding_window_counter", "leaky_bucket", "gcra"}
+
+// Local is an in-process limiter for running without Redis and for degrading
+// when Redis fails. It implements token_bucket, sliding_window and
+// leaky_bucket; gcra is served as a token bucket and sliding_window_counter as
+// a sliding window. State lives in sharded maps and idle keys expire after
+// their TTL.
+//
+// With replicas > 1 every instance enforces its share of the limit, i.e.
+// limit/replicas (and burst/replicas), rounded up.
+type Local struct {
+	seed     maphash.Seed
+	shards   [localShards]localShard
+	replicas int64
+}
+
+type localShard struct {
+	mu      sync.Mutex
+	entries map[string]*localEntry
+}
+
+type localEntry struct {
+	level    float64    // tokens (token bucket) or queue level (leaky bucket)
+	last     int64      // ms of the last refill / leak
+	hits     []localHit // sliding window log, oldest first
+	expireAt int64
+}
+
+type localHit struct {
+	at int64
+	n  int64
+}
+
+func NewLocal(replicas int) *Local {
+	if replicas < 1 {
+		replicas = 1
+	}
+	l := &Local{seed: maphash.MakeSeed(), replicas: int64(replicas)}
+	for i := range l.shards {
+		l.shards[i].entries = make(map[string]*localEntry)
+	}
+	return l
+}
+
+func (l *Local) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	if rule.WindowMs <= 0 || rule.Limit <= 0 {
+		err := errors.New("invalid rule")
+		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
+	}
+	if key == "" {
+		err := errors.New("empty key")
+		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
+	}
+	rule.Limit = l.share(rule.Limit)
+	rule.Burst = l.share(max(rule.Burst, 0))
+	cost = normalizeCost(cost)
+	nowMs := now.UnixMilli()
+
+	var capacity int64
+	var eval func(e *localEntry) types.Decision
+	switch algo := normalizeAlgo(rule.Algo); algo {
+	case "", "token_bucket", "gcra":
+		capacity = rule.Limit + rule.Burst
+		eval = func(e *localEntry) types.Decision { return localTokenBucket(e, rule, cost, nowMs) }
+	case "sliding_window", "sliding_window_counter":
+		capacity = rule.Limit
+		eval = func(e *localEntry) types.Decision { return localSliding(e, rule, cost, nowMs) }
+	case "leaky_bucket":
+		capacity = rule.Burst
+		if capacity <= 0 {
+			capacity = rule.Limit
+		}
+		eval = func(e *localEntry) types.Decision { return localLeaky(e, rule, capacity, cost, nowMs) }
+	default:
+		err := errors.New("local limiter does not support algorithm: " + algo)
+		return types.Decision{Allowed: false, Reason: "unsupported_algorithm", Err: err}, err
+	}
+	if dec, ok := exceedsCapacity(cost, capacity); ok {
+		return dec, nil
+	}
+
+	s := &l.shards[maphash.String(l.seed, key)%localShards]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || e.expireAt <= nowMs {
+		e = &localEntry{level: math.NaN(), last: nowMs}
+		s.entries[key] = e
+	}
+	return eval(e), nil
+}
+
+// Sweep evicts the keys whose TTL has passed and returns how many it removed.
+func (l *Local) Sweep(now time.Time) int {
+	nowMs := now.UnixMilli()
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		for k, e := range s.entries {
+			if e.expireAt <= nowMs {
+				delete(s.entries, k)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Run sweeps expired keys every interval until ctx is done.
+func (l *Local) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.Sweep(now)
+		}
+	}
+}
+
+func (l *Local) share(v int64) int64 {
+	return (v + l.replicas - 1) / l.replicas
+}
+
+func localTokenBucket(e *localEntry, rule config.Rule, cost, nowMs int64) types.Decision {
+	capacity := float64(rule.Limit + rule.Burst)
+	rate := float64(rule.Limit) / float64(rule.WindowMs)
+	if math.IsNaN(e.level) {
+		e.level = capacity
+	}
+	if nowMs > e.last {
+		e.level = math.Min(capacity, e.level+float64(nowMs-e.last)*rate)
+		e.last = nowMs
+	}
+	e.expireAt = nowMs + max(rule.WindowMs, int64(math.Ceil(capacity/rate)))
+
+	if e.level < float64(cost) {
+		return types.Decision{
+			Allowed:      false,
+			Remaining:    int64(e.level),
+			RetryAfterMs: int64(math.Ceil((float64(cost) - e.level) / rate)),
+			Reason:       "rate_limited",
+		}
+	}
+	e.level -= float64(cost)
+	return types.Decision{Allowed: true, Remaining: int64(e.level), Reason: "allowed"}
+}
+
+func localSliding(e *localEntry, rule config.Rule, cost, nowMs int64) types.Decision {
+	cut := 0
+	for cut < len(e.hits) && e.hits[cut].at <= nowMs-rule.WindowMs {
+		cut++
+	}
+	e.hits = e.hits[cut:]
+	var count int64
+	for _, h := range e.hits {
+		count += h.n
+	}
+	e.expireAt = nowMs + rule.WindowMs
+
+	if count+cost > rule.Limit {
+		// wait until enough of the oldest hits leave the window
+		need, retry := count+cost-rule.Limit, rule.WindowMs
+		for _, h := range e.hits {
+			need -= h.n
+			if need <= 0 {
+				retry = max(1, h.at+rule.WindowMs-nowMs)
+				break
+			}
+		}
+		return types.Decision{Allowed: false, Remaining: rule.Limit - count, RetryAfterMs: retry, Reason: "rate_limited"}
+	}
+	if n := len(e.hits); n > 0 && e.hits[n-1].at == nowMs {
+		e.hits[n-1].n += cost
+	} else {
+		e.hits = append(e.hits, localHit{at: nowMs, n: cost})
+	}
+	return types.Decision{Allowed: true, Remaining: rule.Limit - count - cost, Reason: "allowed"}
+}
+
+func localLeaky(e *localEntry, rule config.Rule, maxQueue, cost, nowMs int64) types.Decision {
+	rate := float64(rule.Limit) / float64(rule.WindowMs)
+	if math.IsNaN(e.level) {
+		e.level = 0
+	}
+	if nowMs > e.last {
+		e.level = math.Max(0, e.level-float64(nowMs-e.last)*rate)
+		e.last = nowMs
+	}
+	e.expireAt = nowMs + max(1000, int64(float64(maxQueue)/rate)) + 1000
+
+	limit := float64(maxQueue)
+	if e.level+float64(cost)-1 >= limit {
+		return types.Decision{
+			Allowed:      false,
+			Remaining:    int64(math.Max(0, limit-e.level)),
+			RetryAfterMs: int64(math.Floor((e.level+float64(cost)-1-limit)/rate)) + 1,
+			Reason:       "rate_limited",
+		}
+	}
+	e.level += float64(cost)
+	return types.Decision{Allowed: true, Remaining: int64(math.Max(0, limit-e.level)), Reason: "allowed"}
+}
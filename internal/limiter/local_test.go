@@ -0,0 +1,132 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestLocal_TokenBucket(t *testing.T) {
+	l := NewLocal(1)
+	rule := config.Rule{Algo: "token_bucket", Limit: 2, WindowMs: 1000}
+	now := time.UnixMilli(1_000_000)
+
+	for i := 0; i < 2; i++ {
+		dec, err := l.Allow(context.Background(), rule, "k", 1, now)
+		if err != nil || !dec.Allowed {
+			t.Fatalf("request %d: expected allowed, got %+v err=%v", i, dec, err)
+		}
+	}
+	dec, err := l.Allow(context.Background(), rule, "k", 1, now)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dec.Allowed || dec.RetryAfterMs != 500 {
+		t.Fatalf("expected deny with 500ms retry, got %+v", dec)
+	}
+	dec, _ = l.Allow(context.Background(), rule, "k", 1, now.Add(500*time.Millisecond))
+	if !dec.Allowed {
+		t.Fatalf("expected allowed after refill, got %+v", dec)
+	}
+}
+
+func TestLocal_SlidingWindow(t *testing.T) {
+	l := NewLocal(1)
+	rule := config.Rule{Algo: "sliding_window", Limit: 3, WindowMs: 1000}
+	now := time.UnixMilli(1_000_000)
+
+	if dec, _ := l.Allow(context.Background(), rule, "k", 2, now); !dec.Allowed {
+		t.Fatalf("expected allowed, got %+v", dec)
+	}
+	if dec, _ := l.Allow(context.Background(), rule, "k", 1, now.Add(200*time.Millisecond)); !dec.Allowed {
+		t.Fatalf("expected allowed, got %+v", dec)
+	}
+	dec, _ := l.Allow(context.Background(), rule, "k", 2, now.Add(300*time.Millisecond))
+	if dec.Allowed || dec.RetryAfterMs != 700 {
+		t.Fatalf("expected deny until the first hits leave the window, got %+v", dec)
+	}
+	if dec, _ := l.Allow(context.Background(), rule, "k", 2, now.Add(time.Second)); !dec.Allowed {
+		t.Fatalf("expected allowed once the window slid, got %+v", dec)
+	}
+}
+
+func TestLocal_LeakyBucket(t *testing.T) {
+	l := NewLocal(1)
+	rule := config.Rule{Algo: "leaky_bucket", Limit: 10, WindowMs: 1000, Burst: 2}
+	now := time.UnixMilli(1_000_000)
+
+	for i := 0; i < 2; i++ {
+		if dec, _ := l.Allow(context.Background(), rule, "k", 1, now); !dec.Allowed {
+			t.Fatalf("request %d: expected allowed, got %+v", i, dec)
+		}
+	}
+	if dec, _ := l.Allow(context.Background(), rule, "k", 1, now); dec.Allowed {
+		t.Fatalf("expected full queue to deny, got %+v", dec)
+	}
+	if dec, _ := l.Allow(context.Background(), rule, "k", 1, now.Add(100*time.Millisecond)); !dec.Allowed {
+		t.Fatalf("expected allowed after leaking, got %+v", dec)
+	}
+}
+
+func TestLocal_ReplicaShare(t *testing.T) {
+	l := NewLocal(3)
+	rule := config.Rule{Algo: "sliding_window", Limit: 10, WindowMs: 1000}
+	now := time.UnixMilli(1_000_000)
+
+	// ceil(10/3) = 4 per instance
+	dec, _ := l.Allow(context.Background(), rule, "k", 4, now)
+	if !dec.Allowed || dec.Remaining != 0 {
+		t.Fatalf("expected the whole share to be granted, got %+v", dec)
+	}
+	if dec, _ := l.Allow(context.Background(), rule, "k", 1, now); dec.Allowed {
+		t.Fatalf("expected deny beyond the replica share, got %+v", dec)
+	}
+}
+
+func TestLocal_Sweep(t *testing.T) {
+	l := NewLocal(1)
+	rule := config.Rule{Algo: "sliding_window", Limit: 1, WindowMs: 1000}
+	now := time.UnixMilli(1_000_000)
+
+	_, _ = l.Allow(context.Background(), rule, "a", 1, now)
+	_, _ = l.Allow(context.Background(), rule, "b", 1, now.Add(800*time.Millisecond))
+	if n := l.Sweep(now.Add(time.Second)); n != 1 {
+		t.Fatalf("expected 1 evicted key, got %d", n)
+	}
+	if n := l.Sweep(now.Add(2 * time.Second)); n != 1 {
+		t.Fatalf("expected 1 evicted key, got %d", n)
+	}
+}
+
+func TestLocal_UnsupportedAlgo(t *testing.T) {
+	l := NewLocal(1)
+	rule := config.Rule{Algo: "concurrency", Limit: 1, WindowMs: 1000}
+	if _, err := l.Allow(context.Background(), rule, "k", 1, time.Now()); err == nil {
+		t.Fatal("expected error for concurrency")
+	}
+}
+
+func TestLocal_MuxForLocalOnly(t *testing.T) {
+	l := NewLocal(1)
+	limiters := make(map[string]Limiter, len(LocalAlgos))
+	for _, algo := range LocalAlgos {
+		limiters[algo] = l
+	}
+	mux := NewMux("token_bucket", limiters)
+	now := time.UnixMilli(1_000_000)
+
+	for _, algo := range LocalAlgos {
+		rule := config.Rule{Algo: algo, Limit: 1, WindowMs: 1000}
+		if dec, err := mux.Allow(context.Background(), rule, "k:"+algo, 1, now); err != nil || !dec.Allowed {
+			t.Fatalf("%s: expected allowed, got %+v err=%v", algo, dec, err)
+		}
+	}
+	rule := config.Rule{Algo: "concurrency", Limit: 1, WindowMs: 1000}
+	if dec, err := mux.Allow(context.Background(), rule, "k", 1, now); err == nil || dec.Reason != "unsupported_algorithm" {
+		t.Fatalf("concurrency needs redis, got %+v err=%v", dec, err)
+	}
+}
@@ -12,9 +12,10 @@ import (
 	"github.com/nanjiek/pixiu-rls/internal/types"
 )
 
-// Limiter defines the limiter interface used by the engine.
+// Limiter defines the limiter interface used by the engine. cost is the
+// number of units the request consumes; values <= 0 count as 1.
 type Limiter interface {
-	Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error)
+	Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error)
 }
 
 // Mux routes to a limiter by rule.Algo with a default fallback.
@@ -41,18 +42,71 @@ func NewMux(defaultAlgo string, limiters map[string]Limiter) *Mux {
 	}
 }
 
-func (m *Mux) Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error) {
+func (m *Mux) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
+	lim, err := m.route(rule)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "unsupported_algorithm"}, err
+	}
+	return lim.Allow(ctx, rule, key, cost, now)
+}
+
+// Acquire takes a lease from the rule's limiter if it is a Leaser.
+func (m *Mux) Acquire(ctx context.Context, rule config.Rule, key, leaseID string, cost int64, ttl time.Duration, now time.Time) (types.Decision, error) {
+	ls, err := m.leaser(rule)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "unsupported_algorithm"}, err
+	}
+	return ls.Acquire(ctx, rule, key, leaseID, cost, ttl, now)
+}
+
+// Release frees a lease taken by Acquire.
+func (m *Mux) Release(ctx context.Context, rule config.Rule, key, leaseID string, now time.Time) (bool, error) {
+	ls, err := m.leaser(rule)
+	if err != nil {
+		return false, err
+	}
+	return ls.Release(ctx, rule, key, leaseID, now)
+}
+
+func (m *Mux) route(rule config.Rule) (Limiter, error) {
 	algo := normalizeAlgo(rule.Algo)
 	if algo == "" {
 		algo = m.defaultAlgo
 	}
 	lim, ok := m.limiters[algo]
 	if !ok || lim == nil {
-		return types.Decision{Allowed: false, Reason: "unsupported_algorithm"}, errors.New("unsupported algorithm: " + algo)
+		return nil, errors.New("unsupported algorithm: " + algo)
 	}
-	return lim.Allow(ctx, rule, key, now)
+	return lim, nil
+}
+
+func (m *Mux) leaser(rule config.Rule) (Leaser, error) {
+	lim, err := m.route(rule)
+	if err != nil {
+		return nil, err
+	}
+	ls, ok := lim.(Leaser)
+	if !ok {
+		return nil, errors.New("algorithm does not support leases: " + normalizeAlgo(rule.Algo))
+	}
+	return ls, nil
 }
 
 func normalizeAlgo(algo string) string {
 	return strings.ToLower(strings.TrimSpace(algo))
 }
+
+func normalizeCost(cost int64) int64 {
+	if cost <= 0 {
+		return 1
+	}
+	return cost
+}
+
+// exceedsCapacity denies a cost that no amount of waiting can admit.
+func exceedsCapacity(cost, capacity int64) (types.Decision, bool) {
+	if cost <= capacity {
+		return types.Decision{}, false
+	}
+	return types.Decision{Allowed: false, Reason: "cost_exceeds_capacity"}, true
+}
@@ -15,7 +15,7 @@ type mockLimiter struct {
 	allowed bool
 }
 
-func (m *mockLimiter) Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error) {
+func (m *mockLimiter) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
 	return types.Decision{Allowed: m.allowed, Reason: "mock"}, nil
 }
 
@@ -23,7 +23,7 @@ func TestMux_DefaultAlgo(t *testing.T) {
 	mux := NewMux("token_bucket", map[string]Limiter{
 		"token_bucket": &mockLimiter{allowed: true},
 	})
-	dec, err := mux.Allow(context.Background(), config.Rule{}, "k1", time.Now())
+	dec, err := mux.Allow(context.Background(), config.Rule{}, "k1", 1, time.Now())
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
@@ -36,8 +36,17 @@ func TestMux_UnsupportedAlgo(t *testing.T) {
 	mux := NewMux("token_bucket", map[string]Limiter{
 		"token_bucket": &mockLimiter{allowed: true},
 	})
-	_, err := mux.Allow(context.Background(), config.Rule{Algo: "unknown"}, "k1", time.Now())
+	_, err := mux.Allow(context.Background(), config.Rule{Algo: "unknown"}, "k1", 1, time.Now())
 	if err == nil {
 		t.Fatal("expected error for unsupported algorithm")
 	}
 }
+
+func TestMux_AcquireRequiresLeaser(t *testing.T) {
+	mux := NewMux("token_bucket", map[string]Limiter{
+		"token_bucket": &mockLimiter{allowed: true},
+	})
+	if _, err := mux.Acquire(context.Background(), config.Rule{Algo: "token_bucket"}, "k1", "l1", 1, 0, time.Now()); err == nil {
+		t.Fatal("expected error for an algorithm without leases")
+	}
+}
@@ -5,12 +5,14 @@
 -- ARGV[3]: burst
 -- ARGV[4]: now_ms
 -- ARGV[5]: ttl_ms
+-- ARGV[6]: cost (tokens to take, default 1)
 
 local limit = tonumber(ARGV[1])
 local window_ms = tonumber(ARGV[2])
 local burst = tonumber(ARGV[3])
 local now_ms = tonumber(ARGV[4])
 local ttl_ms = tonumber(ARGV[5])
+local cost = tonumber(ARGV[6] or 1)
 
 local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
 local last = tonumber(redis.call("HGET", KEYS[1], "last_refill"))
@@ -26,17 +28,20 @@ tokens = math.min(limit + burst, tokens + refill)
 last = now_ms
 
 local allowed = 0
-if tokens >= 1 then
-  tokens = tokens - 1
+if tokens >= cost then
+  tokens = tokens - cost
   allowed = 1
 end
 
-local reset_ms = 0
-if tokens < 1 then
-  local need = 1 - tokens
-  reset_ms = now_ms + math.floor(need / rate_per_ms)
-else
-  reset_ms = now_ms
+-- reset_ms: when a denied request's cost, or after an admission the next
+-- single token, becomes available
+local need = 1
+if allowed == 0 then
+  need = cost
+end
+local reset_ms = now_ms
+if tokens < need then
+  reset_ms = now_ms + math.ceil((need - tokens) / rate_per_ms)
 end
 
 redis.call("HSET", KEYS[1], "tokens", tokens, "last_refill", last)
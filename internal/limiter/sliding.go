@@ -2,10 +2,17 @@ package limiter
 
 import (
 	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
 	"errors"
 	"time"
 )
 
+import (
+	"github.com/redis/go-redis/v9"
+)
+
 import (
 	"github.com/nanjiek/pixiu-rls/internal/config"
 	"github.com/nanjiek/pixiu-rls/internal/repo"
@@ -13,19 +20,23 @@ import (
 	"github.com/nanjiek/pixiu-rls/internal/util"
 )
 
+//go:embed sliding.lua
+var slidingWindowScript string
+
 // SlidingWindow enforces rate limits with a sliding window script.
 type SlidingWindow struct {
-	repo *repo.RedisRepo
+	repo   *repo.RedisRepo
+	script *redis.Script
 }
 
 func NewSlidingWindow(rdb *repo.RedisRepo) *SlidingWindow {
 	if rdb == nil {
 		panic("limiter: nil redis repo")
 	}
-	return &SlidingWindow{repo: rdb}
+	return &SlidingWindow{repo: rdb, script: redis.NewScript(slidingWindowScript)}
 }
 
-func (s *SlidingWindow) Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error) {
+func (s *SlidingWindow) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
 	if rule.WindowMs <= 0 || rule.Limit <= 0 {
 		err := errors.New("invalid rule")
 		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
@@ -34,15 +45,33 @@ func (s *SlidingWindow) Allow(ctx context.Context, rule config.Rule, key string,
 		err := errors.New("empty key")
 		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
 	}
+	cost = normalizeCost(cost)
+	if dec, ok := exceedsCapacity(cost, rule.Limit); ok {
+		return dec, nil
+	}
 
-	res, err := repo.ScriptSliding.Run(ctx, s.repo.Cli, []string{key}, now.UnixMilli(), rule.WindowMs, rule.Limit).Result()
+	res, err := s.script.Run(ctx, s.repo.Cli, slidingWindowKeys(key), slidingWindowArgs(rule, now.UnixMilli(), cost, requestToken())...).Result()
 	if err != nil {
 		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
 	}
+	results, _ := res.([]interface{})
+	return decodeQueue(results)
+}
 
-	results, ok := res.([]interface{})
-	if !ok || len(results) < 2 {
-		err = errors.New("invalid script response")
+// slidingWindowKeys returns the request log and the key holding its total
+// cost; limiter keys carry a hash tag, so both live in one cluster slot.
+func slidingWindowKeys(key string) []string {
+	return []string{key, key + ":total"}
+}
+
+func slidingWindowArgs(rule config.Rule, nowMs, cost int64, token string) []interface{} {
+	return []interface{}{nowMs, rule.WindowMs, rule.Limit, cost, token}
+}
+
+// decodeQueue turns a sliding.lua or leaky.lua reply into a decision.
+func decodeQueue(results []interface{}) (types.Decision, error) {
+	if len(results) < 2 {
+		err := errors.New("invalid script response")
 		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
 	}
 
@@ -56,6 +85,17 @@ func (s *SlidingWindow) Allow(ctx context.Context, rule config.Rule, key string,
 	}
 	if !allowed {
 		decision.Reason = "rate_limited"
+		if len(results) > 2 {
+			decision.RetryAfterMs = util.ToInt64(results[2])
+		}
 	}
 	return decision, nil
 }
+
+// requestToken returns a random value that makes the ZSET members of one
+// request unique, even when several requests share a millisecond.
+func requestToken() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,70 @@
+-- Sliding window log script
+-- KEYS[1] = zset_key, one member per admitted request: now_ms:token#cost, score = now_ms
+-- KEYS[2] = total cost of the members of KEYS[1]
+-- ARGV[1] = now_ms
+-- ARGV[2] = window_ms
+-- ARGV[3] = limit
+-- ARGV[4] = cost (units of this request, default 1)
+-- ARGV[5] = per-request token, keeps members of same-millisecond requests distinct
+-- returns {allowed, remaining, retry_ms}
+
+local now    = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit  = tonumber(ARGV[3])
+local cost   = tonumber(ARGV[4] or 1)
+local token  = ARGV[5] or ''
+
+-- 请求的权重编码在成员末尾；没有权重的成员（旧格式）按 1 计
+local function weight(member)
+  return tonumber(string.match(member, '#(%d+)$')) or 1
+end
+
+-- 删除窗口外的请求，并从总量中扣除它们的权重
+local cnt = tonumber(redis.call('GET', KEYS[2]))
+local trimmed = false
+if cnt ~= nil then
+  local expired = redis.call('ZRANGEBYSCORE', KEYS[1], 0, now - window)
+  for _, m in ipairs(expired) do
+    cnt = cnt - weight(m)
+  end
+  trimmed = #expired > 0
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+if redis.call('ZCARD', KEYS[1]) == 0 then
+  cnt = 0
+elseif cnt == nil then
+  -- 总量丢失：按窗口内的成员重算一次
+  cnt = 0
+  for _, m in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+    cnt = cnt + weight(m)
+  end
+  trimmed = true
+end
+
+if cnt + cost > limit then
+  if trimmed then
+    redis.call('SET', KEYS[2], cnt, 'PX', math.max(1, redis.call('PTTL', KEYS[1])))
+  end
+  -- 被拒绝的请求不计入窗口；等待足够多的最早记录滑出窗口
+  local need = cnt + cost - limit
+  local retry = window
+  local oldest = redis.call('ZRANGE', KEYS[1], 0, need - 1, 'WITHSCORES')
+  local freed = 0
+  for i = 1, #oldest, 2 do
+    freed = freed + weight(oldest[i])
+    if freed >= need then
+      retry = math.max(1, tonumber(oldest[i + 1]) + window - now)
+      break
+    end
+  end
+  return {0, math.max(0, limit - cnt), retry}
+end
+
+-- 插入当前请求（一个成员携带 cost 权重；成员带请求 token，同一毫秒的请求不会互相覆盖）
+redis.call('ZADD', KEYS[1], now, now .. ':' .. token .. '#' .. cost)
+
+-- 设置过期时间，避免 key 永久存在；总量与成员同时过期
+redis.call('SET', KEYS[2], cnt + cost, 'PX', window + 1000)
+redis.call('PEXPIRE', KEYS[1], window + 1000)
+
+return {1, limit - cnt - cost, 0}
@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"errors"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,16 +17,22 @@ import (
 //go:embed script.lua
 var tokenBucketScript string
 
+// defaultTTLFactor keeps an idle bucket for this many windows.
+const defaultTTLFactor = 2
+
 // ScriptExecutor executes a Lua script and returns raw results.
 type ScriptExecutor interface {
 	Eval(ctx context.Context, script string, keys []string, args ...interface{}) ([]interface{}, error)
 }
 
-// TokenBucket applies token bucket algorithm via Lua script.
+// TokenBucket applies token bucket algorithm via Lua script. Rules with
+// localBatch enabled are served from tokens leased in chunks (see tokenlease.go).
 type TokenBucket struct {
-	exec      ScriptExecutor
-	script    string
-	ttlFactor int64
+	exec        ScriptExecutor
+	script      string
+	leaseScript string
+	ttlFactor   int64
+	leases      sync.Map // key -> *tokenLease
 }
 
 func NewTokenBucket(exec ScriptExecutor) *TokenBucket {
@@ -33,13 +40,14 @@ func NewTokenBucket(exec ScriptExecutor) *TokenBucket {
 		panic("limiter: nil ScriptExecutor")
 	}
 	return &TokenBucket{
-		exec:      exec,
-		script:    tokenBucketScript,
-		ttlFactor: 2,
+		exec:        exec,
+		script:      tokenBucketScript,
+		leaseScript: tokenLeaseScript,
+		ttlFactor:   defaultTTLFactor,
 	}
 }
 
-func (t *TokenBucket) Allow(ctx context.Context, rule config.Rule, key string, now time.Time) (types.Decision, error) {
+func (t *TokenBucket) Allow(ctx context.Context, rule config.Rule, key string, cost int64, now time.Time) (types.Decision, error) {
 	if rule.WindowMs <= 0 || rule.Limit <= 0 {
 		err := errors.New("invalid rule")
 		return types.Decision{Allowed: false, Reason: "invalid_rule", Err: err}, err
@@ -48,35 +56,48 @@ func (t *TokenBucket) Allow(ctx context.Context, rule config.Rule, key string, n
 		err := errors.New("empty key")
 		return types.Decision{Allowed: false, Reason: "empty_key", Err: err}, err
 	}
+	cost = normalizeCost(cost)
+	if dec, ok := exceedsCapacity(cost, rule.Limit+max(rule.Burst, 0)); ok {
+		return dec, nil
+	}
 
 	nowMs := now.UnixNano() / int64(time.Millisecond)
-	ttlMs := rule.WindowMs * t.ttlFactor
-	if ttlMs <= 0 {
-		ttlMs = rule.WindowMs
+	ttlMs := t.ttl(rule)
+	if rule.LocalBatch.Size > 0 {
+		return t.allowLeased(ctx, rule, key, cost, nowMs, ttlMs)
 	}
 
-	res, err := t.exec.Eval(ctx, t.script, []string{key}, rule.Limit, rule.WindowMs, rule.Burst, nowMs, ttlMs)
+	res, err := t.exec.Eval(ctx, t.script, []string{key}, tokenBucketArgs(rule, nowMs, ttlMs, cost)...)
 	if err != nil {
 		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
 	}
+	return decodeTokenBucket(res, nowMs)
+}
+
+func tokenBucketArgs(rule config.Rule, nowMs, ttlMs, cost int64) []interface{} {
+	return []interface{}{rule.Limit, rule.WindowMs, rule.Burst, nowMs, ttlMs, cost}
+}
+
+// decodeTokenBucket turns a script.lua reply into a decision.
+func decodeTokenBucket(res []interface{}, nowMs int64) (types.Decision, error) {
 	if len(res) < 3 {
-		err = errors.New("invalid script response")
+		err := errors.New("invalid script response")
 		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
 	}
 
 	allowed, ok := toInt64(res[0])
 	if !ok {
-		err = errors.New("invalid allowed value")
+		err := errors.New("invalid allowed value")
 		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
 	}
 	remaining, ok := toInt64(res[1])
 	if !ok {
-		err = errors.New("invalid remaining value")
+		err := errors.New("invalid remaining value")
 		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
 	}
 	resetMs, ok := toInt64(res[2])
 	if !ok {
-		err = errors.New("invalid reset value")
+		err := errors.New("invalid reset value")
 		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
 	}
 
@@ -94,6 +115,18 @@ func (t *TokenBucket) Allow(ctx context.Context, rule config.Rule, key string, n
 	return decision, nil
 }
 
+func (t *TokenBucket) ttl(rule config.Rule) int64 {
+	return tokenBucketTTL(rule, t.ttlFactor)
+}
+
+func tokenBucketTTL(rule config.Rule, factor int64) int64 {
+	ttlMs := rule.WindowMs * factor
+	if ttlMs <= 0 {
+		ttlMs = rule.WindowMs
+	}
+	return ttlMs
+}
+
 func toInt64(v interface{}) (int64, bool) {
 	switch val := v.(type) {
 	case int64:
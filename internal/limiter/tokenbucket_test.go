@@ -31,7 +31,7 @@ func TestTokenBucketAllow(t *testing.T) {
 	tb := NewTokenBucket(exec)
 
 	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000, Burst: 0}
-	dec, err := tb.Allow(context.Background(), rule, "k1", time.UnixMilli(100))
+	dec, err := tb.Allow(context.Background(), rule, "k1", 1, time.UnixMilli(100))
 	if err != nil {
 		t.Fatalf("allow failed: %v", err)
 	}
@@ -53,7 +53,7 @@ func TestTokenBucketRateLimited(t *testing.T) {
 	tb := NewTokenBucket(exec)
 
 	rule := config.Rule{RuleID: "r1", Limit: 1, WindowMs: 1000, Burst: 0}
-	dec, err := tb.Allow(context.Background(), rule, "k1", time.UnixMilli(1000))
+	dec, err := tb.Allow(context.Background(), rule, "k1", 1, time.UnixMilli(1000))
 	if err != nil {
 		t.Fatalf("allow failed: %v", err)
 	}
@@ -67,7 +67,7 @@ func TestTokenBucketError(t *testing.T) {
 	tb := NewTokenBucket(exec)
 
 	rule := config.Rule{RuleID: "r1", Limit: 1, WindowMs: 1000}
-	if _, err := tb.Allow(context.Background(), rule, "k1", time.Now()); err == nil {
+	if _, err := tb.Allow(context.Background(), rule, "k1", 1, time.Now()); err == nil {
 		t.Fatalf("expected error")
 	}
 }
@@ -79,7 +79,34 @@ func TestTokenBucketInvalidResponse(t *testing.T) {
 	tb := NewTokenBucket(exec)
 
 	rule := config.Rule{RuleID: "r1", Limit: 1, WindowMs: 1000}
-	if _, err := tb.Allow(context.Background(), rule, "k1", time.Now()); err == nil {
+	if _, err := tb.Allow(context.Background(), rule, "k1", 1, time.Now()); err == nil {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestTokenBucketCost(t *testing.T) {
+	exec := &fakeExec{
+		result: []interface{}{int64(1), int64(5), int64(1000)},
+	}
+	tb := NewTokenBucket(exec)
+
+	rule := config.Rule{RuleID: "r1", Limit: 10, WindowMs: 1000, Burst: 2}
+	if _, err := tb.Allow(context.Background(), rule, "k1", 5, time.UnixMilli(100)); err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if len(exec.args) != 6 || exec.args[5] != int64(5) {
+		t.Fatalf("cost not passed to script: %#v", exec.args)
+	}
+
+	exec.args = nil
+	dec, err := tb.Allow(context.Background(), rule, "k1", 13, time.UnixMilli(100))
+	if err != nil {
+		t.Fatalf("allow failed: %v", err)
+	}
+	if dec.Allowed || dec.Reason != "cost_exceeds_capacity" {
+		t.Fatalf("unexpected decision: %#v", dec)
+	}
+	if exec.args != nil {
+		t.Fatalf("script should not run for an impossible cost")
+	}
+}
@@ -0,0 +1,154 @@
+package limiter
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+//go:embed tokenlease.lua
+var tokenLeaseScript string
+
+const defaultLeaseMs = 100
+
+// tokenLease holds the tokens this instance leased from a bucket for a rule
+// with localBatch enabled. Requests spend them without touching Redis until
+// they run out or the lease expires; the leftover goes back with the next
+// lease call or when Sweep finds the lease expired.
+type tokenLease struct {
+	mu       sync.Mutex
+	rule     config.Rule
+	tokens   int64 // leased and not yet spent
+	remote   int64 // tokens left in Redis after the last lease call
+	expireAt int64
+	retryAt  int64 // after a denied lease call, deny locally until then
+	dead     bool  // removed by Sweep; callers must load a fresh lease
+}
+
+func (t *TokenBucket) allowLeased(ctx context.Context, rule config.Rule, key string, cost, nowMs, ttlMs int64) (types.Decision, error) {
+	l := t.lockLease(key)
+	defer l.mu.Unlock()
+
+	if l.expireAt > nowMs && l.tokens >= cost {
+		l.tokens -= cost
+		return types.Decision{Allowed: true, Remaining: l.remote + l.tokens, Reason: "allowed"}, nil
+	}
+	if l.retryAt > nowMs {
+		return types.Decision{Allowed: false, Remaining: 0, RetryAfterMs: l.retryAt - nowMs, Reason: "rate_limited"}, nil
+	}
+
+	want := max(rule.LocalBatch.Size, cost)
+	res, err := t.exec.Eval(ctx, t.leaseScript, []string{key}, rule.Limit, rule.WindowMs, rule.Burst, nowMs, ttlMs, l.tokens, want, cost)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "limiter_eval_failed", Err: err}, err
+	}
+	vals, err := leaseResult(res)
+	if err != nil {
+		return types.Decision{Allowed: false, Reason: "invalid_script_response", Err: err}, err
+	}
+	granted, remote, resetMs := vals[0], vals[1], vals[2]
+
+	l.rule = rule
+	l.remote = remote
+	if granted < cost {
+		l.tokens, l.expireAt = 0, 0
+		decision := types.Decision{Allowed: false, Remaining: remote, Reason: "rate_limited"}
+		if resetMs > nowMs {
+			decision.RetryAfterMs = resetMs - nowMs
+			l.retryAt = min(resetMs, nowMs+leaseMs(rule))
+		}
+		return decision, nil
+	}
+	l.retryAt = 0
+	l.tokens = granted - cost
+	l.expireAt = nowMs + leaseMs(rule)
+	return types.Decision{Allowed: true, Remaining: remote + l.tokens, Reason: "allowed"}, nil
+}
+
+// lockLease returns the locked lease of key, creating it when missing.
+func (t *TokenBucket) lockLease(key string) *tokenLease {
+	for {
+		v, ok := t.leases.Load(key)
+		if !ok {
+			v, _ = t.leases.LoadOrStore(key, &tokenLease{})
+		}
+		l := v.(*tokenLease)
+		l.mu.Lock()
+		if !l.dead {
+			return l
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Sweep gives the unused tokens of expired leases back to Redis and drops
+// those leases. It returns how many leases it dropped.
+func (t *TokenBucket) Sweep(ctx context.Context, now time.Time) int {
+	nowMs := now.UnixMilli()
+	n := 0
+	t.leases.Range(func(k, v any) bool {
+		l := v.(*tokenLease)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.expireAt > nowMs {
+			return true
+		}
+		if l.tokens > 0 {
+			rule := l.rule
+			// a failed give-back only leaves the tokens unspent until they refill
+			_, _ = t.exec.Eval(ctx, t.leaseScript, []string{k.(string)}, rule.Limit, rule.WindowMs, rule.Burst, nowMs, t.ttl(rule), l.tokens, 0, 0)
+		}
+		l.dead = true
+		t.leases.Delete(k)
+		n++
+		return true
+	})
+	return n
+}
+
+// Run sweeps expired leases every interval until ctx is done.
+func (t *TokenBucket) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tk.C:
+			t.Sweep(ctx, now)
+		}
+	}
+}
+
+func leaseMs(rule config.Rule) int64 {
+	ms := rule.LocalBatch.LeaseMs
+	if ms <= 0 {
+		ms = defaultLeaseMs
+	}
+	return min(ms, rule.WindowMs)
+}
+
+func leaseResult(res []interface{}) ([3]int64, error) {
+	var vals [3]int64
+	if len(res) < 3 {
+		return vals, errors.New("invalid script response")
+	}
+	for i := range vals {
+		v, ok := toInt64(res[i])
+		if !ok {
+			return vals, errors.New("invalid script response")
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
@@ -0,0 +1,47 @@
+-- Token bucket lease script, sharing state with script.lua
+-- KEYS[1]: bucket key
+-- ARGV[1]: limit
+-- ARGV[2]: window_ms
+-- ARGV[3]: burst
+-- ARGV[4]: now_ms
+-- ARGV[5]: ttl_ms
+-- ARGV[6]: give_back (unused tokens of the previous lease)
+-- ARGV[7]: want (tokens to lease)
+-- ARGV[8]: need (fewest tokens worth leasing; 0 only returns tokens)
+
+local limit = tonumber(ARGV[1])
+local window_ms = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local now_ms = tonumber(ARGV[4])
+local ttl_ms = tonumber(ARGV[5])
+local give_back = tonumber(ARGV[6])
+local want = tonumber(ARGV[7])
+local need = tonumber(ARGV[8])
+
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local last = tonumber(redis.call("HGET", KEYS[1], "last_refill"))
+if tokens == nil or last == nil then
+  tokens = limit + burst
+  last = now_ms
+end
+
+local rate_per_ms = limit / window_ms
+local delta = math.max(0, now_ms - last)
+tokens = math.min(limit + burst, tokens + delta * rate_per_ms + give_back)
+last = now_ms
+
+local granted = 0
+if need > 0 and tokens >= need then
+  granted = math.min(want, math.floor(tokens))
+  tokens = tokens - granted
+end
+
+local reset_ms = now_ms
+if granted == 0 and tokens < need then
+  reset_ms = now_ms + math.ceil((need - tokens) / rate_per_ms)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "last_refill", last)
+redis.call("PEXPIRE", KEYS[1], ttl_ms)
+
+return { granted, math.floor(tokens), reset_ms }
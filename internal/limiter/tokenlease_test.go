@@ -0,0 +1,111 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+// seqExec answers successive Eval calls with the queued results.
+type seqExec struct {
+	results [][]interface{}
+	err     error
+	calls   [][]interface{}
+}
+
+func (s *seqExec) Eval(ctx context.Context, script string, keys []string, args ...interface{}) ([]interface{}, error) {
+	s.calls = append(s.calls, args)
+	if s.err != nil {
+		return nil, s.err
+	}
+	res := s.results[0]
+	s.results = s.results[1:]
+	return res, nil
+}
+
+func batchRule() config.Rule {
+	return config.Rule{RuleID: "r1", Limit: 100, WindowMs: 1000, LocalBatch: config.LocalBatchCfg{Size: 10, LeaseMs: 50}}
+}
+
+func TestTokenBucketLocalBatchServesLeasedTokens(t *testing.T) {
+	exec := &seqExec{results: [][]interface{}{
+		{int64(10), int64(90), int64(1000)},
+		{int64(10), int64(80), int64(1000)},
+	}}
+	tb := NewTokenBucket(exec)
+	now := time.UnixMilli(1_000_000)
+
+	for i := 0; i < 10; i++ {
+		dec, err := tb.Allow(context.Background(), batchRule(), "k1", 1, now)
+		if err != nil || !dec.Allowed {
+			t.Fatalf("request %d: expected allowed, got %+v err=%v", i, dec, err)
+		}
+	}
+	if len(exec.calls) != 1 {
+		t.Fatalf("expected one lease call for 10 requests, got %d", len(exec.calls))
+	}
+	// want=10, need=1, nothing to give back
+	if args := exec.calls[0]; args[5] != int64(0) || args[6] != int64(10) || args[7] != int64(1) {
+		t.Fatalf("unexpected lease args: %#v", args)
+	}
+
+	dec, _ := tb.Allow(context.Background(), batchRule(), "k1", 1, now)
+	if !dec.Allowed || len(exec.calls) != 2 || dec.Remaining != 89 {
+		t.Fatalf("expected a second lease, got %+v after %d calls", dec, len(exec.calls))
+	}
+}
+
+func TestTokenBucketLocalBatchReturnsLeftover(t *testing.T) {
+	exec := &seqExec{results: [][]interface{}{
+		{int64(10), int64(90), int64(1000)},
+		{int64(10), int64(95), int64(1000)},
+	}}
+	tb := NewTokenBucket(exec)
+	now := time.UnixMilli(1_000_000)
+
+	_, _ = tb.Allow(context.Background(), batchRule(), "k1", 3, now)
+	// the lease expired: its 7 unused tokens go back with the next lease call
+	_, _ = tb.Allow(context.Background(), batchRule(), "k1", 1, now.Add(60*time.Millisecond))
+	if args := exec.calls[1]; args[5] != int64(7) {
+		t.Fatalf("expected 7 tokens returned, got %#v", args)
+	}
+
+	exec.results = append(exec.results, []interface{}{int64(0), int64(104), int64(0)})
+	if n := tb.Sweep(context.Background(), now.Add(200*time.Millisecond)); n != 1 {
+		t.Fatalf("expected one swept lease, got %d", n)
+	}
+	if args := exec.calls[2]; args[5] != int64(9) || args[6] != 0 || args[7] != 0 {
+		t.Fatalf("unexpected give-back args: %#v", args)
+	}
+}
+
+func TestTokenBucketLocalBatchDenyIsCached(t *testing.T) {
+	exec := &seqExec{results: [][]interface{}{
+		{int64(0), int64(0), int64(1_000_020)},
+	}}
+	tb := NewTokenBucket(exec)
+	now := time.UnixMilli(1_000_000)
+
+	for i := 0; i < 3; i++ {
+		dec, err := tb.Allow(context.Background(), batchRule(), "k1", 1, now.Add(time.Duration(i)*time.Millisecond))
+		if err != nil || dec.Allowed || dec.RetryAfterMs != int64(20-i) {
+			t.Fatalf("request %d: expected deny, got %+v err=%v", i, dec, err)
+		}
+	}
+	if len(exec.calls) != 1 {
+		t.Fatalf("denies within the retry window should stay local, got %d calls", len(exec.calls))
+	}
+}
+
+func TestTokenBucketLocalBatchEvalError(t *testing.T) {
+	tb := NewTokenBucket(&seqExec{err: errors.New("boom")})
+	dec, err := tb.Allow(context.Background(), batchRule(), "k1", 1, time.Now())
+	if err == nil || dec.Allowed || dec.Reason != "limiter_eval_failed" {
+		t.Fatalf("expected eval failure, got %+v err=%v", dec, err)
+	}
+}
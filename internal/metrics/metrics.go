@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/rules"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+const namespace = "pixiu_rls"
+
+// latencyBuckets spans local evaluations (~0.1ms) to slow Redis round trips.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5}
+
+// Metrics exports engine activity, the rule snapshot and the rule poller in
+// Prometheus format. It implements core.Hook, so embedders get the engine
+// metrics by passing it to Engine.SetHook without running the HTTP server.
+type Metrics struct {
+	reg          prometheus.Registerer
+	decisions    *prometheus.CounterVec
+	engine       *prometheus.HistogramVec
+	limiter      *prometheus.HistogramVec
+	scriptErrors *prometheus.CounterVec
+	ipLookups    *prometheus.CounterVec
+}
+
+// New creates the engine metrics and registers them with reg. It panics if
+// they are already registered, like prometheus.MustRegister.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		reg: reg,
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decisions_total",
+			Help:      "Rate limit decisions by rule, algorithm and reason.",
+		}, []string{"rule_id", "algo", "reason"}),
+		engine: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "engine_duration_seconds",
+			Help:      "Duration of engine calls by operation (allow, batch, acquire).",
+			Buckets:   latencyBuckets,
+		}, []string{"op"}),
+		limiter: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "limiter_duration_seconds",
+			Help:      "Duration of limiter evaluations by algorithm.",
+			Buckets:   latencyBuckets,
+		}, []string{"algo"}),
+		scriptErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redis_script_errors_total",
+			Help:      "Limiter evaluations that failed, by algorithm.",
+		}, []string{"algo"}),
+		ipLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "iplist_lookups_total",
+			Help:      "IP list lookups by the level that answered them (l1 local cache, l2 Redis).",
+		}, []string{"level"}),
+	}
+	reg.MustRegister(m.decisions, m.engine, m.limiter, m.scriptErrors, m.ipLookups)
+	return m
+}
+
+// Handler serves the metrics gathered by g.
+func Handler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+}
+
+// WatchRules exports the version and size of the cache's rule snapshot.
+func (m *Metrics) WatchRules(c *rules.Cache) {
+	m.reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rule_snapshot_version",
+			Help:      "Version of the active rule snapshot; increases on every replacement.",
+		}, func() float64 { return float64(c.GetSnapshot().Version) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rules",
+			Help:      "Number of rules in the active snapshot.",
+		}, func() float64 { return float64(len(c.GetSnapshot().Rules)) }),
+	)
+}
+
+// WatchPoller exports the pull counters of a rule poller (e.g. Nacos).
+func (m *Metrics) WatchPoller(p *rules.Poller) {
+	polls := func(result string, get func(rules.PollerStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "rule_polls_total",
+			Help:        "Rule source pulls by result.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(get(p.Stats())) })
+	}
+	m.reg.MustRegister(
+		polls("success", func(s rules.PollerStats) uint64 { return s.Successes }),
+		polls("failure", func(s rules.PollerStats) uint64 { return s.Failures }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rule_last_sync_timestamp_seconds",
+			Help:      "Unix time of the last successful rule source pull, 0 if none.",
+		}, func() float64 {
+			if t := p.Stats().LastSync; !t.IsZero() {
+				return float64(t.UnixMilli()) / 1000
+			}
+			return 0
+		}),
+	)
+}
+
+// WatchAudit exports the dropped-event counter of an audit stream.
+func (m *Metrics) WatchAudit(a interface{ Dropped() uint64 }) {
+	m.reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_dropped_total",
+		Help:      "Audit events dropped because the buffer was full or the write failed.",
+	}, func() float64 { return float64(a.Dropped()) }))
+}
+
+func (m *Metrics) OnDecision(rule config.Rule, dec types.Decision) {
+	m.decisions.WithLabelValues(rule.RuleID, algoLabel(rule), dec.Reason).Inc()
+}
+
+func (m *Metrics) OnEvaluate(op string, elapsed time.Duration) {
+	m.engine.WithLabelValues(op).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) OnLimiter(rule config.Rule, elapsed time.Duration, err error) {
+	algo := algoLabel(rule)
+	m.limiter.WithLabelValues(algo).Observe(elapsed.Seconds())
+	if err != nil {
+		m.scriptErrors.WithLabelValues(algo).Inc()
+	}
+}
+
+func (m *Metrics) OnIPListLookup(level string) {
+	m.ipLookups.WithLabelValues(level).Inc()
+}
+
+// algoLabel is the normalized algorithm of rule, or "" for the zero rule.
+func algoLabel(rule config.Rule) string {
+	if rule.RuleID == "" {
+		return ""
+	}
+	algo := strings.ToLower(strings.TrimSpace(rule.Algo))
+	if algo == "" {
+		return "token_bucket"
+	}
+	return algo
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/rules"
+	"github.com/nanjiek/pixiu-rls/internal/types"
+)
+
+func TestMetricsHook(t *testing.T) {
+	m := New(prometheus.NewRegistry())
+	rule := config.Rule{RuleID: "login", Algo: ""}
+
+	m.OnDecision(rule, types.Decision{Allowed: true, Reason: "allowed"})
+	m.OnDecision(rule, types.Decision{Allowed: true, Reason: "allowed"})
+	m.OnDecision(config.Rule{}, types.Decision{Reason: "ip_in_blacklist_l1"})
+	m.OnLimiter(rule, time.Millisecond, errors.New("boom"))
+	m.OnIPListLookup("l1")
+
+	if v := testutil.ToFloat64(m.decisions.WithLabelValues("login", "token_bucket", "allowed")); v != 2 {
+		t.Fatalf("allowed decisions = %v", v)
+	}
+	if v := testutil.ToFloat64(m.decisions.WithLabelValues("", "", "ip_in_blacklist_l1")); v != 1 {
+		t.Fatalf("ip list decisions = %v", v)
+	}
+	if v := testutil.ToFloat64(m.scriptErrors.WithLabelValues("token_bucket")); v != 1 {
+		t.Fatalf("script errors = %v", v)
+	}
+	if v := testutil.ToFloat64(m.ipLookups.WithLabelValues("l1")); v != 1 {
+		t.Fatalf("l1 lookups = %v", v)
+	}
+}
+
+func TestMetricsHandlerExportsRules(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+	cache := rules.NewCache(&config.Config{}, nil)
+	m.WatchRules(cache)
+	cache.ReplaceAll(map[string]config.Rule{"r1": {RuleID: "r1"}, "r2": {RuleID: "r2"}})
+	m.OnEvaluate("allow", 2*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	Handler(reg).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"pixiu_rls_rules 2",
+		"pixiu_rls_rule_snapshot_version 1",
+		`pixiu_rls_engine_duration_seconds_count{op="allow"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in:\n%s", want, body)
+		}
+	}
+}
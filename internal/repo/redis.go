@@ -23,11 +23,18 @@ const (
 	keySWTmpl     = "%s:sw:{%s}:%s"
 	keyTBTmpl     = "%s:tb:{%s}:%s"
 	keyLBTmpl     = "%s:lb:{%s}:%s"
+	keyGCRATmpl   = "%s:gcra:{%s}:%s"
+	keySWCTmpl    = "%s:swc:{%s}:%s"
+	keyCCTmpl     = "%s:cc:{%s}:%s"
+	keyBRTmpl     = "%s:br:{%s}:%s"
 	keyQuotaTmpl  = "%s:quota:%s:{%s}:%s:%s"
 	keyBlacklist  = "%s:blacklist:ip"
 	keyWhitelist  = "%s:whitelist:ip"
 	keyHotIPTmpl  = "%s:hot:ip:%s"
 	keyTmpBlkTmpl = "%s:blacklist:ip:tmp:%s"
+	keyAuditTmpl  = "%s:audit:decisions"
+	keyRevTmpl    = "%s:rulerev:{%s}"
+	keyHistTmpl   = "%s:rulehist:{%s}"
 )
 
 // Preloaded Lua scripts
@@ -47,12 +54,20 @@ type Repo interface {
 	KeySW(ruleID, dimKey string) string
 	KeyTB(ruleID, dimKey string) string
 	KeyLB(ruleID, dimKey string) string
+	KeyGCRA(ruleID, dimKey string) string
+	KeySWC(ruleID, dimKey string) string
+	KeyCC(ruleID, dimKey string) string
+	KeyBreaker(ruleID, dimKey string) string
 	KeyQuota(scope, ruleID, dimKey, ts string) string
 	KeyBlacklistIP() string
 	KeyWhitelistIP() string
 	KeyHotIP(ip string) string
 	KeyTempBlacklistIP(ip string) string
+	KeyAudit() string
+	KeyRuleRev(id string) string
+	KeyRuleHistory(id string) string
 	IsInSet(ctx context.Context, setKey, member string) (bool, error)
+	SetMembers(ctx context.Context, setKey string) ([]string, error)
 	IncrAndExpire(ctx context.Context, key string, ttl time.Duration) (int64, error)
 	SetTempBlacklistIP(ctx context.Context, ip string, ttl time.Duration) error
 	IsTempBlacklisted(ctx context.Context, ip string) (bool, error)
@@ -61,10 +76,17 @@ type Repo interface {
 	Close() error
 }
 
+// Redis deployment modes accepted in RedisCfg.Mode.
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
 type RedisRepo struct {
 	Prefix         string
 	UpdateChannel  string
-	Cli            *redis.ClusterClient
+	Cli            redis.UniversalClient // *redis.Client, failover *redis.Client or *redis.ClusterClient
 	logger         *slog.Logger
 	defaultTimeout time.Duration // Unified timeout config
 }
@@ -87,24 +109,59 @@ func NewRedis(cfg *config.Config, logger *slog.Logger, opts ...Option) (Repo, er
 		opt(r)
 	}
 
-	addrs := normalizeAddrs(cfg.Redis)
-	if len(addrs) == 0 {
-		return nil, errors.New("no redis addresses configured")
+	cli, err := newClient(cfg.Redis)
+	if err != nil {
+		return nil, err
 	}
-
-	clusterOpts := buildClusterOptions(cfg.Redis)
-	r.Cli = redis.NewClusterClient(clusterOpts)
+	r.Cli = cli
+	mode := normalizeMode(cfg.Redis.Mode)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	if err := r.Cli.Ping(ctx).Err(); err != nil {
-		logger.Error("redis cluster ping failed", "err", err)
-		return nil, fmt.Errorf("redis cluster connect failed: %w", err)
+		_ = r.Cli.Close()
+		logger.Error("redis ping failed", "mode", mode, "err", err)
+		return nil, fmt.Errorf("redis %s connect failed: %w", mode, err)
 	}
 
 	return r, nil
 }
 
+// newClient builds the client for the configured mode. All modes share the
+// same key layout; the {ruleID} hash tags only matter to the cluster.
+func newClient(cfg config.RedisCfg) (redis.UniversalClient, error) {
+	addrs := normalizeAddrs(cfg)
+	if len(addrs) == 0 {
+		return nil, errors.New("no redis addresses configured")
+	}
+	switch mode := normalizeMode(cfg.Mode); mode {
+	case ModeStandalone:
+		if len(addrs) > 1 {
+			return nil, errors.New("standalone mode takes a single redis address")
+		}
+		return redis.NewClient(buildStandaloneOptions(cfg)), nil
+	case ModeSentinel:
+		if cfg.MasterName == "" {
+			return nil, errors.New("sentinel mode requires masterName")
+		}
+		return redis.NewFailoverClient(buildFailoverOptions(cfg)), nil
+	case ModeCluster:
+		return redis.NewClusterClient(buildClusterOptions(cfg)), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", mode)
+	}
+}
+
+// normalizeMode defaults an empty mode to cluster, the only mode supported
+// before Mode was introduced.
+func normalizeMode(mode string) string {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		return ModeCluster
+	}
+	return mode
+}
+
 // Option pattern for custom configurations
 type Option func(*RedisRepo)
 
@@ -137,6 +194,22 @@ func (r *RedisRepo) KeyLB(ruleID, dimKey string) string {
 	return fmt.Sprintf(keyLBTmpl, r.Prefix, ruleID, dimKey)
 }
 
+func (r *RedisRepo) KeyGCRA(ruleID, dimKey string) string {
+	return fmt.Sprintf(keyGCRATmpl, r.Prefix, ruleID, dimKey)
+}
+
+func (r *RedisRepo) KeySWC(ruleID, dimKey string) string {
+	return fmt.Sprintf(keySWCTmpl, r.Prefix, ruleID, dimKey)
+}
+
+func (r *RedisRepo) KeyCC(ruleID, dimKey string) string {
+	return fmt.Sprintf(keyCCTmpl, r.Prefix, ruleID, dimKey)
+}
+
+func (r *RedisRepo) KeyBreaker(ruleID, dimKey string) string {
+	return fmt.Sprintf(keyBRTmpl, r.Prefix, ruleID, dimKey)
+}
+
 func (r *RedisRepo) KeyQuota(scope, ruleID, dimKey, ts string) string {
 	return fmt.Sprintf(keyQuotaTmpl, r.Prefix, scope, ruleID, dimKey, ts)
 }
@@ -157,6 +230,20 @@ func (r *RedisRepo) KeyTempBlacklistIP(ip string) string {
 	return fmt.Sprintf(keyTmpBlkTmpl, r.Prefix, ip)
 }
 
+func (r *RedisRepo) KeyAudit() string {
+	return fmt.Sprintf(keyAuditTmpl, r.Prefix)
+}
+
+// KeyRuleRev is the revision counter of a rule's history.
+func (r *RedisRepo) KeyRuleRev(id string) string {
+	return fmt.Sprintf(keyRevTmpl, r.Prefix, id)
+}
+
+// KeyRuleHistory is the capped list of a rule's revisions, newest first.
+func (r *RedisRepo) KeyRuleHistory(id string) string {
+	return fmt.Sprintf(keyHistTmpl, r.Prefix, id)
+}
+
 // IsInSet
 func (r *RedisRepo) IsInSet(parentCtx context.Context, setKey, member string) (bool, error) {
 	ctx, cancel := r.withTimeout(parentCtx, 0)
@@ -164,6 +251,13 @@ func (r *RedisRepo) IsInSet(parentCtx context.Context, setKey, member string) (b
 	return r.Cli.SIsMember(ctx, setKey, member).Result()
 }
 
+// SetMembers returns every member of a set.
+func (r *RedisRepo) SetMembers(parentCtx context.Context, setKey string) ([]string, error) {
+	ctx, cancel := r.withTimeout(parentCtx, 0)
+	defer cancel()
+	return r.Cli.SMembers(ctx, setKey).Result()
+}
+
 // IncrAndExpire
 func (r *RedisRepo) IncrAndExpire(parentCtx context.Context, key string, ttl time.Duration) (int64, error) {
 	ctx, cancel := r.withTimeout(parentCtx, 0)
@@ -226,6 +320,9 @@ func (r *RedisRepo) Eval(parentCtx context.Context, script string, keys []string
 
 // Close
 func (r *RedisRepo) Close() error {
+	if r.Cli == nil {
+		return nil
+	}
 	return r.Cli.Close()
 }
 
@@ -262,6 +359,49 @@ func buildClusterOptions(cfg config.RedisCfg) *redis.ClusterOptions {
 	}
 }
 
+func buildStandaloneOptions(cfg config.RedisCfg) *redis.Options {
+	return &redis.Options{
+		Addr:         normalizeAddrs(cfg)[0],
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		PoolSize:     max(cfg.PoolSize, 100),
+		MinIdleConns: max(cfg.MinIdleConns, 10),
+		DialTimeout:  durationOrDefault(cfg.DialTimeoutMs, 800),
+		ReadTimeout:  durationOrDefault(cfg.ReadTimeoutMs, 800),
+		WriteTimeout: durationOrDefault(cfg.WriteTimeoutMs, 800),
+		MaxRetries:   max(cfg.MaxRetries, 2),
+	}
+}
+
+// buildFailoverOptions treats the configured addresses as sentinels.
+func buildFailoverOptions(cfg config.RedisCfg) *redis.FailoverOptions {
+	return &redis.FailoverOptions{
+		MasterName:       cfg.MasterName,
+		SentinelAddrs:    normalizeAddrs(cfg),
+		SentinelPassword: cfg.SentinelPassword,
+		Password:         cfg.Password,
+		DB:               cfg.DB,
+		PoolSize:         max(cfg.PoolSize, 100),
+		MinIdleConns:     max(cfg.MinIdleConns, 10),
+		DialTimeout:      durationOrDefault(cfg.DialTimeoutMs, 800),
+		ReadTimeout:      durationOrDefault(cfg.ReadTimeoutMs, 800),
+		WriteTimeout:     durationOrDefault(cfg.WriteTimeoutMs, 800),
+		MaxRetries:       max(cfg.MaxRetries, 2),
+	}
+}
+
+// ForEachMaster runs fn against every master: each cluster master, or the
+// single server in standalone and sentinel mode. Use it for node-local
+// commands such as SCAN.
+func (r *RedisRepo) ForEachMaster(ctx context.Context, fn func(ctx context.Context, cli redis.UniversalClient) error) error {
+	if cc, ok := r.Cli.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return fn(ctx, c)
+		})
+	}
+	return fn(ctx, r.Cli)
+}
+
 func max(val, def int) int {
 	if val > def {
 		return val
@@ -275,3 +415,77 @@ func durationOrDefault(ms int, defMs int) time.Duration {
 	}
 	return time.Duration(ms) * time.Millisecond
 }
+
+// XAddPipelined appends entries to stream in one pipeline, trimming it to
+// about maxLen entries (<=0 disables trimming).
+func (r *RedisRepo) XAddPipelined(parentCtx context.Context, stream string, maxLen int64, entries []map[string]interface{}) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ctx, cancel := r.withTimeout(parentCtx, 500*time.Millisecond)
+	defer cancel()
+	pipe := r.Cli.Pipeline()
+	for _, values := range entries {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: stream, MaxLen: maxLen, Approx: maxLen > 0, Values: values})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("xadd to %s failed: %w", stream, err)
+	}
+	return nil
+}
+
+// ScriptCall is one invocation of a script within a pipelined batch.
+type ScriptCall struct {
+	Keys []string
+	Args []interface{}
+}
+
+// EvalPipelined runs script once per call in a single pipeline; in cluster
+// mode the client splits the pipeline by node, so each node costs one round trip.
+// Results and errors are reported per call.
+func (r *RedisRepo) EvalPipelined(parentCtx context.Context, script *redis.Script, calls []ScriptCall) ([][]interface{}, []error) {
+	out := make([][]interface{}, len(calls))
+	errs := make([]error, len(calls))
+	if len(calls) == 0 {
+		return out, errs
+	}
+	ctx, cancel := r.withTimeout(parentCtx, 500*time.Millisecond)
+	defer cancel()
+
+	run := func(idx []int, sha bool) {
+		pipe := r.Cli.Pipeline()
+		cmds := make([]*redis.Cmd, len(idx))
+		for i, ci := range idx {
+			c := calls[ci]
+			if sha {
+				cmds[i] = script.EvalSha(ctx, pipe, c.Keys, c.Args...)
+			} else {
+				cmds[i] = script.Eval(ctx, pipe, c.Keys, c.Args...)
+			}
+		}
+		_, _ = pipe.Exec(ctx)
+		for i, ci := range idx {
+			res, err := cmds[i].Slice()
+			out[ci], errs[ci] = res, err
+		}
+	}
+
+	all := make([]int, len(calls))
+	for i := range all {
+		all[i] = i
+	}
+	run(all, true)
+
+	// Nodes that have not cached the script yet answer NOSCRIPT; resend the
+	// source only to those calls.
+	var retry []int
+	for i, err := range errs {
+		if err != nil && redis.HasErrorPrefix(err, "NOSCRIPT") {
+			retry = append(retry, i)
+		}
+	}
+	if len(retry) > 0 {
+		run(retry, false)
+	}
+	return out, errs
+}
@@ -4,6 +4,10 @@ import (
 	"testing"
 )
 
+import (
+	"github.com/redis/go-redis/v9"
+)
+
 import (
 	"github.com/nanjiek/pixiu-rls/internal/config"
 )
@@ -19,6 +23,52 @@ func TestNormalizeAddrs(t *testing.T) {
 	}
 }
 
+func TestNewClientModes(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  config.RedisCfg
+		want string
+	}{
+		{"default is cluster", config.RedisCfg{Addrs: []string{"127.0.0.1:7000", "127.0.0.1:7001"}}, "cluster"},
+		{"cluster", config.RedisCfg{Mode: "Cluster", Addr: "127.0.0.1:7000"}, "cluster"},
+		{"standalone", config.RedisCfg{Mode: "standalone", Addr: "127.0.0.1:6379", DB: 2}, "client"},
+		{"sentinel", config.RedisCfg{Mode: "sentinel", Addr: "127.0.0.1:26379,127.0.0.2:26379", MasterName: "mymaster"}, "client"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cli, err := newClient(tc.cfg)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer cli.Close()
+			var got string
+			switch cli.(type) {
+			case *redis.ClusterClient:
+				got = "cluster"
+			case *redis.Client:
+				got = "client"
+			}
+			if got != tc.want {
+				t.Fatalf("client = %T, want %s", cli, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewClientInvalid(t *testing.T) {
+	cases := map[string]config.RedisCfg{
+		"no address":         {Mode: "standalone"},
+		"standalone multi":   {Mode: "standalone", Addrs: []string{"a:1", "b:1"}},
+		"sentinel no master": {Mode: "sentinel", Addr: "127.0.0.1:26379"},
+		"unknown mode":       {Mode: "replica", Addr: "127.0.0.1:6379"},
+	}
+	for name, cfg := range cases {
+		if _, err := newClient(cfg); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
 func TestKeyTemplates(t *testing.T) {
 	r := &RedisRepo{Prefix: "pixiu"}
 	if got := r.KeyRule("r1"); got != "pixiu:rule:{r1}" {
@@ -33,7 +83,43 @@ func TestKeyTemplates(t *testing.T) {
 	if got := r.KeyLB("r1", "d1"); got != "pixiu:lb:{r1}:d1" {
 		t.Fatalf("KeyLB = %s", got)
 	}
+	if got := r.KeyGCRA("r1", "d1"); got != "pixiu:gcra:{r1}:d1" {
+		t.Fatalf("KeyGCRA = %s", got)
+	}
+	if got := r.KeySWC("r1", "d1"); got != "pixiu:swc:{r1}:d1" {
+		t.Fatalf("KeySWC = %s", got)
+	}
+	if got := r.KeyCC("r1", "d1"); got != "pixiu:cc:{r1}:d1" {
+		t.Fatalf("KeyCC = %s", got)
+	}
+	if got := r.KeyBreaker("r1", "d1"); got != "pixiu:br:{r1}:d1" {
+		t.Fatalf("KeyBreaker = %s", got)
+	}
 	if got := r.KeyQuota("min", "r1", "d1", "202401"); got != "pixiu:quota:min:{r1}:d1:202401" {
 		t.Fatalf("KeyQuota = %s", got)
 	}
+	if got := r.KeyAudit(); got != "pixiu:audit:decisions" {
+		t.Fatalf("KeyAudit = %s", got)
+	}
+	if got := r.KeyRuleRev("r1"); got != "pixiu:rulerev:{r1}" {
+		t.Fatalf("KeyRuleRev = %s", got)
+	}
+	if got := r.KeyRuleHistory("r1"); got != "pixiu:rulehist:{r1}" {
+		t.Fatalf("KeyRuleHistory = %s", got)
+	}
+}
+
+func TestSlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31C3 {
+		t.Fatalf("crc16 = %#x", got)
+	}
+	if got := Slot("foo"); got != 12182 {
+		t.Fatalf("Slot(foo) = %d", got)
+	}
+	if Slot("pixiu:tb:{r1}:a") != Slot("pixiu:sw:{r1}:b") {
+		t.Fatalf("keys sharing a hash tag must share a slot")
+	}
+	if Slot("a{}{b}") != int(crc16("a{}{b}"))%SlotCount {
+		t.Fatalf("empty hash tag must hash the whole key")
+	}
 }
@@ -0,0 +1,35 @@
+package repo
+
+import (
+	"strings"
+)
+
+// SlotCount is the number of Redis Cluster hash slots.
+const SlotCount = 16384
+
+// Slot returns the Redis Cluster hash slot of key, honouring {hash tags}
+// the same way the cluster does: only the first non-empty tag is hashed.
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key)) % SlotCount
+}
+
+// crc16 implements CRC-16/XMODEM as used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -5,24 +5,39 @@ import (
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+import (
+	"github.com/redis/go-redis/v9"
+)
+
 import (
 	"github.com/nanjiek/pixiu-rls/internal/config"
 	"github.com/nanjiek/pixiu-rls/internal/rcu"
 	"github.com/nanjiek/pixiu-rls/internal/repo"
 )
 
+// ErrRuleNotFound is returned when a rule does not exist.
+var ErrRuleNotFound = errors.New("rule not found")
+
 // ImmutableRuleSet 不可变规则集，用于 RCU 快照
 type ImmutableRuleSet struct {
-	Rules map[string]config.Rule
+	Rules   map[string]config.Rule
+	Version uint64 // 快照版本号，每次替换加一（初始为 0）
 }
 
 type Cache struct {
 	cfg      *config.Config
 	rdb      *repo.RedisRepo
 	ruleSnap *rcu.Snapshot[ImmutableRuleSet]
+
+	mu        sync.Mutex // serializes snapshot swaps and listener notification
+	listeners []func(*ImmutableRuleSet)
+	history   historyStore
 }
 
 func NewCache(cfg *config.Config, r *repo.RedisRepo) *Cache {
@@ -30,16 +45,32 @@ func NewCache(cfg *config.Config, r *repo.RedisRepo) *Cache {
 	initSet := &ImmutableRuleSet{
 		Rules: make(map[string]config.Rule),
 	}
-	return &Cache{
+	c := &Cache{
 		cfg:      cfg,
 		rdb:      r,
 		ruleSnap: rcu.NewSnapshot(initSet),
 	}
+	if c.inMemory() {
+		c.history = &memHistory{}
+	} else {
+		c.history = redisHistory{rdb: r}
+	}
+	return c
 }
 
 func (c *Cache) Bootstrap(ctx context.Context) error {
 	// 1) 写入 bootstrap 规则到 Redis（仅首次，不覆盖同名）
+	local := make(map[string]config.Rule, len(c.cfg.BootstrapRules))
 	for _, r := range c.cfg.BootstrapRules {
+		if errs := Validate(r); len(errs) > 0 {
+			return &ValidationError{RuleID: r.RuleID, Errors: errs}
+		}
+		if c.inMemory() {
+			local[r.RuleID] = r
+			r := r
+			c.record(ctx, r.RuleID, &r, SourceBootstrap)
+			continue
+		}
 		key := c.rdb.KeyRule(r.RuleID)
 		exists, _ := c.rdb.Cli.Exists(ctx, key).Result()
 		if exists == 0 {
@@ -47,44 +78,69 @@ func (c *Cache) Bootstrap(ctx context.Context) error {
 			if err := c.rdb.Cli.Set(ctx, key, b, 0).Err(); err != nil {
 				return err
 			}
+			r := r
+			c.record(ctx, r.RuleID, &r, SourceBootstrap)
 		}
 	}
+	if c.inMemory() {
+		c.ReplaceAll(local)
+		return nil
+	}
 	// 2) 全量加载到本地
 	return c.ReloadAll(ctx)
 }
 
+// inMemory reports whether the cache runs without Redis (local-only mode):
+// rules then come from the config or a rule source and admin changes are
+// kept in this process only.
+func (c *Cache) inMemory() bool {
+	return c.rdb == nil || c.rdb.Cli == nil
+}
+
 func (c *Cache) ReloadAll(ctx context.Context) error {
+	if c.inMemory() {
+		return nil
+	}
+	var mu sync.Mutex
 	tmp := make(map[string]config.Rule)
-	cursor := uint64(0)
 	pattern := c.rdb.KeyRule("*")
 
-	for {
-		// 使用SCAN替代KEYS，避免阻塞Redis
-		keys, newCursor, err := c.rdb.Cli.Scan(ctx, cursor, pattern, 100).Result()
-		if err != nil {
-			slog.Error("failed to scan rules", "error", err)
-			return err
-		}
-
-		for _, key := range keys {
-			val, err := c.rdb.Cli.Get(ctx, key).Bytes()
+	// SCAN 只遍历单个节点，集群模式下需逐个 master 扫描
+	err := c.rdb.ForEachMaster(ctx, func(ctx context.Context, cli redis.UniversalClient) error {
+		cursor := uint64(0)
+		for {
+			// 使用SCAN替代KEYS，避免阻塞Redis
+			keys, newCursor, err := cli.Scan(ctx, cursor, pattern, 100).Result()
 			if err != nil {
-				slog.Warn("failed to get rule", "key", key, "error", err)
-				continue
+				return err
 			}
 
-			var rule config.Rule
-			if err := json.Unmarshal(val, &rule); err != nil {
-				slog.Warn("failed to unmarshal rule", "key", key, "error", err)
-				continue
+			for _, key := range keys {
+				val, err := cli.Get(ctx, key).Bytes()
+				if err != nil {
+					slog.Warn("failed to get rule", "key", key, "error", err)
+					continue
+				}
+
+				var rule config.Rule
+				if err := json.Unmarshal(val, &rule); err != nil {
+					slog.Warn("failed to unmarshal rule", "key", key, "error", err)
+					continue
+				}
+				mu.Lock()
+				tmp[rule.RuleID] = rule
+				mu.Unlock()
 			}
-			tmp[rule.RuleID] = rule
-		}
 
-		cursor = newCursor
-		if cursor == 0 {
-			break
+			cursor = newCursor
+			if cursor == 0 {
+				return nil
+			}
 		}
+	})
+	if err != nil {
+		slog.Error("failed to scan rules", "error", err)
+		return err
 	}
 
 	c.ReplaceAll(tmp)
@@ -113,6 +169,9 @@ func (c *Cache) Resolve(ruleID string, dims map[string]string) (config.Rule, err
 }
 
 func (c *Cache) StartWatcher(ctx context.Context) {
+	if c.inMemory() {
+		return
+	}
 	sub := c.rdb.Cli.Subscribe(ctx, c.rdb.UpdateChannel)
 	ch := sub.Channel()
 	for {
@@ -127,14 +186,25 @@ func (c *Cache) StartWatcher(ctx context.Context) {
 	}
 }
 
+// Upsert validates and stores a rule and records it in the rule's history
+// (see WithChange). An invalid rule is rejected with a *ValidationError and
+// never reaches Redis.
 func (c *Cache) Upsert(ctx context.Context, r config.Rule) error {
-	if r.RuleID == "" {
-		return errors.New("ruleId required")
+	_, err := c.upsert(ctx, r)
+	return err
+}
+
+func (c *Cache) upsert(ctx context.Context, r config.Rule) (Revision, error) {
+	if errs := Validate(r); len(errs) > 0 {
+		return Revision{}, &ValidationError{RuleID: r.RuleID, Errors: errs}
 	}
-	b, _ := json.Marshal(r)
-	if err := c.rdb.Cli.Set(ctx, c.rdb.KeyRule(r.RuleID), b, 0).Err(); err != nil {
-		return err
+	if !c.inMemory() {
+		b, _ := json.Marshal(r)
+		if err := c.rdb.Cli.Set(ctx, c.rdb.KeyRule(r.RuleID), b, 0).Err(); err != nil {
+			return Revision{}, err
+		}
 	}
+	rev, _ := c.record(ctx, r.RuleID, &r, SourceHTTP)
 
 	// 更新本地快照：复制当前规则集，修改后替换
 	oldSnap := c.ruleSnap.Load()
@@ -147,9 +217,119 @@ func (c *Cache) Upsert(ctx context.Context, r config.Rule) error {
 	newSet := &ImmutableRuleSet{
 		Rules: newRules,
 	}
-	c.ruleSnap.Replace(newSet)
+	c.swap(newSet)
+
+	if c.inMemory() {
+		return rev, nil
+	}
+	return rev, c.rdb.PublishUpdate(ctx, r.RuleID)
+}
 
-	return c.rdb.PublishUpdate(ctx, r.RuleID)
+// Delete removes a rule from Redis and the local snapshot, records the
+// deletion in the rule's history, then notifies other instances through the
+// updates channel.
+func (c *Cache) Delete(ctx context.Context, id string) error {
+	_, err := c.delete(ctx, id)
+	return err
+}
+
+func (c *Cache) delete(ctx context.Context, id string) (Revision, error) {
+	if id == "" {
+		return Revision{}, errors.New("ruleId required")
+	}
+	var n int64
+	if !c.inMemory() {
+		var err error
+		if n, err = c.rdb.Cli.Del(ctx, c.rdb.KeyRule(id)).Result(); err != nil {
+			return Revision{}, err
+		}
+	}
+
+	oldSnap := c.ruleSnap.Load()
+	if _, ok := oldSnap.Rules[id]; !ok && n == 0 {
+		return Revision{}, ErrRuleNotFound
+	}
+	rev, _ := c.record(ctx, id, nil, SourceHTTP)
+	newRules := make(map[string]config.Rule, len(oldSnap.Rules))
+	for k, v := range oldSnap.Rules {
+		if k != id {
+			newRules[k] = v
+		}
+	}
+	c.swap(&ImmutableRuleSet{Rules: newRules})
+
+	if c.inMemory() {
+		return rev, nil
+	}
+	return rev, c.rdb.PublishUpdate(ctx, id)
+}
+
+// ListFilter narrows List results. Zero values match everything.
+type ListFilter struct {
+	Algo        string   // normalized algorithm name; "" matches all
+	Enabled     *bool    // nil matches both
+	MatchPrefix string   // prefix of Rule.Match
+	IDPrefixes  []string // RuleID must start with one of these; empty matches all
+	Offset      int
+	Limit       int // <=0 means no limit
+}
+
+// List returns rules matching the filter ordered by RuleID, together with
+// the total number of matches before pagination.
+func (c *Cache) List(f ListFilter) ([]config.Rule, int) {
+	snapshot := c.ruleSnap.Load()
+	algo := strings.ToLower(strings.TrimSpace(f.Algo))
+
+	matched := make([]config.Rule, 0, len(snapshot.Rules))
+	for _, r := range snapshot.Rules {
+		if algo != "" && normalizeAlgo(r.Algo) != algo {
+			continue
+		}
+		if f.Enabled != nil && r.Enabled != *f.Enabled {
+			continue
+		}
+		if f.MatchPrefix != "" && !strings.HasPrefix(r.Match, f.MatchPrefix) {
+			continue
+		}
+		if len(f.IDPrefixes) > 0 && !hasAnyPrefix(r.RuleID, f.IDPrefixes) {
+			continue
+		}
+		matched = append(matched, r)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].RuleID < matched[j].RuleID
+	})
+
+	total := len(matched)
+	start := f.Offset
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := total
+	if f.Limit > 0 && start+f.Limit < end {
+		end = start + f.Limit
+	}
+	return matched[start:end], total
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeAlgo(algo string) string {
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	if algo == "" {
+		return "token_bucket"
+	}
+	return algo
 }
 
 func (c *Cache) Get(id string) (config.Rule, bool) {
@@ -168,10 +348,34 @@ func (c *Cache) ReplaceAll(rules map[string]config.Rule) {
 	newSet := &ImmutableRuleSet{
 		Rules: rules,
 	}
-	c.ruleSnap.Replace(newSet)
+	c.swap(newSet)
 	slog.Info("reloaded rules", "count", len(rules))
 }
 
+// OnReplace registers fn to be called with every new snapshot after it is
+// swapped in, so derived indexes (e.g. route matching) follow hot reloads.
+// fn is also invoked once with the current snapshot.
+func (c *Cache) OnReplace(fn func(*ImmutableRuleSet)) {
+	if fn == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, fn)
+	fn(c.ruleSnap.Load())
+}
+
+// swap replaces the RCU snapshot and notifies listeners.
+func (c *Cache) swap(next *ImmutableRuleSet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next.Version = c.ruleSnap.Load().Version + 1
+	c.ruleSnap.Replace(next)
+	for _, fn := range c.listeners {
+		fn(next)
+	}
+}
+
 // BuildRuleMap normalizes a rule slice into a map keyed by RuleID.
 func BuildRuleMap(rules []config.Rule) map[string]config.Rule {
 	res := make(map[string]config.Rule, len(rules))
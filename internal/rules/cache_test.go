@@ -1,6 +1,8 @@
 package rules
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -258,3 +260,79 @@ func TestBuildRuleMap(t *testing.T) {
 		t.Fatalf("missing r2")
 	}
 }
+
+func TestCacheOnReplaceNotifies(t *testing.T) {
+	cache := NewCache(&config.Config{}, nil)
+
+	var seen []int
+	cache.OnReplace(func(set *ImmutableRuleSet) {
+		seen = append(seen, len(set.Rules))
+	})
+	cache.ReplaceAll(map[string]config.Rule{
+		"r1": {RuleID: "r1", Limit: 1, Enabled: true},
+		"r2": {RuleID: "r2", Limit: 2, Enabled: true},
+	})
+
+	if len(seen) != 2 || seen[0] != 0 || seen[1] != 2 {
+		t.Fatalf("unexpected notifications: %v", seen)
+	}
+}
+
+func TestCacheList(t *testing.T) {
+	cache := NewCache(&config.Config{}, nil)
+	cache.ReplaceAll(map[string]config.Rule{
+		"c": {RuleID: "c", Match: "/api/users", Algo: "sliding_window", Enabled: true},
+		"a": {RuleID: "a", Match: "/api/login", Enabled: true},
+		"b": {RuleID: "b", Match: "/admin/*", Algo: "token_bucket", Enabled: false},
+		"d": {RuleID: "d", Match: "/api/orders", Algo: "TOKEN_BUCKET", Enabled: true},
+	})
+
+	items, total := cache.List(ListFilter{})
+	if total != 4 || len(items) != 4 || items[0].RuleID != "a" || items[3].RuleID != "d" {
+		t.Fatalf("unexpected list: %d %#v", total, items)
+	}
+
+	enabled := true
+	items, total = cache.List(ListFilter{Algo: "token_bucket", Enabled: &enabled})
+	if total != 2 || items[0].RuleID != "a" || items[1].RuleID != "d" {
+		t.Fatalf("unexpected filtered list: %d %#v", total, items)
+	}
+
+	items, total = cache.List(ListFilter{MatchPrefix: "/api/", Offset: 1, Limit: 1})
+	if total != 3 || len(items) != 1 || items[0].RuleID != "c" {
+		t.Fatalf("unexpected page: %d %#v", total, items)
+	}
+
+	items, total = cache.List(ListFilter{Offset: 10})
+	if total != 4 || len(items) != 0 {
+		t.Fatalf("offset past end: %d %#v", total, items)
+	}
+}
+
+func TestCacheInMemoryMode(t *testing.T) {
+	cfg := &config.Config{BootstrapRules: []config.Rule{
+		{RuleID: "r1", Match: "/api", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true},
+	}}
+	cache := NewCache(cfg, nil)
+	ctx := context.Background()
+
+	if err := cache.Bootstrap(ctx); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	if _, ok := cache.GetSnapshot().Rules["r1"]; !ok {
+		t.Fatal("bootstrap rule missing")
+	}
+	if err := cache.Upsert(ctx, config.Rule{RuleID: "r2", Match: "/x", Algo: "token_bucket", WindowMs: 1000, Limit: 1, Enabled: true}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := cache.Delete(ctx, "r1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := cache.Delete(ctx, "r1"); !errors.Is(err, ErrRuleNotFound) {
+		t.Fatalf("expected ErrRuleNotFound, got %v", err)
+	}
+	rules := cache.GetSnapshot().Rules
+	if len(rules) != 1 || rules["r2"].RuleID != "r2" {
+		t.Fatalf("unexpected rules: %#v", rules)
+	}
+}
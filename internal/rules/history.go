@@ -0,0 +1,292 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/repo"
+)
+
+// Change sources recorded in the revision history. Rule sources record the
+// name the poller was configured with (e.g. "nacos").
+const (
+	SourceHTTP      = "http"
+	SourceBootstrap = "bootstrap"
+	SourceRollback  = "rollback"
+)
+
+// maxRevisions is how many revisions are kept per rule.
+const maxRevisions = 100
+
+// ErrRevisionNotFound is returned when a rule has no such revision.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is one recorded state of a rule.
+type Revision struct {
+	Rev        int64        `json:"rev,omitempty"`        // per-rule sequence number, from 1
+	Rule       *config.Rule `json:"rule,omitempty"`       // nil when the rule was deleted
+	Author     string       `json:"author,omitempty"`     // who made the change, if known
+	Source     string       `json:"source"`               // http | bootstrap | rollback | the poller's source name
+	At         int64        `json:"at"`                   // unix ms
+	RollbackOf int64        `json:"rollbackOf,omitempty"` // the revision a rollback restored
+}
+
+// Change describes who is changing rules and through what; attach it with
+// WithChange so the revisions written by Upsert and Delete carry it.
+type Change struct {
+	Author     string
+	Source     string
+	RollbackOf int64
+}
+
+type changeKey struct{}
+
+// WithChange returns ctx carrying ch.
+func WithChange(ctx context.Context, ch Change) context.Context {
+	return context.WithValue(ctx, changeKey{}, ch)
+}
+
+func changeFrom(ctx context.Context) Change {
+	ch, _ := ctx.Value(changeKey{}).(Change)
+	return ch
+}
+
+// historyStore keeps the revisions of each rule, newest first.
+type historyStore interface {
+	// append stores rev under the next sequence number and returns it.
+	append(ctx context.Context, id string, rev Revision) (Revision, error)
+	// list returns up to limit revisions, newest first; limit <= 0 means all.
+	list(ctx context.Context, id string, limit int) ([]Revision, error)
+}
+
+// appendRevisionLua numbers the revision and prepends it to the capped list.
+// ARGV[1] is the revision JSON without "rev"; it always has other fields, so
+// splicing "rev" in after the opening brace yields valid JSON.
+var appendRevisionLua = redis.NewScript(`
+local rev = redis.call('INCR', KEYS[1])
+redis.call('LPUSH', KEYS[2], '{"rev":' .. rev .. ',' .. string.sub(ARGV[1], 2))
+redis.call('LTRIM', KEYS[2], 0, tonumber(ARGV[2]) - 1)
+return rev
+`)
+
+// redisHistory keeps each rule's revisions in a capped Redis list next to
+// its sequence counter; both keys share the rule's hash tag.
+type redisHistory struct {
+	rdb *repo.RedisRepo
+}
+
+func (h redisHistory) append(ctx context.Context, id string, rev Revision) (Revision, error) {
+	rev.Rev = 0
+	b, err := json.Marshal(rev)
+	if err != nil {
+		return Revision{}, err
+	}
+	n, err := appendRevisionLua.Run(ctx, h.rdb.Cli, []string{h.rdb.KeyRuleRev(id), h.rdb.KeyRuleHistory(id)}, string(b), maxRevisions).Int64()
+	if err != nil {
+		return Revision{}, err
+	}
+	rev.Rev = n
+	return rev, nil
+}
+
+func (h redisHistory) list(ctx context.Context, id string, limit int) ([]Revision, error) {
+	vals, err := h.rdb.Cli.LRange(ctx, h.rdb.KeyRuleHistory(id), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]Revision, 0, len(vals))
+	for _, v := range vals {
+		var rev Revision
+		if err := json.Unmarshal([]byte(v), &rev); err != nil {
+			slog.Warn("failed to unmarshal rule revision", "rule_id", id, "error", err)
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+// memHistory is the in-process store of local-only mode.
+type memHistory struct {
+	mu   sync.Mutex
+	revs map[string][]Revision // oldest first
+}
+
+func (h *memHistory) append(ctx context.Context, id string, rev Revision) (Revision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.revs == nil {
+		h.revs = make(map[string][]Revision)
+	}
+	list := h.revs[id]
+	rev.Rev = 1
+	if len(list) > 0 {
+		rev.Rev = list[len(list)-1].Rev + 1
+	}
+	list = append(list, rev)
+	if len(list) > maxRevisions {
+		list = list[len(list)-maxRevisions:]
+	}
+	h.revs[id] = list
+	return rev, nil
+}
+
+func (h *memHistory) list(ctx context.Context, id string, limit int) ([]Revision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := h.revs[id]
+	if limit <= 0 || limit > len(list) {
+		limit = len(list)
+	}
+	revs := make([]Revision, 0, limit)
+	for i := len(list) - 1; i >= 0 && len(revs) < limit; i-- {
+		revs = append(revs, list[i])
+	}
+	return revs, nil
+}
+
+// record appends a revision of rule id (nil rule: deleted) described by the
+// change in ctx, defaulting to source. History is best effort: a failed write
+// is logged and does not undo the change.
+func (c *Cache) record(ctx context.Context, id string, rule *config.Rule, source string) (Revision, bool) {
+	ch := changeFrom(ctx)
+	if ch.Source == "" {
+		ch.Source = source
+	}
+	rev, err := c.history.append(ctx, id, Revision{
+		Rule:       rule,
+		Author:     ch.Author,
+		Source:     ch.Source,
+		At:         time.Now().UnixMilli(),
+		RollbackOf: ch.RollbackOf,
+	})
+	if err != nil {
+		slog.Warn("failed to record rule revision", "rule_id", id, "source", ch.Source, "error", err)
+		return Revision{}, false
+	}
+	return rev, true
+}
+
+// recordReplace records a revision for every rule that a whole-snapshot
+// replacement from source added, changed or removed. A rule whose latest
+// revision already matches is skipped, so restarts and the other replicas
+// pulling the same payload do not repeat it.
+func (c *Cache) recordReplace(ctx context.Context, old, next map[string]config.Rule, source string) {
+	changed := func(id string, rule *config.Rule) bool {
+		latest, err := c.history.list(ctx, id, 1)
+		if err != nil || len(latest) == 0 {
+			return err == nil && rule != nil
+		}
+		return !reflect.DeepEqual(latest[0].Rule, rule)
+	}
+	for id, r := range next {
+		if prev, ok := old[id]; ok && reflect.DeepEqual(prev, r) {
+			continue
+		}
+		r := r
+		if changed(id, &r) {
+			c.record(ctx, id, &r, source)
+		}
+	}
+	for id := range old {
+		if _, ok := next[id]; !ok && changed(id, nil) {
+			c.record(ctx, id, nil, source)
+		}
+	}
+}
+
+// History returns up to limit revisions of rule id, newest first.
+func (c *Cache) History(ctx context.Context, id string, limit int) ([]Revision, error) {
+	return c.history.list(ctx, id, limit)
+}
+
+// Revision returns revision rev of rule id.
+func (c *Cache) Revision(ctx context.Context, id string, rev int64) (Revision, error) {
+	revs, err := c.history.list(ctx, id, 0)
+	if err != nil {
+		return Revision{}, err
+	}
+	for _, r := range revs {
+		if r.Rev == rev {
+			return r, nil
+		}
+	}
+	return Revision{}, ErrRevisionNotFound
+}
+
+// Rollback restores revision to of rule id through Upsert or Delete, so the
+// change is published to every instance, and returns the revision it wrote.
+func (c *Cache) Rollback(ctx context.Context, id string, to int64) (Revision, error) {
+	target, err := c.Revision(ctx, id, to)
+	if err != nil {
+		return Revision{}, err
+	}
+	ch := changeFrom(ctx)
+	ctx = WithChange(ctx, Change{Author: ch.Author, Source: SourceRollback, RollbackOf: to})
+	if target.Rule == nil {
+		return c.delete(ctx, id)
+	}
+	return c.upsert(ctx, *target.Rule)
+}
+
+// FieldChange is one field that differs between two rule revisions. Nested
+// fields use dotted names (e.g. "quota.perMinute").
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// DiffRules lists the fields that differ from a to b, sorted by name. A nil
+// rule (deleted, or before the first revision) has no fields.
+func DiffRules(a, b *config.Rule) []FieldChange {
+	fa, fb := flattenRule(a), flattenRule(b)
+	var changes []FieldChange
+	for k, va := range fa {
+		if vb, ok := fb[k]; !ok || !reflect.DeepEqual(va, vb) {
+			changes = append(changes, FieldChange{Field: k, From: va, To: fb[k]})
+		}
+	}
+	for k, vb := range fb {
+		if _, ok := fa[k]; !ok {
+			changes = append(changes, FieldChange{Field: k, To: vb})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func flattenRule(r *config.Rule) map[string]any {
+	out := make(map[string]any)
+	if r == nil {
+		return out
+	}
+	b, _ := json.Marshal(r)
+	var m map[string]any
+	_ = json.Unmarshal(b, &m)
+	var walk func(prefix string, m map[string]any)
+	walk = func(prefix string, m map[string]any) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]any); ok {
+				walk(prefix+k+".", sub)
+				continue
+			}
+			out[prefix+k] = v
+		}
+	}
+	walk("", m)
+	return out
+}
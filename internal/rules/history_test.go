@@ -0,0 +1,95 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestHistoryUpsertDeleteRollback(t *testing.T) {
+	ctx := WithChange(context.Background(), Change{Author: "alice"})
+	cache := NewCache(&config.Config{}, nil)
+
+	v1 := config.Rule{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true}
+	v2 := v1
+	v2.Limit = 20
+	if err := cache.Upsert(ctx, v1); err != nil {
+		t.Fatalf("upsert v1: %v", err)
+	}
+	if err := cache.Upsert(ctx, v2); err != nil {
+		t.Fatalf("upsert v2: %v", err)
+	}
+	if err := cache.Delete(ctx, "r1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	revs, err := cache.History(ctx, "r1", 0)
+	if err != nil || len(revs) != 3 {
+		t.Fatalf("expected 3 revisions, got %d err=%v", len(revs), err)
+	}
+	if revs[0].Rev != 3 || revs[0].Rule != nil || revs[2].Rev != 1 || revs[2].Rule.Limit != 10 {
+		t.Fatalf("unexpected revisions: %+v", revs)
+	}
+	if revs[1].Author != "alice" || revs[1].Source != SourceHTTP {
+		t.Fatalf("unexpected change info: %+v", revs[1])
+	}
+
+	rev, err := cache.Rollback(ctx, "r1", 2)
+	if err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if rev.Rev != 4 || rev.Source != SourceRollback || rev.RollbackOf != 2 || rev.Author != "alice" {
+		t.Fatalf("unexpected rollback revision: %+v", rev)
+	}
+	if got, ok := cache.Get("r1"); !ok || got.Limit != 20 {
+		t.Fatalf("rule not restored: %+v", got)
+	}
+
+	if _, err := cache.Rollback(ctx, "r1", 9); !errors.Is(err, ErrRevisionNotFound) {
+		t.Fatalf("expected ErrRevisionNotFound, got %v", err)
+	}
+}
+
+func TestRecordReplaceSkipsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCache(&config.Config{}, nil)
+	r1 := config.Rule{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 10}
+	r2 := config.Rule{RuleID: "r2", Algo: "gcra", WindowMs: 1000, Limit: 5}
+
+	cache.recordReplace(ctx, nil, map[string]config.Rule{"r1": r1, "r2": r2}, "nacos")
+	// a restart sees the same rules against an empty snapshot
+	cache.recordReplace(ctx, nil, map[string]config.Rule{"r1": r1, "r2": r2}, "nacos")
+	cache.recordReplace(ctx, map[string]config.Rule{"r1": r1, "r2": r2}, map[string]config.Rule{"r1": r1}, "nacos")
+
+	if revs, _ := cache.History(ctx, "r1", 0); len(revs) != 1 || revs[0].Source != "nacos" {
+		t.Fatalf("unexpected r1 history: %+v", revs)
+	}
+	if revs, _ := cache.History(ctx, "r2", 0); len(revs) != 2 || revs[0].Rule != nil {
+		t.Fatalf("unexpected r2 history: %+v", revs)
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	a := &config.Rule{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 10}
+	b := *a
+	b.Limit = 20
+	b.Quota.PerMinute = 100
+
+	changes := DiffRules(a, &b)
+	if len(changes) != 2 || changes[0].Field != "limit" || changes[1].Field != "quota.perMinute" {
+		t.Fatalf("unexpected diff: %+v", changes)
+	}
+	if changes[0].From != float64(10) || changes[0].To != float64(20) || changes[1].From != float64(0) {
+		t.Fatalf("unexpected values: %+v", changes)
+	}
+	if len(DiffRules(a, a)) != 0 {
+		t.Fatalf("a rule does not differ from itself")
+	}
+	if len(DiffRules(nil, a)) == 0 {
+		t.Fatalf("a new rule differs from the empty rule")
+	}
+}
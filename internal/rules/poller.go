@@ -2,9 +2,13 @@ package rules
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,17 +21,41 @@ import (
 type PollerConfig struct {
 	Interval   time.Duration
 	FailPolicy string // fail-open | fail-closed
+	Source     string // recorded as the source of rule revisions; default "source"
 }
 
-// Poller periodically pulls rules from an external source (e.g., Nacos).
+// Poller periodically pulls rules from an external source (e.g., Nacos or a file).
 type Poller struct {
 	source     source.RuleSource
 	cache      *Cache
 	interval   time.Duration
 	failPolicy string
+	name       string
 	lastVer    string
+	rejected   string // fingerprint of the last rejected payload
 	log        *slog.Logger
 	mu         sync.Mutex
+
+	successes atomic.Uint64
+	failures  atomic.Uint64
+	lastSync  atomic.Int64 // unix ms of the last successful pull
+}
+
+// PollerStats counts pulls since start. A pull fails when the source cannot
+// be fetched or its payload is rejected; an unchanged version is a success.
+type PollerStats struct {
+	Successes uint64
+	Failures  uint64
+	LastSync  time.Time // zero until the first successful pull
+}
+
+// Stats returns the pull counters.
+func (p *Poller) Stats() PollerStats {
+	st := PollerStats{Successes: p.successes.Load(), Failures: p.failures.Load()}
+	if ms := p.lastSync.Load(); ms > 0 {
+		st.LastSync = time.UnixMilli(ms)
+	}
+	return st
 }
 
 func NewPoller(src source.RuleSource, cache *Cache, cfg PollerConfig) *Poller {
@@ -35,11 +63,16 @@ func NewPoller(src source.RuleSource, cache *Cache, cfg PollerConfig) *Poller {
 	if interval <= 0 {
 		interval = 5 * time.Second
 	}
+	name := cfg.Source
+	if name == "" {
+		name = "source"
+	}
 	return &Poller{
 		source:     src,
 		cache:      cache,
 		interval:   interval,
 		failPolicy: strings.ToLower(strings.TrimSpace(cfg.FailPolicy)),
+		name:       name,
 		log:        slog.Default(),
 	}
 }
@@ -50,10 +83,15 @@ func (p *Poller) SyncOnce(ctx context.Context) error {
 	return err
 }
 
-// Start runs the polling loop until ctx is done.
+// Start runs the polling loop until ctx is done. When the source is a
+// source.Watcher, it also pulls as soon as the source reports a change; the
+// periodic pull then only covers missed notifications.
 func (p *Poller) Start(ctx context.Context) {
 	if _, err := p.pull(ctx); err != nil {
-		p.log.Warn("nacos pull failed on startup", "error", err)
+		p.log.Warn("rule source pull failed on startup", "error", err)
+	}
+	if w, ok := p.source.(source.Watcher); ok {
+		go p.watch(ctx, w)
 	}
 
 	ticker := time.NewTicker(p.interval)
@@ -64,13 +102,50 @@ func (p *Poller) Start(ctx context.Context) {
 			return
 		case <-ticker.C:
 			if _, err := p.pull(ctx); err != nil {
-				p.log.Warn("nacos pull failed", "error", err)
+				p.log.Warn("rule source pull failed", "error", err)
 			}
 		}
 	}
 }
 
+// watch pulls whenever w reports a change. After an error it waits one poll
+// interval, so a failing source or a rejected payload cannot spin the loop.
+func (p *Poller) watch(ctx context.Context, w source.Watcher) {
+	for ctx.Err() == nil {
+		changed, err := w.Watch(ctx, p.version())
+		if err == nil && changed {
+			_, err = p.pull(ctx)
+		}
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		p.log.Warn("rule source watch failed", "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+// version returns the version of the last applied payload.
+func (p *Poller) version() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastVer
+}
+
 func (p *Poller) pull(ctx context.Context) (bool, error) {
+	changed, err := p.apply(ctx)
+	if err != nil {
+		p.failures.Add(1)
+		return false, err
+	}
+	p.successes.Add(1)
+	p.lastSync.Store(time.Now().UnixMilli())
+	return changed, nil
+}
+
+func (p *Poller) apply(ctx context.Context) (bool, error) {
 	payload, err := p.source.Fetch(ctx)
 	if err != nil {
 		p.handleFailure()
@@ -84,12 +159,30 @@ func (p *Poller) pull(ctx context.Context) (bool, error) {
 		return false, nil
 	}
 
+	// A payload with any invalid rule is rejected as a whole so that the
+	// last-good snapshot stays in effect.
+	if err := validatePayload(payload.Rules); err != nil {
+		// The source keeps serving the same bad payload until it is fixed, so
+		// only its first rejection is an error.
+		level := slog.LevelError
+		if fp := fingerprint(payload); fp == p.rejected {
+			level = slog.LevelDebug
+		} else {
+			p.rejected = fp
+		}
+		p.log.Log(ctx, level, "rejected rules payload", "version", payload.Version, "error", err)
+		return false, err
+	}
+	p.rejected = ""
+
 	ruleMap := BuildRuleMap(payload.Rules)
 	if len(ruleMap) == 0 {
-		p.log.Warn("nacos payload contains no valid rules")
+		p.log.Warn("rule source payload contains no valid rules")
 	}
 
+	old := p.cache.GetSnapshot().Rules
 	p.cache.ReplaceAll(ruleMap)
+	p.cache.recordReplace(ctx, old, ruleMap, p.name)
 	p.lastVer = payload.Version
 	return true, nil
 }
@@ -99,3 +192,28 @@ func (p *Poller) handleFailure() {
 		p.cache.ReplaceAll(map[string]config.Rule{})
 	}
 }
+
+// fingerprint identifies a payload by its version, or by a hash of its rules
+// when the source does not version them.
+func fingerprint(payload source.RulesPayload) string {
+	if payload.Version != "" {
+		return "v:" + payload.Version
+	}
+	h := fnv.New64a()
+	_ = json.NewEncoder(h).Encode(payload.Rules)
+	return fmt.Sprintf("h:%x", h.Sum64())
+}
+
+func validatePayload(rules []config.Rule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if errs := Validate(r); len(errs) > 0 {
+			return &ValidationError{RuleID: r.RuleID, Errors: errs}
+		}
+		if seen[r.RuleID] {
+			return &ValidationError{RuleID: r.RuleID, Errors: []FieldError{{Field: "ruleId", Message: "duplicate rule id"}}}
+		}
+		seen[r.RuleID] = true
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package rules
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
 )
 
 import (
@@ -99,3 +103,131 @@ func TestPollerFailClosedClearsRules(t *testing.T) {
 		t.Fatalf("expected empty snapshot")
 	}
 }
+
+func TestPollerRejectsInvalidPayload(t *testing.T) {
+	cache := NewCache(&config.Config{}, nil)
+	src := &fakeSource{
+		payload: source.RulesPayload{
+			Version: "v1",
+			Rules: []config.Rule{
+				{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true},
+			},
+		},
+	}
+	poller := NewPoller(src, cache, PollerConfig{FailPolicy: "fail-closed"})
+	if err := poller.SyncOnce(context.Background()); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	good := cache.GetSnapshot()
+
+	src.payload = source.RulesPayload{
+		Version: "v2",
+		Rules: []config.Rule{
+			{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 20, Enabled: true},
+			{RuleID: "r2", Algo: "token_bucket", WindowMs: 0, Limit: 10, Enabled: true},
+		},
+	}
+	err := poller.SyncOnce(context.Background())
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.RuleID != "r2" {
+		t.Fatalf("expected validation error for r2, got %v", err)
+	}
+	if cache.GetSnapshot() != good {
+		t.Fatalf("last-good snapshot should be kept")
+	}
+}
+
+func TestPollerLogsRejectionOncePerPayload(t *testing.T) {
+	cache := NewCache(&config.Config{}, nil)
+	bad := []config.Rule{{RuleID: "r1", Algo: "token_bucket", WindowMs: 0, Limit: 10, Enabled: true}}
+	src := &fakeSource{payload: source.RulesPayload{Rules: bad}}
+	poller := NewPoller(src, cache, PollerConfig{})
+	var buf bytes.Buffer
+	poller.log = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	errorLines := func() int { return strings.Count(buf.String(), "level=ERROR") }
+	for i := 0; i < 3; i++ {
+		_ = poller.SyncOnce(context.Background())
+	}
+	if n := errorLines(); n != 1 {
+		t.Fatalf("same payload logged %d errors, want 1:\n%s", n, buf.String())
+	}
+	if n := strings.Count(buf.String(), "level=DEBUG"); n != 2 {
+		t.Fatalf("repeats logged %d debug lines, want 2", n)
+	}
+
+	src.payload.Rules = []config.Rule{{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 0, Enabled: true}}
+	_ = poller.SyncOnce(context.Background())
+	src.payload.Version = "v2"
+	_ = poller.SyncOnce(context.Background())
+	if n := errorLines(); n != 3 {
+		t.Fatalf("distinct payloads logged %d errors, want 3", n)
+	}
+}
+
+func TestPollerStats(t *testing.T) {
+	cache := NewCache(&config.Config{}, nil)
+	src := &fakeSource{payload: source.RulesPayload{Version: "v1"}}
+	poller := NewPoller(src, cache, PollerConfig{})
+
+	_ = poller.SyncOnce(context.Background())
+	_ = poller.SyncOnce(context.Background()) // same version still counts as a success
+	src.err = errors.New("boom")
+	_ = poller.SyncOnce(context.Background())
+
+	st := poller.Stats()
+	if st.Successes != 2 || st.Failures != 1 || st.LastSync.IsZero() {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if v := cache.GetSnapshot().Version; v != 1 {
+		t.Fatalf("snapshot version = %d, want 1", v)
+	}
+}
+
+// watchSource reports each Watch version, then a change once signalled.
+type watchSource struct {
+	fakeSource
+	changes  chan struct{}
+	versions chan string
+}
+
+func (w *watchSource) Watch(ctx context.Context, version string) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case w.versions <- version:
+	}
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-w.changes:
+		return true, nil
+	}
+}
+
+func TestPollerPullsOnWatchedChange(t *testing.T) {
+	cache := NewCache(&config.Config{}, nil)
+	src := &watchSource{changes: make(chan struct{}), versions: make(chan string)}
+	src.payload = source.RulesPayload{Version: "v1", Rules: []config.Rule{
+		{RuleID: "r1", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	poller := NewPoller(src, cache, PollerConfig{Interval: time.Hour})
+	go poller.Start(ctx)
+
+	if v := <-src.versions; v != "v1" {
+		t.Fatalf("watch should start from the applied version, got %q", v)
+	}
+	src.payload = source.RulesPayload{Version: "v2", Rules: []config.Rule{
+		{RuleID: "r2", Algo: "token_bucket", WindowMs: 1000, Limit: 10, Enabled: true},
+	}}
+	src.changes <- struct{}{}
+	if v := <-src.versions; v != "v2" {
+		t.Fatalf("a change should be pulled before watching again, got %q", v)
+	}
+	if _, ok := cache.GetSnapshot().Rules["r2"]; !ok {
+		t.Fatalf("unexpected snapshot: %#v", cache.GetSnapshot().Rules)
+	}
+}
@@ -0,0 +1,160 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+const defaultConsulWaitMs = 30000
+
+// ConsulSource reads rules from Consul KV and implements Watcher with
+// blocking queries. The version is the X-Consul-Index of the read, which
+// Consul also advances when a key under the prefix is deleted.
+type ConsulSource struct {
+	cfg     config.ConsulCfg
+	client  *http.Client
+	watcher *http.Client
+	wait    time.Duration
+}
+
+func NewConsulSource(cfg config.ConsulCfg) *ConsulSource {
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	wait := time.Duration(cfg.WaitMs) * time.Millisecond
+	if wait <= 0 {
+		wait = defaultConsulWaitMs * time.Millisecond
+	}
+	return &ConsulSource{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		// Consul adds up to wait/16 of jitter to a blocking query
+		watcher: &http.Client{Timeout: wait + wait/16 + timeout},
+		wait:    wait,
+	}
+}
+
+type consulKV struct {
+	Key   string  `json:"Key"`
+	Value *string `json:"Value"` // base64; null for folders
+}
+
+func (s *ConsulSource) Fetch(ctx context.Context) (RulesPayload, error) {
+	if s.cfg.Addr == "" || s.cfg.Key == "" {
+		return RulesPayload{}, errors.New("consul addr and key are required")
+	}
+
+	resp, body, err := s.get(ctx, s.client, nil)
+	if err != nil {
+		return RulesPayload{}, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return RulesPayload{}, fmt.Errorf("consul key %s not found", s.cfg.Key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return RulesPayload{}, fmt.Errorf("consul fetch failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	version := resp.Header.Get("X-Consul-Index")
+	if version == "" {
+		return RulesPayload{}, errors.New("consul fetch: missing X-Consul-Index")
+	}
+
+	var kvs []consulKV
+	if err := json.Unmarshal(body, &kvs); err != nil {
+		return RulesPayload{}, fmt.Errorf("consul fetch: malformed response: %w", err)
+	}
+	var rules []config.Rule
+	found := false
+	for _, kv := range kvs {
+		if kv.Value == nil || strings.HasSuffix(kv.Key, "/") {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(*kv.Value)
+		if err != nil {
+			return RulesPayload{}, fmt.Errorf("consul fetch: malformed value of %s: %w", kv.Key, err)
+		}
+		list, err := parseKV(kv.Key, value, s.cfg.Format)
+		if err != nil {
+			return RulesPayload{}, err
+		}
+		rules = append(rules, list...)
+		found = true
+	}
+	if !found {
+		return RulesPayload{}, fmt.Errorf("consul key %s has no rules", s.cfg.Key)
+	}
+	return RulesPayload{Rules: rules, Version: version}, nil
+}
+
+// Watch runs a blocking query at index version. Consul answers when the
+// index moves past it or after the wait time; a different index is a change.
+// An empty version (nothing fetched yet) is reported as a change at once.
+func (s *ConsulSource) Watch(ctx context.Context, version string) (bool, error) {
+	if version == "" {
+		return true, nil
+	}
+	q := url.Values{}
+	q.Set("index", version)
+	q.Set("wait", strconv.FormatInt(s.wait.Milliseconds(), 10)+"ms")
+	resp, body, err := s.get(ctx, s.watcher, q)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return false, fmt.Errorf("consul watch failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	// Consul may reset the index (e.g. after a snapshot restore); any
+	// difference, not only an increase, means refetch.
+	index := resp.Header.Get("X-Consul-Index")
+	return index != "" && index != version, nil
+}
+
+func (s *ConsulSource) get(ctx context.Context, client *http.Client, q url.Values) (*http.Response, []byte, error) {
+	base, err := url.Parse(s.cfg.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	base.Path = strings.TrimRight(base.Path, "/") + "/v1/kv/" + strings.TrimLeft(s.cfg.Key, "/")
+	if q == nil {
+		q = url.Values{}
+	}
+	if s.cfg.Prefix {
+		q.Set("recurse", "true")
+	}
+	if s.cfg.Datacenter != "" {
+		q.Set("dc", s.cfg.Datacenter)
+	}
+	base.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", s.cfg.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
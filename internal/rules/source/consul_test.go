@@ -0,0 +1,63 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func TestConsulFetchAndWatch(t *testing.T) {
+	index := "12"
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/rls/rules" || r.Header.Get("X-Consul-Token") != "tok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		query = r.URL.RawQuery
+		w.Header().Set("X-Consul-Index", index)
+		fmt.Fprintf(w, `[{"Key":"rls/rules/","Value":null},{"Key":"rls/rules/a.json","Value":%q,"ModifyIndex":12}]`,
+			b64(`[{"ruleId":"r1","algo":"token_bucket","windowMs":1000,"limit":10}]`))
+	}))
+	defer server.Close()
+
+	src := NewConsulSource(config.ConsulCfg{Addr: server.URL, Key: "rls/rules", Prefix: true, Token: "tok", Datacenter: "dc1", WaitMs: 500})
+	got, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if len(got.Rules) != 1 || got.Rules[0].RuleID != "r1" || got.Version != "12" {
+		t.Fatalf("unexpected payload: %#v", got)
+	}
+
+	// the stub answers at once, as Consul does when the wait elapses
+	if changed, err := src.Watch(context.Background(), got.Version); err != nil || changed {
+		t.Fatalf("an unchanged index is no change, got %v err=%v", changed, err)
+	}
+	if query != "dc=dc1&index=12&recurse=true&wait=500ms" {
+		t.Fatalf("unexpected blocking query: %s", query)
+	}
+	index = "15"
+	if changed, err := src.Watch(context.Background(), got.Version); err != nil || !changed {
+		t.Fatalf("expected a change, got %v err=%v", changed, err)
+	}
+}
+
+func TestConsulKeyNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "3")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	src := NewConsulSource(config.ConsulCfg{Addr: server.URL, Key: "rls/rules"})
+	if _, err := src.Fetch(context.Background()); err == nil {
+		t.Fatalf("expected a missing key to fail")
+	}
+}
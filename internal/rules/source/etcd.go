@@ -0,0 +1,292 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+// etcdWatchTimeout bounds one watch stream so a silently dropped connection
+// is replaced; it ends without a change.
+const etcdWatchTimeout = 5 * time.Minute
+
+// EtcdSource reads rules from etcd v3 through its JSON gateway (/v3/kv/range)
+// and implements Watcher with /v3/watch. The version is the highest
+// mod_revision of the rule keys, followed by the key count in prefix mode so
+// that deleting a key is a change too.
+type EtcdSource struct {
+	cfg     config.EtcdCfg
+	client  *http.Client
+	watcher *http.Client
+
+	mu    sync.Mutex
+	token string
+	rev   int64 // store revision of the last fetch; watches start after it
+}
+
+func NewEtcdSource(cfg config.EtcdCfg) *EtcdSource {
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &EtcdSource{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: timeout},
+		watcher: &http.Client{}, // bounded by etcdWatchTimeout instead
+	}
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdKV struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+func (s *EtcdSource) Fetch(ctx context.Context) (RulesPayload, error) {
+	if len(s.cfg.Endpoints) == 0 || s.cfg.Key == "" {
+		return RulesPayload{}, errors.New("etcd endpoints and key are required")
+	}
+
+	resp, err := s.do(ctx, s.client, "/v3/kv/range", s.keyRange())
+	if err != nil {
+		return RulesPayload{}, fmt.Errorf("etcd fetch failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return RulesPayload{}, err
+	}
+
+	var res struct {
+		Header etcdHeader `json:"header"`
+		KVs    []etcdKV   `json:"kvs"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return RulesPayload{}, fmt.Errorf("etcd fetch: malformed response: %w", err)
+	}
+	if len(res.KVs) == 0 {
+		return RulesPayload{}, fmt.Errorf("etcd key %s not found", s.cfg.Key)
+	}
+
+	var (
+		rules  []config.Rule
+		maxRev int64
+	)
+	for _, kv := range res.KVs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return RulesPayload{}, fmt.Errorf("etcd fetch: malformed key: %w", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return RulesPayload{}, fmt.Errorf("etcd fetch: malformed value of %s: %w", key, err)
+		}
+		list, err := parseKV(string(key), value, s.cfg.Format)
+		if err != nil {
+			return RulesPayload{}, err
+		}
+		rules = append(rules, list...)
+		if kv.ModRevision > maxRev {
+			maxRev = kv.ModRevision
+		}
+	}
+
+	s.mu.Lock()
+	s.rev = res.Header.Revision
+	s.mu.Unlock()
+
+	version := strconv.FormatInt(maxRev, 10)
+	if s.cfg.Prefix {
+		version += "/" + strconv.Itoa(len(res.KVs))
+	}
+	return RulesPayload{Rules: rules, Version: version}, nil
+}
+
+// Watch streams etcd events for the rule keys after the revision of the last
+// fetch and reports a change on the first event. A compacted start revision
+// is reported as a change, so the poller fetches afresh. version is unused:
+// the start revision is the store revision the last fetch saw.
+func (s *EtcdSource) Watch(ctx context.Context, version string) (bool, error) {
+	s.mu.Lock()
+	rev := s.rev
+	s.mu.Unlock()
+	if rev == 0 {
+		return true, nil // nothing fetched yet
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, etcdWatchTimeout)
+	defer cancel()
+
+	create := s.keyRange()
+	create["start_revision"] = strconv.FormatInt(rev+1, 10)
+	resp, err := s.do(wctx, s.watcher, "/v3/watch", map[string]interface{}{"create_request": create})
+	if err != nil {
+		return false, fmt.Errorf("etcd watch failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Events          []json.RawMessage `json:"events"`
+				Canceled        bool              `json:"canceled"`
+				CompactRevision int64             `json:"compact_revision,string"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() == nil && wctx.Err() != nil {
+				return false, nil // watch timeout: reconnect
+			}
+			return false, fmt.Errorf("etcd watch: %w", err)
+		}
+		switch {
+		case len(msg.Result.Events) > 0, msg.Result.CompactRevision > 0:
+			return true, nil
+		case msg.Result.Canceled:
+			return false, errors.New("etcd watch canceled by server")
+		}
+	}
+}
+
+// keyRange is the range request for the rule key or prefix.
+func (s *EtcdSource) keyRange() map[string]interface{} {
+	r := map[string]interface{}{"key": base64.StdEncoding.EncodeToString([]byte(s.cfg.Key))}
+	if s.cfg.Prefix {
+		r["range_end"] = base64.StdEncoding.EncodeToString(prefixEnd(s.cfg.Key))
+	}
+	return r
+}
+
+// do POSTs a gateway request to the first endpoint that answers and returns
+// the response of a 200; the caller closes its body. A 401 drops the cached
+// token so the next request authenticates again.
+func (s *EtcdSource) do(ctx context.Context, client *http.Client, path string, payload interface{}) (*http.Response, error) {
+	token, err := s.auth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ep := range s.cfg.Endpoints {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(ep, "/")+path, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && token != "" {
+			s.mu.Lock()
+			if s.token == token {
+				s.token = ""
+			}
+			s.mu.Unlock()
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil, lastErr
+}
+
+// auth returns the token from /v3/auth/authenticate, or "" when no username
+// is configured.
+func (s *EtcdSource) auth(ctx context.Context) (string, error) {
+	if s.cfg.Username == "" {
+		return "", nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" {
+		return s.token, nil
+	}
+
+	b, _ := json.Marshal(map[string]string{"name": s.cfg.Username, "password": s.cfg.Password})
+	var lastErr error
+	for _, ep := range s.cfg.Endpoints {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(ep, "/")+"/v3/auth/authenticate", bytes.NewReader(b))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("etcd authenticate failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		var res struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil || res.Token == "" {
+			return "", errors.New("etcd authenticate failed: no token in response")
+		}
+		s.token = res.Token
+		return s.token, nil
+	}
+	return "", lastErr
+}
+
+// prefixEnd is the range end covering every key that starts with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // every key
+}
+
+// parseKV parses the rules stored under a KV key, taking the format from the
+// key's extension unless one is configured.
+func parseKV(key string, raw []byte, format string) ([]config.Rule, error) {
+	if format == "" {
+		format = formatOf(key)
+	}
+	rules, err := parseRules(raw, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,107 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestEtcdFetchPrefix(t *testing.T) {
+	var rangeReq map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/auth/authenticate":
+			_, _ = w.Write([]byte(`{"token":"tok"}`))
+		case "/v3/kv/range":
+			if r.Header.Get("Authorization") != "tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewDecoder(r.Body).Decode(&rangeReq)
+			fmt.Fprintf(w, `{"header":{"revision":"42"},"kvs":[
+				{"key":%q,"value":%q,"mod_revision":"7"},
+				{"key":%q,"value":%q,"mod_revision":"9"}],"count":"2"}`,
+				b64("/rls/rules/a.json"), b64(`[{"ruleId":"r1","algo":"token_bucket","windowMs":1000,"limit":10}]`),
+				b64("/rls/rules/b.yaml"), b64("- ruleId: r2\n  algo: gcra\n  windowMs: 1000\n  limit: 5\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	src := NewEtcdSource(config.EtcdCfg{
+		Endpoints: []string{"http://127.0.0.1:1", server.URL}, // the first endpoint is down
+		Key:       "/rls/rules/",
+		Prefix:    true,
+		Username:  "rls",
+		Password:  "secret",
+	})
+	got, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if len(got.Rules) != 2 || got.Rules[0].RuleID != "r1" || got.Rules[1].RuleID != "r2" || got.Version != "9/2" {
+		t.Fatalf("unexpected payload: %#v", got)
+	}
+	if rangeReq["key"] != b64("/rls/rules/") || rangeReq["range_end"] != b64("/rls/rules0") {
+		t.Fatalf("unexpected range request: %#v", rangeReq)
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	var watchReq struct {
+		CreateRequest map[string]string `json:"create_request"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			fmt.Fprintf(w, `{"header":{"revision":"42"},"kvs":[{"key":%q,"value":%q,"mod_revision":"7"}]}`,
+				b64("rules"), b64(`[{"ruleId":"r1","algo":"token_bucket","windowMs":1000,"limit":10}]`))
+		case "/v3/watch":
+			_ = json.NewDecoder(r.Body).Decode(&watchReq)
+			_, _ = w.Write([]byte(`{"result":{"header":{"revision":"42"},"created":true}}` + "\n"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte(`{"result":{"header":{"revision":"43"},"events":[{"kv":{"key":"cnVsZXM=","mod_revision":"43"}}]}}` + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	src := NewEtcdSource(config.EtcdCfg{Endpoints: []string{server.URL}, Key: "rules"})
+	got, err := src.Fetch(context.Background())
+	if err != nil || got.Version != "7" {
+		t.Fatalf("unexpected payload: %#v err=%v", got, err)
+	}
+	changed, err := src.Watch(context.Background(), got.Version)
+	if err != nil || !changed {
+		t.Fatalf("expected a change, got %v err=%v", changed, err)
+	}
+	if watchReq.CreateRequest["start_revision"] != "43" || watchReq.CreateRequest["key"] != b64("rules") {
+		t.Fatalf("unexpected watch request: %#v", watchReq)
+	}
+}
+
+func TestEtcdKeyNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"header":{"revision":"42"}}`))
+	}))
+	defer server.Close()
+
+	src := NewEtcdSource(config.EtcdCfg{Endpoints: []string{server.URL}, Key: "rules"})
+	if _, err := src.Fetch(context.Background()); err == nil {
+		t.Fatalf("expected a missing key to fail")
+	}
+}
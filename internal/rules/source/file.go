@@ -0,0 +1,201 @@
+package source
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+const (
+	defaultFileWatchInterval = time.Second
+	fileReadAttempts         = 3
+)
+
+// FileSource reads rules from a JSON or YAML file, or merges every rule file
+// of a directory in name order. It implements Watcher by polling the files'
+// mtimes.
+//
+// Reads are checked against a fingerprint of the files (resolved symlink
+// target, size, mtime) taken before and after: a read that overlaps a
+// Kubernetes ConfigMap symlink swap or any other rewrite is retried, and
+// fails rather than returning a mix of old and new files.
+type FileSource struct {
+	cfg      config.FileCfg
+	interval time.Duration
+
+	mu   sync.Mutex
+	seen string // fingerprint of the last read
+}
+
+func NewFileSource(cfg config.FileCfg) *FileSource {
+	interval := time.Duration(cfg.WatchIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultFileWatchInterval
+	}
+	return &FileSource{cfg: cfg, interval: interval}
+}
+
+func (s *FileSource) Fetch(ctx context.Context) (RulesPayload, error) {
+	if !s.cfg.Enabled() {
+		return RulesPayload{}, errors.New("rules file is not configured")
+	}
+
+	for i := 0; i < fileReadAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return RulesPayload{}, err
+		}
+		before, files, err := s.fingerprint()
+		if err != nil {
+			return RulesPayload{}, err
+		}
+		payload, err := s.read(files)
+		after, _, ferr := s.fingerprint()
+		if ferr != nil || after != before {
+			continue // the files changed under us; read them again
+		}
+		if err != nil {
+			return RulesPayload{}, err
+		}
+		s.mu.Lock()
+		s.seen = before
+		s.mu.Unlock()
+		return payload, nil
+	}
+	return RulesPayload{}, fmt.Errorf("rules file %s kept changing while being read", s.cfg.Path)
+}
+
+// Watch polls the files until their fingerprint differs from the last read.
+// version is unused: the poller compares content versions after pulling.
+func (s *FileSource) Watch(ctx context.Context, version string) (bool, error) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-t.C:
+			fp, _, err := s.fingerprint()
+			if err != nil {
+				return false, err
+			}
+			s.mu.Lock()
+			changed := fp != s.seen
+			s.mu.Unlock()
+			if changed {
+				return true, nil
+			}
+		}
+	}
+}
+
+// read parses files and merges their rules. The version is the MD5 of the
+// contents, so touching a file without changing it is not a new version.
+func (s *FileSource) read(files []string) (RulesPayload, error) {
+	var rules []config.Rule
+	h := md5.New()
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			return RulesPayload{}, err
+		}
+		format := s.cfg.Format
+		if format == "" {
+			format = formatOf(f)
+		}
+		list, err := parseRules(raw, format)
+		if err != nil {
+			return RulesPayload{}, fmt.Errorf("%s: %w", f, err)
+		}
+		rules = append(rules, list...)
+		h.Write([]byte(filepath.Base(f)))
+		h.Write(raw)
+	}
+	return RulesPayload{
+		Rules:   rules,
+		Version: fmt.Sprintf("%x", h.Sum(nil)),
+	}, nil
+}
+
+// fingerprint lists the rule files and describes their current state.
+func (s *FileSource) fingerprint() (string, []string, error) {
+	files, err := s.files()
+	if err != nil {
+		return "", nil, err
+	}
+	var b strings.Builder
+	for _, f := range files {
+		target, err := filepath.EvalSymlinks(f)
+		if err != nil {
+			return "", nil, err
+		}
+		st, err := os.Stat(target)
+		if err != nil {
+			return "", nil, err
+		}
+		b.WriteString(target)
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatInt(st.Size(), 10))
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatInt(st.ModTime().UnixNano(), 10))
+		b.WriteByte('\n')
+	}
+	return b.String(), files, nil
+}
+
+// files returns the configured file, or the rule files of the configured
+// directory in name order. Hidden entries are skipped, which leaves out the
+// "..data" and timestamped directories of a ConfigMap mount.
+func (s *FileSource) files() ([]string, error) {
+	st, err := os.Stat(s.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return []string{s.cfg.Path}, nil
+	}
+
+	entries, err := os.ReadDir(s.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || formatOf(name) == "" {
+			continue
+		}
+		p := filepath.Join(s.cfg.Path, name)
+		if st, err := os.Stat(p); err != nil || st.IsDir() {
+			continue
+		}
+		files = append(files, p)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no rule files in %s", s.cfg.Path)
+	}
+	return files, nil
+}
+
+// formatOf maps a file extension to a parseRules format, or "" if the file
+// is not a rule file.
+func formatOf(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return ""
+	}
+}
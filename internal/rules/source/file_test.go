@@ -0,0 +1,108 @@
+package source
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestFileSourceSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	writeFile(t, path, "- ruleId: r1\n  algo: token_bucket\n  windowMs: 1000\n  limit: 10\n")
+
+	src := NewFileSource(config.FileCfg{Path: path})
+	got, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if len(got.Rules) != 1 || got.Rules[0].RuleID != "r1" || got.Version == "" {
+		t.Fatalf("unexpected payload: %#v", got)
+	}
+
+	// rewriting the same content keeps the version
+	writeFile(t, path, "- ruleId: r1\n  algo: token_bucket\n  windowMs: 1000\n  limit: 10\n")
+	again, err := src.Fetch(context.Background())
+	if err != nil || again.Version != got.Version {
+		t.Fatalf("version should follow content: %q vs %q err=%v", again.Version, got.Version, err)
+	}
+}
+
+func TestFileSourceMergesDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "b.json"), `[{"ruleId":"r2","algo":"gcra","windowMs":1000,"limit":5}]`)
+	writeFile(t, filepath.Join(dir, "a.yml"), "rules:\n  - ruleId: r1\n    algo: token_bucket\n    windowMs: 1000\n    limit: 10\n")
+	writeFile(t, filepath.Join(dir, "README.md"), "not rules")
+	writeFile(t, filepath.Join(dir, ".hidden.json"), "broken")
+
+	got, err := NewFileSource(config.FileCfg{Path: dir}).Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if len(got.Rules) != 2 || got.Rules[0].RuleID != "r1" || got.Rules[1].RuleID != "r2" {
+		t.Fatalf("unexpected rules: %#v", got.Rules)
+	}
+}
+
+// TestFileSourceConfigMapSwap mimics the kubelet: files are symlinks through
+// "..data", which is atomically re-pointed at a new timestamped directory.
+func TestFileSourceConfigMapSwap(t *testing.T) {
+	dir := t.TempDir()
+	v1, v2 := filepath.Join(dir, "..v1"), filepath.Join(dir, "..v2")
+	for _, d := range []string{v1, v2} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(v1, "rules.json"), `[{"ruleId":"r1","algo":"token_bucket","windowMs":1000,"limit":10}]`)
+	writeFile(t, filepath.Join(v2, "rules.json"), `[{"ruleId":"r2","algo":"token_bucket","windowMs":1000,"limit":10}]`)
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "rules.json"), filepath.Join(dir, "rules.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewFileSource(config.FileCfg{Path: dir, WatchIntervalMs: 5})
+	got, err := src.Fetch(context.Background())
+	if err != nil || len(got.Rules) != 1 || got.Rules[0].RuleID != "r1" {
+		t.Fatalf("unexpected payload: %#v err=%v", got, err)
+	}
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if changed, err := src.Watch(ctx, got.Version); err != nil || !changed {
+		t.Fatalf("expected the swap to be seen, got %v err=%v", changed, err)
+	}
+	got, err = src.Fetch(context.Background())
+	if err != nil || len(got.Rules) != 1 || got.Rules[0].RuleID != "r2" {
+		t.Fatalf("unexpected payload after swap: %#v err=%v", got, err)
+	}
+}
+
+func TestFileSourceRejectsPartialFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeFile(t, path, `[{"ruleId":"r1","algo":"token_bu`)
+	if _, err := NewFileSource(config.FileCfg{Path: path}).Fetch(context.Background()); err == nil {
+		t.Fatalf("expected a truncated file to be rejected")
+	}
+}
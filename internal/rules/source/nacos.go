@@ -11,7 +11,9 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,13 +25,30 @@ import (
 	"github.com/nanjiek/pixiu-rls/internal/config"
 )
 
-const defaultNacosGroup = "DEFAULT_GROUP"
+const (
+	defaultNacosGroup       = "DEFAULT_GROUP"
+	defaultNacosLongPollMs  = 30000
+	nacosTokenRefreshFactor = 0.9 // refresh the access token after 90% of its TTL
 
-// NacosSource pulls rules from Nacos config center via HTTP.
+	// Listener protocol separators: fields of one config are joined by
+	// wordSep, configs are terminated by lineSep.
+	nacosWordSep = "\x02"
+	nacosLineSep = "\x01"
+)
+
+// NacosSource pulls rules from Nacos config center via HTTP. It implements
+// Watcher with the config listener, so a Poller wakes up as soon as the
+// dataId changes.
 type NacosSource struct {
-	cfg    config.NacosCfg
-	client *http.Client
-	log    *slog.Logger
+	cfg      config.NacosCfg
+	client   *http.Client
+	listener *http.Client
+	longPoll time.Duration
+	log      *slog.Logger
+
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
 }
 
 func NewNacosSource(cfg config.NacosCfg) *NacosSource {
@@ -37,10 +56,16 @@ func NewNacosSource(cfg config.NacosCfg) *NacosSource {
 	if timeout <= 0 {
 		timeout = 2 * time.Second
 	}
+	longPoll := time.Duration(cfg.LongPollTimeoutMs) * time.Millisecond
+	if cfg.LongPollTimeoutMs == 0 {
+		longPoll = defaultNacosLongPollMs * time.Millisecond
+	}
 	return &NacosSource{
-		cfg:    cfg,
-		client: &http.Client{Timeout: timeout},
-		log:    slog.Default(),
+		cfg:      cfg,
+		client:   &http.Client{Timeout: timeout},
+		listener: &http.Client{Timeout: longPoll + timeout},
+		longPoll: longPoll,
+		log:      slog.Default(),
 	}
 }
 
@@ -49,23 +74,20 @@ func (s *NacosSource) Fetch(ctx context.Context) (RulesPayload, error) {
 		return RulesPayload{}, errors.New("nacos is disabled")
 	}
 
-	reqURL, err := s.buildURL()
-	if err != nil {
-		return RulesPayload{}, err
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
-	if err != nil {
-		return RulesPayload{}, err
-	}
-
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return RulesPayload{}, err
+	q := url.Values{}
+	q.Set("dataId", s.cfg.DataID)
+	q.Set("group", s.group())
+	path := "/nacos/v1/cs/configs"
+	if s.v2() {
+		path = "/nacos/v2/cs/config"
+		if s.cfg.Namespace != "" {
+			q.Set("namespaceId", s.cfg.Namespace)
+		}
+	} else if s.cfg.Namespace != "" {
+		q.Set("tenant", s.cfg.Namespace)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	resp, body, err := s.do(ctx, s.client, http.MethodGet, path, q, nil, nil)
 	if err != nil {
 		return RulesPayload{}, err
 	}
@@ -74,6 +96,12 @@ func (s *NacosSource) Fetch(ctx context.Context) (RulesPayload, error) {
 	}
 
 	version := resp.Header.Get("Content-MD5")
+	if s.v2() {
+		if body, err = decodeV2Config(body); err != nil {
+			return RulesPayload{}, err
+		}
+		version = "" // the header, if any, describes the envelope
+	}
 	if version == "" {
 		sum := md5.Sum(body)
 		version = fmt.Sprintf("%x", sum[:])
@@ -90,33 +118,186 @@ func (s *NacosSource) Fetch(ctx context.Context) (RulesPayload, error) {
 	}, nil
 }
 
-func (s *NacosSource) buildURL() (string, error) {
-	base, err := url.Parse(s.cfg.Addr)
+// Watch long-polls the Nacos config listener with version as the content
+// MD5. Nacos answers as soon as the content differs, or with an empty body
+// once the long-poll timeout elapses. With the listener disabled it blocks
+// until ctx is done.
+func (s *NacosSource) Watch(ctx context.Context, version string) (bool, error) {
+	if s.longPoll < 0 {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	if !s.cfg.Enabled() {
+		return false, errors.New("nacos is disabled")
+	}
+
+	listening := s.cfg.DataID + nacosWordSep + s.group() + nacosWordSep + version
+	if s.cfg.Namespace != "" {
+		listening += nacosWordSep + s.cfg.Namespace
+	}
+	form := url.Values{}
+	form.Set("Listening-Configs", listening+nacosLineSep)
+	header := http.Header{}
+	header.Set("Long-Pulling-Timeout", strconv.FormatInt(s.longPoll.Milliseconds(), 10))
+
+	resp, body, err := s.do(ctx, s.listener, http.MethodPost, "/nacos/v1/cs/configs/listener", nil, form, header)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("nacos listen failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	// a change is reported as the URL-encoded "dataId^2group[^2tenant]^1" lines
+	changed, err := url.QueryUnescape(strings.TrimSpace(string(body)))
+	if err != nil {
+		return false, fmt.Errorf("nacos listen: malformed response: %w", err)
+	}
+	return changed != "", nil
+}
+
+// do sends one request to Nacos with the access token attached and returns
+// the response with its body read. A 401/403 drops the cached token so the
+// next request logs in again.
+func (s *NacosSource) do(ctx context.Context, client *http.Client, method, path string, q, form url.Values, header http.Header) (*http.Response, []byte, error) {
+	token, err := s.token(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if token != "" {
+		if q == nil {
+			q = url.Values{}
+		}
+		q.Set("accessToken", token)
+	}
+	reqURL, err := s.buildURL(path, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reqBody io.Reader
+	if form != nil {
+		reqBody = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if token != "" && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		s.mu.Lock()
+		if s.accessToken == token {
+			s.accessToken = ""
+		}
+		s.mu.Unlock()
+	}
+	return resp, body, nil
+}
+
+// token returns a valid access token, logging in when there is none or it is
+// about to expire. It returns "" when no username is configured.
+func (s *NacosSource) token(ctx context.Context) (string, error) {
+	if s.cfg.Username == "" {
+		return "", nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && time.Now().Before(s.tokenExpiry) {
+		return s.accessToken, nil
+	}
+
+	reqURL, err := s.buildURL("/nacos/v1/auth/login", nil)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("username", s.cfg.Username)
+	form.Set("password", s.cfg.Password)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return "", err
 	}
-	base.Path = strings.TrimRight(base.Path, "/") + "/nacos/v1/cs/configs"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	group := s.cfg.Group
-	if group == "" {
-		group = defaultNacosGroup
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nacos login failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
 	}
 
-	q := base.Query()
-	q.Set("dataId", s.cfg.DataID)
-	q.Set("group", group)
-	if s.cfg.Namespace != "" {
-		q.Set("tenant", s.cfg.Namespace)
+	var res struct {
+		AccessToken string `json:"accessToken"`
+		TokenTTL    int64  `json:"tokenTtl"` // seconds
 	}
-	if s.cfg.Username != "" {
-		q.Set("username", s.cfg.Username)
-		q.Set("password", s.cfg.Password)
+	if err := json.Unmarshal(body, &res); err != nil || res.AccessToken == "" {
+		return "", errors.New("nacos login failed: no access token in response")
 	}
-	base.RawQuery = q.Encode()
+	ttl := time.Duration(float64(res.TokenTTL)*nacosTokenRefreshFactor) * time.Second
+	s.accessToken = res.AccessToken
+	s.tokenExpiry = time.Now().Add(ttl)
+	return s.accessToken, nil
+}
 
+func (s *NacosSource) buildURL(path string, q url.Values) (string, error) {
+	base, err := url.Parse(s.cfg.Addr)
+	if err != nil {
+		return "", err
+	}
+	base.Path = strings.TrimRight(base.Path, "/") + path
+	base.RawQuery = q.Encode()
 	return base.String(), nil
 }
 
+func (s *NacosSource) group() string {
+	if s.cfg.Group == "" {
+		return defaultNacosGroup
+	}
+	return s.cfg.Group
+}
+
+func (s *NacosSource) v2() bool {
+	return strings.EqualFold(strings.TrimSpace(s.cfg.APIVersion), "v2")
+}
+
+// decodeV2Config unwraps the {"code":0,"data":"<content>"} envelope of the
+// v2 open API.
+func decodeV2Config(body []byte) ([]byte, error) {
+	var res struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("nacos fetch: malformed v2 response: %w", err)
+	}
+	if res.Code != 0 {
+		return nil, fmt.Errorf("nacos fetch failed: code %d: %s", res.Code, res.Message)
+	}
+	return []byte(res.Data), nil
+}
+
 func parseRules(raw []byte, format string) ([]config.Rule, error) {
 	trimmed := bytes.TrimSpace(raw)
 	if len(trimmed) == 0 {
@@ -2,6 +2,7 @@ package source
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -85,3 +86,96 @@ func TestFetchAutoDetect(t *testing.T) {
 		t.Fatalf("unexpected rules: %#v", got.Rules)
 	}
 }
+
+func TestFetchLogsInWithAccessToken(t *testing.T) {
+	logins := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nacos/v1/auth/login":
+			logins++
+			if r.FormValue("username") != "rls" || r.FormValue("password") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"accessToken":"tok","tokenTtl":18000}`))
+		case "/nacos/v1/cs/configs":
+			if r.URL.Query().Get("accessToken") != "tok" || r.URL.Query().Has("password") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`[{"ruleId":"r1","algo":"token_bucket","windowMs":1000,"limit":10,"enabled":true}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	src := NewNacosSource(config.NacosCfg{Addr: server.URL, DataID: "rules", Username: "rls", Password: "secret"})
+	for i := 0; i < 2; i++ {
+		if _, err := src.Fetch(context.Background()); err != nil {
+			t.Fatalf("fetch %d failed: %v", i, err)
+		}
+	}
+	if logins != 1 {
+		t.Fatalf("the access token should be reused, got %d logins", logins)
+	}
+}
+
+func TestFetchV2OpenAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nacos/v2/cs/config" || r.URL.Query().Get("namespaceId") != "prod" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"code":0,"message":"success","data":"- ruleId: r4\n  algo: gcra\n  windowMs: 1000\n  limit: 10\n"}`))
+	}))
+	defer server.Close()
+
+	src := NewNacosSource(config.NacosCfg{Addr: server.URL, DataID: "rules", Namespace: "prod", APIVersion: "v2"})
+	got, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if len(got.Rules) != 1 || got.Rules[0].RuleID != "r4" || len(got.Version) != 32 {
+		t.Fatalf("unexpected payload: %#v", got)
+	}
+}
+
+func TestWatchListener(t *testing.T) {
+	var listening, timeout string
+	changed := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nacos/v1/cs/configs/listener" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		listening, timeout = r.FormValue("Listening-Configs"), r.Header.Get("Long-Pulling-Timeout")
+		if changed {
+			_, _ = w.Write([]byte("rules%02DEFAULT_GROUP%02prod%01\n"))
+		}
+	}))
+	defer server.Close()
+
+	src := NewNacosSource(config.NacosCfg{Addr: server.URL, DataID: "rules", Namespace: "prod", LongPollTimeoutMs: 500})
+	got, err := src.Watch(context.Background(), "abc")
+	if err != nil || !got {
+		t.Fatalf("expected a change, got %v err=%v", got, err)
+	}
+	if listening != "rules\x02DEFAULT_GROUP\x02abc\x02prod\x01" || timeout != "500" {
+		t.Fatalf("unexpected listener request: %q timeout=%q", listening, timeout)
+	}
+
+	changed = false
+	if got, err := src.Watch(context.Background(), "abc"); err != nil || got {
+		t.Fatalf("an empty response means unchanged, got %v err=%v", got, err)
+	}
+}
+
+func TestWatchDisabled(t *testing.T) {
+	src := NewNacosSource(config.NacosCfg{Addr: "http://127.0.0.1:1", DataID: "rules", LongPollTimeoutMs: -1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, err := src.Watch(ctx, ""); got || !errors.Is(err, context.Canceled) {
+		t.Fatalf("a disabled listener should wait for ctx, got %v err=%v", got, err)
+	}
+}
@@ -18,3 +18,11 @@ type RulesPayload struct {
 type RuleSource interface {
 	Fetch(ctx context.Context) (RulesPayload, error)
 }
+
+// Watcher is implemented by sources that can wait for their rules to change,
+// e.g. with a Nacos long-polling listener.
+type Watcher interface {
+	// Watch blocks until the rules differ from version or a server-side
+	// timeout elapses, and reports whether they changed.
+	Watch(ctx context.Context, version string) (bool, error)
+}
@@ -0,0 +1,289 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/identity"
+)
+
+const (
+	maxRuleIDLen   = 128
+	maxWindowMs    = int64(24 * time.Hour / time.Millisecond)
+	minPriority    = -10000
+	maxPriority    = 10000
+	maxSlidingSize = 100000 // sliding_window keeps one ZSET member per admitted request
+)
+
+// FieldError describes one invalid field of a rule. Field uses the JSON
+// path of the field, e.g. "windowMs", "methods[1]" or "quota.perHour".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError is returned when a rule fails Validate.
+type ValidationError struct {
+	RuleID string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Error())
+	}
+	return fmt.Sprintf("invalid rule %q: %s", e.RuleID, strings.Join(msgs, "; "))
+}
+
+// algoChecks holds the algorithm-specific constraints, keyed by normalized
+// algorithm name. An algorithm missing from this map is rejected; a nil
+// check means the algorithm has no constraints beyond the common ones.
+var algoChecks = map[string]func(config.Rule) []FieldError{
+	"token_bucket":           checkBucket,
+	"leaky_bucket":           checkBucket,
+	"sliding_window":         checkSliding,
+	"sliding_window_counter": nil,
+	"concurrency":            nil,
+	"gcra":                   checkBucket,
+}
+
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true, "*": true,
+}
+
+var clientKinds = map[string]bool{
+	identity.KindUser: true, identity.KindIP: true, identity.KindAPIKey: true,
+}
+
+// Validate checks a rule against the constraints the engine relies on at
+// request time. It returns nil when the rule is valid.
+func Validate(r config.Rule) []FieldError {
+	var errs []FieldError
+	add := func(field, format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case r.RuleID == "":
+		add("ruleId", "is required")
+	case len(r.RuleID) > maxRuleIDLen:
+		add("ruleId", "must be at most %d characters", maxRuleIDLen)
+	case !validName(r.RuleID):
+		add("ruleId", "may only contain letters, digits and -_.:")
+	}
+
+	errs = append(errs, checkMatch(r.Match)...)
+
+	seen := make(map[string]bool, len(r.Methods))
+	for i, m := range r.Methods {
+		field := "methods[" + strconv.Itoa(i) + "]"
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch {
+		case !httpMethods[m]:
+			add(field, "unknown HTTP method %q", r.Methods[i])
+		case seen[m]:
+			add(field, "duplicate method %q", m)
+		}
+		seen[m] = true
+	}
+
+	if r.Client != "" && !clientKinds[strings.ToLower(strings.TrimSpace(r.Client))] {
+		add("client", "must be one of %s, %s, %s", identity.KindUser, identity.KindIP, identity.KindAPIKey)
+	}
+	if r.Priority < minPriority || r.Priority > maxPriority {
+		add("priority", "must be between %d and %d", minPriority, maxPriority)
+	}
+	switch strings.ToLower(strings.TrimSpace(r.Mode)) {
+	case "", "enforce", "shadow":
+	default:
+		add("mode", "must be enforce or shadow")
+	}
+
+	if r.WindowMs <= 0 {
+		add("windowMs", "must be greater than 0")
+	} else if r.WindowMs > maxWindowMs {
+		add("windowMs", "must be at most %d (24h)", maxWindowMs)
+	}
+	if r.Limit <= 0 {
+		add("limit", "must be greater than 0")
+	}
+	if r.Burst < 0 {
+		add("burst", "must not be negative")
+	}
+	algo := normalizeAlgo(r.Algo)
+	if check, ok := algoChecks[algo]; !ok {
+		add("algo", "unsupported algorithm %q", r.Algo)
+	} else if check != nil {
+		errs = append(errs, check(r)...)
+	}
+
+	dims := make(map[string]bool, len(r.Dims))
+	for i, d := range r.Dims {
+		field := "dims[" + strconv.Itoa(i) + "]"
+		switch {
+		case d == "":
+			add(field, "must not be empty")
+		case !validName(d):
+			add(field, "may only contain letters, digits and -_.:")
+		case dims[d]:
+			add(field, "duplicate dimension %q", d)
+		}
+		dims[d] = true
+	}
+
+	errs = append(errs, checkQuota(r.Quota)...)
+	errs = append(errs, checkBreaker(r.Breaker)...)
+	errs = append(errs, checkLocalBatch(r, algo)...)
+	return errs
+}
+
+// checkMatch accepts "", "*", an exact path, or a path prefix ending in "*".
+func checkMatch(match string) []FieldError {
+	if match == "" || match == "*" {
+		return nil
+	}
+	fail := func(msg string) []FieldError {
+		return []FieldError{{Field: "match", Message: msg}}
+	}
+	if !strings.HasPrefix(match, "/") {
+		return fail(`must be "*" or start with "/"`)
+	}
+	if strings.ContainsAny(match, " \t\r\n?#") {
+		return fail("must not contain whitespace, query or fragment")
+	}
+	if i := strings.Index(match, "*"); i >= 0 && i != len(match)-1 {
+		return fail(`"*" is only allowed as the trailing character`)
+	}
+	return nil
+}
+
+func checkBucket(r config.Rule) []FieldError {
+	if r.WindowMs > 0 && r.Limit > 0 && r.Limit > r.WindowMs*1000 {
+		return []FieldError{{Field: "limit", Message: "rate exceeds 1000 requests per millisecond"}}
+	}
+	return nil
+}
+
+func checkSliding(r config.Rule) []FieldError {
+	if r.Limit > maxSlidingSize {
+		return []FieldError{{Field: "limit", Message: fmt.Sprintf("must be at most %d for sliding_window", maxSlidingSize)}}
+	}
+	return nil
+}
+
+func checkQuota(q config.QuotaCfg) []FieldError {
+	var errs []FieldError
+	limits := []struct {
+		field string
+		v     int64
+	}{
+		{"quota.perMinute", q.PerMinute},
+		{"quota.perHour", q.PerHour},
+		{"quota.perDay", q.PerDay},
+	}
+	// A shorter period must not allow more than a longer one that contains it.
+	prev := -1
+	for i, l := range limits {
+		if l.v < 0 {
+			errs = append(errs, FieldError{Field: l.field, Message: "must not be negative"})
+			continue
+		}
+		if l.v == 0 {
+			continue
+		}
+		if prev >= 0 && limits[prev].v > l.v {
+			errs = append(errs, FieldError{Field: l.field, Message: "must not be less than " + limits[prev].field})
+		}
+		prev = i
+	}
+	if q.TimeZone != "" {
+		if _, err := time.LoadLocation(q.TimeZone); err != nil {
+			errs = append(errs, FieldError{Field: "quota.timeZone", Message: "unknown time zone " + strconv.Quote(q.TimeZone)})
+		}
+	}
+	return errs
+}
+
+func checkBreaker(b config.BreakerCfg) []FieldError {
+	var errs []FieldError
+	nonNeg := func(field string, v int64) {
+		if v < 0 {
+			errs = append(errs, FieldError{Field: "breaker." + field, Message: "must not be negative"})
+		}
+	}
+	nonNeg("rlDenyThreshold", int64(b.RLDenyThreshold))
+	nonNeg("rlDenyWindowMs", b.RLDenyWindowMs)
+	nonNeg("minOpenMs", b.MinOpenMs)
+	nonNeg("halfOpenMinPass", int64(b.HalfOpenMinPass))
+	nonNeg("halfOpenMaxFail", int64(b.HalfOpenMaxFail))
+	if b.HalfOpenProbePercent < 0 || b.HalfOpenProbePercent > 100 {
+		errs = append(errs, FieldError{Field: "breaker.halfOpenProbePercent", Message: "must be between 0 and 100"})
+	}
+	if b.RLDenyWindowMs > maxWindowMs {
+		errs = append(errs, FieldError{Field: "breaker.rlDenyWindowMs", Message: fmt.Sprintf("must be at most %d (24h)", maxWindowMs)})
+	}
+	if !b.Enabled || len(errs) > 0 {
+		return errs
+	}
+	// an enabled breaker runs exactly what is stored, so nothing may be left
+	// to a hidden default
+	for _, f := range []struct {
+		field string
+		v     int64
+	}{
+		{"rlDenyThreshold", int64(b.RLDenyThreshold)},
+		{"rlDenyWindowMs", b.RLDenyWindowMs},
+		{"minOpenMs", b.MinOpenMs},
+		{"halfOpenProbePercent", int64(b.HalfOpenProbePercent)},
+		{"halfOpenMinPass", int64(b.HalfOpenMinPass)},
+		{"halfOpenMaxFail", int64(b.HalfOpenMaxFail)},
+	} {
+		if f.v == 0 {
+			errs = append(errs, FieldError{Field: "breaker." + f.field, Message: "is required when the breaker is enabled"})
+		}
+	}
+	return errs
+}
+
+func checkLocalBatch(r config.Rule, algo string) []FieldError {
+	b := r.LocalBatch
+	var errs []FieldError
+	switch {
+	case b.Size < 0:
+		errs = append(errs, FieldError{Field: "localBatch.size", Message: "must not be negative"})
+	case b.Size > 0 && algo != "token_bucket":
+		errs = append(errs, FieldError{Field: "localBatch.size", Message: "is only supported by token_bucket"})
+	case b.Size > 0 && r.Limit > 0 && b.Size > r.Limit+max(r.Burst, 0):
+		errs = append(errs, FieldError{Field: "localBatch.size", Message: "must not exceed limit+burst"})
+	}
+	switch {
+	case b.LeaseMs < 0:
+		errs = append(errs, FieldError{Field: "localBatch.leaseMs", Message: "must not be negative"})
+	case b.LeaseMs > 0 && r.WindowMs > 0 && b.LeaseMs > r.WindowMs:
+		errs = append(errs, FieldError{Field: "localBatch.leaseMs", Message: "must not exceed windowMs"})
+	}
+	return errs
+}
+
+func validName(s string) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package rules
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+func validRule() config.Rule {
+	return config.Rule{
+		RuleID: "login", Match: "/api/login", Methods: []string{"POST"}, Client: "ip",
+		Algo: "token_bucket", WindowMs: 1000, Limit: 10, Burst: 5, Dims: []string{"ip", "route"},
+		Quota: config.QuotaCfg{PerMinute: 100, PerDay: 1000, TimeZone: "UTC"},
+		Breaker: config.BreakerCfg{Enabled: true, RLDenyThreshold: 20, RLDenyWindowMs: 10000, MinOpenMs: 8000,
+			HalfOpenProbePercent: 10, HalfOpenMinPass: 5, HalfOpenMaxFail: 3},
+		Enabled: true,
+	}
+}
+
+func TestValidateAcceptsValidRule(t *testing.T) {
+	if errs := Validate(validRule()); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	r := validRule()
+	r.Algo = ""
+	r.Match = "/v1/*"
+	if errs := Validate(r); len(errs) != 0 {
+		t.Fatalf("default algo and prefix match should pass: %v", errs)
+	}
+	r.LocalBatch = config.LocalBatchCfg{Size: 15, LeaseMs: 50}
+	if errs := Validate(r); len(errs) != 0 {
+		t.Fatalf("localBatch within limit+burst should pass: %v", errs)
+	}
+}
+
+func TestValidateFieldErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(*config.Rule)
+		field string
+	}{
+		{"missing id", func(r *config.Rule) { r.RuleID = "" }, "ruleId"},
+		{"id with braces", func(r *config.Rule) { r.RuleID = "a{b}" }, "ruleId"},
+		{"zero window", func(r *config.Rule) { r.WindowMs = 0 }, "windowMs"},
+		{"zero limit", func(r *config.Rule) { r.Limit = 0 }, "limit"},
+		{"negative burst", func(r *config.Rule) { r.Burst = -1 }, "burst"},
+		{"unknown algo", func(r *config.Rule) { r.Algo = "fixed" }, "algo"},
+		{"sliding too large", func(r *config.Rule) { r.Algo = "sliding_window"; r.Limit = maxSlidingSize + 1 }, "limit"},
+		{"relative match", func(r *config.Rule) { r.Match = "api/login" }, "match"},
+		{"inner wildcard", func(r *config.Rule) { r.Match = "/api/*/x" }, "match"},
+		{"bad method", func(r *config.Rule) { r.Methods = []string{"POST", "FETCH"} }, "methods[1]"},
+		{"dup method", func(r *config.Rule) { r.Methods = []string{"get", "GET"} }, "methods[1]"},
+		{"bad client", func(r *config.Rule) { r.Client = "tenant" }, "client"},
+		{"priority", func(r *config.Rule) { r.Priority = maxPriority + 1 }, "priority"},
+		{"mode", func(r *config.Rule) { r.Mode = "dry-run" }, "mode"},
+		{"empty dim", func(r *config.Rule) { r.Dims = []string{"ip", ""} }, "dims[1]"},
+		{"dup dim", func(r *config.Rule) { r.Dims = []string{"ip", "ip"} }, "dims[1]"},
+		{"quota order", func(r *config.Rule) { r.Quota.PerHour = 50 }, "quota.perHour"},
+		{"quota negative", func(r *config.Rule) { r.Quota.PerDay = -1 }, "quota.perDay"},
+		{"time zone", func(r *config.Rule) { r.Quota.TimeZone = "Mars/Base" }, "quota.timeZone"},
+		{"probe percent", func(r *config.Rule) { r.Breaker.HalfOpenProbePercent = 120 }, "breaker.halfOpenProbePercent"},
+		{"breaker negative", func(r *config.Rule) { r.Breaker.MinOpenMs = -1 }, "breaker.minOpenMs"},
+		{"breaker zero threshold", func(r *config.Rule) { r.Breaker.RLDenyThreshold = 0 }, "breaker.rlDenyThreshold"},
+		{"breaker zero window", func(r *config.Rule) { r.Breaker.RLDenyWindowMs = 0 }, "breaker.rlDenyWindowMs"},
+		{"batch algo", func(r *config.Rule) { r.Algo = "gcra"; r.LocalBatch.Size = 5 }, "localBatch.size"},
+		{"batch too large", func(r *config.Rule) { r.LocalBatch.Size = 16 }, "localBatch.size"},
+		{"batch lease", func(r *config.Rule) { r.LocalBatch = config.LocalBatchCfg{Size: 5, LeaseMs: 2000} }, "localBatch.leaseMs"},
+	}
+	for _, tt := range tests {
+		r := validRule()
+		tt.edit(&r)
+		errs := Validate(r)
+		if len(errs) != 1 || errs[0].Field != tt.field {
+			t.Fatalf("%s: expected one error on %s, got %v", tt.name, tt.field, errs)
+		}
+	}
+}
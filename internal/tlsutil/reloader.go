@@ -0,0 +1,223 @@
+// Package tlsutil builds server TLS configs whose certificate and client CAs
+// follow the files on disk.
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// Reloader holds the current certificate and client CA pool of a TLSCfg and
+// re-reads them when the files change. A reload that fails (e.g. the key was
+// written before the certificate) keeps the previous material and is retried
+// on the next check.
+type Reloader struct {
+	cfg        config.TLSCfg
+	clientAuth tls.ClientAuthType
+	minVersion uint16
+	interval   time.Duration
+	log        *slog.Logger
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+	files string // fingerprint of the loaded files
+}
+
+// New validates cfg and loads its files.
+func New(cfg config.TLSCfg) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls certFile and keyFile are required")
+	}
+	r := &Reloader{cfg: cfg, interval: defaultReloadInterval, log: slog.Default()}
+	if cfg.ReloadIntervalMs > 0 {
+		r.interval = time.Duration(cfg.ReloadIntervalMs) * time.Millisecond
+	}
+
+	switch strings.ToLower(cfg.ClientAuth) {
+	case "":
+		r.clientAuth = tls.NoClientCert
+		if cfg.ClientCAFile != "" {
+			r.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	case "none":
+		r.clientAuth = tls.NoClientCert
+	case "optional":
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown tls clientAuth %q (want none, optional or require)", cfg.ClientAuth)
+	}
+	if r.clientAuth != tls.NoClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("tls clientCAFile is required to verify client certificates")
+	}
+
+	switch cfg.MinVersion {
+	case "", "1.2":
+		r.minVersion = tls.VersionTLS12
+	case "1.3":
+		r.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported tls minVersion %q", cfg.MinVersion)
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns a server config that picks up the current certificate and
+// client CAs on every handshake. nextProtos is the ALPN list of the listener
+// (e.g. "h2", "http/1.1").
+func (r *Reloader) Config(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			cert, pool := r.cert, r.pool
+			r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:       r.minVersion,
+				NextProtos:       nextProtos,
+				Certificates:     []tls.Certificate{*cert},
+				ClientAuth:       r.clientAuth,
+				ClientCAs:        pool,
+				VerifyConnection: r.verifyClient,
+			}, nil
+		},
+	}
+}
+
+// verifyClient enforces the SAN/CN allow lists on a verified client
+// certificate. Connections without one (clientAuth optional) pass.
+func (r *Reloader) verifyClient(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || (len(r.cfg.AllowedCNs) == 0 && len(r.cfg.AllowedSANs) == 0) {
+		return nil
+	}
+	leaf := cs.VerifiedChains[0][0]
+	if slices.Contains(r.cfg.AllowedCNs, leaf.Subject.CommonName) {
+		return nil
+	}
+	for _, san := range sans(leaf) {
+		if slices.Contains(r.cfg.AllowedSANs, san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate %q is not allowed", leaf.Subject.CommonName)
+}
+
+func sans(c *x509.Certificate) []string {
+	out := make([]string, 0, len(c.DNSNames)+len(c.EmailAddresses)+len(c.IPAddresses)+len(c.URIs))
+	out = append(out, c.DNSNames...)
+	out = append(out, c.EmailAddresses...)
+	for _, ip := range c.IPAddresses {
+		out = append(out, ip.String())
+	}
+	for _, u := range c.URIs {
+		out = append(out, u.String())
+	}
+	return out
+}
+
+// Run checks the files every reload interval until ctx is done.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				r.log.Warn("tls reload failed, keeping the current certificate", "error", err)
+			}
+		}
+	}
+}
+
+// Reload re-reads the files if their fingerprint changed since the last
+// successful load.
+func (r *Reloader) Reload() error {
+	files, err := r.fingerprint()
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	unchanged := files == r.files
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load tls key pair: %w", err)
+	}
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read tls clientCAFile: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls clientCAFile %s has no certificates", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	first := r.cert == nil
+	r.cert, r.pool, r.files = &cert, pool, files
+	r.mu.Unlock()
+	if !first {
+		attrs := []any{"cert", r.cfg.CertFile}
+		if cert.Leaf != nil {
+			attrs = append(attrs, "not_after", cert.Leaf.NotAfter)
+		}
+		r.log.Info("tls certificate reloaded", attrs...)
+	}
+	return nil
+}
+
+// fingerprint identifies the current contents of the files by their resolved
+// path (Kubernetes swaps secret volumes through symlinks), size and mtime.
+func (r *Reloader) fingerprint() (string, error) {
+	var sb strings.Builder
+	for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return "", err
+		}
+		fi, err := os.Stat(target)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", target, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sb.String(), nil
+}
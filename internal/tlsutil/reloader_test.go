@@ -0,0 +1,175 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/nanjiek/pixiu-rls/internal/config"
+	"github.com/nanjiek/pixiu-rls/internal/identity"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns PEM certificate and key for cn, valid for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func writeFile(t *testing.T, path string, b []byte, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLSAndReload(t *testing.T) {
+	ca := newCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	certPEM, keyPEM := ca.issue(t, 10, "rls", x509.ExtKeyUsageServerAuth)
+	mtime := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, certPEM, mtime)
+	writeFile(t, keyFile, keyPEM, mtime)
+	writeFile(t, caFile, ca.pem, mtime)
+
+	certs, err := New(config.TLSCfg{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, AllowedCNs: []string{"gw-1"}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", certs.Config("http/1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, identity.PeerCN(r.TLS))
+	})}
+	go srv.Serve(lis)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	dial := func(cn string) (*http.Response, error) {
+		cfg := &tls.Config{RootCAs: roots}
+		if cn != "" {
+			cp, kp := ca.issue(t, 20, cn, x509.ExtKeyUsageClientAuth)
+			pair, err := tls.X509KeyPair(cp, kp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Certificates = []tls.Certificate{pair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+		return client.Get("https://" + lis.Addr().String())
+	}
+
+	resp, err := dial("gw-1")
+	if err != nil {
+		t.Fatalf("allowed client: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "gw-1" {
+		t.Fatalf("peer CN = %q", body)
+	}
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 10 {
+		t.Fatalf("unexpected server certificate")
+	}
+	if _, err := dial("gw-2"); err == nil {
+		t.Fatalf("a CN outside allowedCNs must be rejected")
+	}
+	if _, err := dial(""); err == nil {
+		t.Fatalf("a client without a certificate must be rejected")
+	}
+
+	// rotate the server certificate in place
+	certPEM, keyPEM = ca.issue(t, 11, "rls", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	resp, err = dial("gw-1")
+	if err != nil {
+		t.Fatalf("after reload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 11 {
+		t.Fatalf("rotated certificate not served")
+	}
+
+	// a half-written rotation keeps the current certificate
+	writeFile(t, keyFile, []byte("garbage"), time.Now().Add(time.Second))
+	if err := certs.Reload(); err == nil {
+		t.Fatalf("expected a mismatched key pair to fail")
+	}
+	if resp, err = dial("gw-1"); err != nil {
+		t.Fatalf("failed reload must keep serving: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewRejectsClientAuthWithoutCA(t *testing.T) {
+	if _, err := New(config.TLSCfg{CertFile: "a", KeyFile: "b", ClientAuth: "require"}); err == nil {
+		t.Fatalf("expected require without clientCAFile to fail")
+	}
+}
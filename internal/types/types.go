@@ -6,6 +6,8 @@ type Decision struct {
 	Allowed      bool   // 是否允许请求
 	Remaining    int64  // 剩余可用配额
 	RetryAfterMs int64  // 建议重试时间(毫秒)
+	ResetAtMs    int64  // 限流状态完全恢复的时间(Unix 毫秒)，0 表示未知
 	Reason       string // 判定原因
+	RuleID       string // 做出拒绝判定的规则(多规则评估时)
 	Err          error  // 错误信息(如有)
 }